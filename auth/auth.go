@@ -2,6 +2,7 @@ package auth
 
 import (
 	"fmt"
+	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/types"
 )
@@ -32,14 +33,21 @@ func NewAuthService() (*AuthService, error) {
 	// 创建token管理器（即使没有配置也创建）
 	tokenManager := NewTokenManager(configs)
 
-	// 预热第一个可用token（如果有配置）
-	if len(configs) > 0 {
+	// 启用后台调度器时由调度器预热所有token，否则预热第一个可用token
+	if config.TokenBackgroundRefreshEnabled {
+		tokenManager.StartScheduler(DefaultTokenSchedulerConfig())
+	} else if len(configs) > 0 {
 		_, warmupErr := tokenManager.getBestToken()
 		if warmupErr != nil {
 			logger.Warn("token预热失败", logger.Err(warmupErr))
 		}
 	}
 
+	if config.TokenHealthProbeEnabled {
+		monitor := tokenManager.StartHealthMonitor(DefaultTokenHealthConfig())
+		monitor.AddListener(notifyHealthEvent)
+	}
+
 	logger.Info("AuthService创建完成", logger.Int("config_count", len(configs)))
 
 	return &AuthService{
@@ -64,6 +72,14 @@ func (as *AuthService) GetTokenWithFingerprint() (types.TokenInfo, *Fingerprint,
 	return as.tokenManager.GetTokenWithFingerprint()
 }
 
+// GetTokenWithKey 获取token、指纹及其缓存key
+func (as *AuthService) GetTokenWithKey() (types.TokenInfo, *Fingerprint, string, error) {
+	if as.tokenManager == nil {
+		return types.TokenInfo{}, nil, "", fmt.Errorf("token管理器未初始化")
+	}
+	return as.tokenManager.GetTokenWithKey()
+}
+
 // MarkTokenFailed 标记当前token请求失败
 func (as *AuthService) MarkTokenFailed() {
 	if as.tokenManager == nil {
@@ -75,6 +91,26 @@ func (as *AuthService) MarkTokenFailed() {
 	}
 }
 
+// MarkTokenSuccess 标记处理该请求的token请求成功，重置失败计数
+func (as *AuthService) MarkTokenSuccess(tokenKey string) {
+	if as.tokenManager == nil || tokenKey == "" {
+		return
+	}
+	as.tokenManager.MarkTokenSuccess(tokenKey)
+}
+
+// ReportTokenError 上报处理该请求的token的上游错误
+// 账号被暂停时立即标记暂停；启用健康探测时同时推进健康状态机
+func (as *AuthService) ReportTokenError(tokenKey, errorMsg string) {
+	if as.tokenManager == nil || tokenKey == "" {
+		return
+	}
+	if as.tokenManager.rateLimiter != nil {
+		as.tokenManager.rateLimiter.CheckAndMarkSuspended(tokenKey, errorMsg)
+	}
+	as.tokenManager.observeHealth(tokenKey, fmt.Errorf("%s", errorMsg))
+}
+
 // GetTokenManager 获取底层的TokenManager（用于高级操作）
 func (as *AuthService) GetTokenManager() *TokenManager {
 	return as.tokenManager
@@ -10,35 +10,49 @@ import (
 	"time"
 
 	"kiro2api/logger"
+	"kiro2api/notify"
+	"kiro2api/utils"
 )
 
 // ProxyInfo 代理信息
 type ProxyInfo struct {
-	URL           string    // 代理URL，如 http://127.0.0.1:40000
-	UseCount      int       // 使用次数
-	FailCount     int       // 连续失败次数
-	LastUsed      time.Time // 最后使用时间
-	LastCheck     time.Time // 最后健康检查时间
-	IsHealthy     bool      // 是否健康
-	CurrentIP     string    // 当前出口IP
-	ResponseTime  int64     // 响应时间(ms)
+	URL          string    // 代理URL，如 http://127.0.0.1:40000
+	UseCount     int       // 使用次数
+	FailCount    int       // 连续失败次数
+	LastUsed     time.Time // 最后使用时间
+	LastCheck    time.Time // 最后健康检查时间
+	IsHealthy    bool      // 是否健康
+	CurrentIP    string    // 当前出口IP
+	ResponseTime int64     // 响应时间(ms)
+
+	// 健康统计
+	SuccessCount      int64     // 累计成功次数
+	FailureCount      int64     // 累计失败次数
+	TotalResponseTime int64     // 成功请求累计耗时(ms)，用于计算平均值
+	LastError         string    // 最近一次失败原因
+	LastFailure       time.Time // 最近一次失败时间
+	BoundTokens       int       // 绑定到此代理的token数
 }
 
 // ProxyPool 代理池
 type ProxyPool struct {
-	proxies       []*ProxyInfo
-	mutex         sync.RWMutex
-	rng           *rand.Rand
-	
+	proxies []*ProxyInfo
+	mutex   sync.RWMutex
+	rng     *rand.Rand
+
 	// 配置
-	maxUseCount       int           // 单个代理最大使用次数
-	maxFailCount      int           // 最大连续失败次数
+	maxUseCount         int           // 单个代理最大使用次数
+	maxFailCount        int           // 最大连续失败次数
 	healthCheckInterval time.Duration // 健康检查间隔
-	cooldownDuration  time.Duration // 失败后冷却时间
-	
+	cooldownDuration    time.Duration // 失败后冷却时间
+
 	// 状态
 	currentIndex int
 	enabled      bool
+
+	// token -> 代理的粘性绑定，只有代理不健康时才故障转移
+	bindings  map[string]*ProxyInfo
+	failovers int64
 }
 
 // ProxyPoolConfig 代理池配置
@@ -91,24 +105,32 @@ func NewProxyPool(cfg ProxyPoolConfig) *ProxyPool {
 		maxFailCount:        cfg.MaxFailCount,
 		healthCheckInterval: cfg.HealthCheckInterval,
 		cooldownDuration:    cfg.CooldownDuration,
-		enabled:             len(cfg.Proxies) > 0,
+		bindings:            make(map[string]*ProxyInfo),
 	}
 
 	// 初始化代理列表
 	for _, proxyURL := range cfg.Proxies {
-		if proxyURL != "" {
-			pool.proxies = append(pool.proxies, &ProxyInfo{
-				URL:       proxyURL,
-				IsHealthy: true, // 初始假设健康
-			})
+		if proxyURL == "" {
+			continue
+		}
+		if _, err := utils.ParseProxyURL(proxyURL); err != nil {
+			logger.Warn("跳过无效代理",
+				logger.String("proxy", maskProxyURL(proxyURL)),
+				logger.Err(err))
+			continue
 		}
+		pool.proxies = append(pool.proxies, &ProxyInfo{
+			URL:       proxyURL,
+			IsHealthy: true, // 初始假设健康
+		})
 	}
+	pool.enabled = len(pool.proxies) > 0
 
 	if pool.enabled {
 		logger.Info("代理池初始化完成",
 			logger.Int("proxy_count", len(pool.proxies)),
 			logger.Int("max_use_count", pool.maxUseCount))
-		
+
 		// 启动后台健康检查
 		go pool.backgroundHealthCheck()
 	}
@@ -134,8 +156,7 @@ func (pp *ProxyPool) GetProxy() *ProxyInfo {
 	}
 
 	if len(available) == 0 {
-		logger.Warn("没有可用代理，尝试重置所有代理状态")
-		pp.resetAllProxies()
+		pp.handleEmptyPoolUnlocked()
 		return nil
 	}
 
@@ -157,16 +178,97 @@ func (pp *ProxyPool) GetProxy() *ProxyInfo {
 	return selected
 }
 
-// isProxyAvailable 检查代理是否可用
-func (pp *ProxyPool) isProxyAvailable(proxy *ProxyInfo) bool {
-	// 不健康的代理需要检查冷却时间
-	if !proxy.IsHealthy {
-		if time.Since(proxy.LastUsed) < pp.cooldownDuration {
-			return false
+// GetProxyForToken 获取token绑定的代理
+// 同一token始终使用同一出口，绑定的代理不健康时才迁移到绑定数最少的健康代理
+func (pp *ProxyPool) GetProxyForToken(tokenKey string) *ProxyInfo {
+	if tokenKey == "" {
+		return pp.GetProxy()
+	}
+	if !pp.enabled || len(pp.proxies) == 0 {
+		return nil
+	}
+
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	bound := pp.bindings[tokenKey]
+	if bound != nil && pp.isProxyHealthy(bound) {
+		return bound
+	}
+
+	// 选择绑定数最少的健康代理，相同时随机打散
+	var candidates []*ProxyInfo
+	for _, proxy := range pp.proxies {
+		if proxy == bound || !pp.isProxyHealthy(proxy) {
+			continue
+		}
+		switch {
+		case len(candidates) == 0 || proxy.BoundTokens < candidates[0].BoundTokens:
+			candidates = []*ProxyInfo{proxy}
+		case proxy.BoundTokens == candidates[0].BoundTokens:
+			candidates = append(candidates, proxy)
 		}
-		// 冷却期过后重置状态
-		proxy.IsHealthy = true
-		proxy.FailCount = 0
+	}
+
+	if len(candidates) == 0 {
+		pp.handleEmptyPoolUnlocked()
+		return nil
+	}
+	selected := candidates[pp.rng.Intn(len(candidates))]
+
+	if bound != nil {
+		bound.BoundTokens--
+		pp.failovers++
+		logger.Warn("代理故障转移",
+			logger.String("token_key", tokenKey),
+			logger.String("from", maskProxyURL(bound.URL)),
+			logger.String("to", maskProxyURL(selected.URL)),
+			logger.String("last_error", bound.LastError))
+	} else {
+		logger.Debug("绑定代理",
+			logger.String("token_key", tokenKey),
+			logger.String("proxy", maskProxyURL(selected.URL)))
+	}
+	selected.BoundTokens++
+	pp.bindings[tokenKey] = selected
+
+	return selected
+}
+
+// handleEmptyPoolUnlocked 无可用代理时告警并重置所有代理状态（调用方持有锁）
+func (pp *ProxyPool) handleEmptyPoolUnlocked() {
+	logger.Warn("没有可用代理，尝试重置所有代理状态")
+	notify.Send(notify.Event{
+		Type:     notify.EventProxyPoolEmpty,
+		Severity: notify.SeverityCritical,
+		Title:    "代理池无可用代理",
+		Message:  fmt.Sprintf("%d 个代理均不可用，已重置所有代理状态", len(pp.proxies)),
+		Key:      "proxy_pool",
+		Fields: map[string]any{
+			"proxy_count": len(pp.proxies),
+		},
+	})
+	pp.resetAllProxies()
+}
+
+// isProxyHealthy 检查代理是否健康（不健康的代理冷却期过后视为恢复）
+func (pp *ProxyPool) isProxyHealthy(proxy *ProxyInfo) bool {
+	if proxy.IsHealthy {
+		return true
+	}
+	if time.Since(proxy.LastFailure) < pp.cooldownDuration {
+		return false
+	}
+	// 冷却期过后重置状态
+	proxy.IsHealthy = true
+	proxy.FailCount = 0
+	return true
+}
+
+// isProxyAvailable 检查代理是否可用（随机选择模式，额外受使用次数限制）
+func (pp *ProxyPool) isProxyAvailable(proxy *ProxyInfo) bool {
+	if !pp.isProxyHealthy(proxy) {
+		return false
 	}
 
 	// 使用次数超限
@@ -195,7 +297,7 @@ func (pp *ProxyPool) RecordUse(proxy *ProxyInfo) {
 	proxy.LastUsed = time.Now()
 
 	logger.Debug("代理使用记录",
-		logger.String("proxy", proxy.URL),
+		logger.String("proxy", maskProxyURL(proxy.URL)),
 		logger.Int("use_count", proxy.UseCount))
 }
 
@@ -211,10 +313,12 @@ func (pp *ProxyPool) RecordSuccess(proxy *ProxyInfo, responseTime int64) {
 	proxy.FailCount = 0
 	proxy.IsHealthy = true
 	proxy.ResponseTime = responseTime
+	proxy.SuccessCount++
+	proxy.TotalResponseTime += responseTime
 }
 
 // RecordFailure 记录失败
-func (pp *ProxyPool) RecordFailure(proxy *ProxyInfo) {
+func (pp *ProxyPool) RecordFailure(proxy *ProxyInfo, err error) {
 	if proxy == nil {
 		return
 	}
@@ -223,11 +327,17 @@ func (pp *ProxyPool) RecordFailure(proxy *ProxyInfo) {
 	defer pp.mutex.Unlock()
 
 	proxy.FailCount++
-	if proxy.FailCount >= pp.maxFailCount {
+	proxy.FailureCount++
+	proxy.LastFailure = time.Now()
+	if err != nil {
+		proxy.LastError = truncateReason(err.Error())
+	}
+	if proxy.FailCount >= pp.maxFailCount && proxy.IsHealthy {
 		proxy.IsHealthy = false
 		logger.Warn("代理标记为不健康",
-			logger.String("proxy", proxy.URL),
-			logger.Int("fail_count", proxy.FailCount))
+			logger.String("proxy", maskProxyURL(proxy.URL)),
+			logger.Int("fail_count", proxy.FailCount),
+			logger.String("last_error", proxy.LastError))
 	}
 }
 
@@ -265,17 +375,16 @@ func (pp *ProxyPool) checkAllProxies() {
 
 // checkProxyHealth 检查单个代理健康状态
 func (pp *ProxyPool) checkProxyHealth(proxy *ProxyInfo) {
-	proxyURL, err := url.Parse(proxy.URL)
+	transport, err := utils.NewProxyTransport(proxy.URL)
 	if err != nil {
-		pp.RecordFailure(proxy)
+		pp.RecordFailure(proxy, err)
 		return
 	}
+	defer transport.CloseIdleConnections()
 
 	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		},
-		Timeout: 10 * time.Second,
+		Transport: transport,
+		Timeout:   10 * time.Second,
 	}
 
 	start := time.Now()
@@ -283,9 +392,9 @@ func (pp *ProxyPool) checkProxyHealth(proxy *ProxyInfo) {
 	responseTime := time.Since(start).Milliseconds()
 
 	if err != nil {
-		pp.RecordFailure(proxy)
+		pp.RecordFailure(proxy, err)
 		logger.Debug("代理健康检查失败",
-			logger.String("proxy", proxy.URL),
+			logger.String("proxy", maskProxyURL(proxy.URL)),
 			logger.Err(err))
 		return
 	}
@@ -304,11 +413,11 @@ func (pp *ProxyPool) checkProxyHealth(proxy *ProxyInfo) {
 		pp.mutex.Unlock()
 
 		logger.Debug("代理健康检查成功",
-			logger.String("proxy", proxy.URL),
+			logger.String("proxy", maskProxyURL(proxy.URL)),
 			logger.String("ip", ip),
 			logger.Int64("response_time_ms", responseTime))
 	} else {
-		pp.RecordFailure(proxy)
+		pp.RecordFailure(proxy, fmt.Errorf("健康检查状态码 %d", resp.StatusCode))
 	}
 }
 
@@ -322,7 +431,7 @@ func (pp *ProxyPool) GetProxyURL() (*url.URL, *ProxyInfo) {
 	proxyURL, err := url.Parse(proxy.URL)
 	if err != nil {
 		logger.Error("解析代理URL失败",
-			logger.String("proxy", proxy.URL),
+			logger.String("proxy", maskProxyURL(proxy.URL)),
 			logger.Err(err))
 		return nil, nil
 	}
@@ -350,28 +459,45 @@ func (pp *ProxyPool) GetStats() map[string]any {
 		}
 		totalUseCount += proxy.UseCount
 
+		var avgResponseTime int64
+		if proxy.SuccessCount > 0 {
+			avgResponseTime = proxy.TotalResponseTime / proxy.SuccessCount
+		}
+
 		proxyStats = append(proxyStats, map[string]any{
-			"url":           maskProxyURL(proxy.URL),
-			"use_count":     proxy.UseCount,
-			"fail_count":    proxy.FailCount,
-			"is_healthy":    proxy.IsHealthy,
-			"current_ip":    proxy.CurrentIP,
-			"response_time": proxy.ResponseTime,
-			"last_used":     proxy.LastUsed.Format(time.RFC3339),
-			"last_check":    proxy.LastCheck.Format(time.RFC3339),
+			"url":               maskProxyURL(proxy.URL),
+			"use_count":         proxy.UseCount,
+			"fail_count":        proxy.FailCount,
+			"is_healthy":        proxy.IsHealthy,
+			"current_ip":        proxy.CurrentIP,
+			"response_time":     proxy.ResponseTime,
+			"avg_response_time": avgResponseTime,
+			"success_count":     proxy.SuccessCount,
+			"failure_count":     proxy.FailureCount,
+			"last_error":        proxy.LastError,
+			"bound_tokens":      proxy.BoundTokens,
+			"last_used":         proxy.LastUsed.Format(time.RFC3339),
+			"last_check":        proxy.LastCheck.Format(time.RFC3339),
 		})
 	}
 
+	bindings := make(map[string]string, len(pp.bindings))
+	for tokenKey, proxy := range pp.bindings {
+		bindings[tokenKey] = maskProxyURL(proxy.URL)
+	}
+
 	return map[string]any{
-		"enabled":        pp.enabled,
-		"total_proxies":  len(pp.proxies),
+		"enabled":         pp.enabled,
+		"total_proxies":   len(pp.proxies),
 		"healthy_proxies": healthyCount,
 		"total_use_count": totalUseCount,
+		"bindings":        bindings,
+		"failovers":       pp.failovers,
 		"config": map[string]any{
-			"max_use_count":          pp.maxUseCount,
-			"max_fail_count":         pp.maxFailCount,
-			"health_check_interval":  pp.healthCheckInterval.String(),
-			"cooldown_duration":      pp.cooldownDuration.String(),
+			"max_use_count":         pp.maxUseCount,
+			"max_fail_count":        pp.maxFailCount,
+			"health_check_interval": pp.healthCheckInterval.String(),
+			"cooldown_duration":     pp.cooldownDuration.String(),
 		},
 		"proxies": proxyStats,
 	}
@@ -397,7 +523,7 @@ func (pp *ProxyPool) AddProxy(proxyURL string) error {
 	}
 
 	// 验证URL格式
-	if _, err := url.Parse(proxyURL); err != nil {
+	if _, err := utils.ParseProxyURL(proxyURL); err != nil {
 		return fmt.Errorf("无效的代理URL: %v", err)
 	}
 
@@ -429,6 +555,12 @@ func (pp *ProxyPool) RemoveProxy(proxyURL string) {
 	for i, proxy := range pp.proxies {
 		if proxy.URL == proxyURL {
 			pp.proxies = append(pp.proxies[:i], pp.proxies[i+1:]...)
+			// 解除绑定，相关token下次请求时重新选择
+			for tokenKey, bound := range pp.bindings {
+				if bound == proxy {
+					delete(pp.bindings, tokenKey)
+				}
+			}
 			logger.Info("移除代理", logger.String("proxy", maskProxyURL(proxyURL)))
 			break
 		}
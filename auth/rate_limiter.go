@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"strings"
@@ -9,6 +10,7 @@ import (
 
 	"kiro2api/config"
 	"kiro2api/logger"
+	"kiro2api/notify"
 )
 
 // {{RIPER-10 Action}}
@@ -257,6 +259,28 @@ func (rl *RateLimiter) MarkTokenSuspended(tokenKey string, reason string) {
 		logger.String("reason", reason),
 		logger.Duration("cooldown", rl.suspendedCooldown),
 		logger.String("cooldown_end", state.CooldownEnd.Format(time.RFC3339)))
+
+	notify.Send(notify.Event{
+		Type:     notify.EventAccountSuspended,
+		Severity: notify.SeverityCritical,
+		Title:    "账号被AWS暂停",
+		Message:  fmt.Sprintf("%s 被暂停，进入 %s 冷却", tokenKey, rl.suspendedCooldown),
+		Key:      tokenKey,
+		Fields: map[string]any{
+			"token_key":    tokenKey,
+			"reason":       truncateReason(reason),
+			"cooldown_end": state.CooldownEnd.Format(time.RFC3339),
+		},
+	})
+}
+
+// truncateReason 截断过长的错误信息（通知中只保留前 300 字符）
+func truncateReason(reason string) string {
+	const maxLen = 300
+	if len(reason) <= maxLen {
+		return reason
+	}
+	return reason[:maxLen] + "..."
 }
 
 // IsTokenSuspended 检查token是否被暂停
@@ -348,6 +372,23 @@ func (rl *RateLimiter) IsTokenInCooldown(tokenKey string) bool {
 	return false
 }
 
+// RetryAfter 获取token恢复可用前需等待的时间：冷却剩余时间，达到每日上限时取距计数重置的时间
+func (rl *RateLimiter) RetryAfter(tokenKey string) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	state, exists := rl.tokenStates[tokenKey]
+	if !exists {
+		return 0
+	}
+	now := time.Now()
+	wait := state.CooldownEnd.Sub(now)
+	if rl.dailyMaxRequests > 0 && state.DailyRequests >= rl.dailyMaxRequests {
+		wait = max(wait, state.DailyResetTime.Sub(now))
+	}
+	return max(wait, 0)
+}
+
 // IsDailyLimitExceeded 检查是否超过每日限制
 func (rl *RateLimiter) IsDailyLimitExceeded(tokenKey string) bool {
 	if rl.dailyMaxRequests <= 0 {
@@ -415,17 +456,40 @@ func (rl *RateLimiter) RecordSuccess(tokenKey string) {
 	}
 }
 
+// IsSuspendedError 判断错误消息是否表示账号被AWS暂停
+func IsSuspendedError(errorMsg string) bool {
+	return strings.Contains(errorMsg, "TEMPORARILY_SUSPENDED") ||
+		strings.Contains(errorMsg, "temporarily is suspended")
+}
+
 // CheckAndMarkSuspended 检查错误消息是否包含暂停信息，如果是则标记token
 // 返回true表示token被暂停
 func (rl *RateLimiter) CheckAndMarkSuspended(tokenKey string, errorMsg string) bool {
-	if strings.Contains(errorMsg, "TEMPORARILY_SUSPENDED") ||
-		strings.Contains(errorMsg, "temporarily is suspended") {
+	if IsSuspendedError(errorMsg) {
 		rl.MarkTokenSuspended(tokenKey, errorMsg)
 		return true
 	}
 	return false
 }
 
+// ClearTokenSuspended 解除token的暂停和冷却状态（健康探测确认恢复后调用）
+func (rl *RateLimiter) ClearTokenSuspended(tokenKey string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	state, exists := rl.tokenStates[tokenKey]
+	if !exists || !state.IsSuspended {
+		return
+	}
+	state.IsSuspended = false
+	state.SuspendReason = ""
+	state.CooldownEnd = time.Time{}
+	state.FailCount = 0
+
+	logger.Info("Token暂停状态已解除",
+		logger.String("token_key", tokenKey))
+}
+
 // GetStats 获取统计信息
 func (rl *RateLimiter) GetStats() map[string]any {
 	rl.mutex.Lock()
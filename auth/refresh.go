@@ -12,20 +12,47 @@ import (
 	"time"
 )
 
-// refreshSingleToken 刷新单个token
-func (tm *TokenManager) refreshSingleToken(authConfig AuthConfig) (types.TokenInfo, error) {
+// tokenProxyClient 刷新与使用量查询的代理客户端（按代理复用连接）
+var tokenProxyClient = utils.NewProxyAwareClient()
+
+// currentProxyPool 获取代理池（可在测试中替换）
+var currentProxyPool = GetProxyPool
+
+// httpClientForToken 启用代理池时返回token绑定代理的客户端，否则返回共享客户端
+// 刷新与使用量查询和对话请求走同一出口，避免同一账号出现多个出口IP
+func httpClientForToken(tokenKey string) *http.Client {
+	pool := currentProxyPool()
+	if tokenKey == "" || !pool.IsEnabled() {
+		return utils.SharedHTTPClient
+	}
+	proxy := pool.GetProxyForToken(tokenKey)
+	if proxy == nil {
+		return utils.SharedHTTPClient
+	}
+	client, err := tokenProxyClient.ClientFor(proxy.URL)
+	if err != nil {
+		logger.Warn("创建代理客户端失败，使用默认客户端",
+			logger.String("token_key", tokenKey),
+			logger.Err(err))
+		return utils.SharedHTTPClient
+	}
+	return client
+}
+
+// refreshSingleToken 刷新单个token，请求经tokenKey绑定的代理发出
+func (tm *TokenManager) refreshSingleToken(tokenKey string, authConfig AuthConfig) (types.TokenInfo, error) {
 	switch authConfig.AuthType {
 	case AuthMethodSocial:
-		return refreshSocialToken(authConfig.RefreshToken)
+		return refreshSocialToken(tokenKey, authConfig.RefreshToken)
 	case AuthMethodIdC:
-		return refreshIdCToken(authConfig)
+		return refreshIdCToken(tokenKey, authConfig)
 	default:
 		return types.TokenInfo{}, fmt.Errorf("不支持的认证类型: %s", authConfig.AuthType)
 	}
 }
 
 // refreshSocialToken 刷新Social认证token
-func refreshSocialToken(refreshToken string) (types.TokenInfo, error) {
+func refreshSocialToken(tokenKey, refreshToken string) (types.TokenInfo, error) {
 	refreshReq := types.RefreshRequest{
 		RefreshToken: refreshToken,
 	}
@@ -42,7 +69,7 @@ func refreshSocialToken(refreshToken string) (types.TokenInfo, error) {
 
 	req.Header.Set("Content-Type", "application/json")
 
-	client := utils.SharedHTTPClient
+	client := httpClientForToken(tokenKey)
 	resp, err := client.Do(req)
 	if err != nil {
 		return types.TokenInfo{}, fmt.Errorf("请求失败: %v", err)
@@ -77,7 +104,7 @@ func refreshSocialToken(refreshToken string) (types.TokenInfo, error) {
 }
 
 // refreshIdCToken 刷新IdC认证token
-func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
+func refreshIdCToken(tokenKey string, authConfig AuthConfig) (types.TokenInfo, error) {
 	refreshReq := types.IdcRefreshRequest{
 		ClientId:     authConfig.ClientID,
 		ClientSecret: authConfig.ClientSecret,
@@ -97,8 +124,11 @@ func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
 
 	// 设置IdC特殊headers（使用指纹随机化）
 	fpManager := GetFingerprintManager()
-	tokenKey := authConfig.RefreshToken[:20]
-	fp := fpManager.GetFingerprint(tokenKey)
+	fpKey := authConfig.RefreshToken
+	if len(fpKey) > 20 {
+		fpKey = fpKey[:20]
+	}
+	fp := fpManager.GetFingerprint(fpKey)
 	
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Host", "oidc.us-east-1.amazonaws.com")
@@ -110,7 +140,7 @@ func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
 	req.Header.Set("User-Agent", "node")
 	req.Header.Set("Accept-Encoding", fp.AcceptEncoding)
 
-	client := utils.SharedHTTPClient
+	client := httpClientForToken(tokenKey)
 	resp, err := client.Do(req)
 	if err != nil {
 		return types.TokenInfo{}, fmt.Errorf("IdC请求失败: %v", err)
@@ -141,12 +171,12 @@ func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
 	return token, nil
 }
 
-// RefreshSocialToken 公开的Social token刷新函数
-func RefreshSocialToken(refreshToken string) (types.TokenInfo, error) {
-	return refreshSocialToken(refreshToken)
+// RefreshSocialToken 公开的Social token刷新函数，tokenKey 为空时不走代理池
+func RefreshSocialToken(tokenKey, refreshToken string) (types.TokenInfo, error) {
+	return refreshSocialToken(tokenKey, refreshToken)
 }
 
-// RefreshIdCToken 公开的IdC token刷新函数
-func RefreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
-	return refreshIdCToken(authConfig)
+// RefreshIdCToken 公开的IdC token刷新函数，tokenKey 为空时不走代理池
+func RefreshIdCToken(tokenKey string, authConfig AuthConfig) (types.TokenInfo, error) {
+	return refreshIdCToken(tokenKey, authConfig)
 }
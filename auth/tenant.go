@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"kiro2api/store"
+	"kiro2api/types"
+)
+
+// 租户凭据在 API Key 中的前缀
+// 完整格式: PROXY_API_KEY:<凭据>，凭据支持以下三种形式
+const (
+	// TenantCredentialBase64Prefix base64编码的JSON凭据: b64:<base64(JSON)>
+	TenantCredentialBase64Prefix = "b64:"
+
+	// TenantCredentialIDPrefix 已注册租户ID: tenant:<ID>
+	TenantCredentialIDPrefix = "tenant:"
+)
+
+// TenantCredential 多租户模式下的用户凭据，同时支持 Social 和 IdC
+type TenantCredential struct {
+	AuthType     string `json:"auth"`
+	RefreshToken string `json:"refreshToken"`
+	ClientID     string `json:"clientId,omitempty"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+
+	// TenantID 已注册租户的ID（内联凭据为空）
+	TenantID string `json:"-"`
+}
+
+// ParseTenantCredential 解析 API Key 冒号之后的租户凭据
+// 1. tenant:<ID>          - 从管理存储中查找已注册租户
+// 2. b64:<base64(JSON)>   - {"auth":"IdC","refreshToken":"...","clientId":"...","clientSecret":"..."}
+// 3. 其他                 - 视为 Social 认证的 RefreshToken（向后兼容）
+func ParseTenantCredential(raw string) (TenantCredential, error) {
+	switch {
+	case strings.HasPrefix(raw, TenantCredentialIDPrefix):
+		return lookupRegisteredTenant(strings.TrimPrefix(raw, TenantCredentialIDPrefix))
+
+	case strings.HasPrefix(raw, TenantCredentialBase64Prefix):
+		return decodeInlineTenantCredential(strings.TrimPrefix(raw, TenantCredentialBase64Prefix))
+
+	default:
+		if raw == "" {
+			return TenantCredential{}, fmt.Errorf("租户凭据为空")
+		}
+		return TenantCredential{
+			AuthType:     AuthMethodSocial,
+			RefreshToken: raw,
+		}, nil
+	}
+}
+
+// lookupRegisteredTenant 查找已注册租户
+func lookupRegisteredTenant(id string) (TenantCredential, error) {
+	if id == "" {
+		return TenantCredential{}, fmt.Errorf("租户ID为空")
+	}
+
+	s := store.GetStore()
+	if s == nil {
+		return TenantCredential{}, fmt.Errorf("store 未初始化，无法查找租户")
+	}
+
+	tenant, exists := s.GetTenant(id)
+	if !exists {
+		return TenantCredential{}, fmt.Errorf("租户不存在: %s", id)
+	}
+	if tenant.Disabled {
+		return TenantCredential{}, fmt.Errorf("租户已禁用: %s", id)
+	}
+
+	cred := TenantCredential{
+		AuthType:     tenant.AuthType,
+		RefreshToken: tenant.RefreshToken,
+		ClientID:     tenant.ClientID,
+		ClientSecret: tenant.ClientSecret,
+		TenantID:     tenant.ID,
+	}
+	return cred, cred.Validate()
+}
+
+// decodeInlineTenantCredential 解码 base64 JSON 凭据（兼容标准与URL安全编码，可省略填充）
+func decodeInlineTenantCredential(encoded string) (TenantCredential, error) {
+	var data []byte
+	var err error
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding,
+		base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if data, err = enc.DecodeString(encoded); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return TenantCredential{}, fmt.Errorf("租户凭据base64解码失败: %w", err)
+	}
+
+	var cred TenantCredential
+	if err := json.Unmarshal(data, &cred); err != nil {
+		return TenantCredential{}, fmt.Errorf("租户凭据JSON格式无效: %w", err)
+	}
+
+	if cred.AuthType == "" {
+		cred.AuthType = AuthMethodSocial
+	}
+	return cred, cred.Validate()
+}
+
+// Validate 校验凭据必要字段
+func (tc TenantCredential) Validate() error {
+	if tc.RefreshToken == "" {
+		return fmt.Errorf("租户凭据缺少 refreshToken")
+	}
+
+	switch tc.AuthType {
+	case AuthMethodSocial:
+		return nil
+	case AuthMethodIdC:
+		if tc.ClientID == "" || tc.ClientSecret == "" {
+			return fmt.Errorf("IdC 租户凭据缺少 clientId 或 clientSecret")
+		}
+		return nil
+	default:
+		return fmt.Errorf("不支持的认证类型: %s", tc.AuthType)
+	}
+}
+
+// Key 租户的稳定标识，用于缓存、指纹和频率限制（不暴露原始凭据）
+func (tc TenantCredential) Key() string {
+	if tc.TenantID != "" {
+		return "tenant_" + tc.TenantID
+	}
+	sum := sha256.Sum256([]byte(tc.AuthType + "\x00" + tc.ClientID + "\x00" + tc.RefreshToken))
+	return "tenant_" + hex.EncodeToString(sum[:8])
+}
+
+// toAuthConfig 转换为刷新所需的认证配置
+func (tc TenantCredential) toAuthConfig() AuthConfig {
+	return AuthConfig{
+		AuthType:     tc.AuthType,
+		RefreshToken: tc.RefreshToken,
+		ClientID:     tc.ClientID,
+		ClientSecret: tc.ClientSecret,
+		sourceType:   "tenant",
+	}
+}
+
+// refreshTenantToken 按认证类型刷新租户token
+func refreshTenantToken(cred TenantCredential) (types.TokenInfo, error) {
+	switch cred.AuthType {
+	case AuthMethodSocial:
+		return refreshSocialToken(cred.Key(), cred.RefreshToken)
+	case AuthMethodIdC:
+		return refreshIdCToken(cred.Key(), cred.toAuthConfig())
+	default:
+		return types.TokenInfo{}, fmt.Errorf("不支持的认证类型: %s", cred.AuthType)
+	}
+}
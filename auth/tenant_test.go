@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTenantCredential_LegacySocial(t *testing.T) {
+	cred, err := ParseTenantCredential("user_refresh_token")
+
+	assert.NoError(t, err)
+	assert.Equal(t, AuthMethodSocial, cred.AuthType)
+	assert.Equal(t, "user_refresh_token", cred.RefreshToken)
+}
+
+func TestParseTenantCredential_InlineIdC(t *testing.T) {
+	raw := `{"auth":"IdC","refreshToken":"rt","clientId":"cid","clientSecret":"secret"}`
+
+	for name, enc := range map[string]*base64.Encoding{
+		"std":     base64.StdEncoding,
+		"raw_url": base64.RawURLEncoding,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cred, err := ParseTenantCredential(TenantCredentialBase64Prefix + enc.EncodeToString([]byte(raw)))
+
+			assert.NoError(t, err)
+			assert.Equal(t, AuthMethodIdC, cred.AuthType)
+			assert.Equal(t, "rt", cred.RefreshToken)
+			assert.Equal(t, "cid", cred.ClientID)
+			assert.Equal(t, "secret", cred.ClientSecret)
+		})
+	}
+}
+
+func TestParseTenantCredential_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"bad_base64":      TenantCredentialBase64Prefix + "!!!",
+		"bad_json":        TenantCredentialBase64Prefix + base64.StdEncoding.EncodeToString([]byte("not json")),
+		"idc_no_secret":   TenantCredentialBase64Prefix + base64.StdEncoding.EncodeToString([]byte(`{"auth":"IdC","refreshToken":"rt","clientId":"cid"}`)),
+		"unknown_auth":    TenantCredentialBase64Prefix + base64.StdEncoding.EncodeToString([]byte(`{"auth":"Other","refreshToken":"rt"}`)),
+		"empty_tenant_id": TenantCredentialIDPrefix,
+	}
+
+	for name, raw := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseTenantCredential(raw)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestTenantCredential_KeyIsStableAndOpaque(t *testing.T) {
+	a := TenantCredential{AuthType: AuthMethodIdC, RefreshToken: "secret_refresh", ClientID: "cid"}
+	b := TenantCredential{AuthType: AuthMethodIdC, RefreshToken: "secret_refresh", ClientID: "other"}
+
+	assert.Equal(t, a.Key(), a.Key())
+	assert.NotEqual(t, a.Key(), b.Key())
+	assert.NotContains(t, a.Key(), "secret_refresh")
+	assert.Equal(t, "tenant_abc", TenantCredential{TenantID: "abc"}.Key())
+}
+
+func newTestUserTokenCache(maxSize int, calls *int32) *UserTokenCache {
+	c := NewUserTokenCache(maxSize)
+	c.refreshFunc = func(cred TenantCredential) (types.TokenInfo, error) {
+		atomic.AddInt32(calls, 1)
+		if cred.RefreshToken == "bad" {
+			return types.TokenInfo{}, fmt.Errorf("refresh failed")
+		}
+		return types.TokenInfo{
+			AccessToken: "access_" + cred.AuthType + "_" + cred.RefreshToken,
+			ExpiresAt:   time.Now().Add(time.Hour),
+		}, nil
+	}
+	return c
+}
+
+func TestUserTokenCache_AcquireIdCTenant(t *testing.T) {
+	var calls int32
+	c := newTestUserTokenCache(10, &calls)
+	cred := TenantCredential{AuthType: AuthMethodIdC, RefreshToken: "rt", ClientID: "cid", ClientSecret: "secret"}
+
+	first, err := c.Acquire(cred)
+	assert.NoError(t, err)
+	assert.Equal(t, "access_IdC_rt", first.Token.AccessToken)
+	assert.NotNil(t, first.Fingerprint)
+
+	second, err := c.Acquire(cred)
+	assert.NoError(t, err)
+	assert.Same(t, first.Fingerprint, second.Fingerprint, "同一租户应复用指纹")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "缓存命中不应再次刷新")
+
+	stats := c.GetStats()
+	assert.Equal(t, int64(1), stats["hits"])
+	assert.Equal(t, int64(1), stats["misses"])
+}
+
+func TestUserTokenCache_TenantIsolation(t *testing.T) {
+	var calls int32
+	c := newTestUserTokenCache(10, &calls)
+	a := TenantCredential{AuthType: AuthMethodSocial, RefreshToken: "tenant_a"}
+	b := TenantCredential{AuthType: AuthMethodSocial, RefreshToken: "tenant_b"}
+
+	tokenA, err := c.Acquire(a)
+	assert.NoError(t, err)
+	tokenB, err := c.Acquire(b)
+	assert.NoError(t, err)
+	assert.NotSame(t, tokenA.Fingerprint, tokenB.Fingerprint)
+
+	// 租户A冷却不影响租户B
+	c.MarkFailed(tokenA.Key)
+	_, err = c.Acquire(a)
+	assert.Error(t, err)
+	_, err = c.Acquire(b)
+	assert.NoError(t, err)
+}
+
+func TestUserTokenCache_RefreshFailureDoesNotCache(t *testing.T) {
+	var calls int32
+	c := newTestUserTokenCache(10, &calls)
+	cred := TenantCredential{AuthType: AuthMethodSocial, RefreshToken: "bad"}
+
+	_, err := c.Acquire(cred)
+	assert.Error(t, err)
+	assert.Equal(t, 0, c.Size())
+	assert.Equal(t, int64(1), c.GetStats()["refresh_failures"])
+}
+
+func TestUserTokenCache_EvictionAndSingleFlight(t *testing.T) {
+	var calls int32
+	c := newTestUserTokenCache(2, &calls)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = c.GetOrRefresh("same")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "并发刷新同一租户应被去重")
+
+	_, _ = c.GetOrRefresh("second")
+	_, _ = c.GetOrRefresh("third")
+	assert.Equal(t, 2, c.Size())
+	assert.Equal(t, int64(1), c.GetStats()["evictions"])
+}
+
+func TestUserTokenCache_SuccessResetsBackoff(t *testing.T) {
+	var calls int32
+	c := newTestUserTokenCache(10, &calls)
+	cred := TenantCredential{AuthType: AuthMethodSocial, RefreshToken: "rt"}
+
+	tenant, err := c.Acquire(cred)
+	require.NoError(t, err)
+	limiter := c.cache[tenant.Key].rateLimiter
+	failCount := func() int {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		return limiter.tokenStates[tenant.Key].FailCount
+	}
+
+	c.MarkFailed(tenant.Key)
+	c.MarkFailed(tenant.Key)
+	assert.Equal(t, 2, failCount())
+	_, err = c.Acquire(cred)
+	var limitErr *TenantRateLimitError
+	require.ErrorAs(t, err, &limitErr, "失败后处于冷却期")
+	assert.Greater(t, limitErr.RetryAfter, time.Duration(0))
+
+	// 成功后失败计数清零，下次失败从最短退避重新开始
+	c.MarkSuccess(tenant.Key)
+	assert.Equal(t, 0, failCount())
+	c.MarkFailed(tenant.Key)
+	assert.Equal(t, 1, failCount())
+}
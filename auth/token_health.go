@@ -0,0 +1,455 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/notify"
+	"kiro2api/store"
+	"kiro2api/types"
+)
+
+// HealthState 账号健康状态
+// 生命周期：healthy → degraded → quarantined → retired
+type HealthState string
+
+const (
+	HealthHealthy     HealthState = "healthy"     // 正常
+	HealthDegraded    HealthState = "degraded"    // 出现失败，仍参与轮询
+	HealthQuarantined HealthState = "quarantined" // 隔离，不参与轮询，继续探测
+	HealthRetired     HealthState = "retired"     // 退役，不再探测，需管理员重新启用
+)
+
+// HealthEvent 账号健康状态变化事件
+type HealthEvent struct {
+	TokenKey string      `json:"token_key"`
+	StoreID  string      `json:"store_id,omitempty"`
+	From     HealthState `json:"from"`
+	To       HealthState `json:"to"`
+	Reason   string      `json:"reason"`
+	At       time.Time   `json:"at"`
+}
+
+// tokenHealth 单个账号的健康记录
+type tokenHealth struct {
+	state            HealthState
+	reason           string
+	consecutiveFails int
+	changedAt        time.Time
+	quarantinedAt    time.Time
+	lastProbe        time.Time
+	lastProbeErr     string
+}
+
+// TokenHealthMonitor 账号健康探测与自动隔离
+// 定期对每个账号执行一次轻量的使用量查询作为探测，结合请求路径和后台调度器上报的结果驱动状态机，
+// 状态变化时写回 store 并通知监听者
+type TokenHealthMonitor struct {
+	tm *TokenManager
+
+	// 配置参数
+	probeInterval       time.Duration // 探测间隔
+	degradedThreshold   int           // 连续失败多少次进入 degraded
+	quarantineThreshold int           // 连续失败多少次进入 quarantined
+	retireAfter         time.Duration // 隔离多久仍未恢复则退役
+
+	// 可替换的网络调用（便于测试）
+	refreshFunc func(string, AuthConfig) (types.TokenInfo, error)
+	usageFunc   func(string, types.TokenInfo) (*types.UsageLimits, error)
+
+	mutex     sync.Mutex
+	states    map[string]*tokenHealth
+	listeners []func(HealthEvent)
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// TokenHealthConfig 健康探测配置
+type TokenHealthConfig struct {
+	ProbeInterval       time.Duration
+	DegradedThreshold   int
+	QuarantineThreshold int
+	RetireAfter         time.Duration
+}
+
+// DefaultTokenHealthConfig 默认配置（从config包读取）
+func DefaultTokenHealthConfig() TokenHealthConfig {
+	return TokenHealthConfig{
+		ProbeInterval:       config.TokenHealthProbeInterval,
+		DegradedThreshold:   config.TokenHealthDegradedThreshold,
+		QuarantineThreshold: config.TokenHealthQuarantineThreshold,
+		RetireAfter:         config.TokenHealthRetireAfter,
+	}
+}
+
+// NewTokenHealthMonitor 创建健康探测器（未启动），并从 store 恢复已持久化的隔离/退役状态
+func NewTokenHealthMonitor(tm *TokenManager, cfg TokenHealthConfig) *TokenHealthMonitor {
+	if cfg.DegradedThreshold <= 0 {
+		cfg.DegradedThreshold = 1
+	}
+	if cfg.QuarantineThreshold < cfg.DegradedThreshold {
+		cfg.QuarantineThreshold = cfg.DegradedThreshold
+	}
+
+	m := &TokenHealthMonitor{
+		tm:                  tm,
+		probeInterval:       cfg.ProbeInterval,
+		degradedThreshold:   cfg.DegradedThreshold,
+		quarantineThreshold: cfg.QuarantineThreshold,
+		retireAfter:         cfg.RetireAfter,
+		refreshFunc:         tm.refreshSingleToken,
+		usageFunc:           checkUsageLimitsForToken,
+		states:              make(map[string]*tokenHealth),
+		stopCh:              make(chan struct{}),
+	}
+	m.restoreFromStore()
+	return m
+}
+
+// restoreFromStore 恢复 store 中持久化的健康状态（重启后隔离/退役的账号不会被立即选中）
+func (m *TokenHealthMonitor) restoreFromStore() {
+	s := store.GetStore()
+	if s == nil {
+		return
+	}
+
+	for i, cfg := range m.tm.snapshotConfigs() {
+		if cfg.storeID == "" {
+			continue
+		}
+		t, found := s.GetToken(cfg.storeID)
+		if !found {
+			continue
+		}
+		state := HealthState(t.HealthState)
+		if state != HealthQuarantined && state != HealthRetired {
+			continue
+		}
+
+		changedAt, err := time.Parse(time.RFC3339, t.HealthChangedAt)
+		if err != nil {
+			changedAt = time.Now()
+		}
+		m.states[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = &tokenHealth{
+			state:         state,
+			reason:        t.HealthReason,
+			changedAt:     changedAt,
+			quarantinedAt: changedAt,
+		}
+	}
+}
+
+// AddListener 注册状态变化监听者（在状态变化后异步调用）
+func (m *TokenHealthMonitor) AddListener(fn func(HealthEvent)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners = append(m.listeners, fn)
+}
+
+// Start 启动后台探测循环
+func (m *TokenHealthMonitor) Start() {
+	m.wg.Add(1)
+	go m.loop()
+
+	logger.Info("账号健康探测已启动",
+		logger.Duration("probe_interval", m.probeInterval),
+		logger.Int("degraded_threshold", m.degradedThreshold),
+		logger.Int("quarantine_threshold", m.quarantineThreshold),
+		logger.Duration("retire_after", m.retireAfter))
+}
+
+// Stop 停止后台探测循环
+func (m *TokenHealthMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopCh)
+	})
+	m.wg.Wait()
+}
+
+// loop 后台探测循环
+func (m *TokenHealthMonitor) loop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-ticker.C:
+			m.ProbeAll()
+		}
+	}
+}
+
+// ProbeAll 依次探测所有未退役的账号
+func (m *TokenHealthMonitor) ProbeAll() {
+	for i, cfg := range m.tm.snapshotConfigs() {
+		if cfg.Disabled {
+			continue
+		}
+		key := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		if m.GetState(key) == HealthRetired {
+			continue
+		}
+
+		err := m.probe(i, cfg)
+
+		m.mutex.Lock()
+		h := m.getOrCreateUnlocked(key)
+		h.lastProbe = time.Now()
+		h.lastProbeErr = ""
+		if err != nil {
+			h.lastProbeErr = err.Error()
+		}
+		m.mutex.Unlock()
+
+		if err != nil {
+			m.RecordFailure(key, err.Error())
+		} else {
+			m.RecordSuccess(key)
+		}
+	}
+}
+
+// probe 轻量探测：复用缓存中的access token（必要时刷新）查询一次使用限制
+func (m *TokenHealthMonitor) probe(index int, cfg AuthConfig) error {
+	tokenKey := fmt.Sprintf(config.TokenCacheKeyFormat, index)
+	cached, exists := m.tm.cachedTokenSnapshot(index)
+	token := cached.Token
+	if !exists || token.IsExpired() {
+		refreshed, err := m.refreshFunc(tokenKey, cfg)
+		if err != nil {
+			return fmt.Errorf("刷新token失败: %w", err)
+		}
+		token = refreshed
+	}
+
+	if _, err := m.usageFunc(tokenKey, token); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RecordSuccess 记录一次成功，degraded/quarantined 账号恢复为 healthy
+func (m *TokenHealthMonitor) RecordSuccess(tokenKey string) {
+	m.mutex.Lock()
+	h := m.getOrCreateUnlocked(tokenKey)
+	h.consecutiveFails = 0
+	if h.state != HealthDegraded && h.state != HealthQuarantined {
+		m.mutex.Unlock()
+		return
+	}
+	event := m.transitionUnlocked(tokenKey, h, HealthHealthy, "探测恢复正常")
+	m.mutex.Unlock()
+
+	m.emit(event)
+}
+
+// RecordFailure 记录一次失败并按阈值推进状态机
+// 账号被暂停或凭据失效时直接进入隔离
+func (m *TokenHealthMonitor) RecordFailure(tokenKey string, reason string) {
+	m.mutex.Lock()
+	h := m.getOrCreateUnlocked(tokenKey)
+	if h.state == HealthRetired {
+		m.mutex.Unlock()
+		return
+	}
+	h.consecutiveFails++
+
+	target := h.state
+	switch {
+	case h.state == HealthQuarantined:
+		if m.retireAfter > 0 && time.Since(h.quarantinedAt) >= m.retireAfter {
+			target = HealthRetired
+			reason = fmt.Sprintf("隔离超过 %s 仍未恢复: %s", m.retireAfter, reason)
+		}
+	case isFatalHealthError(reason) || h.consecutiveFails >= m.quarantineThreshold:
+		target = HealthQuarantined
+	case h.consecutiveFails >= m.degradedThreshold:
+		target = HealthDegraded
+	}
+
+	if target == h.state {
+		m.mutex.Unlock()
+		return
+	}
+	event := m.transitionUnlocked(tokenKey, h, target, reason)
+	m.mutex.Unlock()
+
+	if target == HealthQuarantined && IsSuspendedError(reason) && m.tm.rateLimiter != nil {
+		m.tm.rateLimiter.MarkTokenSuspended(tokenKey, reason)
+	}
+	m.emit(event)
+}
+
+// IsSelectable 账号是否允许参与轮询（隔离和退役的账号不参与）
+func (m *TokenHealthMonitor) IsSelectable(tokenKey string) bool {
+	state := m.GetState(tokenKey)
+	return state != HealthQuarantined && state != HealthRetired
+}
+
+// GetState 获取账号当前健康状态（未记录过的账号视为 healthy）
+func (m *TokenHealthMonitor) GetState(tokenKey string) HealthState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if h, exists := m.states[tokenKey]; exists {
+		return h.state
+	}
+	return HealthHealthy
+}
+
+// getOrCreateUnlocked 获取或创建健康记录（调用前需持有锁）
+func (m *TokenHealthMonitor) getOrCreateUnlocked(tokenKey string) *tokenHealth {
+	h, exists := m.states[tokenKey]
+	if !exists {
+		h = &tokenHealth{state: HealthHealthy, changedAt: time.Now()}
+		m.states[tokenKey] = h
+	}
+	return h
+}
+
+// transitionUnlocked 切换状态并生成事件（调用前需持有锁）
+// StoreID 由 emit 在释放锁后补全，避免持有健康锁时再获取 TokenManager 锁
+func (m *TokenHealthMonitor) transitionUnlocked(tokenKey string, h *tokenHealth, to HealthState, reason string) HealthEvent {
+	now := time.Now()
+	event := HealthEvent{
+		TokenKey: tokenKey,
+		From:     h.state,
+		To:       to,
+		Reason:   reason,
+		At:       now,
+	}
+
+	h.state = to
+	h.reason = reason
+	h.changedAt = now
+	switch to {
+	case HealthQuarantined:
+		h.quarantinedAt = now
+	case HealthHealthy:
+		h.reason = ""
+		h.quarantinedAt = time.Time{}
+	}
+	return event
+}
+
+// emit 记录事件日志、写回 store 并通知监听者（不可持锁调用）
+func (m *TokenHealthMonitor) emit(event HealthEvent) {
+	event.StoreID = m.tm.storeIDForKey(event.TokenKey)
+
+	fields := []logger.Field{
+		logger.String("event", "token_health_transition"),
+		logger.String("token_key", event.TokenKey),
+		logger.String("store_id", event.StoreID),
+		logger.String("from", string(event.From)),
+		logger.String("to", string(event.To)),
+		logger.String("reason", event.Reason),
+	}
+	if event.To == HealthHealthy {
+		logger.Info("账号健康状态变化", fields...)
+	} else {
+		logger.Warn("账号健康状态变化", fields...)
+	}
+
+	if event.To == HealthHealthy && m.tm.rateLimiter != nil {
+		m.tm.rateLimiter.ClearTokenSuspended(event.TokenKey)
+	}
+
+	if event.StoreID != "" {
+		if s := store.GetStore(); s != nil {
+			// LastError 只记录导致降级、隔离或退役的失败原因，恢复时清空
+			lastError := event.Reason
+			if event.To == HealthHealthy {
+				lastError = ""
+			}
+			s.UpdateTokenStatus(event.StoreID, "", -1, lastError)
+			s.UpdateTokenHealth(event.StoreID, string(event.To), event.Reason)
+		}
+	}
+
+	m.mutex.Lock()
+	listeners := make([]func(HealthEvent), len(m.listeners))
+	copy(listeners, m.listeners)
+	m.mutex.Unlock()
+
+	for _, fn := range listeners {
+		go fn(event)
+	}
+}
+
+// GetStats 获取健康状态统计
+func (m *TokenHealthMonitor) GetStats() map[string]any {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counts := map[HealthState]int{}
+	tokens := make(map[string]any, len(m.states))
+	for key, h := range m.states {
+		counts[h.state]++
+		entry := map[string]any{
+			"state":             h.state,
+			"reason":            h.reason,
+			"consecutive_fails": h.consecutiveFails,
+			"changed_at":        h.changedAt.Format(time.RFC3339),
+		}
+		if !h.lastProbe.IsZero() {
+			entry["last_probe"] = h.lastProbe.Format(time.RFC3339)
+			entry["last_probe_error"] = h.lastProbeErr
+		}
+		tokens[key] = entry
+	}
+
+	return map[string]any{
+		"probe_interval_s":     m.probeInterval.Seconds(),
+		"degraded_threshold":   m.degradedThreshold,
+		"quarantine_threshold": m.quarantineThreshold,
+		"retire_after_s":       m.retireAfter.Seconds(),
+		"counts":               counts,
+		"tokens":               tokens,
+	}
+}
+
+// isFatalHealthError 判断失败是否应直接隔离（账号被暂停或凭据失效）
+func isFatalHealthError(reason string) bool {
+	if IsSuspendedError(reason) {
+		return true
+	}
+	return strings.Contains(reason, "invalid_grant") ||
+		strings.Contains(reason, "状态码 401")
+}
+
+// notifyHealthEvent 将健康状态变化转发为运维通知
+func notifyHealthEvent(event HealthEvent) {
+	severity := notify.SeverityWarning
+	switch event.To {
+	case HealthHealthy:
+		severity = notify.SeverityInfo
+	case HealthRetired:
+		severity = notify.SeverityCritical
+	}
+
+	notify.Send(notify.Event{
+		Type:     notify.EventTokenHealthChanged,
+		Severity: severity,
+		Title:    "账号健康状态变化",
+		Message:  fmt.Sprintf("%s: %s → %s", event.TokenKey, event.From, event.To),
+		Key:      event.TokenKey + ":" + string(event.To),
+		Fields: map[string]any{
+			"token_key": event.TokenKey,
+			"store_id":  event.StoreID,
+			"from":      string(event.From),
+			"to":        string(event.To),
+			"reason":    truncateReason(event.Reason),
+		},
+		Timestamp: event.At,
+	})
+}
@@ -0,0 +1,213 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/store"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHealthMonitor 创建使用独立频率限制器和假探测调用的健康探测器
+func newTestHealthMonitor(configs []AuthConfig, retireAfter time.Duration) (*TokenManager, *TokenHealthMonitor) {
+	tm := NewTokenManager(configs)
+	tm.rateLimiter = NewRateLimiter(DefaultRateLimiterConfig())
+
+	m := NewTokenHealthMonitor(tm, TokenHealthConfig{
+		ProbeInterval:       time.Hour,
+		DegradedThreshold:   1,
+		QuarantineThreshold: 3,
+		RetireAfter:         retireAfter,
+	})
+	m.refreshFunc = func(_ string, cfg AuthConfig) (types.TokenInfo, error) {
+		return types.TokenInfo{AccessToken: "access_" + cfg.RefreshToken, ExpiresAt: time.Now().Add(time.Hour)}, nil
+	}
+	tm.health = m
+	return tm, m
+}
+
+var testStoreOnce sync.Once
+
+// initTestStore 初始化全局 store（进程内只能初始化一次，目录不随单个测试删除）
+func initTestStore(t *testing.T) {
+	t.Helper()
+	testStoreOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "kiro2api-auth-test-")
+		require.NoError(t, err)
+		require.NoError(t, store.InitStore(filepath.Join(dir, "data.json")))
+	})
+	require.NotNil(t, store.GetStore())
+}
+
+func TestTokenHealthMonitor_Lifecycle(t *testing.T) {
+	_, m := newTestHealthMonitor([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "token1"}}, time.Hour)
+
+	events := make(chan HealthEvent, 10)
+	m.AddListener(func(e HealthEvent) { events <- e })
+
+	m.RecordFailure("token_0", "状态码 500")
+	assert.Equal(t, HealthDegraded, m.GetState("token_0"))
+	assert.True(t, m.IsSelectable("token_0"), "degraded 仍参与轮询")
+
+	m.RecordFailure("token_0", "状态码 500")
+	m.RecordFailure("token_0", "状态码 500")
+	assert.Equal(t, HealthQuarantined, m.GetState("token_0"))
+	assert.False(t, m.IsSelectable("token_0"))
+
+	m.RecordSuccess("token_0")
+	assert.Equal(t, HealthHealthy, m.GetState("token_0"))
+
+	var transitions []string
+	for i := 0; i < 3; i++ {
+		select {
+		case e := <-events:
+			transitions = append(transitions, fmt.Sprintf("%s->%s", e.From, e.To))
+		case <-time.After(time.Second):
+			t.Fatal("未收到状态变化事件")
+		}
+	}
+	assert.ElementsMatch(t, []string{"healthy->degraded", "degraded->quarantined", "quarantined->healthy"}, transitions)
+}
+
+func TestAuthService_ReportTokenErrorUsesRequestToken(t *testing.T) {
+	initTestStore(t)
+	saved, err := store.GetStore().AddToken(store.TokenConfig{RefreshToken: "token2"})
+	require.NoError(t, err)
+
+	tm, m := newTestHealthMonitor([]AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "token1"},
+		{AuthType: AuthMethodSocial, RefreshToken: "token2", storeID: saved.ID},
+	}, time.Hour)
+	as := &AuthService{tokenManager: tm}
+
+	// 轮询游标仍指向 token_0，错误应记在实际处理请求的 token_1 上
+	as.ReportTokenError("token_1", "状态码 500")
+	assert.Equal(t, HealthHealthy, m.GetState("token_0"))
+	assert.Equal(t, HealthDegraded, m.GetState("token_1"))
+
+	got, _ := store.GetStore().GetToken(saved.ID)
+	assert.Equal(t, "状态码 500", got.LastError)
+
+	m.RecordSuccess("token_1")
+	got, _ = store.GetStore().GetToken(saved.ID)
+	assert.Empty(t, got.LastError, "恢复后清空 LastError")
+	assert.Equal(t, string(HealthHealthy), got.HealthState)
+}
+
+func TestTokenHealthMonitor_ConcurrentSelectionAndReport(t *testing.T) {
+	tm, _ := newTestHealthMonitor([]AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "token1"},
+		{AuthType: AuthMethodSocial, RefreshToken: "token2"},
+	}, time.Hour)
+	for i := 0; i < 2; i++ {
+		tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = &CachedToken{
+			Token:     types.TokenInfo{AccessToken: fmt.Sprintf("access_%d", i), ExpiresAt: time.Now().Add(time.Hour)},
+			CachedAt:  time.Now(),
+			Available: 100,
+		}
+	}
+	as := &AuthService{tokenManager: tm}
+
+	// 选择 token（持 tm.mutex 读健康状态）与上报错误（健康状态切换）并发执行，不应死锁
+	deadline := time.Now().Add(200 * time.Millisecond)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			tm.mutex.Lock()
+			tm.selectNextAvailableTokenUnlocked()
+			tm.mutex.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for time.Now().Before(deadline) {
+			as.ReportTokenError("token_0", "状态码 500")
+			tm.health.RecordSuccess("token_0")
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("选择 token 与上报错误相互等待，发生死锁")
+	}
+}
+
+func TestTokenHealthMonitor_SuspendedQuarantinesImmediately(t *testing.T) {
+	tm, m := newTestHealthMonitor([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "token1"}}, time.Hour)
+
+	m.RecordFailure("token_0", `{"reason":"TEMPORARILY_SUSPENDED"}`)
+
+	assert.Equal(t, HealthQuarantined, m.GetState("token_0"))
+	assert.True(t, tm.rateLimiter.IsTokenSuspended("token_0"))
+
+	// 探测恢复后解除暂停，不必等待完整的暂停冷却期
+	m.RecordSuccess("token_0")
+	assert.False(t, tm.rateLimiter.IsTokenSuspended("token_0"))
+}
+
+func TestTokenHealthMonitor_RetireAfterQuarantine(t *testing.T) {
+	_, m := newTestHealthMonitor([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "token1"}}, 10*time.Millisecond)
+
+	m.RecordFailure("token_0", "invalid_grant")
+	assert.Equal(t, HealthQuarantined, m.GetState("token_0"))
+
+	time.Sleep(20 * time.Millisecond)
+	m.RecordFailure("token_0", "invalid_grant")
+	assert.Equal(t, HealthRetired, m.GetState("token_0"))
+
+	// 退役后不会被探测成功自动恢复
+	m.RecordSuccess("token_0")
+	assert.Equal(t, HealthRetired, m.GetState("token_0"))
+}
+
+func TestTokenHealthMonitor_ProbeAllQuarantinesFailingAccount(t *testing.T) {
+	configs := []AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "good"},
+		{AuthType: AuthMethodSocial, RefreshToken: "bad"},
+	}
+	tm, m := newTestHealthMonitor(configs, time.Hour)
+
+	var probes int32
+	m.usageFunc = func(_ string, token types.TokenInfo) (*types.UsageLimits, error) {
+		atomic.AddInt32(&probes, 1)
+		if strings.HasSuffix(token.AccessToken, "bad") {
+			return nil, fmt.Errorf("使用限制检查失败: 状态码 500")
+		}
+		return &types.UsageLimits{}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		m.ProbeAll()
+	}
+	assert.Equal(t, int32(6), atomic.LoadInt32(&probes))
+	assert.Equal(t, HealthHealthy, m.GetState("token_0"))
+	assert.Equal(t, HealthQuarantined, m.GetState("token_1"))
+
+	// 隔离的账号不参与轮询
+	for i := range configs {
+		tm.swapCachedToken(i, types.TokenInfo{AccessToken: fmt.Sprintf("access_%d", i), ExpiresAt: time.Now().Add(time.Hour)}, nil, 10)
+	}
+	tm.mutex.Lock()
+	tm.currentIndex = 1
+	_, key := tm.selectNextAvailableTokenUnlocked()
+	tm.mutex.Unlock()
+	assert.Equal(t, "token_0", key)
+}
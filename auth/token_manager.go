@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"kiro2api/config"
 	"kiro2api/logger"
+	"kiro2api/notify"
 	"kiro2api/store"
 	"kiro2api/types"
 	"os"
@@ -30,6 +31,12 @@ type TokenManager struct {
 	// 智能轮换相关
 	rateLimiter        *RateLimiter        // 频率限制器
 	fingerprintManager *FingerprintManager // 指纹管理器
+
+	// 后台调度器（启用后请求路径不再惰性刷新，仅兜底刷新已过期的token）
+	scheduler *TokenScheduler
+
+	// 账号健康探测（隔离/退役的账号不参与轮询）
+	health *TokenHealthMonitor
 }
 
 // SimpleTokenCache 简化的token缓存（纯数据结构，无锁）
@@ -79,15 +86,13 @@ func NewTokenManager(configs []AuthConfig) *TokenManager {
 // getBestToken 获取最优可用token（带严格轮询和频率限制）
 // 统一锁管理：所有操作在单一锁保护下完成，避免多次加锁/解锁
 func (tm *TokenManager) getBestToken() (types.TokenInfo, error) {
+	tm.refreshExpiredTokens()
+
 	tm.mutex.Lock()
 	defer tm.mutex.Unlock()
 
 	// 检查是否需要刷新缓存（在锁内）
-	if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
-		if err := tm.refreshCacheUnlocked(); err != nil {
-			logger.Warn("刷新token缓存失败", logger.Err(err))
-		}
-	}
+	tm.lazyRefreshUnlocked()
 
 	// 选择下一个可用token（严格轮询）
 	bestToken, tokenKey := tm.selectNextAvailableTokenUnlocked()
@@ -130,20 +135,24 @@ func (tm *TokenManager) getBestToken() (types.TokenInfo, error) {
 
 // GetTokenWithFingerprint 获取token及其对应的指纹
 func (tm *TokenManager) GetTokenWithFingerprint() (types.TokenInfo, *Fingerprint, error) {
+	tokenInfo, fingerprint, _, err := tm.GetTokenWithKey()
+	return tokenInfo, fingerprint, err
+}
+
+// GetTokenWithKey 获取token、指纹及其缓存key（用于按token绑定代理）
+func (tm *TokenManager) GetTokenWithKey() (types.TokenInfo, *Fingerprint, string, error) {
+	tm.refreshExpiredTokens()
+
 	tm.mutex.Lock()
 
 	// 检查是否需要刷新缓存
-	if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
-		if err := tm.refreshCacheUnlocked(); err != nil {
-			logger.Warn("刷新token缓存失败", logger.Err(err))
-		}
-	}
+	tm.lazyRefreshUnlocked()
 
 	// 选择下一个可用token（严格轮询）
 	bestToken, tokenKey := tm.selectNextAvailableTokenUnlocked()
 	if bestToken == nil {
 		tm.mutex.Unlock()
-		return types.TokenInfo{}, nil, fmt.Errorf("没有可用的token")
+		return types.TokenInfo{}, nil, "", fmt.Errorf("没有可用的token")
 	}
 
 	tm.mutex.Unlock()
@@ -175,7 +184,7 @@ func (tm *TokenManager) GetTokenWithFingerprint() (types.TokenInfo, *Fingerprint
 		bestToken.Available--
 	}
 
-	return bestToken.Token, fingerprint, nil
+	return bestToken.Token, fingerprint, tokenKey, nil
 }
 
 // MarkTokenFailed 标记token请求失败，触发冷却
@@ -262,6 +271,16 @@ func (tm *TokenManager) selectNextAvailableTokenUnlocked() (*CachedToken, string
 			continue
 		}
 
+		// 检查健康状态（隔离/退役）
+		if tm.health != nil && !tm.health.IsSelectable(key) {
+			logger.Debug("token已被隔离，跳过",
+				logger.String("token_key", key),
+				logger.String("health_state", string(tm.health.GetState(key))))
+			tm.advanceToNextToken()
+			tried++
+			continue
+		}
+
 		cached, exists := tm.cache.tokens[key]
 		if !exists {
 			tm.advanceToNextToken()
@@ -311,6 +330,172 @@ func (tm *TokenManager) selectBestTokenWithKeyUnlocked() (*CachedToken, string)
 	return tm.selectNextAvailableTokenUnlocked()
 }
 
+// lazyRefreshUnlocked 未启用后台调度器时，在请求路径上按TTL惰性刷新缓存
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) lazyRefreshUnlocked() {
+	if tm.scheduler != nil {
+		return
+	}
+	if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
+		if err := tm.refreshCacheUnlocked(); err != nil {
+			logger.Warn("刷新token缓存失败", logger.Err(err))
+		}
+	}
+}
+
+// refreshExpiredTokens 启用后台调度器时的兜底：经调度器单飞刷新已过期的token（不持锁调用）
+func (tm *TokenManager) refreshExpiredTokens() {
+	if scheduler := tm.GetScheduler(); scheduler != nil {
+		scheduler.RefreshExpired()
+	}
+}
+
+// StartScheduler 启动后台token刷新与使用量轮询
+// 启动时会同步预热所有token，之后由调度器负责保持缓存新鲜
+func (tm *TokenManager) StartScheduler(cfg TokenSchedulerConfig) *TokenScheduler {
+	scheduler := NewTokenScheduler(tm, cfg)
+
+	tm.mutex.Lock()
+	tm.scheduler = scheduler
+	tm.mutex.Unlock()
+
+	scheduler.Start()
+	return scheduler
+}
+
+// GetScheduler 获取后台调度器（未启用时为nil）
+func (tm *TokenManager) GetScheduler() *TokenScheduler {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	return tm.scheduler
+}
+
+// StartHealthMonitor 启动账号健康探测
+func (tm *TokenManager) StartHealthMonitor(cfg TokenHealthConfig) *TokenHealthMonitor {
+	monitor := NewTokenHealthMonitor(tm, cfg)
+
+	tm.mutex.Lock()
+	tm.health = monitor
+	tm.mutex.Unlock()
+
+	monitor.Start()
+	return monitor
+}
+
+// GetHealthMonitor 获取账号健康探测器（未启用时为nil）
+func (tm *TokenManager) GetHealthMonitor() *TokenHealthMonitor {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	return tm.health
+}
+
+// observeHealth 将后台调度器或请求路径的结果上报给健康探测器
+func (tm *TokenManager) observeHealth(tokenKey string, err error) {
+	tm.mutex.RLock()
+	health := tm.health
+	tm.mutex.RUnlock()
+
+	if health == nil {
+		return
+	}
+	if err != nil {
+		health.RecordFailure(tokenKey, err.Error())
+	} else {
+		health.RecordSuccess(tokenKey)
+	}
+}
+
+// isRetired 账号是否已退役（退役账号不再刷新和轮询）
+func (tm *TokenManager) isRetired(tokenKey string) bool {
+	tm.mutex.RLock()
+	health := tm.health
+	tm.mutex.RUnlock()
+
+	return health != nil && health.GetState(tokenKey) == HealthRetired
+}
+
+// storeIDForKey 获取cache key对应配置在 store 中的 ID（非 store 来源返回空）
+func (tm *TokenManager) storeIDForKey(tokenKey string) string {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+
+	for i, cfg := range tm.configs {
+		if fmt.Sprintf(config.TokenCacheKeyFormat, i) == tokenKey {
+			return cfg.storeID
+		}
+	}
+	return ""
+}
+
+// snapshotConfigs 获取配置副本（供调度器在锁外使用）
+func (tm *TokenManager) snapshotConfigs() []AuthConfig {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+
+	configs := make([]AuthConfig, len(tm.configs))
+	copy(configs, tm.configs)
+	return configs
+}
+
+// cachedTokenSnapshot 获取指定索引缓存条目的副本
+func (tm *TokenManager) cachedTokenSnapshot(index int) (CachedToken, bool) {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+
+	cached, exists := tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, index)]
+	if !exists || cached == nil {
+		return CachedToken{}, false
+	}
+	return *cached, true
+}
+
+// swapCachedToken 将后台刷新结果换入缓存，仅在赋值期间持锁
+func (tm *TokenManager) swapCachedToken(index int, token types.TokenInfo, usage *types.UsageLimits, available float64) {
+	cacheKey := fmt.Sprintf(config.TokenCacheKeyFormat, index)
+
+	tm.mutex.Lock()
+	var lastUsed time.Time
+	prevAvailable := -1.0
+	if old, exists := tm.cache.tokens[cacheKey]; exists && old != nil {
+		lastUsed = old.LastUsed
+		prevAvailable = old.Available
+	}
+	tm.cache.tokens[cacheKey] = &CachedToken{
+		Token:     token,
+		UsageInfo: usage,
+		CachedAt:  time.Now(),
+		LastUsed:  lastUsed,
+		Available: available,
+	}
+
+	// 检查是否有新的 RefreshToken（Social 认证会返回新的）
+	rotated := false
+	var storeID string
+	if index >= 0 && index < len(tm.configs) {
+		newRefreshToken := token.GetRefreshToken()
+		rotated = newRefreshToken != "" && newRefreshToken != tm.configs[index].RefreshToken
+		storeID = tm.configs[index].storeID
+	}
+	tm.mutex.Unlock()
+
+	if usage != nil && available <= 0 && prevAvailable != 0 {
+		notifyTokenExhausted(cacheKey, storeID)
+	}
+
+	logger.Debug("后台token缓存更新",
+		logger.String("cache_key", cacheKey),
+		logger.Float64("available", available),
+		logger.String("expires_at", token.ExpiresAt.Format(time.RFC3339)))
+
+	if rotated {
+		go func() {
+			if err := tm.PersistCredentials(); err != nil {
+				logger.Warn("Token 回写失败", logger.Err(err))
+			}
+		}()
+	}
+}
+
 // refreshCacheUnlocked 刷新token缓存
 // 内部方法：调用者必须持有 tm.mutex
 func (tm *TokenManager) refreshCacheUnlocked() error {
@@ -324,12 +509,14 @@ func (tm *TokenManager) refreshCacheUnlocked() error {
 		}
 
 		// 刷新token
-		token, err := tm.refreshSingleToken(cfg)
+		cacheKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		token, err := tm.refreshSingleToken(cacheKey, cfg)
 		if err != nil {
 			logger.Warn("刷新单个token失败",
 				logger.Int("config_index", i),
 				logger.String("auth_type", cfg.AuthType),
 				logger.Err(err))
+			notifyRefreshFailed(cacheKey, cfg.AuthType, err)
 			continue
 		}
 
@@ -347,8 +534,7 @@ func (tm *TokenManager) refreshCacheUnlocked() error {
 		var usageInfo *types.UsageLimits
 		var available float64
 
-		checker := NewUsageLimitsChecker()
-		if usage, checkErr := checker.CheckUsageLimits(token); checkErr == nil {
+		if usage, checkErr := checkUsageLimitsForToken(cacheKey, token); checkErr == nil {
 			usageInfo = usage
 			available = CalculateAvailableCount(usage)
 		} else {
@@ -356,7 +542,9 @@ func (tm *TokenManager) refreshCacheUnlocked() error {
 		}
 
 		// 更新缓存（直接访问，已在tm.mutex保护下）
-		cacheKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		if old, exists := tm.cache.tokens[cacheKey]; usageInfo != nil && available <= 0 && (!exists || old.Available != 0) {
+			notifyTokenExhausted(cacheKey, cfg.storeID)
+		}
 		tm.cache.tokens[cacheKey] = &CachedToken{
 			Token:     token,
 			UsageInfo: usageInfo,
@@ -383,6 +571,37 @@ func (tm *TokenManager) refreshCacheUnlocked() error {
 	return nil
 }
 
+// notifyTokenExhausted 发送token额度耗尽通知
+func notifyTokenExhausted(cacheKey, storeID string) {
+	notify.Send(notify.Event{
+		Type:     notify.EventTokenExhausted,
+		Severity: notify.SeverityWarning,
+		Title:    "Token额度耗尽",
+		Message:  fmt.Sprintf("%s 可用次数已降为 0，将在轮询中被跳过", cacheKey),
+		Key:      cacheKey,
+		Fields: map[string]any{
+			"token_key": cacheKey,
+			"store_id":  storeID,
+		},
+	})
+}
+
+// notifyRefreshFailed 发送token刷新失败通知
+func notifyRefreshFailed(tokenKey, authType string, err error) {
+	notify.Send(notify.Event{
+		Type:     notify.EventRefreshFailed,
+		Severity: notify.SeverityWarning,
+		Title:    "Token刷新失败",
+		Message:  fmt.Sprintf("%s 刷新失败", tokenKey),
+		Key:      tokenKey,
+		Fields: map[string]any{
+			"token_key": tokenKey,
+			"auth_type": authType,
+			"error":     truncateReason(err.Error()),
+		},
+	})
+}
+
 // IsUsable 检查缓存的token是否可用
 func (ct *CachedToken) IsUsable() bool {
 	// 检查token是否过期
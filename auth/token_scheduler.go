@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// TokenScheduler 后台token刷新与使用量轮询调度器
+// 在 ExpiresAt 之前主动刷新access token，并按带抖动的间隔轮询使用限制，
+// 结果在短暂持锁的情况下换入缓存，请求路径的token选择不再被网络调用阻塞
+type TokenScheduler struct {
+	tm             *TokenManager
+	refreshManager *utils.TokenRefreshManager // 按配置索引做单飞去重
+	rng            *rand.Rand
+	rngMutex       sync.Mutex
+
+	// 配置参数
+	tickInterval  time.Duration // 调度检查间隔
+	refreshAhead  time.Duration // 提前刷新时间
+	usageInterval time.Duration // 使用量轮询基础间隔
+	jitterPercent int           // 轮询间隔抖动百分比
+
+	// 可替换的网络调用（便于测试）
+	refreshFunc func(string, AuthConfig) (types.TokenInfo, error)
+	usageFunc   func(string, types.TokenInfo) (*types.UsageLimits, error)
+
+	mutex         sync.Mutex
+	nextUsagePoll map[int]time.Time // 每个配置下一次轮询使用量的时间
+	lastFallback  time.Time         // 请求路径最近一次兜底刷新的时间
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// TokenSchedulerConfig 调度器配置
+type TokenSchedulerConfig struct {
+	TickInterval  time.Duration
+	RefreshAhead  time.Duration
+	UsageInterval time.Duration
+	JitterPercent int
+}
+
+// DefaultTokenSchedulerConfig 默认配置（从config包读取）
+func DefaultTokenSchedulerConfig() TokenSchedulerConfig {
+	return TokenSchedulerConfig{
+		TickInterval:  config.TokenSchedulerTickInterval,
+		RefreshAhead:  config.TokenRefreshAhead,
+		UsageInterval: config.TokenUsagePollInterval,
+		JitterPercent: config.TokenUsagePollJitterPercent,
+	}
+}
+
+// NewTokenScheduler 创建后台调度器（未启动）
+func NewTokenScheduler(tm *TokenManager, cfg TokenSchedulerConfig) *TokenScheduler {
+	return &TokenScheduler{
+		tm:             tm,
+		refreshManager: utils.NewTokenRefreshManager(),
+		rng:            rand.New(rand.NewSource(time.Now().UnixNano())),
+		tickInterval:   cfg.TickInterval,
+		refreshAhead:   cfg.RefreshAhead,
+		usageInterval:  cfg.UsageInterval,
+		jitterPercent:  cfg.JitterPercent,
+		refreshFunc:    tm.refreshSingleToken,
+		usageFunc:      checkUsageLimitsForToken,
+		nextUsagePoll:  make(map[int]time.Time),
+		stopCh:         make(chan struct{}),
+	}
+}
+
+// Start 同步预热所有token后启动后台循环
+func (s *TokenScheduler) Start() {
+	s.SyncAll()
+
+	s.wg.Add(1)
+	go s.loop()
+
+	logger.Info("后台token调度器已启动",
+		logger.Duration("tick_interval", s.tickInterval),
+		logger.Duration("refresh_ahead", s.refreshAhead),
+		logger.Duration("usage_interval", s.usageInterval))
+}
+
+// Stop 停止后台循环并等待正在执行的任务结束
+func (s *TokenScheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	s.wg.Wait()
+}
+
+// loop 后台调度循环
+func (s *TokenScheduler) loop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			s.dispatchDue()
+		}
+	}
+}
+
+// SyncAll 立即刷新并轮询所有启用的token，等待全部完成
+func (s *TokenScheduler) SyncAll() {
+	var wg sync.WaitGroup
+	for i, cfg := range s.tm.snapshotConfigs() {
+		if cfg.Disabled {
+			continue
+		}
+		wg.Add(1)
+		go func(index int, cfg AuthConfig) {
+			defer wg.Done()
+			s.runJob(index, cfg, true)
+		}(i, cfg)
+	}
+	wg.Wait()
+}
+
+// RefreshExpired 请求路径兜底：后台刷新失败或调度停滞导致token缺失或已过期时，
+// 经单飞去重刷新这些token并等待完成，每个调度间隔至多触发一次；
+// 已有任务在执行的token直接跳过，由请求选择下一个可用token
+func (s *TokenScheduler) RefreshExpired() {
+	now := time.Now()
+	configs := s.tm.snapshotConfigs()
+	var expired []int
+	for i, cfg := range configs {
+		if cfg.Disabled || s.tm.isRetired(fmt.Sprintf(config.TokenCacheKeyFormat, i)) {
+			continue
+		}
+		if cached, exists := s.tm.cachedTokenSnapshot(i); exists && now.Before(cached.Token.ExpiresAt) {
+			continue
+		}
+		expired = append(expired, i)
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	if now.Sub(s.lastFallback) < s.tickInterval {
+		s.mutex.Unlock()
+		return
+	}
+	s.lastFallback = now
+	s.mutex.Unlock()
+
+	logger.Warn("缓存token已过期，后台调度器未及时刷新，在请求路径上兜底刷新",
+		logger.Int("expired_count", len(expired)))
+
+	var wg sync.WaitGroup
+	for _, index := range expired {
+		wg.Add(1)
+		go func(index int, cfg AuthConfig) {
+			defer wg.Done()
+			s.runJob(index, cfg, true)
+		}(index, configs[index])
+	}
+	wg.Wait()
+}
+
+// dispatchDue 检查每个token是否需要刷新或轮询，异步执行到期任务
+func (s *TokenScheduler) dispatchDue() {
+	now := time.Now()
+	for i, cfg := range s.tm.snapshotConfigs() {
+		if cfg.Disabled || s.tm.isRetired(fmt.Sprintf(config.TokenCacheKeyFormat, i)) {
+			continue
+		}
+
+		needRefresh := s.needsRefresh(i, now)
+		if !needRefresh && !s.usagePollDue(i, now) {
+			continue
+		}
+
+		s.wg.Add(1)
+		go func(index int, cfg AuthConfig, refresh bool) {
+			defer s.wg.Done()
+			s.runJob(index, cfg, refresh)
+		}(i, cfg, needRefresh)
+	}
+}
+
+// needsRefresh 判断token是否缺失或即将过期
+func (s *TokenScheduler) needsRefresh(index int, now time.Time) bool {
+	cached, exists := s.tm.cachedTokenSnapshot(index)
+	if !exists {
+		return true
+	}
+	return cached.Token.ExpiresAt.Sub(now) <= s.refreshAhead
+}
+
+// usagePollDue 判断是否到了轮询使用量的时间
+func (s *TokenScheduler) usagePollDue(index int, now time.Time) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	next, exists := s.nextUsagePoll[index]
+	return !exists || !now.Before(next)
+}
+
+// scheduleNextUsagePoll 安排下一次带抖动的使用量轮询
+func (s *TokenScheduler) scheduleNextUsagePoll(index int) {
+	interval := s.usageInterval
+	if s.jitterPercent > 0 {
+		s.rngMutex.Lock()
+		jitterRange := float64(interval) * float64(s.jitterPercent) / 100.0
+		// 抖动范围为 ±jitterPercent，避免所有账号同时轮询
+		jitter := time.Duration((s.rng.Float64()*2 - 1) * jitterRange)
+		s.rngMutex.Unlock()
+		interval += jitter
+	}
+
+	s.mutex.Lock()
+	s.nextUsagePoll[index] = time.Now().Add(interval)
+	s.mutex.Unlock()
+}
+
+// runJob 执行单个token的刷新/轮询任务（单飞：同一索引同时只有一个任务）
+func (s *TokenScheduler) runJob(index int, cfg AuthConfig, refresh bool) {
+	job, isNew := s.refreshManager.StartRefresh(index)
+	if !isNew {
+		logger.Debug("token调度任务已在执行，跳过",
+			logger.Int("config_index", index),
+			logger.String("started_at", job.StartTime.Format(time.RFC3339)))
+		return
+	}
+
+	token, err := s.syncToken(index, cfg, refresh)
+	if err != nil {
+		s.refreshManager.CompleteRefresh(index, nil, err)
+		return
+	}
+	s.refreshManager.CompleteRefresh(index, &token, nil)
+}
+
+// syncToken 刷新token（如需要）并轮询使用量，最后换入缓存
+// 刷新和轮询的结果同时上报给健康探测器
+func (s *TokenScheduler) syncToken(index int, cfg AuthConfig, refresh bool) (types.TokenInfo, error) {
+	var token types.TokenInfo
+	tokenKey := fmt.Sprintf(config.TokenCacheKeyFormat, index)
+
+	cached, exists := s.tm.cachedTokenSnapshot(index)
+	if refresh || !exists {
+		refreshed, err := s.refreshFunc(tokenKey, cfg)
+		if err != nil {
+			logger.Warn("后台刷新token失败",
+				logger.Int("config_index", index),
+				logger.String("auth_type", cfg.AuthType),
+				logger.Err(err))
+			s.tm.observeHealth(tokenKey, err)
+			notifyRefreshFailed(tokenKey, cfg.AuthType, err)
+			return types.TokenInfo{}, err
+		}
+		token = refreshed
+	} else {
+		token = cached.Token
+	}
+
+	usage, err := s.usageFunc(tokenKey, token)
+	s.scheduleNextUsagePoll(index)
+	s.tm.observeHealth(tokenKey, err)
+	if err != nil {
+		logger.Warn("后台轮询使用限制失败",
+			logger.Int("config_index", index),
+			logger.Err(err))
+		// 使用量未知时保留旧的可用次数，仍然换入新token
+		if exists {
+			s.tm.swapCachedToken(index, token, cached.UsageInfo, cached.Available)
+		} else {
+			s.tm.swapCachedToken(index, token, nil, 0)
+		}
+		return token, nil
+	}
+
+	s.tm.swapCachedToken(index, token, usage, CalculateAvailableCount(usage))
+	return token, nil
+}
+
+// GetStats 获取调度器统计信息
+func (s *TokenScheduler) GetStats() map[string]any {
+	s.mutex.Lock()
+	nextPolls := make(map[string]string, len(s.nextUsagePoll))
+	for index, next := range s.nextUsagePoll {
+		nextPolls[fmt.Sprintf(config.TokenCacheKeyFormat, index)] = next.Format(time.RFC3339)
+	}
+	s.mutex.Unlock()
+
+	return map[string]any{
+		"refresh_ahead_s":  s.refreshAhead.Seconds(),
+		"usage_interval_s": s.usageInterval.Seconds(),
+		"jitter_percent":   s.jitterPercent,
+		"next_usage_polls": nextPolls,
+		"refresh_stats":    s.refreshManager.GetStats(),
+	}
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestScheduler 创建使用假网络调用的调度器
+func newTestScheduler(tm *TokenManager, refreshCalls, usageCalls *int32, expiresIn time.Duration) *TokenScheduler {
+	s := NewTokenScheduler(tm, TokenSchedulerConfig{
+		TickInterval:  time.Hour,
+		RefreshAhead:  5 * time.Minute,
+		UsageInterval: time.Minute,
+		JitterPercent: 20,
+	})
+	s.refreshFunc = func(_ string, cfg AuthConfig) (types.TokenInfo, error) {
+		n := atomic.AddInt32(refreshCalls, 1)
+		return types.TokenInfo{
+			AccessToken:  fmt.Sprintf("access_%s_%d", cfg.RefreshToken, n),
+			RefreshToken: cfg.RefreshToken,
+			ExpiresAt:    time.Now().Add(expiresIn),
+		}, nil
+	}
+	s.usageFunc = func(_ string, token types.TokenInfo) (*types.UsageLimits, error) {
+		atomic.AddInt32(usageCalls, 1)
+		return &types.UsageLimits{
+			UsageBreakdownList: []types.UsageBreakdown{
+				{ResourceType: "CREDIT", UsageLimitWithPrecision: 100, CurrentUsageWithPrecision: 40},
+			},
+		}, nil
+	}
+	return s
+}
+
+func TestTokenScheduler_SyncAllPopulatesCache(t *testing.T) {
+	configs := []AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "token1"},
+		{AuthType: AuthMethodSocial, RefreshToken: "token2"},
+		{AuthType: AuthMethodSocial, RefreshToken: "token3", Disabled: true},
+	}
+	tm := NewTokenManager(configs)
+
+	var refreshCalls, usageCalls int32
+	s := newTestScheduler(tm, &refreshCalls, &usageCalls, time.Hour)
+	s.SyncAll()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&refreshCalls), "禁用的配置不应刷新")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&usageCalls))
+
+	for i := 0; i < 2; i++ {
+		cached, exists := tm.cachedTokenSnapshot(i)
+		assert.True(t, exists)
+		assert.Equal(t, 60.0, cached.Available)
+		assert.NotNil(t, cached.UsageInfo)
+	}
+	_, exists := tm.cachedTokenSnapshot(2)
+	assert.False(t, exists)
+}
+
+func TestTokenScheduler_RefreshesOnlyNearExpiry(t *testing.T) {
+	configs := []AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "fresh"},
+		{AuthType: AuthMethodSocial, RefreshToken: "expiring"},
+	}
+	tm := NewTokenManager(configs)
+
+	tm.mutex.Lock()
+	tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 0)] = &CachedToken{
+		Token:     types.TokenInfo{AccessToken: "old_fresh", ExpiresAt: time.Now().Add(time.Hour)},
+		CachedAt:  time.Now(),
+		Available: 10,
+	}
+	tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 1)] = &CachedToken{
+		Token:     types.TokenInfo{AccessToken: "old_expiring", ExpiresAt: time.Now().Add(time.Minute)},
+		CachedAt:  time.Now(),
+		Available: 10,
+	}
+	tm.mutex.Unlock()
+
+	var refreshCalls, usageCalls int32
+	s := newTestScheduler(tm, &refreshCalls, &usageCalls, time.Hour)
+
+	now := time.Now()
+	assert.False(t, s.needsRefresh(0, now))
+	assert.True(t, s.needsRefresh(1, now))
+
+	s.dispatchDue()
+	s.wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshCalls), "只有即将过期的token应被刷新")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&usageCalls), "首次调度时两个token都应轮询使用量")
+
+	fresh, _ := tm.cachedTokenSnapshot(0)
+	expiring, _ := tm.cachedTokenSnapshot(1)
+	assert.Equal(t, "old_fresh", fresh.Token.AccessToken)
+	assert.Equal(t, "access_expiring_1", expiring.Token.AccessToken)
+
+	// 轮询已安排到未来，再次调度不应产生新的调用
+	s.dispatchDue()
+	s.wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&usageCalls))
+}
+
+func TestTokenScheduler_SingleFlight(t *testing.T) {
+	configs := []AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "token1"}}
+	tm := NewTokenManager(configs)
+
+	var refreshCalls, usageCalls int32
+	s := newTestScheduler(tm, &refreshCalls, &usageCalls, time.Hour)
+
+	release := make(chan struct{})
+	baseRefresh := s.refreshFunc
+	s.refreshFunc = func(key string, cfg AuthConfig) (types.TokenInfo, error) {
+		<-release
+		return baseRefresh(key, cfg)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runJob(0, configs[0], true)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshCalls), "同一token的并发刷新应被去重")
+}
+
+func TestTokenScheduler_RequestPathDoesNotRefresh(t *testing.T) {
+	configs := []AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "token1"}}
+	tm := NewTokenManager(configs)
+
+	var refreshCalls, usageCalls int32
+	s := newTestScheduler(tm, &refreshCalls, &usageCalls, time.Hour)
+	s.SyncAll()
+
+	tm.mutex.Lock()
+	tm.scheduler = s
+	// lastRefresh 为零值，惰性刷新路径本会触发真实网络调用
+	tm.lastRefresh = time.Time{}
+	tm.mutex.Unlock()
+
+	token, err := tm.getBestToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "access_token1_1", token.AccessToken)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshCalls))
+}
+
+// useExpiredToken 启用调度器并写入已过期的缓存token，模拟后台刷新失败或调度停滞
+func useExpiredToken(tm *TokenManager, s *TokenScheduler) func() {
+	expire := func() {
+		tm.mutex.Lock()
+		tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 0)] = &CachedToken{
+			Token:     types.TokenInfo{AccessToken: "expired", ExpiresAt: time.Now().Add(-time.Minute)},
+			CachedAt:  time.Now(),
+			Available: 10,
+		}
+		tm.mutex.Unlock()
+	}
+	tm.mutex.Lock()
+	tm.scheduler = s
+	tm.rateLimiter = nil // 跳过同一token连续使用的频率限制等待
+	tm.mutex.Unlock()
+	expire()
+	return expire
+}
+
+func TestTokenScheduler_RequestPathRefreshesExpiredToken(t *testing.T) {
+	configs := []AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "token1"}}
+	tm := NewTokenManager(configs)
+
+	var refreshCalls, usageCalls int32
+	s := newTestScheduler(tm, &refreshCalls, &usageCalls, time.Hour)
+	refresh := s.refreshFunc
+	s.refreshFunc = func(key string, cfg AuthConfig) (types.TokenInfo, error) {
+		// 兜底刷新在锁外进行，不阻塞其他请求
+		assert.True(t, tm.mutex.TryLock(), "刷新期间不应持有 TokenManager 锁")
+		tm.mutex.Unlock()
+		return refresh(key, cfg)
+	}
+	expire := useExpiredToken(tm, s)
+
+	token, err := tm.getBestToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "access_token1_1", token.AccessToken, "请求路径应兜底刷新已过期的token")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshCalls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&usageCalls))
+
+	// 同一调度间隔内不重复兜底刷新
+	expire()
+	_, err = tm.getBestToken()
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshCalls))
+}
+
+func TestTokenScheduler_FallbackSharesSingleFlight(t *testing.T) {
+	configs := []AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "token1"}}
+	tm := NewTokenManager(configs)
+
+	var refreshCalls, usageCalls int32
+	s := newTestScheduler(tm, &refreshCalls, &usageCalls, time.Hour)
+	useExpiredToken(tm, s)
+
+	// 后台任务正在刷新同一账号时，兜底不再重复使用同一个 refresh token
+	_, isNew := s.refreshManager.StartRefresh(0)
+	assert.True(t, isNew)
+
+	_, err := tm.getBestToken()
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&refreshCalls))
+}
@@ -24,6 +24,18 @@ func NewUsageLimitsChecker() *UsageLimitsChecker {
 	}
 }
 
+// NewUsageLimitsCheckerForToken 创建经tokenKey绑定代理发送请求的使用限制检查器
+func NewUsageLimitsCheckerForToken(tokenKey string) *UsageLimitsChecker {
+	return &UsageLimitsChecker{
+		httpClient: httpClientForToken(tokenKey),
+	}
+}
+
+// checkUsageLimitsForToken 经tokenKey绑定的代理检查使用限制
+func checkUsageLimitsForToken(tokenKey string, token types.TokenInfo) (*types.UsageLimits, error) {
+	return NewUsageLimitsCheckerForToken(tokenKey).CheckUsageLimits(token)
+}
+
 // CheckUsageLimits 检查token的使用限制 (基于token.md API规范)
 func (c *UsageLimitsChecker) CheckUsageLimits(token types.TokenInfo) (*types.UsageLimits, error) {
 	// 构建请求URL (完全遵循token.md中的示例)
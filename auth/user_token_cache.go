@@ -1,24 +1,68 @@
 package auth
 
 import (
+	"fmt"
+	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/types"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // UserTokenCache 用户 Token 缓存（多租户模式）
-// 最多缓存 maxSize 个用户的 Token，使用 LRU 淘汰策略
+// 最多缓存 maxSize 个租户的 Token，使用 LRU 淘汰策略
+// 每个租户拥有独立的指纹和频率限制器，绝不回退到服务端共享 Token 池
 type UserTokenCache struct {
 	mu       sync.RWMutex
 	cache    map[string]*userTokenEntry
 	order    []string // LRU 顺序
 	maxSize  int
+	inflight map[string]*tenantRefreshCall // 单飞：同一租户同时只刷新一次
+
+	// 可替换的刷新函数（便于测试）
+	refreshFunc func(TenantCredential) (types.TokenInfo, error)
+
+	// 统计 - 使用atomic操作
+	hits            int64
+	misses          int64
+	refreshFailures int64
+	evictions       int64
 }
 
 type userTokenEntry struct {
-	token     types.TokenInfo
-	createdAt time.Time
+	token       types.TokenInfo
+	authType    string
+	tenantID    string
+	createdAt   time.Time
+	lastUsed    time.Time
+	requests    int64
+	fingerprint *Fingerprint
+	rateLimiter *RateLimiter
+}
+
+// tenantRefreshCall 正在进行的租户刷新
+type tenantRefreshCall struct {
+	done  chan struct{}
+	token types.TokenInfo
+	err   error
+}
+
+// TenantToken 租户请求所需的完整上下文
+type TenantToken struct {
+	Key         string
+	Token       types.TokenInfo
+	Fingerprint *Fingerprint
+}
+
+// TenantRateLimitError 租户凭据有效，但处于冷却期或已达每日请求上限
+type TenantRateLimitError struct {
+	Reason     string
+	RetryAfter time.Duration // 建议的重试等待时间
+}
+
+func (e *TenantRateLimitError) Error() string {
+	return e.Reason
 }
 
 var (
@@ -29,58 +73,173 @@ var (
 // GetUserTokenCache 获取全局用户 Token 缓存
 func GetUserTokenCache() *UserTokenCache {
 	userTokenCacheOnce.Do(func() {
-		globalUserTokenCache = &UserTokenCache{
-			cache:   make(map[string]*userTokenEntry),
-			order:   make([]string, 0, 100),
-			maxSize: 100,
-		}
+		globalUserTokenCache = NewUserTokenCache(config.TenantCacheMaxSize)
 	})
 	return globalUserTokenCache
 }
 
-// GetOrRefresh 获取用户 Token，如果不存在或已过期则刷新
+// NewUserTokenCache 创建用户 Token 缓存
+func NewUserTokenCache(maxSize int) *UserTokenCache {
+	if maxSize <= 0 {
+		maxSize = 100
+	}
+	return &UserTokenCache{
+		cache:       make(map[string]*userTokenEntry),
+		order:       make([]string, 0, maxSize),
+		maxSize:     maxSize,
+		inflight:    make(map[string]*tenantRefreshCall),
+		refreshFunc: refreshTenantToken,
+	}
+}
+
+// GetOrRefresh 获取 Social 用户 Token，如果不存在或已过期则刷新（向后兼容）
 func (c *UserTokenCache) GetOrRefresh(refreshToken string) (types.TokenInfo, error) {
-	cacheKey := hashRefreshToken(refreshToken)
+	cred := TenantCredential{AuthType: AuthMethodSocial, RefreshToken: refreshToken}
+	return c.getOrRefreshToken(cred)
+}
+
+// Acquire 获取租户 Token、指纹，并按租户自身的频率限制等待
+// 租户处于冷却期或已达每日上限时返回 *TenantRateLimitError，不会回退到共享池
+func (c *UserTokenCache) Acquire(cred TenantCredential) (*TenantToken, error) {
+	if err := cred.Validate(); err != nil {
+		return nil, err
+	}
+
+	token, err := c.getOrRefreshToken(cred)
+	if err != nil {
+		return nil, err
+	}
+
+	key := cred.Key()
+	c.mu.RLock()
+	entry, exists := c.cache[key]
+	c.mu.RUnlock()
+	if !exists {
+		// 刚好被淘汰，直接使用刷新结果（无频率限制状态可用）
+		return &TenantToken{Key: key, Token: token}, nil
+	}
+
+	if entry.rateLimiter.IsTokenInCooldown(key) {
+		return nil, &TenantRateLimitError{Reason: "租户 Token 处于冷却期，请稍后重试", RetryAfter: entry.rateLimiter.RetryAfter(key)}
+	}
+	if entry.rateLimiter.IsDailyLimitExceeded(key) {
+		return nil, &TenantRateLimitError{Reason: "租户已达每日请求上限", RetryAfter: entry.rateLimiter.RetryAfter(key)}
+	}
+
+	entry.rateLimiter.WaitForToken(key)
+	entry.rateLimiter.RecordRequest(key)
+
+	c.mu.Lock()
+	entry.lastUsed = time.Now()
+	entry.requests++
+	c.mu.Unlock()
+
+	return &TenantToken{
+		Key:         key,
+		Token:       token,
+		Fingerprint: entry.fingerprint,
+	}, nil
+}
+
+// MarkFailed 标记租户请求失败（仅影响该租户自身的冷却状态）
+func (c *UserTokenCache) MarkFailed(key string) {
+	c.mu.RLock()
+	entry, exists := c.cache[key]
+	c.mu.RUnlock()
+	if exists {
+		entry.rateLimiter.MarkTokenCooldown(key)
+	}
+}
+
+// MarkSuccess 标记租户请求成功
+func (c *UserTokenCache) MarkSuccess(key string) {
+	c.mu.RLock()
+	entry, exists := c.cache[key]
+	c.mu.RUnlock()
+	if exists {
+		entry.rateLimiter.RecordSuccess(key)
+	}
+}
+
+// getOrRefreshToken 命中缓存直接返回，否则刷新（同一租户并发刷新只执行一次）
+func (c *UserTokenCache) getOrRefreshToken(cred TenantCredential) (types.TokenInfo, error) {
+	key := cred.Key()
 
 	c.mu.RLock()
-	entry, exists := c.cache[cacheKey]
+	entry, exists := c.cache[key]
 	c.mu.RUnlock()
 
 	// 检查缓存是否有效
 	if exists && !entry.token.IsExpired() {
+		atomic.AddInt64(&c.hits, 1)
 		// 更新 LRU 顺序
-		c.touchKey(cacheKey)
-		logger.Debug("使用缓存的用户 Token")
+		c.touchKey(key)
+		logger.Debug("使用缓存的用户 Token", logger.String("tenant_key", key))
 		return entry.token, nil
 	}
+	atomic.AddInt64(&c.misses, 1)
 
-	// 刷新 Token
-	logger.Debug("刷新用户 Token")
-	token, err := refreshSocialToken(refreshToken)
-	if err != nil {
-		return types.TokenInfo{}, err
+	c.mu.Lock()
+	// 双重检查：等待写锁期间可能已有其他请求完成刷新
+	if entry, exists := c.cache[key]; exists && !entry.token.IsExpired() {
+		c.mu.Unlock()
+		return entry.token, nil
+	}
+	if call, running := c.inflight[key]; running {
+		c.mu.Unlock()
+		<-call.done
+		return call.token, call.err
 	}
+	call := &tenantRefreshCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	// 刷新 Token
+	logger.Debug("刷新用户 Token",
+		logger.String("tenant_key", key),
+		logger.String("auth_type", cred.AuthType))
+	call.token, call.err = c.refreshFunc(cred)
 
-	// 存入缓存
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	delete(c.inflight, key)
+	if call.err == nil {
+		c.storeUnlocked(key, cred, call.token)
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		atomic.AddInt64(&c.refreshFailures, 1)
+		notifyRefreshFailed(key, cred.AuthType, call.err)
+		return types.TokenInfo{}, call.err
+	}
+	return call.token, nil
+}
+
+// storeUnlocked 写入缓存（调用前需持有写锁）
+// 已存在的租户保留其指纹和频率限制状态
+func (c *UserTokenCache) storeUnlocked(key string, cred TenantCredential, token types.TokenInfo) {
+	if entry, exists := c.cache[key]; exists {
+		entry.token = token
+		entry.createdAt = time.Now()
+		return
+	}
 
 	// LRU 淘汰
-	if len(c.cache) >= c.maxSize && !exists {
+	if len(c.cache) >= c.maxSize {
 		c.evictOldest()
 	}
 
-	c.cache[cacheKey] = &userTokenEntry{
+	c.cache[key] = &userTokenEntry{
 		token:     token,
+		authType:  cred.AuthType,
+		tenantID:  cred.TenantID,
 		createdAt: time.Now(),
+		// 每个租户独立生成指纹，不与服务端 Token 池共享
+		fingerprint: GetFingerprintManager().GetFingerprint(key),
+		rateLimiter: NewRateLimiter(DefaultRateLimiterConfig()),
 	}
-
-	// 更新 LRU 顺序
-	if !exists {
-		c.order = append(c.order, cacheKey)
-	}
-
-	return token, nil
+	c.order = append(c.order, key)
 }
 
 // touchKey 更新 LRU 顺序（将 key 移到末尾）
@@ -107,16 +266,8 @@ func (c *UserTokenCache) evictOldest() {
 	oldestKey := c.order[0]
 	c.order = c.order[1:]
 	delete(c.cache, oldestKey)
-	logger.Debug("淘汰最旧的用户 Token 缓存")
-}
-
-// hashRefreshToken 对 RefreshToken 进行哈希（用作缓存 key）
-func hashRefreshToken(token string) string {
-	// 使用前 32 字符作为 key（足够唯一且不暴露完整 token）
-	if len(token) > 32 {
-		return token[:32]
-	}
-	return token
+	atomic.AddInt64(&c.evictions, 1)
+	logger.Debug("淘汰最旧的用户 Token 缓存", logger.String("tenant_key", oldestKey))
 }
 
 // Size 返回缓存大小
@@ -125,3 +276,43 @@ func (c *UserTokenCache) Size() int {
 	defer c.mu.RUnlock()
 	return len(c.cache)
 }
+
+// GetStats 获取缓存统计信息（不包含任何凭据内容）
+func (c *UserTokenCache) GetStats() map[string]any {
+	c.mu.RLock()
+	tenants := make([]map[string]any, 0, len(c.cache))
+	authTypes := make(map[string]int)
+	for _, key := range c.order {
+		entry := c.cache[key]
+		authTypes[entry.authType]++
+		tenants = append(tenants, map[string]any{
+			"key":        key,
+			"tenant_id":  entry.tenantID,
+			"auth_type":  entry.authType,
+			"expires_at": entry.token.ExpiresAt.Format(time.RFC3339),
+			"last_used":  entry.lastUsed.Format(time.RFC3339),
+			"requests":   entry.requests,
+		})
+	}
+	size := len(c.cache)
+	c.mu.RUnlock()
+
+	hits := atomic.LoadInt64(&c.hits)
+	misses := atomic.LoadInt64(&c.misses)
+	hitRate := float64(0)
+	if hits+misses > 0 {
+		hitRate = float64(hits) / float64(hits+misses) * 100
+	}
+
+	return map[string]any{
+		"size":             size,
+		"max_size":         c.maxSize,
+		"hits":             hits,
+		"misses":           misses,
+		"hit_rate":         fmt.Sprintf("%.2f%%", hitRate),
+		"refresh_failures": atomic.LoadInt64(&c.refreshFailures),
+		"evictions":        atomic.LoadInt64(&c.evictions),
+		"auth_types":       authTypes,
+		"tenants":          tenants,
+	}
+}
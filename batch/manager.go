@@ -0,0 +1,582 @@
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"kiro2api/logger"
+)
+
+const (
+	metaFile     = "batch.json"
+	requestsFile = "requests.jsonl"
+	resultsFile  = "results.jsonl"
+)
+
+var customIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+var (
+	// ErrNotFound 批次不存在
+	ErrNotFound = errors.New("批次不存在")
+	// ErrNotEnded 批次尚未结束
+	ErrNotEnded = errors.New("批次尚未结束")
+)
+
+// Executor 执行单条请求，返回 HTTP 状态码与响应体；ctx 取消表示服务正在关闭
+type Executor func(ctx context.Context, meta Meta, req Request) (status int, body []byte)
+
+// Options 管理器参数
+type Options struct {
+	Concurrency int           // 并发执行的请求数
+	MaxRequests int           // 单个批次的最大请求数，0 表示不限制
+	Expiry      time.Duration // 批次创建后的有效期，超时未执行的请求记为 expired
+}
+
+// Manager 批次管理器
+type Manager struct {
+	dir  string
+	opts Options
+	exec Executor
+
+	mu      sync.RWMutex
+	batches map[string]*Batch
+
+	jobs   chan job
+	ctx    context.Context
+	stop   context.CancelFunc
+	wg     sync.WaitGroup
+	nowFn  func() time.Time
+	closed bool
+}
+
+// Batch 单个批次的运行状态
+type Batch struct {
+	dir    string
+	mu     sync.Mutex
+	meta   Meta
+	counts RequestCounts
+	done   map[string]bool
+	cancel chan struct{}
+}
+
+type job struct {
+	batch *Batch
+	req   Request
+}
+
+// NewManager 创建管理器，加载 dir 下已有的批次并继续处理未完成的请求
+func NewManager(dir string, opts Options, exec Executor) (*Manager, error) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("创建批次目录失败: %w", err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	m := &Manager{
+		dir:     dir,
+		opts:    opts,
+		exec:    exec,
+		batches: make(map[string]*Batch),
+		jobs:    make(chan job),
+		ctx:     ctx,
+		stop:    stop,
+		nowFn:   time.Now,
+	}
+
+	pending, err := m.load()
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	for i := 0; i < opts.Concurrency; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+	for b, reqs := range pending {
+		m.feed(b, reqs)
+	}
+	return m, nil
+}
+
+// Close 停止处理，正在执行的请求不记录结果，重启后重新执行
+func (m *Manager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.stop()
+	m.wg.Wait()
+}
+
+// Create 创建批次并开始处理
+func (m *Manager) Create(owner, credential string, headers map[string]string, reqs []Request) (MessageBatch, error) {
+	if err := m.validate(reqs); err != nil {
+		return MessageBatch{}, err
+	}
+
+	now := m.nowFn().UTC()
+	b := &Batch{
+		meta: Meta{
+			ID:         newBatchID(),
+			Owner:      owner,
+			Credential: credential,
+			Headers:    headers,
+			Total:      len(reqs),
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(m.opts.Expiry),
+		},
+		done:   make(map[string]bool),
+		cancel: make(chan struct{}),
+	}
+	b.dir = filepath.Join(m.dir, b.meta.ID)
+	if err := os.MkdirAll(b.dir, 0o700); err != nil {
+		return MessageBatch{}, fmt.Errorf("创建批次目录失败: %w", err)
+	}
+
+	var buf bytes.Buffer
+	for _, req := range reqs {
+		line, err := json.Marshal(req)
+		if err != nil {
+			return MessageBatch{}, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := os.WriteFile(filepath.Join(b.dir, requestsFile), buf.Bytes(), 0o600); err != nil {
+		return MessageBatch{}, fmt.Errorf("写入批次请求失败: %w", err)
+	}
+	if err := b.saveMeta(); err != nil {
+		return MessageBatch{}, err
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return MessageBatch{}, errors.New("批次管理器已关闭")
+	}
+	m.batches[b.meta.ID] = b
+	m.mu.Unlock()
+
+	logger.Info("创建消息批次",
+		logger.String("batch_id", b.meta.ID),
+		logger.String("owner", owner),
+		logger.Int("requests", len(reqs)))
+	m.feed(b, reqs)
+	return b.view(), nil
+}
+
+func (m *Manager) validate(reqs []Request) error {
+	if len(reqs) == 0 {
+		return errors.New("requests 不能为空")
+	}
+	if m.opts.MaxRequests > 0 && len(reqs) > m.opts.MaxRequests {
+		return fmt.Errorf("单个批次最多 %d 条请求", m.opts.MaxRequests)
+	}
+	seen := make(map[string]bool, len(reqs))
+	for i, req := range reqs {
+		if !customIDPattern.MatchString(req.CustomID) {
+			return fmt.Errorf("requests[%d].custom_id 必须为 1-64 位字母、数字、- 或 _", i)
+		}
+		if seen[req.CustomID] {
+			return fmt.Errorf("requests[%d].custom_id 重复: %s", i, req.CustomID)
+		}
+		seen[req.CustomID] = true
+
+		var params map[string]any
+		if err := json.Unmarshal(req.Params, &params); err != nil || params == nil {
+			return fmt.Errorf("requests[%d].params 必须为对象", i)
+		}
+	}
+	return nil
+}
+
+// Get 获取批次
+func (m *Manager) Get(id string) (*Batch, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	b, ok := m.batches[id]
+	return b, ok
+}
+
+// List 按创建时间倒序列出 owner 的批次
+func (m *Manager) List(owner string) []MessageBatch {
+	m.mu.RLock()
+	var views []MessageBatch
+	for _, b := range m.batches {
+		if b.Owner() == owner {
+			views = append(views, b.view())
+		}
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(views, func(i, j int) bool {
+		if views[i].CreatedAt.Equal(views[j].CreatedAt) {
+			return views[i].ID > views[j].ID
+		}
+		return views[i].CreatedAt.After(views[j].CreatedAt)
+	})
+	return views
+}
+
+// Cancel 取消批次：尚未开始的请求记为 canceled，执行中的请求照常完成
+func (m *Manager) Cancel(id string) (MessageBatch, error) {
+	b, ok := m.Get(id)
+	if !ok {
+		return MessageBatch{}, ErrNotFound
+	}
+
+	b.mu.Lock()
+	if b.meta.EndedAt == nil && b.meta.CancelInitiatedAt == nil {
+		now := m.nowFn().UTC()
+		b.meta.CancelInitiatedAt = &now
+		if err := b.saveMetaLocked(); err != nil {
+			logger.Warn("保存批次元数据失败", logger.String("batch_id", id), logger.Err(err))
+		}
+		close(b.cancel)
+		logger.Info("取消消息批次", logger.String("batch_id", id))
+	}
+	b.mu.Unlock()
+	return b.view(), nil
+}
+
+// Delete 删除已结束的批次及其结果
+func (m *Manager) Delete(id string) error {
+	b, ok := m.Get(id)
+	if !ok {
+		return ErrNotFound
+	}
+	if b.view().ProcessingStatus != StatusEnded {
+		return ErrNotEnded
+	}
+
+	m.mu.Lock()
+	delete(m.batches, id)
+	m.mu.Unlock()
+	return os.RemoveAll(b.dir)
+}
+
+// feed 将待执行的请求依次交给工作协程
+func (m *Manager) feed(b *Batch, reqs []Request) {
+	go func() {
+		for _, req := range reqs {
+			if skip := m.skipReason(b); skip != "" {
+				b.record(m.nowFn(), req.CustomID, ResultBody{Type: skip})
+				continue
+			}
+			select {
+			case m.jobs <- job{batch: b, req: req}:
+			case <-b.cancel:
+				b.record(m.nowFn(), req.CustomID, ResultBody{Type: ResultCanceled})
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (m *Manager) worker() {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case j := <-m.jobs:
+			m.process(j)
+		}
+	}
+}
+
+func (m *Manager) process(j job) {
+	if skip := m.skipReason(j.batch); skip != "" {
+		j.batch.record(m.nowFn(), j.req.CustomID, ResultBody{Type: skip})
+		return
+	}
+
+	status, body := m.exec(m.ctx, j.batch.Meta(), j.req)
+	if m.ctx.Err() != nil {
+		return
+	}
+
+	result := ResultBody{Type: ResultSucceeded, Message: json.RawMessage(body)}
+	if status != 200 {
+		result = erroredResult(status, body)
+	} else if !json.Valid(body) {
+		result = erroredResult(502, nil)
+	}
+	j.batch.record(m.nowFn(), j.req.CustomID, result)
+}
+
+// skipReason 批次已取消或已过期时返回对应的结果类型
+func (m *Manager) skipReason(b *Batch) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.meta.CancelInitiatedAt != nil:
+		return ResultCanceled
+	case !m.nowFn().Before(b.meta.ExpiresAt):
+		return ResultExpired
+	}
+	return ""
+}
+
+// load 加载已有批次，返回未完成批次的待执行请求
+func (m *Manager) load() (map[*Batch][]Request, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, fmt.Errorf("读取批次目录失败: %w", err)
+	}
+
+	pending := make(map[*Batch][]Request)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		b, reqs, err := loadBatch(filepath.Join(m.dir, entry.Name()))
+		if err != nil {
+			logger.Warn("加载消息批次失败，已跳过", logger.String("dir", entry.Name()), logger.Err(err))
+			continue
+		}
+		m.batches[b.meta.ID] = b
+		if len(reqs) > 0 {
+			pending[b] = reqs
+		}
+	}
+	if len(pending) > 0 {
+		logger.Info("继续处理未完成的消息批次", logger.Int("batches", len(pending)))
+	}
+	return pending, nil
+}
+
+func loadBatch(dir string) (*Batch, []Request, error) {
+	b := &Batch{dir: dir, done: make(map[string]bool), cancel: make(chan struct{})}
+	data, err := os.ReadFile(filepath.Join(dir, metaFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(data, &b.meta); err != nil {
+		return nil, nil, err
+	}
+	if b.meta.CancelInitiatedAt != nil {
+		close(b.cancel)
+	}
+	if err := b.loadResults(); err != nil {
+		return nil, nil, err
+	}
+	if b.meta.EndedAt != nil {
+		return b, nil, nil
+	}
+
+	f, err := os.Open(filepath.Join(dir, requestsFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var reqs []Request
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var req Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return nil, nil, fmt.Errorf("解析批次请求失败: %w", err)
+		}
+		if !b.done[req.CustomID] {
+			reqs = append(reqs, req)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(reqs) == 0 {
+		b.mu.Lock()
+		b.finishLocked(time.Now())
+		b.mu.Unlock()
+	}
+	return b, reqs, nil
+}
+
+// loadResults 读取已有结果，丢弃写入中断留下的不完整末行
+func (b *Batch) loadResults() error {
+	path := filepath.Join(b.dir, resultsFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if end := bytes.LastIndexByte(data, '\n') + 1; end < len(data) {
+		data = data[:end]
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			return err
+		}
+	}
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		var result Result
+		if len(line) == 0 || json.Unmarshal(line, &result) != nil || b.done[result.CustomID] {
+			continue
+		}
+		b.done[result.CustomID] = true
+		b.count(result.Result.Type)
+	}
+	return nil
+}
+
+// record 追加单条结果，全部完成时标记批次结束
+func (b *Batch) record(now time.Time, customID string, result ResultBody) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done[customID] {
+		return
+	}
+
+	line, err := json.Marshal(Result{CustomID: customID, Result: result})
+	if err == nil {
+		err = appendLine(filepath.Join(b.dir, resultsFile), line)
+	}
+	if err != nil {
+		logger.Error("写入批次结果失败",
+			logger.String("batch_id", b.meta.ID),
+			logger.String("custom_id", customID),
+			logger.Err(err))
+		return
+	}
+	b.done[customID] = true
+	b.count(result.Type)
+	if len(b.done) >= b.meta.Total {
+		b.finishLocked(now)
+	}
+}
+
+func (b *Batch) finishLocked(now time.Time) {
+	if b.meta.EndedAt != nil {
+		return
+	}
+	ended := now.UTC()
+	b.meta.EndedAt = &ended
+	if err := b.saveMetaLocked(); err != nil {
+		logger.Warn("保存批次元数据失败", logger.String("batch_id", b.meta.ID), logger.Err(err))
+	}
+	logger.Info("消息批次处理完成",
+		logger.String("batch_id", b.meta.ID),
+		logger.Int("succeeded", b.counts.Succeeded),
+		logger.Int("errored", b.counts.Errored),
+		logger.Int("canceled", b.counts.Canceled),
+		logger.Int("expired", b.counts.Expired))
+}
+
+func (b *Batch) count(resultType string) {
+	switch resultType {
+	case ResultSucceeded:
+		b.counts.Succeeded++
+	case ResultErrored:
+		b.counts.Errored++
+	case ResultCanceled:
+		b.counts.Canceled++
+	case ResultExpired:
+		b.counts.Expired++
+	}
+}
+
+// Meta 返回批次元数据副本
+func (b *Batch) Meta() Meta {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.meta
+}
+
+// Owner 返回创建者的客户端标识
+func (b *Batch) Owner() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.meta.Owner
+}
+
+// ResultsPath 返回结果文件路径
+func (b *Batch) ResultsPath() string {
+	return filepath.Join(b.dir, resultsFile)
+}
+
+// View 返回 Anthropic message_batch 对象，resultsURL 为批次结束后的结果地址
+func (b *Batch) View(resultsURL string) MessageBatch {
+	view := b.view()
+	if view.ProcessingStatus == StatusEnded {
+		view.ResultsURL = &resultsURL
+	}
+	return view
+}
+
+func (b *Batch) view() MessageBatch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := StatusInProgress
+	switch {
+	case b.meta.EndedAt != nil:
+		status = StatusEnded
+	case b.meta.CancelInitiatedAt != nil:
+		status = StatusCanceling
+	}
+	counts := b.counts
+	counts.Processing = b.meta.Total - len(b.done)
+	return MessageBatch{
+		ID:                b.meta.ID,
+		Type:              "message_batch",
+		ProcessingStatus:  status,
+		RequestCounts:     counts,
+		EndedAt:           b.meta.EndedAt,
+		CreatedAt:         b.meta.CreatedAt,
+		ExpiresAt:         b.meta.ExpiresAt,
+		CancelInitiatedAt: b.meta.CancelInitiatedAt,
+	}
+}
+
+func (b *Batch) saveMeta() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.saveMetaLocked()
+}
+
+// saveMetaLocked 先写临时文件再重命名，元数据含多租户凭据，仅所有者可读
+func (b *Batch) saveMetaLocked() error {
+	data, err := json.MarshalIndent(b.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.dir, metaFile)
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return fmt.Errorf("写入批次元数据失败: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func appendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func newBatchID() string {
+	buf := make([]byte, 12)
+	_, _ = rand.Read(buf)
+	return "msgbatch_" + hex.EncodeToString(buf)
+}
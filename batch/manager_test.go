@@ -0,0 +1,221 @@
+package batch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRequests(ids ...string) []Request {
+	reqs := make([]Request, 0, len(ids))
+	for _, id := range ids {
+		reqs = append(reqs, Request{CustomID: id, Params: json.RawMessage(`{"model":"claude-sonnet-4-20250514","max_tokens":16,"messages":[]}`)})
+	}
+	return reqs
+}
+
+func testOptions() Options {
+	return Options{Concurrency: 2, MaxRequests: 10, Expiry: time.Hour}
+}
+
+// waitEnded 等待批次处理结束
+func waitEnded(t *testing.T, m *Manager, id string) MessageBatch {
+	t.Helper()
+	var view MessageBatch
+	require.Eventually(t, func() bool {
+		b, ok := m.Get(id)
+		if !ok {
+			return false
+		}
+		view = b.View("")
+		return view.ProcessingStatus == StatusEnded
+	}, 5*time.Second, 10*time.Millisecond)
+	return view
+}
+
+func readResults(t *testing.T, b *Batch) map[string]ResultBody {
+	t.Helper()
+	f, err := os.Open(b.ResultsPath())
+	require.NoError(t, err)
+	defer f.Close()
+
+	results := make(map[string]ResultBody)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var result Result
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &result))
+		_, dup := results[result.CustomID]
+		require.False(t, dup, "结果重复: %s", result.CustomID)
+		results[result.CustomID] = result.Result
+	}
+	return results
+}
+
+func TestManager_CreateAndProcess(t *testing.T) {
+	exec := func(_ context.Context, meta Meta, req Request) (int, []byte) {
+		if req.CustomID == "bad" {
+			return http.StatusTooManyRequests, []byte(`{"error":{"message":"slow down","code":"429"}}`)
+		}
+		return http.StatusOK, []byte(`{"id":"msg_1","type":"message","content":[{"type":"text","text":"` + meta.Owner + `"}]}`)
+	}
+	m, err := NewManager(t.TempDir(), testOptions(), exec)
+	require.NoError(t, err)
+	defer m.Close()
+
+	view, err := m.Create("tenant_a", "", nil, testRequests("ok-1", "ok-2", "bad"))
+	require.NoError(t, err)
+	assert.Equal(t, "message_batch", view.Type)
+	assert.Regexp(t, `^msgbatch_[0-9a-f]{24}$`, view.ID)
+
+	view = waitEnded(t, m, view.ID)
+	assert.Equal(t, RequestCounts{Succeeded: 2, Errored: 1}, view.RequestCounts)
+	assert.NotNil(t, view.EndedAt)
+
+	b, _ := m.Get(view.ID)
+	results := readResults(t, b)
+	assert.Equal(t, ResultSucceeded, results["ok-1"].Type)
+	assert.Contains(t, string(results["ok-1"].Message), "tenant_a")
+	require.NotNil(t, results["bad"].Error)
+	assert.Equal(t, "rate_limit_error", results["bad"].Error.Error.Type)
+	assert.Equal(t, "slow down", results["bad"].Error.Error.Message)
+
+	assert.Len(t, m.List("tenant_a"), 1)
+	assert.Empty(t, m.List("tenant_b"))
+
+	require.NoError(t, m.Delete(view.ID))
+	_, ok := m.Get(view.ID)
+	assert.False(t, ok)
+	assert.ErrorIs(t, m.Delete(view.ID), ErrNotFound)
+}
+
+func TestManager_Validate(t *testing.T) {
+	m, err := NewManager(t.TempDir(), testOptions(), nil)
+	require.NoError(t, err)
+	defer m.Close()
+
+	cases := map[string][]Request{
+		"empty":        nil,
+		"too_many":     testRequests("1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"),
+		"bad_id":       testRequests("has space"),
+		"duplicate_id": testRequests("a", "a"),
+		"bad_params":   {{CustomID: "a", Params: json.RawMessage(`[]`)}},
+	}
+	for name, reqs := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := m.Create("default", "", nil, reqs)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestManager_Cancel(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	exec := func(ctx context.Context, _ Meta, _ Request) (int, []byte) {
+		started <- struct{}{}
+		<-release
+		return http.StatusOK, []byte(`{"type":"message"}`)
+	}
+	opts := testOptions()
+	opts.Concurrency = 1
+	m, err := NewManager(t.TempDir(), opts, exec)
+	require.NoError(t, err)
+	defer m.Close()
+
+	view, err := m.Create("default", "", nil, testRequests("a", "b", "c"))
+	require.NoError(t, err)
+	<-started
+
+	view, err = m.Cancel(view.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusCanceling, view.ProcessingStatus)
+	assert.NotNil(t, view.CancelInitiatedAt)
+	close(release)
+
+	view = waitEnded(t, m, view.ID)
+	assert.Equal(t, RequestCounts{Succeeded: 1, Canceled: 2}, view.RequestCounts, "执行中的请求照常完成")
+
+	_, err = m.Cancel("msgbatch_missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestManager_ResumeAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	blockFirst := true
+	exec := func(ctx context.Context, _ Meta, req Request) (int, []byte) {
+		mu.Lock()
+		calls[req.CustomID]++
+		block := blockFirst && req.CustomID == "b"
+		mu.Unlock()
+		if block {
+			<-ctx.Done()
+			return http.StatusInternalServerError, nil
+		}
+		return http.StatusOK, []byte(`{"type":"message"}`)
+	}
+
+	opts := testOptions()
+	opts.Concurrency = 1
+	m, err := NewManager(dir, opts, exec)
+	require.NoError(t, err)
+	view, err := m.Create("default", "", map[string]string{"Anthropic-Version": "2023-06-01"}, testRequests("a", "b", "c"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls["b"] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	m.Close()
+
+	// 模拟写入中断留下的不完整末行
+	b, _ := m.Get(view.ID)
+	f, err := os.OpenFile(b.ResultsPath(), os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"custom_id":"c","res`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	mu.Lock()
+	blockFirst = false
+	mu.Unlock()
+	m, err = NewManager(dir, opts, exec)
+	require.NoError(t, err)
+	defer m.Close()
+
+	view = waitEnded(t, m, view.ID)
+	assert.Equal(t, RequestCounts{Succeeded: 3}, view.RequestCounts)
+	b, _ = m.Get(view.ID)
+	assert.Len(t, readResults(t, b), 3)
+	assert.Equal(t, "2023-06-01", b.Meta().Headers["Anthropic-Version"])
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 1, calls["a"], "已完成的请求不应重复执行")
+	assert.Equal(t, 2, calls["b"], "中断的请求应在重启后重新执行")
+}
+
+func TestManager_Expired(t *testing.T) {
+	opts := testOptions()
+	opts.Expiry = -time.Second
+	m, err := NewManager(t.TempDir(), opts, func(context.Context, Meta, Request) (int, []byte) {
+		t.Error("过期批次的请求不应执行")
+		return http.StatusOK, nil
+	})
+	require.NoError(t, err)
+	defer m.Close()
+
+	view, err := m.Create("default", "", nil, testRequests("a", "b"))
+	require.NoError(t, err)
+	view = waitEnded(t, m, view.ID)
+	assert.Equal(t, RequestCounts{Expired: 2}, view.RequestCounts)
+}
@@ -0,0 +1,133 @@
+// Package batch 本地模拟 Anthropic Message Batches API：批次持久化到数据目录，
+// 由有限并发的工作协程逐条执行，服务重启后继续处理未完成的批次
+package batch
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// 批次处理状态
+const (
+	StatusInProgress = "in_progress"
+	StatusCanceling  = "canceling"
+	StatusEnded      = "ended"
+)
+
+// 单条请求的结果类型
+const (
+	ResultSucceeded = "succeeded"
+	ResultErrored   = "errored"
+	ResultCanceled  = "canceled"
+	ResultExpired   = "expired"
+)
+
+// Request 批次中的单条请求
+type Request struct {
+	CustomID string          `json:"custom_id"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// Result 结果文件（JSONL）中的一行
+type Result struct {
+	CustomID string     `json:"custom_id"`
+	Result   ResultBody `json:"result"`
+}
+
+// ResultBody 单条请求的执行结果
+type ResultBody struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message,omitempty"`
+	Error   *ErrorEnvelope  `json:"error,omitempty"`
+}
+
+// ErrorEnvelope Anthropic 错误响应格式
+type ErrorEnvelope struct {
+	Type  string      `json:"type"`
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail 错误详情
+type ErrorDetail struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// RequestCounts 各状态的请求数
+type RequestCounts struct {
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Errored    int `json:"errored"`
+	Canceled   int `json:"canceled"`
+	Expired    int `json:"expired"`
+}
+
+// MessageBatch Anthropic message_batch 对象
+type MessageBatch struct {
+	ID                string        `json:"id"`
+	Type              string        `json:"type"`
+	ProcessingStatus  string        `json:"processing_status"`
+	RequestCounts     RequestCounts `json:"request_counts"`
+	EndedAt           *time.Time    `json:"ended_at"`
+	CreatedAt         time.Time     `json:"created_at"`
+	ExpiresAt         time.Time     `json:"expires_at"`
+	ArchivedAt        *time.Time    `json:"archived_at"`
+	CancelInitiatedAt *time.Time    `json:"cancel_initiated_at"`
+	ResultsURL        *string       `json:"results_url"`
+}
+
+// Meta 批次元数据（batch.json）
+type Meta struct {
+	ID                string            `json:"id"`
+	Owner             string            `json:"owner"`                // 创建者的客户端标识，仅创建者可访问
+	Credential        string            `json:"credential,omitempty"` // 多租户凭据，重启后继续处理时使用
+	Headers           map[string]string `json:"headers,omitempty"`    // 创建请求的请求头（不含认证信息）
+	Total             int               `json:"total"`
+	CreatedAt         time.Time         `json:"created_at"`
+	ExpiresAt         time.Time         `json:"expires_at"`
+	CancelInitiatedAt *time.Time        `json:"cancel_initiated_at,omitempty"`
+	EndedAt           *time.Time        `json:"ended_at,omitempty"`
+}
+
+// errorTypeForStatus 按 HTTP 状态码映射 Anthropic 错误类型
+func errorTypeForStatus(status int) string {
+	switch {
+	case status == http.StatusBadRequest:
+		return "invalid_request_error"
+	case status == http.StatusUnauthorized:
+		return "authentication_error"
+	case status == http.StatusForbidden:
+		return "permission_error"
+	case status == http.StatusNotFound:
+		return "not_found_error"
+	case status == http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status == 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// erroredResult 由失败响应构造 errored 结果，响应体为 {"error": {"message", "type"/"code"}} 时保留原始信息
+func erroredResult(status int, body []byte) ResultBody {
+	detail := ErrorDetail{Type: errorTypeForStatus(status), Message: http.StatusText(status)}
+	var resp struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &resp) == nil {
+		if resp.Error.Message != "" {
+			detail.Message = resp.Error.Message
+		}
+		if resp.Error.Type != "" && resp.Error.Type != "error" {
+			detail.Type = resp.Error.Type
+		}
+	}
+	return ResultBody{Type: ResultErrored, Error: &ErrorEnvelope{Type: "error", Error: detail}}
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,6 +20,77 @@ import (
 // ParserMaxErrors 解析器容忍的最大错误次数
 const ParserMaxErrors = 10
 
+// EventStreamCRCMode EventStream prelude/消息 CRC 校验模式
+// strict: 校验失败立即中止流并向客户端发送 SSE error 事件
+// lenient（默认）: 丢弃损坏帧，在下一个有效 prelude 处重新同步
+var EventStreamCRCMode = strings.ToLower(getEnvString("EVENTSTREAM_CRC_MODE", "lenient"))
+
+// ========== Thinking 配置 ==========
+
+// ThinkingTagFallbackModels 从文本中解析 <thinking> 标签的模型列表，逗号分隔，支持 * 前缀匹配
+// 默认为空：只使用结构化推理事件，避免回答中的字面标签被误识别为推理内容；
+// 仅为以文本标签输出推理的模型开启，收到结构化推理事件后该请求也会停止标签解析
+var ThinkingTagFallbackModels = getEnvString("THINKING_TAG_FALLBACK_MODELS", "")
+
+// ThinkingHistoryMode 历史消息中 thinking 块的处理方式
+// inline（默认）: 签名校验通过的 thinking 以 <thinking> 标签形式放回助手消息内容
+// strip: 全部移除
+// redacted_thinking 为加密内容，上游无法识别，始终移除
+var ThinkingHistoryMode = strings.ToLower(getEnvString("THINKING_HISTORY_MODE", "inline"))
+
+// ThinkingSignatureKey thinking 块签名密钥（为空时由 KIRO_CLIENT_TOKEN 派生）
+var ThinkingSignatureKey = os.Getenv("THINKING_SIGNATURE_KEY")
+
+// ========== 系统提示配置 ==========
+
+// SystemPromptMode 系统提示（含 tool_choice 指令与 thinking 标签）发送给上游的方式
+// 上游对话状态没有原生的 system 字段，系统提示只能作为对话文本发送
+// history（默认）: 历史开头插入合成的用户消息与助手 "OK" 回复
+// prepend: 拼接到第一条用户消息开头，不插入合成轮次
+var SystemPromptMode = strings.ToLower(getEnvString("SYSTEM_PROMPT_MODE", "history"))
+
+// SystemPromptMaxBytes 客户端系统提示的最大字节数（默认：0 表示不限制），超出部分截断
+var SystemPromptMaxBytes = getEnvInt("SYSTEM_PROMPT_MAX_BYTES", 0)
+
+// SystemPromptDedupe 是否去除重复的样板内容（默认：false）
+// 包括内容相同的 system 块，以及历史用户消息中重复出现的 <system-reminder> 段落（保留首次出现）
+// 开启后会改写发送给上游的历史用户消息，需显式开启
+var SystemPromptDedupe = getEnvBool("SYSTEM_PROMPT_DEDUPE", false)
+
+// ========== Web Search 模拟配置 ==========
+
+// WebSearchBackend web_search 服务端工具的搜索后端（为空时不模拟，web_search 工具被静默过滤）
+// stub: 本地固定结果，用于测试与联调
+// searxng: 调用 WEB_SEARCH_SEARXNG_URL 指向的 SearXNG 实例
+var WebSearchBackend = strings.ToLower(getEnvString("WEB_SEARCH_BACKEND", ""))
+
+// WebSearchSearXNGURL SearXNG 实例地址（需启用 JSON 输出格式）
+var WebSearchSearXNGURL = getEnvString("WEB_SEARCH_SEARXNG_URL", "")
+
+// WebSearchTimeout 单次搜索超时
+var WebSearchTimeout = getEnvDuration("WEB_SEARCH_TIMEOUT", 10*time.Second)
+
+// WebSearchMaxResults 单次搜索返回给模型的最大结果数
+var WebSearchMaxResults = getEnvInt("WEB_SEARCH_MAX_RESULTS", 5)
+
+// WebSearchMaxRounds 单个请求内执行搜索后续写上游的最大轮数，超出后以 pause_turn 结束
+var WebSearchMaxRounds = getEnvInt("WEB_SEARCH_MAX_ROUNDS", 5)
+
+// ========== 流式响应保活配置 ==========
+
+// SSEPingInterval 等待上游数据时向客户端发送心跳的间隔（0 表示关闭）
+// Anthropic 端点发送 ping 事件，OpenAI 端点发送 SSE 注释，防止中间代理断开空闲连接
+var SSEPingInterval = getEnvDuration("SSE_PING_INTERVAL", 15*time.Second)
+
+// UpstreamIdleTimeout 上游连续无数据的最长时间，超时后向客户端发送 error 事件并结束流（0 表示不限制）
+var UpstreamIdleTimeout = getEnvDuration("UPSTREAM_IDLE_TIMEOUT", 180*time.Second)
+
+// SSEValidation 下发 SSE 事件的协议校验模式（ssevalidator）
+// off（默认）: 不校验
+// log: 违规时记录警告，事件照常发送
+// strict: 违规事件不发送并记录错误
+var SSEValidation = strings.ToLower(getEnvString("SSE_VALIDATION", "off"))
+
 // ========== Token缓存配置 ==========
 
 // TokenCacheTTL Token缓存的生存时间
@@ -30,6 +102,25 @@ var HTTPClientKeepAlive = getEnvDuration("HTTP_CLIENT_KEEP_ALIVE", 30*time.Secon
 // HTTPClientTLSHandshakeTimeout HTTP客户端TLS握手超时
 var HTTPClientTLSHandshakeTimeout = getEnvDuration("HTTP_CLIENT_TLS_TIMEOUT", 15*time.Second)
 
+// ========== 后台Token调度配置 ==========
+
+// TokenBackgroundRefreshEnabled 是否启用后台token刷新与使用量轮询
+// 关闭后回退到请求路径上的惰性刷新
+var TokenBackgroundRefreshEnabled = getEnvBool("TOKEN_BACKGROUND_REFRESH", true)
+
+// TokenSchedulerTickInterval 后台调度器检查到期任务的间隔
+var TokenSchedulerTickInterval = getEnvDuration("TOKEN_SCHEDULER_TICK", 15*time.Second)
+
+// TokenRefreshAhead 在 ExpiresAt 之前多久主动刷新access token
+var TokenRefreshAhead = getEnvDuration("TOKEN_REFRESH_AHEAD", 5*time.Minute)
+
+// TokenUsagePollInterval 使用限制轮询的基础间隔
+// 应小于 TokenCacheTTL，否则缓存条目会在两次轮询之间过期
+var TokenUsagePollInterval = getEnvDuration("TOKEN_USAGE_POLL_INTERVAL", 2*time.Minute)
+
+// TokenUsagePollJitterPercent 使用限制轮询间隔的抖动百分比（±）
+var TokenUsagePollJitterPercent = getEnvInt("TOKEN_USAGE_POLL_JITTER_PERCENT", 20)
+
 // ========== 防封号配置（增强版 - 2025-12-17更新） ==========
 // 问题：多token快速轮换触发AWS安全检测，导致账户被暂停
 // 解决：增加请求间隔，减少轮换频率
@@ -86,6 +177,102 @@ var RateLimitJitterPercent = getEnvInt("RATE_LIMIT_JITTER_PERCENT", 30)
 // 当检测到TEMPORARILY_SUSPENDED错误时，token进入长时间冷却
 var SuspendedTokenCooldown = getEnvDuration("SUSPENDED_TOKEN_COOLDOWN", 24*time.Hour)
 
+// ========== 账号健康探测配置 ==========
+
+// TokenHealthProbeEnabled 是否启用账号健康探测与自动隔离
+var TokenHealthProbeEnabled = getEnvBool("TOKEN_HEALTH_PROBE", true)
+
+// TokenHealthProbeInterval 健康探测间隔（每个账号一次轻量的使用量查询）
+var TokenHealthProbeInterval = getEnvDuration("TOKEN_HEALTH_PROBE_INTERVAL", 10*time.Minute)
+
+// TokenHealthDegradedThreshold 连续失败多少次标记为 degraded
+var TokenHealthDegradedThreshold = getEnvInt("TOKEN_HEALTH_DEGRADED_THRESHOLD", 1)
+
+// TokenHealthQuarantineThreshold 连续失败多少次进入隔离（不再参与轮询）
+// 账号被暂停或凭据失效时直接隔离，不受此阈值限制
+var TokenHealthQuarantineThreshold = getEnvInt("TOKEN_HEALTH_QUARANTINE_THRESHOLD", 3)
+
+// TokenHealthRetireAfter 隔离超过此时间仍未恢复则退役
+// 应大于 SuspendedTokenCooldown，给被暂停的账号留出恢复时间
+var TokenHealthRetireAfter = getEnvDuration("TOKEN_HEALTH_RETIRE_AFTER", 72*time.Hour)
+
+// ========== 事件通知配置 ==========
+
+// NotifyWebhooks 事件通知 Webhook 列表，逗号分隔
+// 每项格式为 [format+]URL，format 可选 slack / dingtalk / feishu，省略时发送通用 JSON
+var NotifyWebhooks = os.Getenv("NOTIFY_WEBHOOKS")
+
+// NotifyEvents 需要通知的事件类型，逗号分隔，为空表示全部
+var NotifyEvents = os.Getenv("NOTIFY_EVENTS")
+
+// NotifyDedupeWindow 同一事件（类型+对象）的去重窗口
+var NotifyDedupeWindow = getEnvDuration("NOTIFY_DEDUPE_WINDOW", 10*time.Minute)
+
+// NotifyMaxRetries Webhook 投递失败后的最大重试次数
+var NotifyMaxRetries = getEnvInt("NOTIFY_MAX_RETRIES", 3)
+
+// NotifyRetryBackoff 重试退避基数（每次翻倍）
+var NotifyRetryBackoff = getEnvDuration("NOTIFY_RETRY_BACKOFF", 2*time.Second)
+
+// NotifyTimeout 单次 Webhook 请求超时
+var NotifyTimeout = getEnvDuration("NOTIFY_TIMEOUT", 10*time.Second)
+
+// UpstreamErrorSpikeWindow 上游错误率统计窗口
+var UpstreamErrorSpikeWindow = getEnvDuration("UPSTREAM_ERROR_SPIKE_WINDOW", 5*time.Minute)
+
+// UpstreamErrorSpikeThreshold 上游错误率告警阈值（百分比，0 表示关闭）
+var UpstreamErrorSpikeThreshold = getEnvInt("UPSTREAM_ERROR_SPIKE_PERCENT", 50)
+
+// UpstreamErrorSpikeMinRequests 窗口内至少多少请求才计算错误率
+var UpstreamErrorSpikeMinRequests = getEnvInt("UPSTREAM_ERROR_SPIKE_MIN_REQUESTS", 20)
+
+// ========== 上游流捕获配置 ==========
+
+// CaptureRequestIDs 需要捕获的请求ID列表，逗号分隔（匹配 X-Request-ID）
+var CaptureRequestIDs = os.Getenv("CAPTURE_REQUEST_IDS")
+
+// CaptureSampleRate 随机抽样捕获比例（0-1，0 表示关闭抽样）
+var CaptureSampleRate = getEnvFloat("CAPTURE_SAMPLE_RATE", 0)
+
+// CaptureMaxBytes 单次捕获中上游响应与下发事件各自保存的最大字节数
+var CaptureMaxBytes = getEnvInt("CAPTURE_MAX_BYTES", 8*1024*1024)
+
+// ========== 请求改写规则配置 ==========
+
+// RewriteRulesFile 请求改写规则文件路径（JSON 或 YAML，为空时不启用）
+// 文件不存在时以空规则集启动，管理 API 修改规则后写回该文件
+var RewriteRulesFile = getEnvString("REWRITE_RULES_FILE", "")
+
+// ========== 消息批次配置 ==========
+
+// BatchConcurrency /v1/messages/batches 同时执行的请求数（默认：2），请求仍受 Token 频率限制约束
+var BatchConcurrency = getEnvInt("BATCH_CONCURRENCY", 2)
+
+// BatchMaxRequests 单个批次的最大请求数（默认：10000，0 表示不限制）
+var BatchMaxRequests = getEnvInt("BATCH_MAX_REQUESTS", 10000)
+
+// BatchExpiry 批次有效期（默认：24h），超时仍未执行的请求记为 expired
+var BatchExpiry = getEnvDuration("BATCH_EXPIRY", 24*time.Hour)
+
+// ========== 响应缓存配置 ==========
+
+// ResponseCache /v1/messages 响应缓存后端：memory（进程内 LRU）、disk（K2A_DATA_DIR/response_cache），为空时不启用
+var ResponseCache = getEnvString("RESPONSE_CACHE", "")
+
+// ResponseCacheTTL 缓存响应的有效期（默认：1h）
+var ResponseCacheTTL = getEnvDuration("RESPONSE_CACHE_TTL", time.Hour)
+
+// ResponseCacheMaxEntries memory 后端最多缓存的响应数（默认：1000，LRU淘汰）
+var ResponseCacheMaxEntries = getEnvInt("RESPONSE_CACHE_MAX_ENTRIES", 1000)
+
+// ResponseCacheDeterministicOnly 仅缓存 temperature 为 0 的请求（默认：true）
+var ResponseCacheDeterministicOnly = getEnvBool("RESPONSE_CACHE_DETERMINISTIC_ONLY", true)
+
+// ========== 多租户配置 ==========
+
+// TenantCacheMaxSize 多租户模式下最多缓存的租户数量（LRU淘汰）
+var TenantCacheMaxSize = getEnvInt("TENANT_CACHE_MAX_SIZE", 100)
+
 // ========== 工具限制配置 ==========
 
 // MaxToolDescriptionLength 工具描述的最大长度（字符数，默认：10000）
@@ -93,6 +280,27 @@ var SuspendedTokenCooldown = getEnvDuration("SUSPENDED_TOKEN_COOLDOWN", 24*time.
 // 防止超长内容导致上游 API 错误
 var MaxToolDescriptionLength = getEnvInt("MAX_TOOL_DESCRIPTION_LENGTH", 10000)
 
+// ToolNameMaxLength 发送给上游的工具名最大长度（默认：64）
+// 超长或含非法字符（点号、unicode 等）的工具名会被改写，响应中还原为原名
+var ToolNameMaxLength = getEnvInt("TOOL_NAME_MAX_LENGTH", 64)
+
+// ToolSchemaMaxDepth 工具 input_schema 的最大嵌套深度（默认：8，0 表示不限制）
+// 超出部分只保留类型与描述；内部另有 32 层与 $ref 展开规模的硬上限
+var ToolSchemaMaxDepth = getEnvInt("TOOL_SCHEMA_MAX_DEPTH", 8)
+
+// ToolSchemaMaxEnumValues 工具 input_schema 中单个 enum 保留的最大取值数（默认：100，0 表示不限制）
+var ToolSchemaMaxEnumValues = getEnvInt("TOOL_SCHEMA_MAX_ENUM_VALUES", 100)
+
+// ToolSchemaMaxBytes 单个工具 input_schema 序列化后的最大字节数（默认：32768，0 表示不限制）
+// 超出时依次去除嵌套描述、降低嵌套深度
+var ToolSchemaMaxBytes = getEnvInt("TOOL_SCHEMA_MAX_BYTES", 32768)
+
+// ToolChoiceMaxRetries tool_choice 要求调用工具但响应未调用时的自动重试次数（0 表示不重试）
+var ToolChoiceMaxRetries = getEnvInt("TOOL_CHOICE_MAX_RETRIES", 1)
+
+// StructuredOutputMaxRetries response_format=json_schema 输出未通过 schema 校验时的自动重试次数（0 表示不重试）
+var StructuredOutputMaxRetries = getEnvInt("STRUCTURED_OUTPUT_MAX_RETRIES", 1)
+
 // ========== 辅助函数 ==========
 
 // getEnvDuration 从环境变量读取时间间隔，支持格式如 "5s", "1m", "2h"
@@ -105,6 +313,14 @@ func getEnvDuration(key string, defaultVal time.Duration) time.Duration {
 	return defaultVal
 }
 
+// getEnvString 从环境变量读取字符串，未设置时使用默认值
+func getEnvString(key string, defaultVal string) string {
+	if val := strings.TrimSpace(os.Getenv(key)); val != "" {
+		return val
+	}
+	return defaultVal
+}
+
 // getEnvInt 从环境变量读取整数
 func getEnvInt(key string, defaultVal int) int {
 	if val := os.Getenv(key); val != "" {
@@ -115,6 +331,17 @@ func getEnvInt(key string, defaultVal int) int {
 	return defaultVal
 }
 
+// getEnvBool 从环境变量读取布尔值，接受 true/1/yes/on 和 false/0/no/off
+func getEnvBool(key string, defaultVal bool) bool {
+	switch strings.ToLower(strings.TrimSpace(os.Getenv(key))) {
+	case "true", "1", "yes", "on":
+		return true
+	case "false", "0", "no", "off":
+		return false
+	}
+	return defaultVal
+}
+
 // getEnvFloat 从环境变量读取浮点数
 func getEnvFloat(key string, defaultVal float64) float64 {
 	if val := os.Getenv(key); val != "" {
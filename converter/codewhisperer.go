@@ -8,6 +8,7 @@ import (
 	"kiro2api/logger"
 	"kiro2api/types"
 	"kiro2api/utils"
+	"kiro2api/websearch"
 
 	"github.com/gin-gonic/gin"
 )
@@ -22,21 +23,8 @@ import (
 // determineChatTriggerType 智能确定聊天触发类型 (SOLID-SRP: 单一责任)
 func determineChatTriggerType(anthropicReq types.AnthropicRequest) string {
 	// 如果有工具调用，通常是自动触发的
-	if len(anthropicReq.Tools) > 0 {
-		// 检查tool_choice是否强制要求使用工具
-		if anthropicReq.ToolChoice != nil {
-			if tc, ok := anthropicReq.ToolChoice.(*types.ToolChoice); ok && tc != nil {
-				if tc.Type == "any" || tc.Type == "tool" {
-					return "AUTO" // 自动工具调用
-				}
-			} else if tcMap, ok := anthropicReq.ToolChoice.(map[string]any); ok {
-				if tcType, exists := tcMap["type"].(string); exists {
-					if tcType == "any" || tcType == "tool" {
-						return "AUTO" // 自动工具调用
-					}
-				}
-			}
-		}
+	if len(anthropicReq.Tools) > 0 && ResolveToolChoice(anthropicReq.ToolChoice).RequiresTool() {
+		return "AUTO" // 自动工具调用
 	}
 
 	// 默认为手动触发
@@ -86,120 +74,51 @@ func validateCodeWhispererRequest(cwReq *types.CodeWhispererRequest) error {
 	return nil
 }
 
-// extractToolResultsFromMessage 从消息内容中提取工具结果
-func extractToolResultsFromMessage(content any) []types.ToolResult {
+// extractToolResultsFromMessage 从消息内容中提取工具结果，工具结果中的图片单独返回
+func extractToolResultsFromMessage(content any) ([]types.ToolResult, []types.CodeWhispererImage) {
 	var toolResults []types.ToolResult
+	var images []types.CodeWhispererImage
+
+	appendResult := func(toolUseId string, content any, hasContent bool, isError bool) {
+		toolResult := types.ToolResult{ToolUseId: toolUseId, Status: "success"}
+		if hasContent {
+			var resultImages []types.CodeWhispererImage
+			toolResult.Content, resultImages = toolResultContent(content)
+			images = append(images, resultImages...)
+		}
+		if isError {
+			toolResult.Status = "error"
+			toolResult.IsError = true
+		}
+		toolResults = append(toolResults, toolResult)
+	}
 
 	switch v := content.(type) {
 	case []any:
 		for _, item := range v {
-			if block, ok := item.(map[string]any); ok {
-				if blockType, exists := block["type"]; exists {
-					if typeStr, ok := blockType.(string); ok && typeStr == "tool_result" {
-						toolResult := types.ToolResult{}
-
-						// 提取 tool_use_id
-						if toolUseId, ok := block["tool_use_id"].(string); ok {
-							toolResult.ToolUseId = toolUseId
-						}
-
-						// 提取 content - 转换为数组格式
-						if content, exists := block["content"]; exists {
-							// 将 content 转换为 []map[string]any 格式
-							var contentArray []map[string]any
-
-							// 处理不同的 content 格式
-							switch c := content.(type) {
-							case string:
-								// 如果是字符串，包装成标准格式
-								contentArray = []map[string]any{
-									{"text": c},
-								}
-							case []any:
-								// 如果已经是数组，保持原样
-								for _, item := range c {
-									if m, ok := item.(map[string]any); ok {
-										contentArray = append(contentArray, m)
-									}
-								}
-							case map[string]any:
-								// 如果是单个对象，包装成数组
-								contentArray = []map[string]any{c}
-							default:
-								// 其他格式，尝试转换为字符串
-								contentArray = []map[string]any{
-									{"text": fmt.Sprintf("%v", c)},
-								}
-							}
-
-							toolResult.Content = contentArray
-						}
-
-						// 提取 status (默认为 success)
-						toolResult.Status = "success"
-						if isError, ok := block["is_error"].(bool); ok && isError {
-							toolResult.Status = "error"
-							toolResult.IsError = true
-						}
-
-						toolResults = append(toolResults, toolResult)
-
-						// logger.Debug("提取到工具结果",
-						// 	logger.String("tool_use_id", toolResult.ToolUseId),
-						// 	logger.String("status", toolResult.Status),
-						// 	logger.Int("content_items", len(toolResult.Content)))
-					}
-				}
+			block, ok := item.(map[string]any)
+			if !ok || block["type"] != "tool_result" {
+				continue
 			}
+			toolUseId, _ := block["tool_use_id"].(string)
+			resultContent, hasContent := block["content"]
+			isError, _ := block["is_error"].(bool)
+			appendResult(toolUseId, resultContent, hasContent, isError)
 		}
 	case []types.ContentBlock:
 		for _, block := range v {
-			if block.Type == "tool_result" {
-				toolResult := types.ToolResult{}
-
-				if block.ToolUseId != nil {
-					toolResult.ToolUseId = *block.ToolUseId
-				}
-
-				// 处理 content
-				if block.Content != nil {
-					var contentArray []map[string]any
-
-					switch c := block.Content.(type) {
-					case string:
-						contentArray = []map[string]any{
-							{"text": c},
-						}
-					case []any:
-						for _, item := range c {
-							if m, ok := item.(map[string]any); ok {
-								contentArray = append(contentArray, m)
-							}
-						}
-					case map[string]any:
-						contentArray = []map[string]any{c}
-					default:
-						contentArray = []map[string]any{
-							{"text": fmt.Sprintf("%v", c)},
-						}
-					}
-
-					toolResult.Content = contentArray
-				}
-
-				// 设置 status
-				toolResult.Status = "success"
-				if block.IsError != nil && *block.IsError {
-					toolResult.Status = "error"
-					toolResult.IsError = true
-				}
-
-				toolResults = append(toolResults, toolResult)
+			if block.Type != "tool_result" {
+				continue
+			}
+			toolUseId := ""
+			if block.ToolUseId != nil {
+				toolUseId = *block.ToolUseId
 			}
+			appendResult(toolUseId, block.Content, block.Content != nil, block.IsError != nil && *block.IsError)
 		}
 	}
 
-	return toolResults
+	return toolResults, images
 }
 
 // truncateDescription 截断描述长度，防止超长内容导致上游 API 错误
@@ -271,33 +190,27 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	// 	logger.String("role", lastMessage.Role),
 	// 	logger.String("content_type", fmt.Sprintf("%T", lastMessage.Content)))
 
-	textContent, images, err := processMessageContent(lastMessage.Content)
+	current, err := userInputFromContent(lastMessage.Content)
 	if err != nil {
 		return cwReq, fmt.Errorf("处理消息内容失败: %v", err)
 	}
 
-	cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = textContent
+	// 与工具结果同时发送的用户文本原样保留
+	cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = current.text
 	// 确保Images字段始终是数组，即使为空
-	if len(images) > 0 {
-		cwReq.ConversationState.CurrentMessage.UserInputMessage.Images = images
+	if len(current.images) > 0 {
+		cwReq.ConversationState.CurrentMessage.UserInputMessage.Images = current.images
 	} else {
 		cwReq.ConversationState.CurrentMessage.UserInputMessage.Images = []types.CodeWhispererImage{}
 	}
 
-	// 新增：检查并处理 ToolResults
-	if lastMessage.Role == "user" {
-		toolResults := extractToolResultsFromMessage(lastMessage.Content)
-		if len(toolResults) > 0 {
-			cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.ToolResults = toolResults
+	// 检查并处理 ToolResults
+	if lastMessage.Role == "user" && len(current.toolResults) > 0 {
+		cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.ToolResults = current.toolResults
 
-			logger.Debug("已添加工具结果到请求",
-				logger.Int("tool_results_count", len(toolResults)),
-				logger.String("conversation_id", cwReq.ConversationState.ConversationId))
-
-			// 对于包含 tool_result 的请求，content 应该为空字符串（符合 req2.json 的格式）
-			cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = ""
-			logger.Debug("工具结果请求，设置 content 为空字符串")
-		}
+		logger.Debug("已添加工具结果到请求",
+			logger.Int("tool_results_count", len(current.toolResults)),
+			logger.String("conversation_id", cwReq.ConversationState.ConversationId))
 	}
 
 	// 检查模型映射是否存在，如果不存在则返回错误
@@ -314,12 +227,15 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	cwReq.ConversationState.CurrentMessage.UserInputMessage.Origin = "AI_EDITOR" // v0.4兼容性：固定使用AI_EDITOR
 
 	// 处理 tools 信息 - 根据req.json实际结构优化工具转换
-	if len(anthropicReq.Tools) > 0 {
+	// tool_choice 为 none 时不声明任何工具
+	toolChoice := ResolveToolChoice(anthropicReq.ToolChoice)
+	if len(anthropicReq.Tools) > 0 && (toolChoice == nil || toolChoice.Type != "none") {
 		// logger.Debug("开始处理工具配置",
 		// 	logger.Int("tools_count", len(anthropicReq.Tools)),
 		// 	logger.String("conversation_id", cwReq.ConversationState.ConversationId))
 
 		var tools []types.CodeWhispererTool
+		var normalizedTools []string
 		for i, tool := range anthropicReq.Tools {
 			// 验证工具定义的完整性 (SOLID-SRP: 单一责任验证)
 			if tool.Name == "" {
@@ -327,11 +243,22 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 				continue
 			}
 
-			// 过滤不支持的工具：web_search (静默过滤，不发送到上游)
-			if tool.Name == "web_search" || tool.Name == "websearch" {
+			// 指定工具时只声明该工具
+			if !toolAllowedByChoice(toolChoice, tool.Name) {
 				continue
 			}
 
+			// web_search：配置搜索后端时声明为普通工具，由代理拦截执行；否则静默过滤
+			if isWebSearchToolName(tool.Name) {
+				if !websearch.Enabled() {
+					continue
+				}
+				if tool.IsServerWebSearch() {
+					tools = append(tools, webSearchToolSpec(tool.Name))
+					continue
+				}
+			}
+
 			// logger.Debug("转换工具定义",
 			// 	logger.Int("tool_index", i),
 			// 	logger.String("tool_name", tool.Name),
@@ -340,16 +267,26 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 
 			// 根据req.json的实际结构，确保JSON Schema完整性
 			cwTool := types.CodeWhispererTool{}
-			cwTool.ToolSpecification.Name = tool.Name
+			cwTool.ToolSpecification.Name = UpstreamToolName(tool.Name)
 			// 截断工具描述长度，防止超长内容导致上游 API 错误
 			cwTool.ToolSpecification.Description = truncateDescription(tool.Description)
 
-			// 直接使用原始的InputSchema，避免过度处理 (恢复v0.4兼容性)
+			// 规范化 InputSchema：内联引用、化简联合类型、去除上游不支持的关键字
+			schema, changes := NormalizeToolSchema(tool.InputSchema)
+			if len(changes) > 0 {
+				normalizedTools = append(normalizedTools, tool.Name)
+				logger.Debug("工具schema已规范化",
+					logger.String("tool_name", tool.Name),
+					logger.String("changes", strings.Join(changes, ",")))
+			}
 			cwTool.ToolSpecification.InputSchema = types.InputSchema{
-				Json: tool.InputSchema,
+				Json: schema,
 			}
 			tools = append(tools, cwTool)
 		}
+		if len(normalizedTools) > 0 && ctx != nil {
+			ctx.Header("X-Tool-Schema-Normalized", strings.Join(normalizedTools, ","))
+		}
 
 		// 工具配置放在 UserInputMessageContext.Tools 中 (符合req.json结构)
 		cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools = tools
@@ -361,60 +298,32 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 
 		// 生成 thinking 前缀（借鉴 kiro.rs）
 		thinkingPrefix := generateThinkingPrefix(anthropicReq.Thinking)
+		promptMode := systemPromptMode()
 
-		// 构建综合系统提示
-		var systemContentBuilder strings.Builder
+		// 构建综合系统提示（按 SYSTEM_PROMPT_* 配置去重、限制大小）
+		systemContent := clientSystemPrompt(anthropicReq.System)
 
-		// 添加原有的 system 消息
-		if len(anthropicReq.System) > 0 {
-			for _, sysMsg := range anthropicReq.System {
-				content, err := utils.GetMessageContent(sysMsg)
-				if err == nil {
-					systemContentBuilder.WriteString(content)
-					systemContentBuilder.WriteString("\n")
-				}
+		// 上游不支持 tool_choice，以系统指令约束工具使用
+		if len(anthropicReq.Tools) > 0 {
+			if directive := toolChoiceDirective(toolChoice); directive != "" {
+				systemContent = strings.TrimSpace(systemContent + "\n" + directive)
 			}
 		}
 
-		// 如果有系统内容，添加到历史记录 (恢复v0.4结构化类型)
-		if systemContentBuilder.Len() > 0 {
-			systemContent := strings.TrimSpace(systemContentBuilder.String())
-
-			// 注入 thinking 标签到系统消息最前面（借鉴 kiro.rs）
-			// 如果启用了 thinking 且系统消息中不存在 thinking 标签，则注入
-			if thinkingPrefix != "" && !hasThinkingTags(systemContent) {
-				systemContent = thinkingPrefix + "\n" + systemContent
-				logger.Debug("已注入 thinking 标签到系统消息",
-					logger.String("prefix", thinkingPrefix))
-			}
-
-			userMsg := types.HistoryUserMessage{}
-			userMsg.UserInputMessage.Content = systemContent
-			userMsg.UserInputMessage.ModelId = modelId
-			userMsg.UserInputMessage.Origin = "AI_EDITOR" // v0.4兼容性：固定使用AI_EDITOR
-			history = append(history, userMsg)
-
-			assistantMsg := types.HistoryAssistantMessage{}
-			assistantMsg.AssistantResponseMessage.Content = "OK"
-			assistantMsg.AssistantResponseMessage.ToolUses = nil
-			history = append(history, assistantMsg)
-		} else if thinkingPrefix != "" {
-			// 没有系统消息但有 thinking 配置，插入新的系统消息（借鉴 kiro.rs）
-			userMsg := types.HistoryUserMessage{}
-			userMsg.UserInputMessage.Content = thinkingPrefix
-			userMsg.UserInputMessage.ModelId = modelId
-			userMsg.UserInputMessage.Origin = "AI_EDITOR"
-			history = append(history, userMsg)
-
-			assistantMsg := types.HistoryAssistantMessage{}
-			assistantMsg.AssistantResponseMessage.Content = "OK"
-			assistantMsg.AssistantResponseMessage.ToolUses = nil
-			history = append(history, assistantMsg)
-
-			logger.Debug("已插入 thinking 标签作为系统消息",
+		// 注入 thinking 标签到系统消息最前面（借鉴 kiro.rs）
+		// 如果启用了 thinking 且系统消息中不存在 thinking 标签，则注入
+		if thinkingPrefix != "" && !hasThinkingTags(systemContent) {
+			systemContent = strings.TrimSpace(thinkingPrefix + "\n" + systemContent)
+			logger.Debug("已注入 thinking 标签到系统消息",
 				logger.String("prefix", thinkingPrefix))
 		}
 
+		if promptMode == SystemPromptModeHistory && systemContent != "" {
+			history = append(history, syntheticSystemTurn(systemContent, modelId)...)
+		}
+
+		reminders := newReminderDeduper()
+
 		// 然后处理常规消息历史 (修复配对逻辑：合并连续user消息，然后与assistant配对)
 		// 关键修复：收集连续的user消息并合并，遇到assistant时配对添加
 		var userMessagesBuffer []types.AnthropicRequestMessage // 累积连续的user消息
@@ -430,46 +339,9 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			if msg.Role == "assistant" {
 				// 遇到assistant，处理之前累积的user消息
 				if len(userMessagesBuffer) > 0 {
-					// 合并所有累积的user消息
-					mergedUserMsg := types.HistoryUserMessage{}
-					var contentParts []string
-					var allImages []types.CodeWhispererImage
-					var allToolResults []types.ToolResult
-
-					for _, userMsg := range userMessagesBuffer {
-						// 处理每个user消息的内容和图片
-						messageContent, messageImages, err := processMessageContent(userMsg.Content)
-						if err == nil && messageContent != "" {
-							contentParts = append(contentParts, messageContent)
-							if len(messageImages) > 0 {
-								allImages = append(allImages, messageImages...)
-							}
-						}
-
-						// 收集工具结果
-						toolResults := extractToolResultsFromMessage(userMsg.Content)
-						if len(toolResults) > 0 {
-							allToolResults = append(allToolResults, toolResults...)
-						}
-					}
-
-					// 设置合并后的内容
-					mergedUserMsg.UserInputMessage.Content = strings.Join(contentParts, "\n")
-					if len(allImages) > 0 {
-						mergedUserMsg.UserInputMessage.Images = allImages
-					}
-					if len(allToolResults) > 0 {
-						mergedUserMsg.UserInputMessage.UserInputMessageContext.ToolResults = allToolResults
-						// 如果历史用户消息包含工具结果，也将 content 设置为空字符串
-						mergedUserMsg.UserInputMessage.Content = ""
-						// logger.Debug("历史用户消息包含工具结果",
-						// 	logger.Int("merged_messages", len(userMessagesBuffer)),
-						// 	logger.Int("tool_results_count", len(allToolResults)))
-					}
-
-					mergedUserMsg.UserInputMessage.ModelId = modelId
-					mergedUserMsg.UserInputMessage.Origin = "AI_EDITOR"
-					history = append(history, mergedUserMsg)
+					input := mergeUserInputs(userMessagesBuffer)
+					input.text = reminders.apply(input.text)
+					history = append(history, historyUserMessage(input, modelId))
 
 					// 清空缓冲区
 					userMessagesBuffer = nil
@@ -484,8 +356,31 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 					assistantMsg.AssistantResponseMessage.Content = ""
 				}
 
+				// web_search 模拟的搜索结果以文本形式保留在历史中
+				searchText, hasText := webSearchHistoryText(msg.Content)
+				if searchText != "" {
+					if hasText {
+						assistantMsg.AssistantResponseMessage.Content = searchText + "\n\n" + assistantMsg.AssistantResponseMessage.Content
+					} else {
+						assistantMsg.AssistantResponseMessage.Content = searchText
+					}
+				}
+
+				// 按 THINKING_HISTORY_MODE 保留或移除 thinking 块
+				if thinking, hasText := extractHistoryThinking(msg.Content); thinking != "" {
+					if hasText || searchText != "" {
+						assistantMsg.AssistantResponseMessage.Content = thinking + "\n\n" + assistantMsg.AssistantResponseMessage.Content
+					} else {
+						// 只有 thinking 与工具调用时不使用占位文本
+						assistantMsg.AssistantResponseMessage.Content = thinking
+					}
+				}
+
 				// 提取助手消息中的工具调用
 				toolUses := extractToolUsesFromMessage(msg.Content)
+				for i := range toolUses {
+					toolUses[i].Name = UpstreamToolName(toolUses[i].Name)
+				}
 				if len(toolUses) > 0 {
 					assistantMsg.AssistantResponseMessage.ToolUses = toolUses
 				} else {
@@ -499,38 +394,9 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		// 处理结尾的孤立user消息（理论上不应该存在，因为最后一条已经是current message）
 		// 修复：合并孤立的user消息并添加占位assistant回复以保持配对
 		if len(userMessagesBuffer) > 0 {
-			// 合并所有孤立的user消息
-			mergedUserMsg := types.HistoryUserMessage{}
-			var contentParts []string
-			var allImages []types.CodeWhispererImage
-			var allToolResults []types.ToolResult
-
-			for _, userMsg := range userMessagesBuffer {
-				messageContent, messageImages, err := processMessageContent(userMsg.Content)
-				if err == nil && messageContent != "" {
-					contentParts = append(contentParts, messageContent)
-					if len(messageImages) > 0 {
-						allImages = append(allImages, messageImages...)
-					}
-				}
-				toolResults := extractToolResultsFromMessage(userMsg.Content)
-				if len(toolResults) > 0 {
-					allToolResults = append(allToolResults, toolResults...)
-				}
-			}
-
-			mergedUserMsg.UserInputMessage.Content = strings.Join(contentParts, "\n")
-			if len(allImages) > 0 {
-				mergedUserMsg.UserInputMessage.Images = allImages
-			}
-			if len(allToolResults) > 0 {
-				mergedUserMsg.UserInputMessage.UserInputMessageContext.ToolResults = allToolResults
-				// 如果包含工具结果，将 content 设置为空字符串
-				mergedUserMsg.UserInputMessage.Content = ""
-			}
-			mergedUserMsg.UserInputMessage.ModelId = modelId
-			mergedUserMsg.UserInputMessage.Origin = "AI_EDITOR"
-			history = append(history, mergedUserMsg)
+			input := mergeUserInputs(userMessagesBuffer)
+			input.text = reminders.apply(input.text)
+			history = append(history, historyUserMessage(input, modelId))
 
 			// 添加占位的 assistant 回复以保持配对
 			assistantMsg := types.HistoryAssistantMessage{}
@@ -543,6 +409,10 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		}
 
 		cwReq.ConversationState.History = history
+
+		if promptMode == SystemPromptModePrepend && systemContent != "" {
+			prependSystemPrompt(&cwReq, systemContent)
+		}
 	}
 
 	// 处理 thinking 配置 (Claude 深度思考模式)
@@ -634,8 +504,8 @@ func extractToolUsesFromMessage(content any) []types.ToolUseEntry {
 							toolUse.Name = name
 						}
 
-						// 过滤不支持的工具：web_search (静默过滤)
-						if toolUse.Name == "web_search" || toolUse.Name == "websearch" {
+						// 未启用 web_search 模拟时静默过滤
+						if filterWebSearchToolUse(toolUse.Name) {
 							continue
 						}
 
@@ -667,8 +537,8 @@ func extractToolUsesFromMessage(content any) []types.ToolUseEntry {
 					toolUse.Name = *block.Name
 				}
 
-				// 过滤不支持的工具：web_search (静默过滤)
-				if toolUse.Name == "web_search" || toolUse.Name == "websearch" {
+				// 未启用 web_search 模拟时静默过滤
+				if filterWebSearchToolUse(toolUse.Name) {
 					continue
 				}
 
@@ -737,43 +607,12 @@ func isThinkingCompatibleModel(model string) bool {
 // validateToolChoiceForThinking 验证 thinking 模式下的 tool_choice 兼容性
 // 启用 thinking 时，tool_choice 只能为 auto 或 none
 func validateToolChoiceForThinking(req types.AnthropicRequest) error {
-	if req.ToolChoice == nil {
+	tc := ResolveToolChoice(req.ToolChoice)
+	if tc == nil {
 		return nil // 默认为 auto，兼容
 	}
-
-	// 检查 tool_choice 类型 - 处理 *types.ToolChoice 指针类型
-	if tc, ok := req.ToolChoice.(*types.ToolChoice); ok && tc != nil {
-		if tc.Type != "auto" && tc.Type != "none" && tc.Type != "" {
-			return fmt.Errorf("thinking 模式下 tool_choice 只能为 auto 或 none，当前为: %s", tc.Type)
-		}
-		return nil
+	if tc.Type != "auto" && tc.Type != "none" && tc.Type != "" {
+		return fmt.Errorf("thinking 模式下 tool_choice 只能为 auto 或 none，当前为: %s", tc.Type)
 	}
-
-	// 检查 tool_choice 类型 - 处理 types.ToolChoice 值类型
-	if tc, ok := req.ToolChoice.(types.ToolChoice); ok {
-		if tc.Type != "auto" && tc.Type != "none" && tc.Type != "" {
-			return fmt.Errorf("thinking 模式下 tool_choice 只能为 auto 或 none，当前为: %s", tc.Type)
-		}
-		return nil
-	}
-
-	// 检查 tool_choice 类型 - 处理 map[string]any 类型
-	if tcMap, ok := req.ToolChoice.(map[string]any); ok {
-		if tcType, exists := tcMap["type"].(string); exists {
-			if tcType != "auto" && tcType != "none" && tcType != "" {
-				return fmt.Errorf("thinking 模式下 tool_choice 只能为 auto 或 none，当前为: %s", tcType)
-			}
-		}
-		return nil
-	}
-
-	// 检查 tool_choice 类型 - 处理字符串类型 (如 "auto", "none")
-	if tcStr, ok := req.ToolChoice.(string); ok {
-		if tcStr != "auto" && tcStr != "none" && tcStr != "" {
-			return fmt.Errorf("thinking 模式下 tool_choice 只能为 auto 或 none，当前为: %s", tcStr)
-		}
-		return nil
-	}
-
 	return nil
 }
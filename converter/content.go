@@ -23,8 +23,21 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 
 	case []any:
 		// 内容块数组
+		webSearchQueries := make(map[string]string) // server_tool_use id -> 查询词
 		for i, item := range v {
 			if block, ok := item.(map[string]any); ok {
+				// web_search 服务端工具块：上游无对应结构，还原为文本
+				switch block["type"] {
+				case "server_tool_use":
+					id, query := serverToolUseQuery(block)
+					webSearchQueries[id] = query
+					continue
+				case "web_search_tool_result":
+					id, _ := block["tool_use_id"].(string)
+					textParts = append(textParts, wrapHistoryBlock(renderWebSearchResult(webSearchQueries[id], block["content"])))
+					continue
+				}
+
 				contentBlock, err := parseContentBlock(block)
 				if err != nil {
 					logger.Warn("解析内容块失败，跳过", logger.Err(err), logger.Int("index", i))
@@ -53,15 +66,7 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 						}
 					}
 				case "tool_result":
-					// 处理工具结果，支持复杂的内容结构
-					if contentBlock.Content != nil {
-						parsedContent := utils.ParseToolResultContent(contentBlock.Content)
-						// 如果内容为空，提供默认值
-						if parsedContent == "" {
-							parsedContent = "Tool executed successfully"
-						}
-						textParts = append(textParts, parsedContent)
-					}
+					// 工具结果由 extractToolResultsFromMessage 以 ToolResults 结构携带，不计入文本
 				}
 			} else {
 				logger.Warn("内容块不是map[string]any类型",
@@ -94,15 +99,7 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 					}
 				}
 			case "tool_result":
-				// 处理工具结果，支持复杂的内容结构
-				if block.Content != nil {
-					parsedContent := utils.ParseToolResultContent(block.Content)
-					// 如果内容为空，提供默认值
-					if parsedContent == "" {
-						parsedContent = "Tool executed successfully"
-					}
-					textParts = append(textParts, parsedContent)
-				}
+				// 工具结果由 extractToolResultsFromMessage 以 ToolResults 结构携带，不计入文本
 			}
 		}
 
@@ -111,7 +108,8 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 		return "", nil, fmt.Errorf("不支持的内容类型: %T", content)
 	}
 
-	result := strings.Join(textParts, "")
+	// 多个文本块之间保留换行，避免相邻文本粘连
+	result := strings.Join(textParts, "\n")
 
 	// 保留关键调试信息用于问题定位
 	if result == "" && len(images) == 0 {
@@ -189,6 +187,19 @@ func parseContentBlock(block map[string]any) (types.ContentBlock, error) {
 			contentBlock.IsError = &isError
 		}
 
+	case "thinking":
+		if thinking, ok := block["thinking"].(string); ok {
+			contentBlock.Thinking = &thinking
+		}
+		if signature, ok := block["signature"].(string); ok {
+			contentBlock.Signature = &signature
+		}
+
+	case "redacted_thinking":
+		if data, ok := block["data"].(string); ok {
+			contentBlock.Data = &data
+		}
+
 	case "tool_use":
 		if id, ok := block["id"].(string); ok {
 			contentBlock.ID = &id
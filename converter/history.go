@@ -0,0 +1,131 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// 用户消息无损转换：文本按原顺序保留（含与工具结果同时发送的文本），
+// 工具结果只通过 ToolResults 结构携带（保留 is_error 与原始内容，空结果不替换为占位文本），
+// 工具结果中的图片随所在用户消息的 images 发送
+
+// userInput 一条（或一组连续）用户消息转换后的内容
+type userInput struct {
+	text        string
+	images      []types.CodeWhispererImage
+	toolResults []types.ToolResult
+}
+
+// userInputFromContent 转换单条用户消息内容
+func userInputFromContent(content any) (userInput, error) {
+	text, images, err := processMessageContent(content)
+	if err != nil {
+		return userInput{}, err
+	}
+	toolResults, resultImages := extractToolResultsFromMessage(content)
+	return userInput{
+		text:        text,
+		images:      append(images, resultImages...),
+		toolResults: toolResults,
+	}, nil
+}
+
+// mergeUserInputs 合并连续的用户消息（上游要求 user/assistant 交替），按原顺序保留全部文本、图片与工具结果
+func mergeUserInputs(messages []types.AnthropicRequestMessage) userInput {
+	var merged userInput
+	var textParts []string
+	for i, msg := range messages {
+		input, err := userInputFromContent(msg.Content)
+		if err != nil {
+			logger.Warn("历史用户消息内容处理失败，跳过文本与图片", logger.Err(err), logger.Int("index", i))
+			input.toolResults, _ = extractToolResultsFromMessage(msg.Content)
+		}
+		if input.text != "" {
+			textParts = append(textParts, input.text)
+		}
+		merged.images = append(merged.images, input.images...)
+		merged.toolResults = append(merged.toolResults, input.toolResults...)
+	}
+	merged.text = strings.Join(textParts, "\n")
+	return merged
+}
+
+// historyUserMessage 生成历史中的用户消息
+func historyUserMessage(input userInput, modelId string) types.HistoryUserMessage {
+	msg := types.HistoryUserMessage{}
+	msg.UserInputMessage.Content = input.text
+	msg.UserInputMessage.ModelId = modelId
+	msg.UserInputMessage.Origin = "AI_EDITOR"
+	if len(input.images) > 0 {
+		msg.UserInputMessage.Images = input.images
+	}
+	if len(input.toolResults) > 0 {
+		msg.UserInputMessage.UserInputMessageContext.ToolResults = input.toolResults
+	}
+	return msg
+}
+
+// toolResultContent 将 tool_result 的 content 转为上游格式 [{"text": ...}]，图片提取为独立图片并以占位文本标注位置
+func toolResultContent(content any) ([]map[string]any, []types.CodeWhispererImage) {
+	var items []any
+	switch c := content.(type) {
+	case nil:
+		return []map[string]any{{"text": ""}}, nil
+	case string:
+		return []map[string]any{{"text": c}}, nil
+	case []any:
+		items = c
+	case map[string]any:
+		items = []any{c}
+	case []types.ContentBlock:
+		for _, block := range c {
+			if b, err := utils.SafeMarshal(block); err == nil {
+				var m map[string]any
+				if utils.SafeUnmarshal(b, &m) == nil {
+					items = append(items, m)
+				}
+			}
+		}
+	default:
+		return []map[string]any{{"text": fmt.Sprintf("%v", c)}}, nil
+	}
+
+	result := make([]map[string]any, 0, len(items))
+	var images []types.CodeWhispererImage
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			result = append(result, map[string]any{"text": v})
+		case map[string]any:
+			switch v["type"] {
+			case "image", "image_url":
+				block, err := parseContentBlock(v)
+				if err == nil && block.Source != nil && utils.ValidateImageContent(block.Source) == nil {
+					if image := utils.CreateCodeWhispererImage(block.Source); image != nil {
+						images = append(images, *image)
+						result = append(result, map[string]any{"text": fmt.Sprintf("[image: %s]", block.Source.MediaType)})
+						continue
+					}
+				}
+				logger.Warn("工具结果中的图片无效，已跳过", logger.Err(err))
+				result = append(result, map[string]any{"text": "[image omitted]"})
+			default:
+				if text, ok := v["text"].(string); ok {
+					result = append(result, map[string]any{"text": text})
+				} else if b, err := utils.SafeMarshal(v); err == nil {
+					result = append(result, map[string]any{"text": string(b)})
+				}
+			}
+		default:
+			result = append(result, map[string]any{"text": fmt.Sprintf("%v", v)})
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, map[string]any{"text": ""})
+	}
+	return result, images
+}
@@ -0,0 +1,84 @@
+package converter
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+var updateHistoryGolden = flag.Bool("update", false, "重新生成 testdata/history 下的 golden 文件")
+
+// historyGolden 转换结果中参与比较的部分（会话 ID 等随机字段不比较）
+type historyGolden struct {
+	History        []any `json:"history"`
+	CurrentMessage any   `json:"currentMessage"`
+}
+
+func TestHistoryGoldenCorpus(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "history", "*.json"))
+	if err != nil {
+		t.Fatalf("Glob() error = %v", err)
+	}
+
+	count := 0
+	for _, path := range fixtures {
+		if strings.HasSuffix(path, ".golden.json") {
+			continue
+		}
+		count++
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile() error = %v", err)
+			}
+			var req types.AnthropicRequest
+			if err := json.Unmarshal(raw, &req); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+			cwReq, err := BuildCodeWhispererRequest(req, c)
+			if err != nil {
+				t.Fatalf("BuildCodeWhispererRequest() error = %v", err)
+			}
+
+			out := historyGolden{
+				History:        cwReq.ConversationState.History,
+				CurrentMessage: cwReq.ConversationState.CurrentMessage,
+			}
+			got, err := json.MarshalIndent(out, "", "  ")
+			if err != nil {
+				t.Fatalf("MarshalIndent() error = %v", err)
+			}
+			got = append(got, '\n')
+
+			goldenPath := filepath.Join("testdata", "history", name+".golden.json")
+			if *updateHistoryGolden {
+				if err := os.WriteFile(goldenPath, got, 0o644); err != nil {
+					t.Fatalf("WriteFile() error = %v", err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("缺少 golden 文件 %s（使用 -update 生成）: %v", goldenPath, err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("%s 与 golden 不一致:\ngot:\n%s\nwant:\n%s", name, got, want)
+			}
+		})
+	}
+	if count == 0 {
+		t.Fatal("testdata/history 下没有样本")
+	}
+}
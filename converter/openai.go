@@ -70,9 +70,27 @@ func ConvertOpenAIToAnthropic(openaiReq types.OpenAIRequest) types.AnthropicRequ
 		anthropicReq.ToolChoice = convertOpenAIToolChoiceToAnthropic(openaiReq.ToolChoice)
 	}
 
+	// parallel_tool_calls=false 对应 disable_parallel_tool_use
+	if openaiReq.ParallelToolCalls != nil && !*openaiReq.ParallelToolCalls {
+		tc := ResolveToolChoice(anthropicReq.ToolChoice)
+		if tc == nil {
+			tc = &types.ToolChoice{Type: "auto"}
+		}
+		tc.DisableParallelToolUse = true
+		anthropicReq.ToolChoice = tc
+	}
+
+	// response_format=json_schema 转为强制调用的结构化输出工具
+	applyStructuredOutput(&anthropicReq, ResolveStructuredOutput(openaiReq.ResponseFormat))
+
 	return anthropicReq
 }
 
+// thinkingTagText OpenAI 协议没有 thinking 字段，与流式响应一致以 <thinking> 标签透出推理内容
+func thinkingTagText(thinking string) string {
+	return "<thinking>\n" + thinking + "\n</thinking>\n\n"
+}
+
 // ConvertAnthropicToOpenAI 将Anthropic响应转换为OpenAI响应
 func ConvertAnthropicToOpenAI(anthropicResp map[string]any, model string, messageId string) types.OpenAIResponse {
 	content := ""
@@ -91,6 +109,10 @@ func ConvertAnthropicToOpenAI(anthropicResp map[string]any, model string, messag
 						if text, ok := textBlock["text"].(string); ok {
 							textParts = append(textParts, text)
 						}
+					case "thinking":
+						if thinking, ok := textBlock["thinking"].(string); ok && thinking != "" {
+							textParts = append(textParts, thinkingTagText(thinking))
+						}
 					case "tool_use":
 						finishReason = "tool_calls"
 						if toolUseId, ok := textBlock["id"].(string); ok {
@@ -124,6 +146,10 @@ func ConvertAnthropicToOpenAI(anthropicResp map[string]any, model string, messag
 					if text, ok := textBlock["text"].(string); ok {
 						textParts = append(textParts, text)
 					}
+				case "thinking":
+					if thinking, ok := textBlock["thinking"].(string); ok && thinking != "" {
+						textParts = append(textParts, thinkingTagText(thinking))
+					}
 				case "tool_use":
 					finishReason = "tool_calls"
 					if toolUseId, ok := textBlock["id"].(string); ok {
@@ -180,6 +180,22 @@ func TestConvertAnthropicToOpenAI_MultipleContentBlocks(t *testing.T) {
 	assert.Contains(t, openaiResp.Choices[0].Message.Content, "Second part")
 }
 
+func TestConvertAnthropicToOpenAI_ThinkingBlocks(t *testing.T) {
+	anthropicResp := map[string]any{
+		"content": []map[string]any{
+			{"type": "thinking", "thinking": "先分析问题", "signature": "sig"},
+			{"type": "redacted_thinking", "data": "ZW5jcnlwdGVk"},
+			{"type": "text", "text": "答案是42"},
+		},
+		"stop_reason": "end_turn",
+	}
+
+	result := ConvertAnthropicToOpenAI(anthropicResp, "claude-sonnet-4", "msg_123")
+
+	// 与流式响应一致以 <thinking> 标签透出推理内容，加密推理不透出
+	assert.Equal(t, "<thinking>\n先分析问题\n</thinking>\n\n答案是42", result.Choices[0].Message.Content)
+}
+
 func TestConvertAnthropicToOpenAI_StopReasonMapping(t *testing.T) {
 	tests := []struct {
 		name                 string
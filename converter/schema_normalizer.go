@@ -0,0 +1,553 @@
+package converter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/utils"
+)
+
+// 工具 input_schema 规范化：上游只接受 JSON Schema 的常用子集，
+// MCP 等客户端生成的 $ref/$defs、anyOf/oneOf、format、additionalProperties、超大 enum 会被拒绝，
+// 发送前统一内联引用、简化联合类型、去除不兼容关键字，并限制嵌套深度与体积
+
+// 规范化修改类型，用于日志与 X-Tool-Schema-Normalized 响应头
+const (
+	schemaChangeRef      = "ref"
+	schemaChangeUnion    = "union"
+	schemaChangeKeywords = "keywords"
+	schemaChangeEnum     = "enum"
+	schemaChangeDepth    = "depth"
+	schemaChangeSize     = "size"
+)
+
+// 与配置无关的内部上限：共享 $defs 被多处引用时逐层内联会指数膨胀，
+// 即使 TOOL_SCHEMA_MAX_DEPTH=0 也需限制展开规模
+const (
+	schemaHardMaxDepth = 32    // 嵌套深度上限
+	schemaMaxNodes     = 10000 // 规范化处理的节点数上限，超出后不再内联 $ref
+)
+
+// unsupportedSchemaKeywords 上游不支持、直接移除的关键字
+var unsupportedSchemaKeywords = []string{
+	"$schema", "$id", "$comment", "$anchor", "strict", "nullable",
+	"additionalProperties", "patternProperties", "unevaluatedProperties", "unevaluatedItems",
+	"propertyNames", "dependentRequired", "dependentSchemas", "dependencies",
+	"if", "then", "else", "not", "examples", "contentEncoding", "contentMediaType",
+	"readOnly", "writeOnly", "deprecated",
+}
+
+// NormalizeToolSchema 返回规范化后的 schema 副本与修改类型列表（未修改时为空）
+func NormalizeToolSchema(schema map[string]any) (map[string]any, []string) {
+	n := &schemaNormalizer{
+		root:     schema,
+		changes:  make(map[string]bool),
+		maxDepth: config.ToolSchemaMaxDepth,
+		maxEnum:  config.ToolSchemaMaxEnumValues,
+	}
+
+	normalized := n.normalize(deepCopySchema(schema), 0, nil)
+	ensureObjectSchema(normalized)
+	normalized = n.capSize(schema, normalized)
+
+	changes := make([]string, 0, len(n.changes))
+	for change := range n.changes {
+		changes = append(changes, change)
+	}
+	sort.Strings(changes)
+	return normalized, changes
+}
+
+type schemaNormalizer struct {
+	root     map[string]any // 原始根 schema，用于解析 $ref
+	changes  map[string]bool
+	maxDepth int
+	maxEnum  int
+	nodes    int // 已处理的节点数
+}
+
+// normalize 递归规范化单个 schema；refStack 用于检测循环引用
+func (n *schemaNormalizer) normalize(schema map[string]any, depth int, refStack []string) map[string]any {
+	if schema == nil {
+		return map[string]any{}
+	}
+	n.nodes++
+
+	// 内联 $ref，兄弟关键字覆盖引用目标
+	if ref, ok := schema["$ref"].(string); ok {
+		delete(schema, "$ref")
+		n.changes[schemaChangeRef] = true
+		target, found := n.resolveRef(ref)
+		switch {
+		case !found:
+			appendSchemaNote(schema, "Unresolved reference "+ref+".")
+		case containsString(refStack, ref):
+			// 循环引用：截断为无结构对象
+			if _, ok := schema["type"]; !ok {
+				schema["type"] = "object"
+			}
+			appendSchemaNote(schema, "Recursive reference "+ref+".")
+		case n.nodes >= schemaMaxNodes:
+			// 展开规模超出上限：同样截断为无结构对象
+			if _, ok := schema["type"]; !ok {
+				schema["type"] = "object"
+			}
+			appendSchemaNote(schema, "Reference "+ref+" omitted, schema too large.")
+			n.changes[schemaChangeSize] = true
+		default:
+			inlined := deepCopySchema(target)
+			for k, v := range schema {
+				inlined[k] = v
+			}
+			return n.normalize(inlined, depth, append(refStack[:len(refStack):len(refStack)], ref))
+		}
+	}
+	for _, key := range []string{"$defs", "definitions"} {
+		if _, ok := schema[key]; ok {
+			delete(schema, key)
+			n.changes[schemaChangeRef] = true
+		}
+	}
+
+	for _, key := range unsupportedSchemaKeywords {
+		if _, ok := schema[key]; ok {
+			delete(schema, key)
+			n.changes[schemaChangeKeywords] = true
+		}
+	}
+	if format, ok := schema["format"].(string); ok {
+		delete(schema, "format")
+		appendSchemaNote(schema, fmt.Sprintf("Format: %s.", format))
+		n.changes[schemaChangeKeywords] = true
+	}
+	if c, ok := schema["const"]; ok {
+		delete(schema, "const")
+		schema["enum"] = []any{c}
+		n.changes[schemaChangeKeywords] = true
+	}
+
+	n.simplifyType(schema)
+	n.mergeAllOf(schema, depth, refStack)
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if variants, ok := schema[key].([]any); ok {
+			delete(schema, key)
+			n.changes[schemaChangeUnion] = true
+			n.mergeUnion(schema, variants, depth, refStack)
+		}
+	}
+
+	n.capEnum(schema)
+
+	// 超过最大深度：保留类型与描述，去除嵌套结构
+	maxDepth := n.maxDepth
+	if maxDepth <= 0 || maxDepth > schemaHardMaxDepth {
+		maxDepth = schemaHardMaxDepth
+	}
+	if depth >= maxDepth {
+		if _, hasProps := schema["properties"]; hasProps || schema["items"] != nil {
+			delete(schema, "properties")
+			delete(schema, "required")
+			delete(schema, "items")
+			n.changes[schemaChangeDepth] = true
+		}
+		return schema
+	}
+
+	if props, ok := schema["properties"].(map[string]any); ok {
+		for name, prop := range props {
+			propSchema, _ := prop.(map[string]any)
+			props[name] = n.normalize(propSchema, depth+1, refStack)
+		}
+	}
+	switch items := schema["items"].(type) {
+	case map[string]any:
+		schema["items"] = n.normalize(items, depth+1, refStack)
+	case []any:
+		// 元组形式：取第一个元素的 schema
+		n.changes[schemaChangeUnion] = true
+		first := map[string]any{}
+		if len(items) > 0 {
+			first, _ = items[0].(map[string]any)
+		}
+		schema["items"] = n.normalize(first, depth+1, refStack)
+	}
+	if prefix, ok := schema["prefixItems"].([]any); ok {
+		delete(schema, "prefixItems")
+		n.changes[schemaChangeUnion] = true
+		if _, hasItems := schema["items"]; !hasItems && len(prefix) > 0 {
+			first, _ := prefix[0].(map[string]any)
+			schema["items"] = n.normalize(first, depth+1, refStack)
+		}
+	}
+	return schema
+}
+
+// simplifyType 将 type 数组化简为单一类型（去除 null，多类型时保留第一个并记入描述）
+func (n *schemaNormalizer) simplifyType(schema map[string]any) {
+	types, ok := schema["type"].([]any)
+	if !ok {
+		return
+	}
+	n.changes[schemaChangeUnion] = true
+	var names []string
+	for _, t := range types {
+		if s, ok := t.(string); ok && s != "null" {
+			names = append(names, s)
+		}
+	}
+	switch len(names) {
+	case 0:
+		delete(schema, "type")
+	case 1:
+		schema["type"] = names[0]
+	default:
+		schema["type"] = names[0]
+		appendSchemaNote(schema, "Accepts: "+strings.Join(names, ", ")+".")
+	}
+}
+
+// mergeAllOf 将 allOf 合并进父 schema（properties 合并，required 取并集）
+func (n *schemaNormalizer) mergeAllOf(schema map[string]any, depth int, refStack []string) {
+	parts, ok := schema["allOf"].([]any)
+	if !ok {
+		return
+	}
+	delete(schema, "allOf")
+	n.changes[schemaChangeUnion] = true
+	for _, part := range parts {
+		partSchema, ok := part.(map[string]any)
+		if !ok {
+			continue
+		}
+		mergeSchemaInto(schema, n.normalize(deepCopySchema(partSchema), depth, refStack), true)
+	}
+}
+
+// mergeUnion 化简 anyOf/oneOf：去除 null 变体；
+// 全部为对象时合并 properties（required 取交集），同类基本类型合并 enum，否则取第一个变体
+func (n *schemaNormalizer) mergeUnion(schema map[string]any, variants []any, depth int, refStack []string) {
+	var schemas []map[string]any
+	for _, v := range variants {
+		vs, ok := v.(map[string]any)
+		if !ok {
+			continue
+		}
+		vs = n.normalize(deepCopySchema(vs), depth, refStack)
+		if vs["type"] == "null" {
+			continue
+		}
+		schemas = append(schemas, vs)
+	}
+	if len(schemas) == 0 {
+		return
+	}
+	if len(schemas) == 1 {
+		mergeSchemaInto(schema, schemas[0], false)
+		return
+	}
+
+	kinds := make([]string, 0, len(schemas))
+	seen := make(map[string]bool)
+	for _, vs := range schemas {
+		kind, _ := vs["type"].(string)
+		if kind == "" {
+			if _, ok := vs["properties"]; ok {
+				kind = "object"
+			}
+		}
+		if !seen[kind] {
+			seen[kind] = true
+			kinds = append(kinds, kind)
+		}
+	}
+
+	if len(kinds) == 1 && kinds[0] == "object" {
+		merged := map[string]any{"type": "object", "properties": map[string]any{}}
+		var required []any
+		for i, vs := range schemas {
+			if props, ok := vs["properties"].(map[string]any); ok {
+				for name, prop := range props {
+					if _, exists := merged["properties"].(map[string]any)[name]; !exists {
+						merged["properties"].(map[string]any)[name] = prop
+					}
+				}
+			}
+			req, _ := vs["required"].([]any)
+			if i == 0 {
+				required = req
+			} else {
+				required = intersectRequired(required, req)
+			}
+		}
+		if len(required) > 0 {
+			merged["required"] = required
+		}
+		mergeSchemaInto(schema, merged, false)
+		return
+	}
+
+	if len(kinds) == 1 && kinds[0] != "" {
+		merged := map[string]any{"type": kinds[0]}
+		var enum []any
+		allEnum := true
+		for _, vs := range schemas {
+			values, ok := vs["enum"].([]any)
+			if !ok {
+				allEnum = false
+				break
+			}
+			enum = append(enum, values...)
+		}
+		if allEnum {
+			merged["enum"] = enum
+		}
+		mergeSchemaInto(schema, merged, false)
+		return
+	}
+
+	mergeSchemaInto(schema, schemas[0], false)
+	if names := strings.Trim(strings.Join(kinds, ", "), ", "); names != "" {
+		appendSchemaNote(schema, "Accepts: "+names+".")
+	}
+}
+
+// capEnum 截断超大 enum
+func (n *schemaNormalizer) capEnum(schema map[string]any) {
+	enum, ok := schema["enum"].([]any)
+	if !ok || n.maxEnum <= 0 || len(enum) <= n.maxEnum {
+		return
+	}
+	schema["enum"] = enum[:n.maxEnum]
+	appendSchemaNote(schema, fmt.Sprintf("Only the first %d of %d allowed values are listed.", n.maxEnum, len(enum)))
+	n.changes[schemaChangeEnum] = true
+}
+
+// capSize 序列化体积超过上限时，依次去除嵌套描述、降低嵌套深度、去除属性描述
+func (n *schemaNormalizer) capSize(original, normalized map[string]any) map[string]any {
+	maxBytes := config.ToolSchemaMaxBytes
+	if maxBytes <= 0 || schemaSize(normalized) <= maxBytes {
+		return normalized
+	}
+	n.changes[schemaChangeSize] = true
+
+	stripDescriptions(normalized, 0, 1)
+	if schemaSize(normalized) <= maxBytes {
+		return normalized
+	}
+
+	depth := n.maxDepth
+	if depth <= 0 {
+		depth = schemaDepth(normalized)
+	}
+	for depth > 1 {
+		depth--
+		retry := &schemaNormalizer{root: original, changes: make(map[string]bool), maxDepth: depth, maxEnum: n.maxEnum}
+		normalized = retry.normalize(deepCopySchema(original), 0, nil)
+		ensureObjectSchema(normalized)
+		stripDescriptions(normalized, 0, 1)
+		if schemaSize(normalized) <= maxBytes {
+			break
+		}
+	}
+	n.changes[schemaChangeDepth] = true
+	if schemaSize(normalized) > maxBytes {
+		stripDescriptions(normalized, 0, 0)
+	}
+	return normalized
+}
+
+// resolveRef 解析本地 JSON Pointer 引用（#、#/$defs/X、#/definitions/X 等）
+func (n *schemaNormalizer) resolveRef(ref string) (map[string]any, bool) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+	var node any = n.root
+	for _, part := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		node = m[strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")]
+	}
+	resolved, ok := node.(map[string]any)
+	return resolved, ok
+}
+
+// mergeSchemaInto 将 src 合并进 dst；override 为 false 时 dst 已有的关键字优先
+func mergeSchemaInto(dst, src map[string]any, override bool) {
+	for k, v := range src {
+		switch k {
+		case "properties":
+			props, _ := dst["properties"].(map[string]any)
+			if props == nil {
+				props = make(map[string]any)
+			}
+			if srcProps, ok := v.(map[string]any); ok {
+				for name, prop := range srcProps {
+					if _, exists := props[name]; override || !exists {
+						props[name] = prop
+					}
+				}
+			}
+			dst["properties"] = props
+		case "required":
+			existing, _ := dst["required"].([]any)
+			for _, r := range asAnySlice(v) {
+				if !containsAny(existing, r) {
+					existing = append(existing, r)
+				}
+			}
+			dst["required"] = existing
+		case "description":
+			if d, ok := dst["description"].(string); ok && d != "" {
+				if s, _ := v.(string); s != "" && s != d && !strings.Contains(d, s) {
+					dst["description"] = d + " " + s
+				}
+				continue
+			}
+			dst[k] = v
+		default:
+			if _, exists := dst[k]; override || !exists {
+				dst[k] = v
+			}
+		}
+	}
+}
+
+// ensureObjectSchema 顶层 schema 必须为带 properties 的 object
+func ensureObjectSchema(schema map[string]any) {
+	if _, ok := schema["type"]; !ok {
+		schema["type"] = "object"
+	}
+	if _, ok := schema["properties"].(map[string]any); !ok && schema["type"] == "object" {
+		schema["properties"] = map[string]any{}
+	}
+}
+
+// stripDescriptions 去除深度超过 keep 的 description（根 schema 深度为 0）
+func stripDescriptions(schema map[string]any, depth, keep int) {
+	if depth > keep {
+		delete(schema, "description")
+	}
+	if props, ok := schema["properties"].(map[string]any); ok {
+		for _, prop := range props {
+			if ps, ok := prop.(map[string]any); ok {
+				stripDescriptions(ps, depth+1, keep)
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		stripDescriptions(items, depth+1, keep)
+	}
+}
+
+func schemaDepth(schema map[string]any) int {
+	deepest := 0
+	if props, ok := schema["properties"].(map[string]any); ok {
+		for _, prop := range props {
+			if ps, ok := prop.(map[string]any); ok {
+				deepest = max(deepest, schemaDepth(ps))
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		deepest = max(deepest, schemaDepth(items))
+	}
+	return deepest + 1
+}
+
+func schemaSize(schema map[string]any) int {
+	b, err := utils.SafeMarshal(schema)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+func appendSchemaNote(schema map[string]any, note string) {
+	if d, ok := schema["description"].(string); ok && d != "" {
+		schema["description"] = d + " " + note
+		return
+	}
+	schema["description"] = note
+}
+
+// deepCopySchema 深拷贝 schema，避免修改客户端请求中的原始数据
+func deepCopySchema(schema map[string]any) map[string]any {
+	copied, _ := deepCopyJSONValue(schema).(map[string]any)
+	if copied == nil {
+		copied = make(map[string]any)
+	}
+	return copied
+}
+
+func deepCopyJSONValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(val))
+		for k, item := range val {
+			m[k] = deepCopyJSONValue(item)
+		}
+		return m
+	case []any:
+		s := make([]any, len(val))
+		for i, item := range val {
+			s[i] = deepCopyJSONValue(item)
+		}
+		return s
+	case []string:
+		s := make([]any, len(val))
+		for i, item := range val {
+			s[i] = item
+		}
+		return s
+	}
+	return v
+}
+
+func intersectRequired(a, b []any) []any {
+	var out []any
+	for _, r := range a {
+		if containsAny(b, r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func asAnySlice(v any) []any {
+	switch s := v.(type) {
+	case []any:
+		return s
+	case []string:
+		out := make([]any, len(s))
+		for i, item := range s {
+			out[i] = item
+		}
+		return out
+	}
+	return nil
+}
+
+func containsAny(values []any, v any) bool {
+	for _, item := range values {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, s string) bool {
+	for _, item := range values {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
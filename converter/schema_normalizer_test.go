@@ -0,0 +1,242 @@
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+func mustSchema(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(s), &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+	return schema
+}
+
+func schemaJSON(schema map[string]any) string {
+	b, _ := json.Marshal(schema)
+	return string(b)
+}
+
+func TestNormalizeToolSchema_Unchanged(t *testing.T) {
+	schema := mustSchema(t, `{"type":"object","properties":{"path":{"type":"string","description":"文件路径"}},"required":["path"]}`)
+	normalized, changes := NormalizeToolSchema(schema)
+	if len(changes) != 0 {
+		t.Errorf("changes = %v, want none", changes)
+	}
+	if !reflect.DeepEqual(normalized, schema) {
+		t.Errorf("normalized = %s", schemaJSON(normalized))
+	}
+}
+
+func TestNormalizeToolSchema_InlinesRefs(t *testing.T) {
+	schema := mustSchema(t, `{
+		"type": "object",
+		"properties": {"user": {"$ref": "#/$defs/User", "description": "用户"}},
+		"$defs": {"User": {"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}}
+	}`)
+	normalized, changes := NormalizeToolSchema(schema)
+
+	want := `{"properties":{"user":{"description":"用户","properties":{"name":{"type":"string"}},"required":["name"],"type":"object"}},"type":"object"}`
+	if got := schemaJSON(normalized); got != want {
+		t.Errorf("normalized = %s\nwant %s", got, want)
+	}
+	if !reflect.DeepEqual(changes, []string{schemaChangeRef}) {
+		t.Errorf("changes = %v", changes)
+	}
+	if _, ok := schema["$defs"]; !ok {
+		t.Error("原始 schema 不应被修改")
+	}
+}
+
+func TestNormalizeToolSchema_RecursiveRef(t *testing.T) {
+	schema := mustSchema(t, `{
+		"type": "object",
+		"properties": {"root": {"$ref": "#/definitions/Node"}},
+		"definitions": {"Node": {"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#/definitions/Node"}}}}}
+	}`)
+	normalized, _ := NormalizeToolSchema(schema)
+
+	got := schemaJSON(normalized)
+	if strings.Contains(got, `"$ref"`) || strings.Contains(got, `"definitions"`) {
+		t.Errorf("引用未完全内联: %s", got)
+	}
+	items := normalized["properties"].(map[string]any)["root"].(map[string]any)["properties"].(map[string]any)["children"].(map[string]any)["items"].(map[string]any)
+	if items["type"] != "object" || !strings.Contains(items["description"].(string), "Recursive reference") {
+		t.Errorf("循环引用应截断为对象: %s", schemaJSON(items))
+	}
+}
+
+func TestNormalizeToolSchema_SharedRefsBounded(t *testing.T) {
+	oldDepth, oldBytes := config.ToolSchemaMaxDepth, config.ToolSchemaMaxBytes
+	t.Cleanup(func() { config.ToolSchemaMaxDepth, config.ToolSchemaMaxBytes = oldDepth, oldBytes })
+	config.ToolSchemaMaxDepth, config.ToolSchemaMaxBytes = 0, 0
+
+	// 每层 10 个属性引用下一层定义，完全内联需要 10^12 个节点
+	defs := map[string]any{"L12": map[string]any{"type": "string"}}
+	for level := 0; level < 12; level++ {
+		props := map[string]any{}
+		for i := 0; i < 10; i++ {
+			props[fmt.Sprintf("p%d", i)] = map[string]any{"$ref": fmt.Sprintf("#/$defs/L%d", level+1)}
+		}
+		defs[fmt.Sprintf("L%d", level)] = map[string]any{"type": "object", "properties": props}
+	}
+	schema := map[string]any{"$ref": "#/$defs/L0", "$defs": defs}
+
+	normalized, changes := NormalizeToolSchema(schema)
+	got := schemaJSON(normalized)
+	if strings.Contains(got, `"$ref"`) || strings.Contains(got, `"$defs"`) {
+		t.Errorf("引用未完全处理")
+	}
+	if !strings.Contains(got, "schema too large") {
+		t.Errorf("超出展开上限的引用应截断")
+	}
+	if len(got) > 4<<20 {
+		t.Errorf("展开结果过大: %d bytes", len(got))
+	}
+	if !reflect.DeepEqual(changes, []string{schemaChangeRef, schemaChangeSize}) {
+		t.Errorf("changes = %v", changes)
+	}
+}
+
+func TestNormalizeToolSchema_SimplifiesUnions(t *testing.T) {
+	schema := mustSchema(t, `{
+		"type": "object",
+		"properties": {
+			"optional": {"anyOf": [{"type": "string"}, {"type": "null"}], "description": "可选"},
+			"nullable": {"type": ["integer", "null"]},
+			"mode": {"oneOf": [{"type": "string", "enum": ["a"]}, {"type": "string", "enum": ["b"]}]},
+			"target": {"anyOf": [
+				{"type": "object", "properties": {"id": {"type": "string"}}, "required": ["id"]},
+				{"type": "object", "properties": {"id": {"type": "string"}, "name": {"type": "string"}}, "required": ["id", "name"]}
+			]},
+			"mixed": {"anyOf": [{"type": "string"}, {"type": "number"}]},
+			"both": {"allOf": [
+				{"type": "object", "properties": {"a": {"type": "string"}}, "required": ["a"]},
+				{"properties": {"b": {"type": "string"}}, "required": ["b"]}
+			]}
+		}
+	}`)
+	normalized, changes := NormalizeToolSchema(schema)
+	props := normalized["properties"].(map[string]any)
+
+	cases := map[string]string{
+		"optional": `{"description":"可选","type":"string"}`,
+		"nullable": `{"type":"integer"}`,
+		"mode":     `{"enum":["a","b"],"type":"string"}`,
+		"target":   `{"properties":{"id":{"type":"string"},"name":{"type":"string"}},"required":["id"],"type":"object"}`,
+		"mixed":    `{"description":"Accepts: string, number.","type":"string"}`,
+		"both":     `{"properties":{"a":{"type":"string"},"b":{"type":"string"}},"required":["a","b"],"type":"object"}`,
+	}
+	for name, want := range cases {
+		if got := schemaJSON(props[name].(map[string]any)); got != want {
+			t.Errorf("%s = %s\nwant %s", name, got, want)
+		}
+	}
+	if !reflect.DeepEqual(changes, []string{schemaChangeUnion}) {
+		t.Errorf("changes = %v", changes)
+	}
+}
+
+func TestNormalizeToolSchema_DropsUnsupportedKeywords(t *testing.T) {
+	schema := mustSchema(t, `{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"type": "object",
+		"additionalProperties": false,
+		"properties": {
+			"when": {"type": "string", "format": "date-time"},
+			"kind": {"const": "file"},
+			"format": {"type": "string"}
+		}
+	}`)
+	normalized, changes := NormalizeToolSchema(schema)
+
+	want := `{"properties":{"format":{"type":"string"},"kind":{"enum":["file"]},"when":{"description":"Format: date-time.","type":"string"}},"type":"object"}`
+	if got := schemaJSON(normalized); got != want {
+		t.Errorf("normalized = %s\nwant %s", got, want)
+	}
+	if !reflect.DeepEqual(changes, []string{schemaChangeKeywords}) {
+		t.Errorf("changes = %v", changes)
+	}
+}
+
+func TestNormalizeToolSchema_CapsEnumDepthAndSize(t *testing.T) {
+	oldEnum, oldDepth, oldBytes := config.ToolSchemaMaxEnumValues, config.ToolSchemaMaxDepth, config.ToolSchemaMaxBytes
+	t.Cleanup(func() {
+		config.ToolSchemaMaxEnumValues, config.ToolSchemaMaxDepth, config.ToolSchemaMaxBytes = oldEnum, oldDepth, oldBytes
+	})
+	config.ToolSchemaMaxEnumValues, config.ToolSchemaMaxDepth, config.ToolSchemaMaxBytes = 2, 2, 0
+
+	schema := mustSchema(t, `{
+		"type": "object",
+		"properties": {
+			"color": {"type": "string", "enum": ["red", "green", "blue"]},
+			"a": {"type": "object", "properties": {"b": {"type": "object", "properties": {"c": {"type": "string"}}}}}
+		}
+	}`)
+	normalized, changes := NormalizeToolSchema(schema)
+	props := normalized["properties"].(map[string]any)
+
+	color := props["color"].(map[string]any)
+	if len(color["enum"].([]any)) != 2 || !strings.Contains(color["description"].(string), "first 2 of 3") {
+		t.Errorf("color = %s", schemaJSON(color))
+	}
+	b := props["a"].(map[string]any)["properties"].(map[string]any)["b"].(map[string]any)
+	if got := schemaJSON(b); got != `{"type":"object"}` {
+		t.Errorf("超出深度的 schema = %s", got)
+	}
+	if !reflect.DeepEqual(changes, []string{schemaChangeDepth, schemaChangeEnum}) {
+		t.Errorf("changes = %v", changes)
+	}
+
+	config.ToolSchemaMaxDepth, config.ToolSchemaMaxBytes = 0, 120
+	schema = mustSchema(t, `{"type":"object","properties":{"a":{"type":"object","description":"`+strings.Repeat("x", 100)+`","properties":{"b":{"type":"string","description":"`+strings.Repeat("y", 100)+`"}}}}}`)
+	normalized, changes = NormalizeToolSchema(schema)
+	if got := schemaJSON(normalized); len(got) > 120 {
+		t.Errorf("体积超出上限: %d bytes: %s", len(got), got)
+	}
+	if !reflect.DeepEqual(changes, []string{schemaChangeDepth, schemaChangeSize}) {
+		t.Errorf("changes = %v", changes)
+	}
+}
+
+func TestBuildCodeWhispererRequest_NormalizesToolSchemas(t *testing.T) {
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 1024,
+		Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "读取文件"}},
+		Tools: []types.AnthropicTool{
+			{Name: "read", InputSchema: mustSchema(t, `{"type":"object","properties":{"path":{"type":"string"}}}`)},
+			{Name: "mcp__fs__write", InputSchema: mustSchema(t, `{"type":"object","properties":{"path":{"$ref":"#/$defs/Path"}},"$defs":{"Path":{"type":"string"}}}`)},
+		},
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	cwReq, err := BuildCodeWhispererRequest(req, c)
+	if err != nil {
+		t.Fatalf("BuildCodeWhispererRequest() error = %v", err)
+	}
+
+	if got := w.Header().Get("X-Tool-Schema-Normalized"); got != "mcp__fs__write" {
+		t.Errorf("X-Tool-Schema-Normalized = %q", got)
+	}
+	tools := cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools
+	if len(tools) != 2 {
+		t.Fatalf("tools = %d, want 2", len(tools))
+	}
+	if got := schemaJSON(tools[1].ToolSpecification.InputSchema.Json); got != `{"properties":{"path":{"type":"string"}},"type":"object"}` {
+		t.Errorf("schema = %s", got)
+	}
+}
@@ -0,0 +1,75 @@
+package converter
+
+import (
+	"fmt"
+
+	"kiro2api/types"
+)
+
+// 结构化输出：上游不支持 response_format，将 JSON Schema 转为强制调用的工具，
+// 服务端取出工具入参并按 schema 校验后作为 message.content 返回
+
+// StructuredOutputToolName 承载结构化输出的工具名
+const StructuredOutputToolName = "structured_output"
+
+// StructuredOutput 解析后的 response_format
+type StructuredOutput struct {
+	Name        string
+	Description string
+	Schema      map[string]any
+	Strict      bool
+}
+
+// ResolveStructuredOutput 解析 response_format，json_schema / json_object 以外返回 nil
+func ResolveStructuredOutput(rf *types.OpenAIResponseFormat) *StructuredOutput {
+	if rf == nil {
+		return nil
+	}
+	switch rf.Type {
+	case "json_schema":
+		if rf.JSONSchema == nil || len(rf.JSONSchema.Schema) == 0 {
+			return nil
+		}
+		so := &StructuredOutput{
+			Name:        rf.JSONSchema.Name,
+			Description: rf.JSONSchema.Description,
+			Schema:      rf.JSONSchema.Schema,
+		}
+		if rf.JSONSchema.Strict != nil {
+			so.Strict = *rf.JSONSchema.Strict
+		}
+		return so
+	case "json_object":
+		return &StructuredOutput{Schema: map[string]any{"type": "object"}}
+	}
+	return nil
+}
+
+// tool 生成承载结构化输出的工具定义
+func (so *StructuredOutput) tool() types.AnthropicTool {
+	description := "Respond with the final answer by calling this tool. The tool input is the answer and must match the schema exactly."
+	if so.Name != "" {
+		description += fmt.Sprintf(" Schema name: %s.", so.Name)
+	}
+	if so.Description != "" {
+		description += " " + so.Description
+	}
+	return types.AnthropicTool{
+		Name:        StructuredOutputToolName,
+		Description: description,
+		InputSchema: so.Schema,
+	}
+}
+
+// applyStructuredOutput 追加结构化输出工具并强制调用
+func applyStructuredOutput(req *types.AnthropicRequest, so *StructuredOutput) {
+	if so == nil {
+		return
+	}
+	req.Tools = append(req.Tools, so.tool())
+	req.ToolChoice = &types.ToolChoice{
+		Type:                   "tool",
+		Name:                   StructuredOutputToolName,
+		DisableParallelToolUse: true,
+	}
+}
@@ -0,0 +1,70 @@
+package converter
+
+import (
+	"testing"
+
+	"kiro2api/types"
+)
+
+func structuredOutputRequest(rf *types.OpenAIResponseFormat) types.OpenAIRequest {
+	return types.OpenAIRequest{
+		Model:          "claude-sonnet-4-20250514",
+		Messages:       []types.OpenAIMessage{{Role: "user", Content: "介绍 Go 语言"}},
+		ResponseFormat: rf,
+	}
+}
+
+func TestResolveStructuredOutput(t *testing.T) {
+	strict := true
+	so := ResolveStructuredOutput(&types.OpenAIResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &types.OpenAIJSONSchema{
+			Name:   "language",
+			Schema: map[string]any{"type": "object"},
+			Strict: &strict,
+		},
+	})
+	if so == nil || so.Name != "language" || !so.Strict {
+		t.Fatalf("ResolveStructuredOutput() = %+v", so)
+	}
+
+	if got := ResolveStructuredOutput(&types.OpenAIResponseFormat{Type: "json_object"}); got == nil || got.Schema["type"] != "object" {
+		t.Errorf("json_object 应使用 object schema，实际 %+v", got)
+	}
+	for _, rf := range []*types.OpenAIResponseFormat{
+		nil,
+		{Type: "text"},
+		{Type: "json_schema"},
+		{Type: "json_schema", JSONSchema: &types.OpenAIJSONSchema{Name: "empty"}},
+	} {
+		if got := ResolveStructuredOutput(rf); got != nil {
+			t.Errorf("ResolveStructuredOutput(%+v) = %+v, want nil", rf, got)
+		}
+	}
+}
+
+func TestConvertOpenAIToAnthropic_StructuredOutputForcesTool(t *testing.T) {
+	schema := map[string]any{"type": "object", "properties": map[string]any{"name": map[string]any{"type": "string"}}}
+	req := ConvertOpenAIToAnthropic(structuredOutputRequest(&types.OpenAIResponseFormat{
+		Type:       "json_schema",
+		JSONSchema: &types.OpenAIJSONSchema{Name: "language", Schema: schema},
+	}))
+
+	if len(req.Tools) != 1 || req.Tools[0].Name != StructuredOutputToolName {
+		t.Fatalf("Tools = %+v, want single %s tool", req.Tools, StructuredOutputToolName)
+	}
+	if req.Tools[0].InputSchema["type"] != "object" {
+		t.Errorf("InputSchema = %+v", req.Tools[0].InputSchema)
+	}
+	tc := ResolveToolChoice(req.ToolChoice)
+	if tc == nil || tc.Type != "tool" || tc.Name != StructuredOutputToolName || !tc.DisableParallelToolUse {
+		t.Errorf("ToolChoice = %+v", tc)
+	}
+}
+
+func TestConvertOpenAIToAnthropic_TextResponseFormatUnchanged(t *testing.T) {
+	req := ConvertOpenAIToAnthropic(structuredOutputRequest(&types.OpenAIResponseFormat{Type: "text"}))
+	if len(req.Tools) != 0 || req.ToolChoice != nil {
+		t.Errorf("text 格式不应添加工具：Tools=%+v ToolChoice=%+v", req.Tools, req.ToolChoice)
+	}
+}
@@ -0,0 +1,140 @@
+package converter
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// 系统提示策略：SYSTEM_PROMPT_MODE 决定系统提示的发送位置，
+// SYSTEM_PROMPT_MAX_BYTES 限制客户端系统提示大小，SYSTEM_PROMPT_DEDUPE 去除 Claude Code 重复发送的样板内容
+
+// 上游对话状态没有原生的 system 字段，系统提示只能作为对话文本发送
+const (
+	SystemPromptModeHistory = "history"
+	SystemPromptModePrepend = "prepend"
+)
+
+// systemPromptTruncatedMarker 系统提示被截断时追加的标记
+const systemPromptTruncatedMarker = "\n[system prompt truncated]"
+
+var systemReminderPattern = regexp.MustCompile(`(?s)<system-reminder>.*?</system-reminder>\n?`)
+
+// systemPromptMode 返回生效的系统提示模式，无效配置按 history 处理
+func systemPromptMode() string {
+	switch config.SystemPromptMode {
+	case SystemPromptModePrepend:
+		return config.SystemPromptMode
+	default:
+		return SystemPromptModeHistory
+	}
+}
+
+// clientSystemPrompt 拼接客户端 system 块，按配置去重并限制大小
+func clientSystemPrompt(system []types.AnthropicSystemMessage) string {
+	var parts []string
+	seen := make(map[string]bool)
+	for _, sysMsg := range system {
+		content, err := utils.GetMessageContent(sysMsg)
+		if err != nil {
+			continue
+		}
+		content = strings.TrimSpace(content)
+		if content == "" {
+			continue
+		}
+		if config.SystemPromptDedupe {
+			if seen[content] {
+				continue
+			}
+			seen[content] = true
+		}
+		parts = append(parts, content)
+	}
+	return capSystemPrompt(strings.Join(parts, "\n"), config.SystemPromptMaxBytes)
+}
+
+// capSystemPrompt 按字节数截断系统提示（不切断 UTF-8 字符），maxBytes<=0 表示不限制
+func capSystemPrompt(text string, maxBytes int) string {
+	if maxBytes <= 0 || len(text) <= maxBytes {
+		return text
+	}
+	cut := maxBytes - len(systemPromptTruncatedMarker)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	logger.Debug("系统提示超出大小限制，已截断",
+		logger.Int("original_bytes", len(text)),
+		logger.Int("max_bytes", maxBytes))
+	return text[:cut] + systemPromptTruncatedMarker
+}
+
+// reminderDeduper 去除历史用户消息中重复出现的 <system-reminder> 段落，nil 表示不去重
+type reminderDeduper struct {
+	seen map[string]bool
+}
+
+func newReminderDeduper() *reminderDeduper {
+	if !config.SystemPromptDedupe {
+		return nil
+	}
+	return &reminderDeduper{seen: make(map[string]bool)}
+}
+
+// apply 保留每个 <system-reminder> 段落的首次出现
+func (d *reminderDeduper) apply(text string) string {
+	if d == nil || !strings.Contains(text, "<system-reminder>") {
+		return text
+	}
+	deduped := systemReminderPattern.ReplaceAllStringFunc(text, func(reminder string) string {
+		key := strings.TrimSpace(reminder)
+		if d.seen[key] {
+			return ""
+		}
+		d.seen[key] = true
+		return reminder
+	})
+	return strings.TrimSpace(deduped)
+}
+
+// syntheticSystemTurn 生成承载系统提示的合成用户消息与助手 "OK" 回复
+func syntheticSystemTurn(content, modelId string) []any {
+	userMsg := types.HistoryUserMessage{}
+	userMsg.UserInputMessage.Content = content
+	userMsg.UserInputMessage.ModelId = modelId
+	userMsg.UserInputMessage.Origin = "AI_EDITOR" // v0.4兼容性：固定使用AI_EDITOR
+
+	assistantMsg := types.HistoryAssistantMessage{}
+	assistantMsg.AssistantResponseMessage.Content = "OK"
+	assistantMsg.AssistantResponseMessage.ToolUses = nil
+	return []any{userMsg, assistantMsg}
+}
+
+// prependSystemPrompt 将系统提示拼接到第一条用户消息开头（历史为空时为当前消息）
+func prependSystemPrompt(cwReq *types.CodeWhispererRequest, systemContent string) {
+	history := cwReq.ConversationState.History
+	if len(history) > 0 {
+		if userMsg, ok := history[0].(types.HistoryUserMessage); ok {
+			userMsg.UserInputMessage.Content = joinSystemPrompt(systemContent, userMsg.UserInputMessage.Content)
+			history[0] = userMsg
+			return
+		}
+	}
+	current := &cwReq.ConversationState.CurrentMessage.UserInputMessage
+	current.Content = joinSystemPrompt(systemContent, current.Content)
+}
+
+func joinSystemPrompt(systemContent, content string) string {
+	if content == "" {
+		return systemContent
+	}
+	return systemContent + "\n\n" + content
+}
@@ -0,0 +1,163 @@
+package converter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+func buildSystemPromptRequest(t *testing.T, thinking bool) types.CodeWhispererRequest {
+	t.Helper()
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 8192,
+		System: []types.AnthropicSystemMessage{
+			{Type: "text", Text: "You are Claude Code, Anthropic's official CLI for Claude."},
+			{Type: "text", Text: "You are Claude Code, Anthropic's official CLI for Claude."},
+			{Type: "text", Text: "Use the tools available to you."},
+		},
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "<system-reminder>\nctx\n</system-reminder>\n第一个问题"},
+			{Role: "assistant", Content: "回答一"},
+			{Role: "user", Content: "<system-reminder>\nctx\n</system-reminder>\n第二个问题"},
+			{Role: "assistant", Content: "回答二"},
+			{Role: "user", Content: "<system-reminder>\nctx\n</system-reminder>\n第三个问题"},
+		},
+	}
+	if thinking {
+		req.Thinking = &types.Thinking{Type: "enabled", BudgetTokens: 2048}
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	cwReq, err := BuildCodeWhispererRequest(req, c)
+	if err != nil {
+		t.Fatalf("BuildCodeWhispererRequest() error = %v", err)
+	}
+	return cwReq
+}
+
+func historyUserContents(history []any) []string {
+	var contents []string
+	for _, h := range history {
+		if msg, ok := h.(types.HistoryUserMessage); ok {
+			contents = append(contents, msg.UserInputMessage.Content)
+		}
+	}
+	return contents
+}
+
+func TestBuildCodeWhispererRequest_SystemPromptModes(t *testing.T) {
+	oldMode, oldDedupe := config.SystemPromptMode, config.SystemPromptDedupe
+	defer func() { config.SystemPromptMode, config.SystemPromptDedupe = oldMode, oldDedupe }()
+	config.SystemPromptDedupe = true
+
+	const system = "You are Claude Code, Anthropic's official CLI for Claude.\nUse the tools available to you."
+
+	t.Run("history", func(t *testing.T) {
+		config.SystemPromptMode = "history"
+		cwReq := buildSystemPromptRequest(t, false)
+		history := cwReq.ConversationState.History
+		if len(history) != 6 {
+			t.Fatalf("history 长度 = %d, want 6", len(history))
+		}
+		if got := historyUserContents(history)[0]; got != system {
+			t.Errorf("合成系统消息 = %q, want %q", got, system)
+		}
+		if msg, ok := history[1].(types.HistoryAssistantMessage); !ok || msg.AssistantResponseMessage.Content != "OK" {
+			t.Errorf("history[1] 应为合成的 OK 回复, got %#v", history[1])
+		}
+	})
+
+	t.Run("未知模式按 history 处理", func(t *testing.T) {
+		config.SystemPromptMode = "context"
+		cwReq := buildSystemPromptRequest(t, false)
+		if got := historyUserContents(cwReq.ConversationState.History)[0]; got != system {
+			t.Errorf("合成系统消息 = %q, want %q", got, system)
+		}
+	})
+
+	t.Run("prepend 启用 thinking 时标签位于系统提示之前", func(t *testing.T) {
+		config.SystemPromptMode = "prepend"
+		cwReq := buildSystemPromptRequest(t, true)
+		prefix := generateThinkingPrefix(&types.Thinking{Type: "enabled", BudgetTokens: 2048})
+		if contents := historyUserContents(cwReq.ConversationState.History); !strings.HasPrefix(contents[0], prefix+"\n"+system) {
+			t.Errorf("第一条用户消息 = %q", contents[0])
+		}
+	})
+
+	t.Run("prepend", func(t *testing.T) {
+		config.SystemPromptMode = "prepend"
+		cwReq := buildSystemPromptRequest(t, false)
+		contents := historyUserContents(cwReq.ConversationState.History)
+		if len(cwReq.ConversationState.History) != 4 {
+			t.Fatalf("history 长度 = %d, want 4（不应插入合成轮次）", len(cwReq.ConversationState.History))
+		}
+		if !strings.HasPrefix(contents[0], system+"\n\n") || !strings.HasSuffix(contents[0], "第一个问题") {
+			t.Errorf("第一条用户消息 = %q", contents[0])
+		}
+	})
+}
+
+func TestBuildCodeWhispererRequest_SystemReminderDedupe(t *testing.T) {
+	oldMode, oldDedupe := config.SystemPromptMode, config.SystemPromptDedupe
+	defer func() { config.SystemPromptMode, config.SystemPromptDedupe = oldMode, oldDedupe }()
+	config.SystemPromptMode = "history"
+
+	config.SystemPromptDedupe = true
+	cwReq := buildSystemPromptRequest(t, false)
+	contents := historyUserContents(cwReq.ConversationState.History)
+	if len(contents) != 3 {
+		t.Fatalf("用户消息数 = %d, want 3", len(contents))
+	}
+	if !strings.Contains(contents[1], "<system-reminder>") {
+		t.Errorf("首次出现的 system-reminder 应保留: %q", contents[1])
+	}
+	if contents[2] != "第二个问题" {
+		t.Errorf("重复的 system-reminder 应移除: %q", contents[2])
+	}
+	if current := cwReq.ConversationState.CurrentMessage.UserInputMessage.Content; !strings.Contains(current, "<system-reminder>") {
+		t.Errorf("当前消息不应去重: %q", current)
+	}
+
+	config.SystemPromptDedupe = false
+	cwReq = buildSystemPromptRequest(t, false)
+	contents = historyUserContents(cwReq.ConversationState.History)
+	if !strings.Contains(contents[2], "<system-reminder>") {
+		t.Errorf("关闭去重时应保留原文: %q", contents[2])
+	}
+	if strings.Count(contents[0], "You are Claude Code") != 2 {
+		t.Errorf("关闭去重时应保留重复的 system 块: %q", contents[0])
+	}
+}
+
+func TestCapSystemPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		maxBytes int
+		want     string
+	}{
+		{name: "不限制", text: "abcdef", maxBytes: 0, want: "abcdef"},
+		{name: "未超出", text: "abcdef", maxBytes: 6, want: "abcdef"},
+		{name: "超出截断", text: strings.Repeat("a", 40), maxBytes: 30, want: "aaaa" + systemPromptTruncatedMarker},
+		{name: "不切断多字节字符", text: strings.Repeat("中", 20), maxBytes: 31, want: "中" + systemPromptTruncatedMarker},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := capSystemPrompt(tt.text, tt.maxBytes)
+			if got != tt.want {
+				t.Errorf("capSystemPrompt() = %q, want %q", got, tt.want)
+			}
+			if tt.maxBytes > 0 && len(got) > tt.maxBytes {
+				t.Errorf("capSystemPrompt() 长度 %d 超出 %d", len(got), tt.maxBytes)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package converter
+
+import (
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// 历史消息中的 thinking 块处理
+// 上游历史消息只有文本与工具调用，thinking 以 <thinking> 标签内联回传（与标签解析模式一致），
+// 或按 THINKING_HISTORY_MODE=strip 全部移除
+
+// extractHistoryThinking 提取助手消息中可回传的 thinking 内容，返回以标签包裹的前缀（无内容时为空）
+// 以及消息是否包含文本块
+// 只保留签名校验通过的 thinking 块：签名由本代理在下发时生成，校验失败说明内容被改动或来自其他来源
+func extractHistoryThinking(content any) (string, bool) {
+	var blocks []types.ContentBlock
+	switch v := content.(type) {
+	case []any:
+		for _, item := range v {
+			if block, ok := item.(map[string]any); ok {
+				if cb, err := parseContentBlock(block); err == nil {
+					blocks = append(blocks, cb)
+				}
+			}
+		}
+	case []types.ContentBlock:
+		blocks = v
+	default:
+		return "", false
+	}
+
+	var parts []string
+	stripped := 0
+	hasText := false
+	for _, block := range blocks {
+		switch block.Type {
+		case "text":
+			hasText = hasText || (block.Text != nil && *block.Text != "")
+		case "thinking":
+			if block.Thinking == nil || *block.Thinking == "" {
+				continue
+			}
+			signature := ""
+			if block.Signature != nil {
+				signature = *block.Signature
+			}
+			if config.ThinkingHistoryMode == "strip" || !utils.VerifyThinkingSignature(*block.Thinking, signature) {
+				stripped++
+				continue
+			}
+			parts = append(parts, *block.Thinking)
+		case "redacted_thinking":
+			stripped++
+		}
+	}
+
+	if stripped > 0 {
+		logger.Debug("历史消息中的 thinking 块已移除",
+			logger.String("mode", config.ThinkingHistoryMode),
+			logger.Int("stripped", stripped),
+			logger.Int("kept", len(parts)))
+	}
+	if len(parts) == 0 {
+		return "", hasText
+	}
+	return "<thinking>" + strings.Join(parts, "\n\n") + "</thinking>", hasText
+}
@@ -0,0 +1,129 @@
+package converter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"kiro2api/config"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+func TestExtractHistoryThinking(t *testing.T) {
+	signed := utils.SignThinking("先读取文件")
+	toolUse := map[string]any{"type": "tool_use", "id": "tooluse_1", "name": "read_file", "input": map[string]any{}}
+
+	tests := []struct {
+		name        string
+		mode        string
+		content     any
+		wantPrefix  string
+		wantHasText bool
+	}{
+		{
+			name: "签名有效的 thinking 内联回传",
+			mode: "inline",
+			content: []any{
+				map[string]any{"type": "thinking", "thinking": "先读取文件", "signature": signed},
+				map[string]any{"type": "text", "text": "好的"},
+				toolUse,
+			},
+			wantPrefix:  "<thinking>先读取文件</thinking>",
+			wantHasText: true,
+		},
+		{
+			name: "签名不匹配的 thinking 被移除",
+			mode: "inline",
+			content: []any{
+				map[string]any{"type": "thinking", "thinking": "被改动的内容", "signature": signed},
+				toolUse,
+			},
+			wantPrefix: "",
+		},
+		{
+			name: "redacted_thinking 始终移除",
+			mode: "inline",
+			content: []any{
+				map[string]any{"type": "redacted_thinking", "data": "ZW5jcnlwdGVk"},
+				map[string]any{"type": "thinking", "thinking": "先读取文件", "signature": signed},
+				toolUse,
+			},
+			wantPrefix: "<thinking>先读取文件</thinking>",
+		},
+		{
+			name: "strip 模式移除全部 thinking",
+			mode: "strip",
+			content: []any{
+				map[string]any{"type": "thinking", "thinking": "先读取文件", "signature": signed},
+				map[string]any{"type": "text", "text": "好的"},
+			},
+			wantPrefix:  "",
+			wantHasText: true,
+		},
+		{
+			name:       "纯文本消息",
+			mode:       "inline",
+			content:    "好的",
+			wantPrefix: "",
+		},
+	}
+
+	old := config.ThinkingHistoryMode
+	defer func() { config.ThinkingHistoryMode = old }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.ThinkingHistoryMode = tt.mode
+			prefix, hasText := extractHistoryThinking(tt.content)
+			if prefix != tt.wantPrefix {
+				t.Errorf("extractHistoryThinking() prefix = %q, want %q", prefix, tt.wantPrefix)
+			}
+			if hasText != tt.wantHasText {
+				t.Errorf("extractHistoryThinking() hasText = %v, want %v", hasText, tt.wantHasText)
+			}
+		})
+	}
+}
+
+func TestBuildCodeWhispererRequest_ThinkingHistory(t *testing.T) {
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 1024,
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "读取 a.go"},
+			{Role: "assistant", Content: []any{
+				map[string]any{"type": "thinking", "thinking": "需要调用工具", "signature": utils.SignThinking("需要调用工具")},
+				map[string]any{"type": "tool_use", "id": "tooluse_1", "name": "read_file", "input": map[string]any{"path": "a.go"}},
+			}},
+			{Role: "user", Content: []any{
+				map[string]any{"type": "tool_result", "tool_use_id": "tooluse_1", "content": "package a"},
+			}},
+		},
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	cwReq, err := BuildCodeWhispererRequest(req, c)
+	if err != nil {
+		t.Fatalf("BuildCodeWhispererRequest() error = %v", err)
+	}
+
+	var assistant *types.HistoryAssistantMessage
+	for _, h := range cwReq.ConversationState.History {
+		if msg, ok := h.(types.HistoryAssistantMessage); ok {
+			assistant = &msg
+		}
+	}
+	if assistant == nil {
+		t.Fatal("history should contain the assistant turn")
+	}
+	if got := assistant.AssistantResponseMessage.Content; got != "<thinking>需要调用工具</thinking>" {
+		t.Errorf("assistant content = %q, want inline thinking without placeholder", got)
+	}
+	if len(assistant.AssistantResponseMessage.ToolUses) != 1 {
+		t.Errorf("tool uses = %d, want 1", len(assistant.AssistantResponseMessage.ToolUses))
+	}
+}
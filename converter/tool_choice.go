@@ -0,0 +1,62 @@
+package converter
+
+import (
+	"fmt"
+
+	"kiro2api/types"
+)
+
+// 上游不支持 tool_choice：通过工具列表裁剪与系统指令实现，响应未调用工具时由服务端重试
+
+// ResolveToolChoice 将 tool_choice（字符串、map 或结构体）统一为 *types.ToolChoice，未设置时返回 nil
+func ResolveToolChoice(toolChoice any) *types.ToolChoice {
+	switch tc := toolChoice.(type) {
+	case *types.ToolChoice:
+		return tc
+	case types.ToolChoice:
+		return &tc
+	case string:
+		if tc == "" {
+			return nil
+		}
+		return &types.ToolChoice{Type: tc}
+	case map[string]any:
+		resolved := &types.ToolChoice{}
+		resolved.Type, _ = tc["type"].(string)
+		resolved.Name, _ = tc["name"].(string)
+		resolved.DisableParallelToolUse, _ = tc["disable_parallel_tool_use"].(bool)
+		return resolved
+	}
+	return nil
+}
+
+// toolChoiceDirective 追加到系统提示的工具使用指令，无需约束时返回空串
+func toolChoiceDirective(tc *types.ToolChoice) string {
+	if tc == nil {
+		return ""
+	}
+	var directive string
+	switch tc.Type {
+	case "any":
+		directive = "You must respond by calling at least one of the available tools. Do not answer with plain text only."
+	case "tool":
+		directive = fmt.Sprintf("You must respond by calling the tool %q. Do not answer with plain text only.", UpstreamToolName(tc.Name))
+	}
+	if tc.DisableParallelToolUse && tc.Type != "none" {
+		if directive != "" {
+			directive += " "
+		}
+		directive += "Call at most one tool in your response."
+	}
+	return directive
+}
+
+// ToolChoiceReminder 响应未调用工具时，重试请求中追加的用户提醒
+func ToolChoiceReminder(tc *types.ToolChoice) string {
+	return "Your previous response did not call a tool. " + toolChoiceDirective(tc)
+}
+
+// toolAllowedByChoice 指定工具时只向上游声明该工具
+func toolAllowedByChoice(tc *types.ToolChoice, name string) bool {
+	return tc == nil || tc.Type != "tool" || tc.Name == name
+}
@@ -0,0 +1,113 @@
+package converter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"kiro2api/types"
+)
+
+func buildToolChoiceTestRequest(t *testing.T, toolChoice any) types.CodeWhispererRequest {
+	t.Helper()
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 1024,
+		Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "提取语言名称"}},
+		Tools: []types.AnthropicTool{
+			{Name: "extract", InputSchema: map[string]any{"type": "object"}},
+			{Name: "search", InputSchema: map[string]any{"type": "object"}},
+		},
+		ToolChoice: toolChoice,
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	cwReq, err := BuildCodeWhispererRequest(req, c)
+	if err != nil {
+		t.Fatalf("BuildCodeWhispererRequest() error = %v", err)
+	}
+	return cwReq
+}
+
+func systemHistoryContent(cwReq types.CodeWhispererRequest) string {
+	if len(cwReq.ConversationState.History) == 0 {
+		return ""
+	}
+	if msg, ok := cwReq.ConversationState.History[0].(types.HistoryUserMessage); ok {
+		return msg.UserInputMessage.Content
+	}
+	return ""
+}
+
+func TestBuildCodeWhispererRequest_ToolChoice(t *testing.T) {
+	tests := []struct {
+		name          string
+		toolChoice    any
+		wantTools     []string
+		wantDirective string
+		wantTrigger   string
+	}{
+		{"未设置", nil, []string{"extract", "search"}, "", "MANUAL"},
+		{"auto", "auto", []string{"extract", "search"}, "", "MANUAL"},
+		{"none", map[string]any{"type": "none"}, nil, "", "MANUAL"},
+		{"any", map[string]any{"type": "any"}, []string{"extract", "search"}, "at least one of the available tools", "AUTO"},
+		{"指定工具", &types.ToolChoice{Type: "tool", Name: "extract"}, []string{"extract"}, `calling the tool "extract"`, "AUTO"},
+		{"禁止并行", map[string]any{"type": "auto", "disable_parallel_tool_use": true}, []string{"extract", "search"}, "at most one tool", "MANUAL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cwReq := buildToolChoiceTestRequest(t, tt.toolChoice)
+
+			var names []string
+			for _, tool := range cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools {
+				names = append(names, tool.ToolSpecification.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.wantTools, ",") {
+				t.Errorf("tools = %v, want %v", names, tt.wantTools)
+			}
+
+			system := systemHistoryContent(cwReq)
+			if tt.wantDirective == "" && strings.Contains(system, "You must") {
+				t.Errorf("unexpected directive in system content %q", system)
+			}
+			if tt.wantDirective != "" && !strings.Contains(system, tt.wantDirective) {
+				t.Errorf("system content = %q, want directive containing %q", system, tt.wantDirective)
+			}
+
+			if got := cwReq.ConversationState.ChatTriggerType; got != tt.wantTrigger {
+				t.Errorf("chatTriggerType = %q, want %q", got, tt.wantTrigger)
+			}
+		})
+	}
+}
+
+func TestResolveToolChoice(t *testing.T) {
+	if ResolveToolChoice(nil) != nil {
+		t.Error("nil tool_choice should resolve to nil")
+	}
+	tc := ResolveToolChoice(map[string]any{"type": "tool", "name": "extract", "disable_parallel_tool_use": true})
+	if tc.Type != "tool" || tc.Name != "extract" || !tc.DisableParallelToolUse || !tc.RequiresTool() {
+		t.Errorf("ResolveToolChoice(map) = %+v", tc)
+	}
+	if tc := ResolveToolChoice("none"); tc.Type != "none" || tc.RequiresTool() {
+		t.Errorf("ResolveToolChoice(\"none\") = %+v", tc)
+	}
+}
+
+func TestConvertOpenAIToAnthropic_ParallelToolCalls(t *testing.T) {
+	disabled := false
+	req := ConvertOpenAIToAnthropic(types.OpenAIRequest{
+		Model:             "claude-sonnet-4-20250514",
+		Messages:          []types.OpenAIMessage{{Role: "user", Content: "hi"}},
+		ToolChoice:        "required",
+		ParallelToolCalls: &disabled,
+	})
+	tc := ResolveToolChoice(req.ToolChoice)
+	if tc == nil || tc.Type != "any" || !tc.DisableParallelToolUse {
+		t.Errorf("tool_choice = %+v, want any with disable_parallel_tool_use", tc)
+	}
+}
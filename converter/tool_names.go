@@ -0,0 +1,110 @@
+package converter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+// 工具名映射：上游只接受 [A-Za-z][A-Za-z0-9_-]* 且长度受限的工具名，
+// 含点号、unicode 或超长的名称（常见于 MCP 工具）在发送前改写为合法名称，
+// 改写是名称的纯函数（清理 + 原名哈希后缀），同一会话各轮请求结果一致；
+// 响应中的工具名由 ToolNameMapper 按当前请求还原，客户端始终只看到原名
+
+// toolNameHashLen 改写名称的哈希后缀长度
+const toolNameHashLen = 8
+
+// UpstreamToolName 返回发送给上游的工具名，合法名称原样返回
+func UpstreamToolName(name string) string {
+	maxLen := config.ToolNameMaxLength
+	if isValidUpstreamToolName(name, maxLen) {
+		return name
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	base := b.String()
+	if base == "" || !isASCIILetter(base[0]) {
+		base = "t_" + base
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	suffix := fmt.Sprintf("_%0*x", toolNameHashLen, h.Sum32())
+	if maxLen > len(suffix) && len(base)+len(suffix) > maxLen {
+		base = base[:maxLen-len(suffix)]
+	}
+	return base + suffix
+}
+
+func isValidUpstreamToolName(name string, maxLen int) bool {
+	if name == "" || (maxLen > 0 && len(name) > maxLen) || !isASCIILetter(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		c := name[i]
+		if !isASCIILetter(c) && !(c >= '0' && c <= '9') && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ToolNameMapper 单个请求内上游工具名到原名的映射
+type ToolNameMapper struct {
+	toClient map[string]string
+}
+
+// NewToolNameMapper 根据请求声明的工具与历史工具调用建立映射，没有被改写的名称时返回 nil
+func NewToolNameMapper(req types.AnthropicRequest) *ToolNameMapper {
+	m := &ToolNameMapper{toClient: make(map[string]string)}
+	for _, tool := range req.Tools {
+		m.add(tool.Name)
+	}
+	if tc := ResolveToolChoice(req.ToolChoice); tc != nil {
+		m.add(tc.Name)
+	}
+	for _, msg := range req.Messages {
+		if msg.Role != "assistant" {
+			continue
+		}
+		for _, toolUse := range extractToolUsesFromMessage(msg.Content) {
+			m.add(toolUse.Name)
+		}
+	}
+	if len(m.toClient) == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *ToolNameMapper) add(name string) {
+	if upstream := UpstreamToolName(name); name != "" && upstream != name {
+		m.toClient[upstream] = name
+	}
+}
+
+// ClientName 将上游返回的工具名还原为客户端声明的原名
+func (m *ToolNameMapper) ClientName(upstream string) string {
+	if m == nil {
+		return upstream
+	}
+	if name, ok := m.toClient[upstream]; ok {
+		return name
+	}
+	return upstream
+}
@@ -0,0 +1,118 @@
+package converter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"kiro2api/types"
+)
+
+func TestUpstreamToolName(t *testing.T) {
+	for _, name := range []string{"read_file", "mcp__github__create_pull_request", "Bash", "tool-1"} {
+		if got := UpstreamToolName(name); got != name {
+			t.Errorf("UpstreamToolName(%q) = %q, want unchanged", name, got)
+		}
+	}
+
+	long := "mcp__" + strings.Repeat("very_long_server_name_", 4) + "__create_pull_request"
+	for _, name := range []string{"github.create_issue", "搜索文档", "1password_lookup", long} {
+		got := UpstreamToolName(name)
+		if got == name {
+			t.Errorf("UpstreamToolName(%q) 应被改写", name)
+		}
+		if !isValidUpstreamToolName(got, 64) {
+			t.Errorf("UpstreamToolName(%q) = %q，不是合法的上游工具名", name, got)
+		}
+		if again := UpstreamToolName(name); again != got {
+			t.Errorf("UpstreamToolName(%q) 结果不稳定: %q != %q", name, got, again)
+		}
+	}
+
+	if a, b := UpstreamToolName("github.create_issue"), UpstreamToolName("github_create.issue"); a == b {
+		t.Errorf("清理后相同的不同名称不应冲突: %q", a)
+	}
+	if got := UpstreamToolName("github.create_issue"); !strings.HasPrefix(got, "github_create_issue_") {
+		t.Errorf("改写名称应保留可读前缀: %q", got)
+	}
+}
+
+func TestToolNameMapper(t *testing.T) {
+	if m := NewToolNameMapper(types.AnthropicRequest{Tools: []types.AnthropicTool{{Name: "read_file"}}}); m != nil {
+		t.Errorf("没有改写的名称时应返回 nil，实际 %+v", m)
+	}
+
+	req := types.AnthropicRequest{
+		Tools: []types.AnthropicTool{{Name: "github.create_issue"}},
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "查询"},
+			{Role: "assistant", Content: []any{map[string]any{"type": "tool_use", "id": "tooluse_1", "name": "文档.搜索", "input": map[string]any{}}}},
+		},
+	}
+	m := NewToolNameMapper(req)
+	for _, name := range []string{"github.create_issue", "文档.搜索"} {
+		if got := m.ClientName(UpstreamToolName(name)); got != name {
+			t.Errorf("ClientName(%q) = %q, want %q", UpstreamToolName(name), got, name)
+		}
+	}
+	if got := m.ClientName("unknown"); got != "unknown" {
+		t.Errorf("未知名称应原样返回，实际 %q", got)
+	}
+	var nilMapper *ToolNameMapper
+	if got := nilMapper.ClientName("x"); got != "x" {
+		t.Errorf("nil mapper ClientName = %q", got)
+	}
+}
+
+func TestBuildCodeWhispererRequest_MangledToolNames(t *testing.T) {
+	name := "github.create_issue"
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 1024,
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "创建 issue"},
+			{Role: "assistant", Content: []any{map[string]any{"type": "tool_use", "id": "tooluse_1", "name": name, "input": map[string]any{}}}},
+			{Role: "user", Content: []any{map[string]any{"type": "tool_result", "tool_use_id": "tooluse_1", "content": "ok"}}},
+		},
+		Tools:      []types.AnthropicTool{{Name: name, InputSchema: map[string]any{"type": "object", "properties": map[string]any{}}}},
+		ToolChoice: map[string]any{"type": "tool", "name": name},
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	cwReq, err := BuildCodeWhispererRequest(req, c)
+	if err != nil {
+		t.Fatalf("BuildCodeWhispererRequest() error = %v", err)
+	}
+
+	upstream := UpstreamToolName(name)
+	tools := cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools
+	if len(tools) != 1 || tools[0].ToolSpecification.Name != upstream {
+		t.Fatalf("tools = %+v, want %s", tools, upstream)
+	}
+
+	var sawToolUse, sawDirective bool
+	for _, item := range cwReq.ConversationState.History {
+		switch msg := item.(type) {
+		case types.HistoryAssistantMessage:
+			for _, tu := range msg.AssistantResponseMessage.ToolUses {
+				if tu.Name != upstream {
+					t.Errorf("历史工具调用名 = %q, want %q", tu.Name, upstream)
+				}
+				sawToolUse = true
+			}
+		case types.HistoryUserMessage:
+			if strings.Contains(msg.UserInputMessage.Content, `"`+upstream+`"`) {
+				sawDirective = true
+			}
+		}
+	}
+	if !sawToolUse {
+		t.Error("历史中缺少工具调用")
+	}
+	if !sawDirective {
+		t.Error("tool_choice 指令应使用上游工具名")
+	}
+}
@@ -103,14 +103,7 @@ func cleanAndValidateToolParameters(params map[string]any) (map[string]any, erro
 		return nil, fmt.Errorf("参数序列化失败: %v", err)
 	}
 
-	// 移除不支持的顶级字段
-	delete(tempParams, "additionalProperties")
-	delete(tempParams, "strict")
-	delete(tempParams, "$schema")
-	delete(tempParams, "$id")
-	delete(tempParams, "$ref")
-	delete(tempParams, "definitions")
-	delete(tempParams, "$defs")
+	// $ref/$defs、additionalProperties 等不兼容关键字由 NormalizeToolSchema 在构建上游请求时统一处理
 
 	// 处理超长参数名 - CodeWhisperer限制参数名长度；保留原名映射
 	if properties, ok := tempParams["properties"].(map[string]any); ok {
@@ -210,8 +203,7 @@ func convertOpenAIToolChoiceToAnthropic(openaiToolChoice any) any {
 		case "required", "any":
 			return &types.ToolChoice{Type: "any"}
 		case "none":
-			// Anthropic没有"none"选项，返回nil表示不强制使用工具
-			return nil
+			return &types.ToolChoice{Type: "none"}
 		default:
 			// 未知字符串，默认为auto
 			return &types.ToolChoice{Type: "auto"}
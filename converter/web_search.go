@@ -0,0 +1,121 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro2api/types"
+	"kiro2api/websearch"
+)
+
+// web_search 服务端工具模拟：向上游声明为普通工具，由代理拦截调用并执行搜索
+
+const webSearchToolDescription = "Search the web for up-to-date information. " +
+	"Returns the title, URL and a snippet of each matching page. " +
+	"Use it for recent events or facts you are unsure about, and cite the URLs you rely on."
+
+// webSearchToolSpec 构造声明给上游的 web_search 工具
+func webSearchToolSpec(name string) types.CodeWhispererTool {
+	cwTool := types.CodeWhispererTool{}
+	cwTool.ToolSpecification.Name = name
+	cwTool.ToolSpecification.Description = webSearchToolDescription
+	cwTool.ToolSpecification.InputSchema = types.InputSchema{
+		Json: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"query": map[string]any{
+					"type":        "string",
+					"description": "The search query",
+				},
+			},
+			"required": []any{"query"},
+		},
+	}
+	return cwTool
+}
+
+// isWebSearchToolName 是否为 web_search 工具名
+func isWebSearchToolName(name string) bool {
+	return name == "web_search" || name == "websearch"
+}
+
+// filterWebSearchToolUse 未启用模拟时，历史中的 web_search 调用被静默过滤
+func filterWebSearchToolUse(name string) bool {
+	return isWebSearchToolName(name) && !websearch.Enabled()
+}
+
+// serverToolUseQuery 提取历史中 server_tool_use 块的 id 与查询词
+func serverToolUseQuery(block map[string]any) (id, query string) {
+	id, _ = block["id"].(string)
+	if input, ok := block["input"].(map[string]any); ok {
+		query, _ = input["query"].(string)
+	}
+	return id, query
+}
+
+// renderWebSearchResult 将历史中的 web_search_tool_result 块还原为提供给上游的文本
+func renderWebSearchResult(query string, content any) string {
+	switch v := content.(type) {
+	case []any:
+		results := make([]websearch.Result, 0, len(v))
+		for _, item := range v {
+			m, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			r := websearch.Result{}
+			r.Title, _ = m["title"].(string)
+			r.URL, _ = m["url"].(string)
+			r.PageAge, _ = m["page_age"].(string)
+			if encoded, ok := m["encrypted_content"].(string); ok {
+				r.Snippet = websearch.DecodeContent(encoded)
+			}
+			results = append(results, r)
+		}
+		return websearch.FormatResults(query, results)
+	case map[string]any:
+		code, _ := v["error_code"].(string)
+		return fmt.Sprintf("Web search for query %q failed: %s", query, code)
+	}
+	return ""
+}
+
+// webSearchHistoryText 将助手历史中的 server_tool_use / web_search_tool_result 块还原为文本
+// hasText 表示消息中是否还有普通文本块
+func webSearchHistoryText(content any) (text string, hasText bool) {
+	blocks, ok := content.([]any)
+	if !ok {
+		return "", false
+	}
+	queries := make(map[string]string) // server_tool_use id -> 查询词
+	var parts []string
+	for _, item := range blocks {
+		block, ok := item.(map[string]any)
+		if !ok {
+			continue
+		}
+		switch block["type"] {
+		case "server_tool_use":
+			id, query := serverToolUseQuery(block)
+			queries[id] = query
+		case "web_search_tool_result":
+			id, _ := block["tool_use_id"].(string)
+			if rendered := renderWebSearchResult(queries[id], block["content"]); rendered != "" {
+				parts = append(parts, rendered)
+			}
+		case "text":
+			if t, _ := block["text"].(string); t != "" {
+				hasText = true
+			}
+		}
+	}
+	return strings.Join(parts, "\n\n"), hasText
+}
+
+// wrapHistoryBlock 历史文本中的独立段落
+func wrapHistoryBlock(text string) string {
+	if text == "" {
+		return ""
+	}
+	return "\n\n" + strings.TrimSpace(text) + "\n\n"
+}
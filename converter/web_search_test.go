@@ -0,0 +1,93 @@
+package converter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"kiro2api/types"
+	"kiro2api/websearch"
+)
+
+func buildWebSearchTestRequest(t *testing.T, messages []types.AnthropicRequestMessage) types.CodeWhispererRequest {
+	t.Helper()
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 1024,
+		Messages:  messages,
+		Tools:     []types.AnthropicTool{{Type: "web_search_20250305", Name: "web_search"}},
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	cwReq, err := BuildCodeWhispererRequest(req, c)
+	if err != nil {
+		t.Fatalf("BuildCodeWhispererRequest() error = %v", err)
+	}
+	return cwReq
+}
+
+func TestBuildCodeWhispererRequest_WebSearchTool(t *testing.T) {
+	messages := []types.AnthropicRequestMessage{{Role: "user", Content: "Go 最新版本？"}}
+
+	websearch.SetBackend(nil)
+	tools := buildWebSearchTestRequest(t, messages).ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools
+	if len(tools) != 0 {
+		t.Errorf("tools = %d, want web_search filtered when emulation is disabled", len(tools))
+	}
+
+	websearch.SetBackend(&websearch.StubBackend{})
+	defer websearch.SetBackend(nil)
+	tools = buildWebSearchTestRequest(t, messages).ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools
+	if len(tools) != 1 || tools[0].ToolSpecification.Name != "web_search" {
+		t.Fatalf("tools = %+v, want declared web_search tool", tools)
+	}
+	if _, ok := tools[0].ToolSpecification.InputSchema.Json["properties"].(map[string]any)["query"]; !ok {
+		t.Errorf("web_search schema should declare query")
+	}
+}
+
+func TestBuildCodeWhispererRequest_WebSearchHistory(t *testing.T) {
+	websearch.SetBackend(&websearch.StubBackend{})
+	defer websearch.SetBackend(nil)
+
+	cwReq := buildWebSearchTestRequest(t, []types.AnthropicRequestMessage{
+		{Role: "user", Content: "Go 最新版本？"},
+		{Role: "assistant", Content: []any{
+			map[string]any{"type": "server_tool_use", "id": "srvtoolu_1", "name": "web_search", "input": map[string]any{"query": "golang latest"}},
+			map[string]any{"type": "web_search_tool_result", "tool_use_id": "srvtoolu_1", "content": []any{
+				map[string]any{"type": "web_search_result", "title": "Go 1.25", "url": "https://go.dev/doc/go1.25", "encrypted_content": websearch.EncodeContent("Release notes"), "page_age": "2025-08-12"},
+			}},
+			map[string]any{"type": "text", "text": "最新版本是 Go 1.25。"},
+		}},
+		{Role: "user", Content: "谢谢"},
+	})
+
+	var assistant *types.HistoryAssistantMessage
+	for _, h := range cwReq.ConversationState.History {
+		if msg, ok := h.(types.HistoryAssistantMessage); ok {
+			assistant = &msg
+		}
+	}
+	if assistant == nil {
+		t.Fatal("history should contain the assistant turn")
+	}
+	content := assistant.AssistantResponseMessage.Content
+	for _, want := range []string{`query: "golang latest"`, "https://go.dev/doc/go1.25", "Release notes", "最新版本是 Go 1.25。"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("assistant content = %q, want it to contain %q", content, want)
+		}
+	}
+	if len(assistant.AssistantResponseMessage.ToolUses) != 0 {
+		t.Errorf("server tool blocks should not become tool uses, got %d", len(assistant.AssistantResponseMessage.ToolUses))
+	}
+}
+
+func TestRenderWebSearchResult_Error(t *testing.T) {
+	got := renderWebSearchResult("q", map[string]any{"type": "web_search_tool_result_error", "error_code": "max_uses_exceeded"})
+	if got != `Web search for query "q" failed: max_uses_exceeded` {
+		t.Errorf("renderWebSearchResult() = %q", got)
+	}
+}
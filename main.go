@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"strings"
 
@@ -26,6 +27,11 @@ func main() {
 		logger.String("config_level", os.Getenv("LOG_LEVEL")),
 		logger.String("config_file", os.Getenv("LOG_FILE")))
 
+	// 回放模式：./kiro2api replay <捕获目录>...
+	if len(os.Args) > 2 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
 	// 初始化管理存储
 	dataDir := os.Getenv("K2A_DATA_DIR")
 	if dataDir == "" {
@@ -37,6 +43,14 @@ func main() {
 		logger.Info("管理存储初始化成功", logger.String("data_dir", dataDir))
 	}
 
+	server.InitCapture(dataDir)
+
+	// 加载请求改写规则，规则文件无效时拒绝启动，避免运维策略静默失效
+	if err := server.InitRewriteRules(); err != nil {
+		logger.Error("加载请求改写规则失败", logger.Err(err))
+		os.Exit(1)
+	}
+
 	// 初始化代理池（如果配置了代理）
 	initProxyPool()
 
@@ -50,6 +64,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	// 初始化响应缓存，配置无效时拒绝启动
+	if err := server.InitResponseCache(dataDir); err != nil {
+		logger.Error("初始化响应缓存失败", logger.Err(err))
+		os.Exit(1)
+	}
+
+	// 初始化消息批次，继续处理重启前未完成的批次
+	if err := server.InitBatches(dataDir, authService); err != nil {
+		logger.Warn("消息批次初始化失败，/v1/messages/batches 不可用", logger.Err(err))
+	}
+
 	port := "8080" // 默认端口
 	if len(os.Args) > 1 {
 		port = os.Args[1]
@@ -72,6 +97,32 @@ func main() {
 }
 
 
+// runReplay 回放捕获并输出与原始下发事件的差异，全部一致时返回0
+func runReplay(dirs []string) int {
+	exitCode := 0
+	for _, dir := range dirs {
+		result, err := server.ReplayCapture(dir)
+		if err != nil {
+			fmt.Printf("%s: 回放失败: %v\n", dir, err)
+			exitCode = 1
+			continue
+		}
+		if result.Meta.Truncated {
+			fmt.Printf("%s: 警告: 捕获已截断，差异可能来自缺失的数据\n", dir)
+		}
+		if result.Match() {
+			fmt.Printf("%s: 一致 (%d 个事件)\n", dir, len(result.Replayed))
+			continue
+		}
+		exitCode = 1
+		fmt.Printf("%s: 不一致 (捕获 %d 个事件, 回放 %d 个事件)\n", dir, len(result.Recorded), len(result.Replayed))
+		for _, line := range result.Diff {
+			fmt.Println(line)
+		}
+	}
+	return exitCode
+}
+
 // initProxyPool 初始化代理池
 func initProxyPool() {
 	proxyList := os.Getenv("PROXY_POOL")
@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+)
+
+// ErrorRateTracker 上游错误率滑动窗口统计
+// 窗口内请求数达到下限且错误率超过阈值时发送一次 upstream_error_spike，错误率回落后才会再次告警
+type ErrorRateTracker struct {
+	mutex            sync.Mutex
+	window           time.Duration
+	thresholdPercent int
+	minRequests      int
+	results          []upstreamResult
+	alerting         bool
+
+	notify func(Event)
+}
+
+type upstreamResult struct {
+	at      time.Time
+	success bool
+}
+
+var (
+	globalErrorRateTracker *ErrorRateTracker
+	errorRateTrackerOnce   sync.Once
+)
+
+// GetErrorRateTracker 获取全局上游错误率统计
+func GetErrorRateTracker() *ErrorRateTracker {
+	errorRateTrackerOnce.Do(func() {
+		globalErrorRateTracker = NewErrorRateTracker(
+			config.UpstreamErrorSpikeWindow,
+			config.UpstreamErrorSpikeThreshold,
+			config.UpstreamErrorSpikeMinRequests,
+			Send,
+		)
+	})
+	return globalErrorRateTracker
+}
+
+// NewErrorRateTracker 创建错误率统计
+func NewErrorRateTracker(window time.Duration, thresholdPercent, minRequests int, notify func(Event)) *ErrorRateTracker {
+	return &ErrorRateTracker{
+		window:           window,
+		thresholdPercent: thresholdPercent,
+		minRequests:      minRequests,
+		notify:           notify,
+	}
+}
+
+// Record 记录一次上游请求结果
+func (t *ErrorRateTracker) Record(success bool) {
+	if t.thresholdPercent <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	t.mutex.Lock()
+	t.results = append(t.results, upstreamResult{at: now, success: success})
+
+	// 丢弃窗口外的记录
+	cutoff := now.Add(-t.window)
+	drop := 0
+	for drop < len(t.results) && t.results[drop].at.Before(cutoff) {
+		drop++
+	}
+	t.results = t.results[drop:]
+
+	total := len(t.results)
+	failures := 0
+	for _, r := range t.results {
+		if !r.success {
+			failures++
+		}
+	}
+	rate := failures * 100 / total
+
+	var event *Event
+	switch {
+	case total >= t.minRequests && rate >= t.thresholdPercent && !t.alerting:
+		t.alerting = true
+		event = &Event{
+			Type:     EventUpstreamErrorSpike,
+			Severity: SeverityCritical,
+			Title:    "上游错误率突增",
+			Message:  fmt.Sprintf("最近 %s 内上游错误率 %d%%（%d/%d），超过阈值 %d%%", t.window, rate, failures, total, t.thresholdPercent),
+			Key:      "upstream",
+			Fields: map[string]any{
+				"error_rate_percent": rate,
+				"failures":           failures,
+				"total":              total,
+			},
+		}
+	case rate < t.thresholdPercent:
+		t.alerting = false
+	}
+	t.mutex.Unlock()
+
+	if event != nil && t.notify != nil {
+		t.notify(*event)
+	}
+}
+
+// GetStats 获取当前窗口统计
+func (t *ErrorRateTracker) GetStats() map[string]any {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	failures := 0
+	for _, r := range t.results {
+		if !r.success {
+			failures++
+		}
+	}
+	return map[string]any{
+		"window_s":          t.window.Seconds(),
+		"threshold_percent": t.thresholdPercent,
+		"min_requests":      t.minRequests,
+		"total":             len(t.results),
+		"failures":          failures,
+		"alerting":          t.alerting,
+	}
+}
@@ -0,0 +1,338 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// EventType 运维事件类型
+type EventType string
+
+const (
+	EventTokenExhausted     EventType = "token_exhausted"      // token额度耗尽
+	EventAccountSuspended   EventType = "account_suspended"    // 账号被AWS暂停
+	EventRefreshFailed      EventType = "refresh_failed"       // token刷新失败
+	EventProxyPoolEmpty     EventType = "proxy_pool_empty"     // 代理池无可用代理
+	EventUpstreamErrorSpike EventType = "upstream_error_spike" // 上游错误率突增
+	EventTokenHealthChanged EventType = "token_health_changed" // 账号健康状态变化
+)
+
+// Severity 事件严重程度
+type Severity string
+
+const (
+	SeverityInfo     Severity = "info"
+	SeverityWarning  Severity = "warning"
+	SeverityCritical Severity = "critical"
+)
+
+// Event 通用事件负载（generic 格式直接序列化此结构）
+type Event struct {
+	Type      EventType      `json:"type"`
+	Severity  Severity       `json:"severity"`
+	Title     string         `json:"title"`
+	Message   string         `json:"message"`
+	Key       string         `json:"key,omitempty"` // 去重维度，如 token_0、proxy_pool
+	Fields    map[string]any `json:"fields,omitempty"`
+	Service   string         `json:"service"`
+	Timestamp time.Time      `json:"timestamp"`
+}
+
+// Webhook 单个通知目标
+type Webhook struct {
+	URL    string
+	Format string // generic / slack / dingtalk / feishu
+}
+
+// NotifierConfig 通知器配置
+type NotifierConfig struct {
+	Webhooks     []Webhook
+	Events       []EventType // 为空表示全部事件
+	DedupeWindow time.Duration
+	MaxRetries   int
+	RetryBackoff time.Duration
+	Timeout      time.Duration
+}
+
+// DefaultNotifierConfig 默认配置（从config包读取）
+func DefaultNotifierConfig() NotifierConfig {
+	var events []EventType
+	for _, e := range strings.Split(config.NotifyEvents, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			events = append(events, EventType(e))
+		}
+	}
+
+	return NotifierConfig{
+		Webhooks:     ParseWebhooks(config.NotifyWebhooks),
+		Events:       events,
+		DedupeWindow: config.NotifyDedupeWindow,
+		MaxRetries:   config.NotifyMaxRetries,
+		RetryBackoff: config.NotifyRetryBackoff,
+		Timeout:      config.NotifyTimeout,
+	}
+}
+
+// ParseWebhooks 解析逗号分隔的 Webhook 列表
+// 每项格式为 [format+]URL，例如 slack+https://hooks.slack.com/services/xxx
+func ParseWebhooks(raw string) []Webhook {
+	var hooks []Webhook
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		hook := Webhook{URL: item, Format: FormatGeneric}
+		if prefix, rest, found := strings.Cut(item, "+"); found && isKnownFormat(prefix) {
+			hook.Format = prefix
+			hook.URL = rest
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// Notifier 事件通知器
+// 事件按类型过滤、按 type+key 在窗口内去重，随后异步投递到每个 Webhook（失败时指数退避重试）
+type Notifier struct {
+	webhooks     []Webhook
+	events       map[EventType]bool
+	client       *http.Client
+	dedupeWindow time.Duration
+	maxRetries   int
+	retryBackoff time.Duration
+
+	mutex    sync.Mutex
+	lastSent map[string]time.Time // 去重记录：type:key -> 最后发送时间
+
+	wg sync.WaitGroup
+
+	// 统计 - 使用atomic操作
+	sent    int64
+	failed  int64
+	deduped int64
+	retries int64
+}
+
+var (
+	globalNotifier *Notifier
+	notifierOnce   sync.Once
+)
+
+// GetNotifier 获取全局通知器
+func GetNotifier() *Notifier {
+	notifierOnce.Do(func() {
+		globalNotifier = NewNotifier(DefaultNotifierConfig())
+		if globalNotifier.IsEnabled() {
+			logger.Info("事件通知已启用",
+				logger.Int("webhook_count", len(globalNotifier.webhooks)),
+				logger.Duration("dedupe_window", globalNotifier.dedupeWindow))
+		}
+	})
+	return globalNotifier
+}
+
+// Send 通过全局通知器发送事件
+func Send(event Event) {
+	GetNotifier().Notify(event)
+}
+
+// NewNotifier 创建通知器
+func NewNotifier(cfg NotifierConfig) *Notifier {
+	var events map[EventType]bool
+	if len(cfg.Events) > 0 {
+		events = make(map[EventType]bool, len(cfg.Events))
+		for _, e := range cfg.Events {
+			events[e] = true
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	return &Notifier{
+		webhooks:     cfg.Webhooks,
+		events:       events,
+		client:       &http.Client{Timeout: cfg.Timeout},
+		dedupeWindow: cfg.DedupeWindow,
+		maxRetries:   cfg.MaxRetries,
+		retryBackoff: cfg.RetryBackoff,
+		lastSent:     make(map[string]time.Time),
+	}
+}
+
+// IsEnabled 是否配置了 Webhook
+func (n *Notifier) IsEnabled() bool {
+	return len(n.webhooks) > 0
+}
+
+// Notify 异步发送事件（未启用、被过滤或在去重窗口内时直接丢弃）
+func (n *Notifier) Notify(event Event) {
+	if !n.IsEnabled() {
+		return
+	}
+	if n.events != nil && !n.events[event.Type] {
+		return
+	}
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	if event.Service == "" {
+		event.Service = "kiro2api"
+	}
+	if event.Severity == "" {
+		event.Severity = SeverityWarning
+	}
+
+	if n.isDuplicate(event) {
+		atomic.AddInt64(&n.deduped, 1)
+		logger.Debug("事件在去重窗口内，跳过通知",
+			logger.String("type", string(event.Type)),
+			logger.String("key", event.Key))
+		return
+	}
+
+	for _, hook := range n.webhooks {
+		n.wg.Add(1)
+		go func(hook Webhook) {
+			defer n.wg.Done()
+			n.deliver(hook, event)
+		}(hook)
+	}
+}
+
+// Wait 等待所有正在投递的通知完成
+func (n *Notifier) Wait() {
+	n.wg.Wait()
+}
+
+// isDuplicate 检查并记录去重窗口
+func (n *Notifier) isDuplicate(event Event) bool {
+	if n.dedupeWindow <= 0 {
+		return false
+	}
+
+	dedupeKey := string(event.Type) + ":" + event.Key
+	now := time.Now()
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if last, exists := n.lastSent[dedupeKey]; exists && now.Sub(last) < n.dedupeWindow {
+		return true
+	}
+	n.lastSent[dedupeKey] = now
+
+	// 顺带清理过期记录，避免无限增长
+	if len(n.lastSent) > 1000 {
+		for k, t := range n.lastSent {
+			if now.Sub(t) >= n.dedupeWindow {
+				delete(n.lastSent, k)
+			}
+		}
+	}
+	return false
+}
+
+// deliver 投递到单个 Webhook，网络错误、5xx 和 429 按指数退避重试
+func (n *Notifier) deliver(hook Webhook, event Event) {
+	body, err := renderPayload(hook.Format, event)
+	if err != nil {
+		atomic.AddInt64(&n.failed, 1)
+		logger.Warn("渲染通知负载失败",
+			logger.String("format", hook.Format),
+			logger.Err(err))
+		return
+	}
+
+	backoff := n.retryBackoff
+	for attempt := 0; ; attempt++ {
+		retryable, err := n.post(hook.URL, body)
+		if err == nil {
+			atomic.AddInt64(&n.sent, 1)
+			logger.Debug("事件通知已发送",
+				logger.String("type", string(event.Type)),
+				logger.String("format", hook.Format))
+			return
+		}
+
+		if !retryable || attempt >= n.maxRetries {
+			atomic.AddInt64(&n.failed, 1)
+			logger.Warn("事件通知发送失败",
+				logger.String("type", string(event.Type)),
+				logger.String("webhook", maskWebhookURL(hook.URL)),
+				logger.Int("attempts", attempt+1),
+				logger.Err(err))
+			return
+		}
+
+		atomic.AddInt64(&n.retries, 1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post 发送一次请求，返回错误是否可重试
+func (n *Notifier) post(url string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("状态码 %d", resp.StatusCode)
+}
+
+// GetStats 获取通知统计信息
+func (n *Notifier) GetStats() map[string]any {
+	webhooks := make([]map[string]string, 0, len(n.webhooks))
+	for _, hook := range n.webhooks {
+		webhooks = append(webhooks, map[string]string{
+			"url":    maskWebhookURL(hook.URL),
+			"format": hook.Format,
+		})
+	}
+
+	return map[string]any{
+		"enabled":         n.IsEnabled(),
+		"webhooks":        webhooks,
+		"dedupe_window_s": n.dedupeWindow.Seconds(),
+		"max_retries":     n.maxRetries,
+		"sent":            atomic.LoadInt64(&n.sent),
+		"failed":          atomic.LoadInt64(&n.failed),
+		"deduped":         atomic.LoadInt64(&n.deduped),
+		"retries":         atomic.LoadInt64(&n.retries),
+	}
+}
+
+// maskWebhookURL 隐藏 Webhook URL 中的路径和参数（通常包含密钥）
+func maskWebhookURL(rawURL string) string {
+	if idx := strings.Index(rawURL, "://"); idx >= 0 {
+		if slash := strings.Index(rawURL[idx+3:], "/"); slash >= 0 {
+			return rawURL[:idx+3+slash] + "/***"
+		}
+	}
+	return rawURL
+}
@@ -0,0 +1,212 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testReceiver 本地 Webhook 接收端，记录收到的请求体
+type testReceiver struct {
+	server   *httptest.Server
+	mutex    sync.Mutex
+	bodies   [][]byte
+	attempts int32
+}
+
+// newTestReceiver 前 failFirst 次请求返回 status，之后返回 200
+func newTestReceiver(t *testing.T, failFirst int32, status int) *testReceiver {
+	r := &testReceiver{}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&r.attempts, 1)
+		body, _ := io.ReadAll(req.Body)
+		if n <= failFirst {
+			w.WriteHeader(status)
+			return
+		}
+		r.mutex.Lock()
+		r.bodies = append(r.bodies, body)
+		r.mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *testReceiver) received() [][]byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([][]byte(nil), r.bodies...)
+}
+
+func newTestNotifier(hooks ...Webhook) *Notifier {
+	return NewNotifier(NotifierConfig{
+		Webhooks:     hooks,
+		DedupeWindow: time.Minute,
+		MaxRetries:   3,
+		RetryBackoff: time.Millisecond,
+		Timeout:      time.Second,
+	})
+}
+
+func testEvent(key string) Event {
+	return Event{
+		Type:     EventTokenExhausted,
+		Severity: SeverityWarning,
+		Title:    "Token额度耗尽",
+		Message:  key + " 可用次数已降为 0",
+		Key:      key,
+		Fields:   map[string]any{"token_key": key},
+	}
+}
+
+func TestParseWebhooks(t *testing.T) {
+	hooks := ParseWebhooks(" https://example.com/a , slack+https://hooks.slack.com/x,dingtalk+https://oapi.dingtalk.com/robot/send?access_token=t,unknown+https://b ")
+
+	require.Len(t, hooks, 4)
+	assert.Equal(t, Webhook{URL: "https://example.com/a", Format: FormatGeneric}, hooks[0])
+	assert.Equal(t, Webhook{URL: "https://hooks.slack.com/x", Format: FormatSlack}, hooks[1])
+	assert.Equal(t, FormatDingTalk, hooks[2].Format)
+	assert.Equal(t, Webhook{URL: "unknown+https://b", Format: FormatGeneric}, hooks[3], "未知前缀视为URL的一部分")
+}
+
+func TestNotifier_GenericPayload(t *testing.T) {
+	r := newTestReceiver(t, 0, 0)
+	n := newTestNotifier(Webhook{URL: r.server.URL, Format: FormatGeneric})
+
+	n.Notify(testEvent("token_0"))
+	n.Wait()
+
+	bodies := r.received()
+	require.Len(t, bodies, 1)
+
+	var got Event
+	require.NoError(t, json.Unmarshal(bodies[0], &got))
+	assert.Equal(t, EventTokenExhausted, got.Type)
+	assert.Equal(t, "kiro2api", got.Service)
+	assert.Equal(t, "token_0", got.Fields["token_key"])
+	assert.False(t, got.Timestamp.IsZero())
+}
+
+func TestNotifier_ChatTemplates(t *testing.T) {
+	slack := newTestReceiver(t, 0, 0)
+	dingtalk := newTestReceiver(t, 0, 0)
+	feishu := newTestReceiver(t, 0, 0)
+	n := newTestNotifier(
+		Webhook{URL: slack.server.URL, Format: FormatSlack},
+		Webhook{URL: dingtalk.server.URL, Format: FormatDingTalk},
+		Webhook{URL: feishu.server.URL, Format: FormatFeishu},
+	)
+
+	n.Notify(testEvent("token_0"))
+	n.Wait()
+
+	var slackBody struct {
+		Text string `json:"text"`
+	}
+	require.NoError(t, json.Unmarshal(slack.received()[0], &slackBody))
+	assert.Contains(t, slackBody.Text, "[kiro2api][warning] Token额度耗尽")
+	assert.Contains(t, slackBody.Text, "token_key: token_0")
+
+	var dingBody struct {
+		MsgType  string            `json:"msgtype"`
+		Markdown map[string]string `json:"markdown"`
+	}
+	require.NoError(t, json.Unmarshal(dingtalk.received()[0], &dingBody))
+	assert.Equal(t, "markdown", dingBody.MsgType)
+	assert.Contains(t, dingBody.Markdown["text"], "token_0 可用次数已降为 0")
+
+	var feishuBody struct {
+		MsgType string            `json:"msg_type"`
+		Content map[string]string `json:"content"`
+	}
+	require.NoError(t, json.Unmarshal(feishu.received()[0], &feishuBody))
+	assert.Equal(t, "text", feishuBody.MsgType)
+	assert.Contains(t, feishuBody.Content["text"], "type: token_exhausted")
+}
+
+func TestNotifier_RetriesServerErrors(t *testing.T) {
+	r := newTestReceiver(t, 2, http.StatusBadGateway)
+	n := newTestNotifier(Webhook{URL: r.server.URL})
+
+	n.Notify(testEvent("token_0"))
+	n.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&r.attempts))
+	assert.Len(t, r.received(), 1)
+	stats := n.GetStats()
+	assert.Equal(t, int64(1), stats["sent"])
+	assert.Equal(t, int64(2), stats["retries"])
+}
+
+func TestNotifier_DoesNotRetryClientErrors(t *testing.T) {
+	r := newTestReceiver(t, 100, http.StatusBadRequest)
+	n := newTestNotifier(Webhook{URL: r.server.URL})
+
+	n.Notify(testEvent("token_0"))
+	n.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&r.attempts))
+	assert.Equal(t, int64(1), n.GetStats()["failed"])
+}
+
+func TestNotifier_DedupeWindow(t *testing.T) {
+	r := newTestReceiver(t, 0, 0)
+	n := newTestNotifier(Webhook{URL: r.server.URL})
+
+	n.Notify(testEvent("token_0"))
+	n.Notify(testEvent("token_0"))
+	n.Notify(testEvent("token_1"))
+	n.Wait()
+
+	assert.Len(t, r.received(), 2, "同一对象的重复事件应被去重")
+	assert.Equal(t, int64(1), n.GetStats()["deduped"])
+}
+
+func TestNotifier_EventFilterAndDisabled(t *testing.T) {
+	r := newTestReceiver(t, 0, 0)
+	n := NewNotifier(NotifierConfig{
+		Webhooks: []Webhook{{URL: r.server.URL}},
+		Events:   []EventType{EventAccountSuspended},
+	})
+
+	n.Notify(testEvent("token_0"))
+	n.Notify(Event{Type: EventAccountSuspended, Key: "token_0"})
+	n.Wait()
+	assert.Len(t, r.received(), 1)
+
+	disabled := NewNotifier(NotifierConfig{})
+	assert.False(t, disabled.IsEnabled())
+	disabled.Notify(testEvent("token_0"))
+}
+
+func TestErrorRateTracker_SpikeAlertsOnce(t *testing.T) {
+	var events []Event
+	tracker := NewErrorRateTracker(time.Minute, 50, 4, func(e Event) { events = append(events, e) })
+
+	tracker.Record(true)
+	tracker.Record(false)
+	tracker.Record(false)
+	assert.Empty(t, events, "未达到最小请求数不告警")
+
+	tracker.Record(false)
+	require.Len(t, events, 1)
+	assert.Equal(t, EventUpstreamErrorSpike, events[0].Type)
+	assert.Equal(t, 75, events[0].Fields["error_rate_percent"])
+
+	// 告警期间不重复发送，错误率回落后复位
+	tracker.Record(false)
+	assert.Len(t, events, 1)
+	for i := 0; i < 10; i++ {
+		tracker.Record(true)
+	}
+	assert.False(t, tracker.GetStats()["alerting"].(bool))
+}
@@ -0,0 +1,79 @@
+package notify
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"kiro2api/utils"
+)
+
+// Webhook 负载格式
+const (
+	FormatGeneric  = "generic"  // 直接发送 Event JSON
+	FormatSlack    = "slack"    // Slack Incoming Webhook
+	FormatDingTalk = "dingtalk" // 钉钉自定义机器人（markdown）
+	FormatFeishu   = "feishu"   // 飞书自定义机器人（text）
+)
+
+// isKnownFormat 是否为支持的负载格式
+func isKnownFormat(format string) bool {
+	switch format {
+	case FormatGeneric, FormatSlack, FormatDingTalk, FormatFeishu:
+		return true
+	}
+	return false
+}
+
+// renderPayload 按格式渲染请求体
+func renderPayload(format string, event Event) ([]byte, error) {
+	switch format {
+	case FormatSlack:
+		return utils.SafeMarshal(map[string]any{
+			"text": fmt.Sprintf("*%s*\n%s", eventHeadline(event), eventBody(event, "• ")),
+		})
+	case FormatDingTalk:
+		return utils.SafeMarshal(map[string]any{
+			"msgtype": "markdown",
+			"markdown": map[string]string{
+				"title": eventHeadline(event),
+				"text":  fmt.Sprintf("### %s\n\n%s", eventHeadline(event), eventBody(event, "- ")),
+			},
+		})
+	case FormatFeishu:
+		return utils.SafeMarshal(map[string]any{
+			"msg_type": "text",
+			"content": map[string]string{
+				"text": fmt.Sprintf("%s\n%s", eventHeadline(event), eventBody(event, "")),
+			},
+		})
+	default:
+		return utils.SafeMarshal(event)
+	}
+}
+
+// eventHeadline 标题行，包含服务名便于机器人关键词校验
+func eventHeadline(event Event) string {
+	return fmt.Sprintf("[%s][%s] %s", event.Service, event.Severity, event.Title)
+}
+
+// eventBody 正文：消息 + 按 key 排序的字段列表
+func eventBody(event Event, bullet string) string {
+	var sb strings.Builder
+	sb.WriteString(event.Message)
+	sb.WriteString("\n")
+
+	keys := make([]string, 0, len(event.Fields))
+	for k := range event.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "\n%s%s: %v", bullet, k, event.Fields[k])
+	}
+	fmt.Fprintf(&sb, "\n%stype: %s", bullet, event.Type)
+	fmt.Fprintf(&sb, "\n%stime: %s", bullet, event.Timestamp.Format(time.RFC3339))
+	return sb.String()
+}
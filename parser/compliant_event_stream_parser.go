@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"kiro2api/logger"
 )
@@ -24,24 +25,37 @@ func (cesp *CompliantEventStreamParser) SetMaxErrors(maxErrors int) {
 	cesp.robustParser.SetMaxErrors(maxErrors)
 }
 
+// SetStrictMode 设置帧校验失败时是否中止流（默认取 EVENTSTREAM_CRC_MODE）
+func (cesp *CompliantEventStreamParser) SetStrictMode(strict bool) {
+	cesp.robustParser.SetStrictMode(strict)
+}
+
 // SetThinkingContext 设置 thinking 流式上下文（借鉴 kiro.rs）
 func (cesp *CompliantEventStreamParser) SetThinkingContext(ctx *ThinkingStreamContext) {
 	cesp.messageProcessor.SetThinkingContext(ctx)
 }
 
+// SetToolNameResolver 设置工具名还原函数（用于还原发送上游前改写的工具名）
+func (cesp *CompliantEventStreamParser) SetToolNameResolver(resolve func(string) string) {
+	cesp.messageProcessor.toolManager.SetToolNameResolver(resolve)
+}
+
 // FlushThinkingBuffer 刷新 thinking 缓冲区，返回剩余事件
 // 在流结束时调用，确保缓冲区中的内容被正确输出
 func (cesp *CompliantEventStreamParser) FlushThinkingBuffer() []SSEEvent {
+	// 流结束时关闭仍打开的结构化 thinking 块
+	events := cesp.messageProcessor.endThinking()
+
 	ctx := cesp.messageProcessor.GetThinkingContext()
 	if ctx == nil || !ctx.ThinkingEnabled {
-		return nil
+		return events
 	}
 
 	result := ctx.FlushBuffer()
-	var events []SSEEvent
 
 	// 输出剩余的 thinking 内容
 	if result.ThinkingContent != "" {
+		cesp.messageProcessor.thinkingText.WriteString(result.ThinkingContent)
 		events = append(events, SSEEvent{
 			Event: "content_block_delta",
 			Data: map[string]any{
@@ -55,18 +69,18 @@ func (cesp *CompliantEventStreamParser) FlushThinkingBuffer() []SSEEvent {
 		})
 	}
 
+	// 标签未闭合的 thinking 块在结束前补充签名
+	if ctx.IsInThinkingBlock() {
+		events = append(events, cesp.messageProcessor.thinkingSignatureEvent(ctx.GetThinkingBlockIndex()))
+	}
+
 	// 输出剩余的文本内容
 	if result.TextContent != "" {
-		textIndex := 0
-		if ctx.IsThinkingExtracted() {
-			textIndex = ctx.GetTextBlockIndex()
-		}
-
 		events = append(events, SSEEvent{
 			Event: "content_block_delta",
 			Data: map[string]any{
 				"type":  "content_block_delta",
-				"index": textIndex,
+				"index": ctx.CurrentTextBlockIndex(),
 				"delta": map[string]any{
 					"type": "text_delta",
 					"text": result.TextContent,
@@ -89,6 +103,9 @@ func (cesp *CompliantEventStreamParser) ParseResponse(streamData []byte) (*Parse
 	// 1. 解析二进制事件流
 	messages, err := cesp.robustParser.ParseStream(streamData)
 	if err != nil {
+		if errors.Is(err, ErrStreamCorrupted) {
+			return nil, err
+		}
 		logger.Warn("事件流解析部分失败", logger.Err(err))
 	}
 
@@ -134,11 +151,17 @@ func (cesp *CompliantEventStreamParser) ParseResponse(streamData []byte) (*Parse
 }
 
 // ParseStream 解析流式数据（增量解析）
+// 仅在严格模式检测到损坏帧时返回 ErrStreamCorrupted，此前已解析的事件仍会返回
 func (cesp *CompliantEventStreamParser) ParseStream(data []byte) ([]SSEEvent, error) {
 	// 解析新的消息
 	messages, err := cesp.robustParser.ParseStream(data)
+	var streamErr error
 	if err != nil {
-		logger.Warn("流式解析部分失败", logger.Err(err))
+		if errors.Is(err, ErrStreamCorrupted) {
+			streamErr = err
+		} else {
+			logger.Warn("流式解析部分失败", logger.Err(err))
+		}
 	}
 
 	var allEvents []SSEEvent
@@ -154,7 +177,12 @@ func (cesp *CompliantEventStreamParser) ParseStream(data []byte) ([]SSEEvent, er
 		allEvents = append(allEvents, events...)
 	}
 
-	return allEvents, nil
+	return allEvents, streamErr
+}
+
+// ProcessMessage 处理已解码的单条消息（配合 Decoder 使用）
+func (cesp *CompliantEventStreamParser) ProcessMessage(message *EventStreamMessage) ([]SSEEvent, error) {
+	return cesp.messageProcessor.ProcessMessage(message)
 }
 
 // generateSummary 生成解析摘要
@@ -272,6 +300,52 @@ func (pr *ParseResult) GetCompletionText() string {
 	return text
 }
 
+// GetThinkingBlocks 按出现顺序汇总 thinking（含 signature）与 redacted_thinking 内容块
+// 无 thinking 上下文时推理块的索引固定为0，因此以块开始事件区分不同的块
+func (pr *ParseResult) GetThinkingBlocks() []map[string]any {
+	var blocks []map[string]any
+	open := make(map[int]map[string]any)
+
+	for _, event := range pr.Events {
+		data, ok := event.Data.(map[string]any)
+		if !ok {
+			continue
+		}
+		index, _ := data["index"].(int)
+		switch event.Event {
+		case "content_block_start":
+			cb, _ := data["content_block"].(map[string]any)
+			switch cb["type"] {
+			case "thinking":
+				block := map[string]any{"type": "thinking", "thinking": "", "signature": ""}
+				blocks = append(blocks, block)
+				open[index] = block
+			case "redacted_thinking":
+				blocks = append(blocks, map[string]any{"type": "redacted_thinking", "data": cb["data"]})
+				delete(open, index)
+			default:
+				delete(open, index)
+			}
+		case "content_block_delta":
+			block := open[index]
+			delta, _ := data["delta"].(map[string]any)
+			if block == nil || delta == nil {
+				continue
+			}
+			switch delta["type"] {
+			case "thinking_delta":
+				text, _ := delta["thinking"].(string)
+				block["thinking"] = block["thinking"].(string) + text
+			case "signature_delta":
+				block["signature"], _ = delta["signature"].(string)
+			}
+		case "content_block_stop":
+			delete(open, index)
+		}
+	}
+	return blocks
+}
+
 // GetToolCalls 获取所有工具调用
 func (pr *ParseResult) GetToolCalls() []*ToolExecution {
 	var tools []*ToolExecution
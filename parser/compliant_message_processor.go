@@ -19,6 +19,11 @@ type CompliantMessageProcessor struct {
 	toolBlockIndex map[string]int
 	// Thinking 流式上下文（借鉴 kiro.rs）
 	thinkingContext *ThinkingStreamContext
+	// 结构化推理块状态：当前打开的 thinking 块及其索引
+	thinkingBlockOpen  bool
+	thinkingBlockIndex int
+	// 当前 thinking 块的完整内容，块结束时据此生成签名
+	thinkingText strings.Builder
 }
 
 // EventHandler 事件处理器接口
@@ -70,11 +75,18 @@ func (cmp *CompliantMessageProcessor) Reset() {
 	if cmp.thinkingContext != nil {
 		cmp.thinkingContext.Reset()
 	}
+	cmp.thinkingBlockOpen = false
+	cmp.thinkingBlockIndex = 0
+	cmp.thinkingText.Reset()
 }
 
 // SetThinkingContext 设置 thinking 流式上下文
 func (cmp *CompliantMessageProcessor) SetThinkingContext(ctx *ThinkingStreamContext) {
 	cmp.thinkingContext = ctx
+	if ctx != nil && ctx.ThinkingEnabled {
+		// 工具块排在 thinking/文本块之后
+		cmp.toolManager.SetTextBlockIndexFunc(ctx.CurrentTextBlockIndex)
+	}
 }
 
 // GetThinkingContext 获取 thinking 流式上下文
@@ -106,8 +118,9 @@ func (cmp *CompliantMessageProcessor) registerEventHandlers() {
 	cmp.eventHandlers[EventTypes.METERING_EVENT] = &NoOpEventHandler{}
 	cmp.eventHandlers[EventTypes.CONTEXT_USAGE_EVENT] = &NoOpEventHandler{}
 
-	// Claude Extended Thinking 事件处理器
-	cmp.eventHandlers[EventTypes.THINKING_EVENT] = &ThinkingEventHandler{}
+	// 结构化推理事件处理器
+	cmp.eventHandlers[EventTypes.REASONING_CONTENT_EVENT] = &ThinkingEventHandler{cmp}
+	cmp.eventHandlers[EventTypes.THINKING_EVENT] = &ThinkingEventHandler{cmp}
 }
 
 // ProcessMessage 处理单个消息
@@ -140,10 +153,36 @@ func (cmp *CompliantMessageProcessor) ProcessMessage(message *EventStreamMessage
 	}
 }
 
+// RetainsPayload 判断处理消息后解析出的字符串是否仍引用 payload。
+// 流式解码器复用缓冲区，返回 true 时调用方需在处理前拷贝 payload；
+// 普通文本事件由处理器只拷贝正文，计量与上下文用量事件不保留任何内容
+func RetainsPayload(message *EventStreamMessage) bool {
+	if message.GetMessageType() != MessageTypes.EVENT {
+		return true
+	}
+	switch message.GetEventType() {
+	case EventTypes.METERING_EVENT, EventTypes.CONTEXT_USAGE_EVENT:
+		return false
+	case EventTypes.ASSISTANT_RESPONSE_EVENT:
+		return isToolCallEvent(message.Payload) || isThinkingEvent(message.Payload)
+	default:
+		return true
+	}
+}
+
 // processEventMessage 处理事件消息
 func (cmp *CompliantMessageProcessor) processEventMessage(message *EventStreamMessage, eventType string) ([]SSEEvent, error) {
 	// 查找并处理事件
 	if handler, exists := cmp.eventHandlers[eventType]; exists {
+		// 推理之后开始输出正文或工具调用：先结束 thinking 块，使后续文本写入文本块
+		if _, isThinking := handler.(*ThinkingEventHandler); !isThinking {
+			if _, isNoOp := handler.(*NoOpEventHandler); !isNoOp {
+				if stopEvents := cmp.endThinking(); len(stopEvents) > 0 {
+					events, err := handler.Handle(message)
+					return append(stopEvents, events...), err
+				}
+			}
+		}
 		return handler.Handle(message)
 	}
 
@@ -160,6 +199,147 @@ func (cmp *CompliantMessageProcessor) processEventMessage(message *EventStreamMe
 	return []SSEEvent{}, nil
 }
 
+// handleReasoning 将上游推理内容映射为 thinking 内容块（thinking_delta），块结束时补充 signature_delta
+// 加密的推理内容输出为独立的 redacted_thinking 块
+func (cmp *CompliantMessageProcessor) handleReasoning(text, signature, redacted string) []SSEEvent {
+	ctx := cmp.thinkingContext
+	if ctx != nil && !ctx.ThinkingEnabled {
+		logger.Debug("请求未启用 thinking，忽略上游推理内容", logger.Int("content_length", len(text)))
+		return []SSEEvent{}
+	}
+
+	events := []SSEEvent{}
+	if redacted != "" {
+		events = append(events, cmp.closeThinkingBlock()...)
+		index, ok := cmp.reserveThinkingBlock()
+		if !ok {
+			return events
+		}
+		events = append(events,
+			SSEEvent{
+				Event: "content_block_start",
+				Data: map[string]any{
+					"type":  "content_block_start",
+					"index": index,
+					"content_block": map[string]any{
+						"type": "redacted_thinking",
+						"data": redacted,
+					},
+				},
+			},
+			SSEEvent{
+				Event: "content_block_stop",
+				Data: map[string]any{
+					"type":  "content_block_stop",
+					"index": index,
+				},
+			})
+	}
+
+	if text == "" && signature == "" {
+		return events
+	}
+
+	if !cmp.thinkingBlockOpen {
+		index, ok := cmp.reserveThinkingBlock()
+		if !ok {
+			return events
+		}
+		cmp.thinkingBlockOpen = true
+		cmp.thinkingBlockIndex = index
+		events = append(events, SSEEvent{
+			Event: "content_block_start",
+			Data: map[string]any{
+				"type":  "content_block_start",
+				"index": index,
+				"content_block": map[string]any{
+					"type":     "thinking",
+					"thinking": "",
+				},
+			},
+		})
+	}
+
+	if text != "" {
+		cmp.thinkingText.WriteString(text)
+		events = append(events, SSEEvent{
+			Event: "content_block_delta",
+			Data: map[string]any{
+				"type":  "content_block_delta",
+				"index": cmp.thinkingBlockIndex,
+				"delta": map[string]any{
+					"type":     "thinking_delta",
+					"thinking": text,
+				},
+			},
+		})
+	}
+	if signature != "" {
+		// 上游签名无法随历史回传，块结束时统一重新签名
+		logger.Debug("收到上游推理签名", logger.Int("signature_length", len(signature)))
+	}
+	return events
+}
+
+// thinkingSignatureEvent 为当前 thinking 块生成 signature_delta，并清空已累计的内容
+func (cmp *CompliantMessageProcessor) thinkingSignatureEvent(index int) SSEEvent {
+	signature := utils.SignThinking(cmp.thinkingText.String())
+	cmp.thinkingText.Reset()
+	return SSEEvent{
+		Event: "content_block_delta",
+		Data: map[string]any{
+			"type":  "content_block_delta",
+			"index": index,
+			"delta": map[string]any{
+				"type":      "signature_delta",
+				"signature": signature,
+			},
+		},
+	}
+}
+
+// reserveThinkingBlock 为推理块分配索引，正文开始后到达的推理内容被忽略
+func (cmp *CompliantMessageProcessor) reserveThinkingBlock() (int, bool) {
+	ctx := cmp.thinkingContext
+	if ctx == nil {
+		// 无 thinking 上下文（如 OpenAI 端点）：仅透出内容，索引固定为0
+		return 0, true
+	}
+	if ctx.IsThinkingExtracted() {
+		logger.Debug("正文已开始，忽略后续推理内容")
+		return 0, false
+	}
+	ctx.BeginNativeThinking()
+	return ctx.ReserveThinkingBlockIndex(), true
+}
+
+// closeThinkingBlock 关闭当前打开的 thinking 块
+func (cmp *CompliantMessageProcessor) closeThinkingBlock() []SSEEvent {
+	if !cmp.thinkingBlockOpen {
+		return nil
+	}
+	cmp.thinkingBlockOpen = false
+	return []SSEEvent{
+		cmp.thinkingSignatureEvent(cmp.thinkingBlockIndex),
+		{
+			Event: "content_block_stop",
+			Data: map[string]any{
+				"type":  "content_block_stop",
+				"index": cmp.thinkingBlockIndex,
+			},
+		},
+	}
+}
+
+// endThinking 结束推理阶段：关闭 thinking 块，之后的文本写入文本块
+func (cmp *CompliantMessageProcessor) endThinking() []SSEEvent {
+	events := cmp.closeThinkingBlock()
+	if cmp.thinkingContext != nil {
+		cmp.thinkingContext.EndNativeThinking()
+	}
+	return events
+}
+
 // processErrorMessage 处理错误消息
 func (cmp *CompliantMessageProcessor) processErrorMessage(message *EventStreamMessage) ([]SSEEvent, error) {
 	var errorData map[string]any
@@ -183,6 +363,13 @@ func (cmp *CompliantMessageProcessor) processErrorMessage(message *EventStreamMe
 			errorMessage = msg
 		}
 	}
+	// AWS EventStream 也可能只在头部给出错误码
+	if errorCode == "" {
+		errorCode = message.GetHeaderString(":error-code")
+	}
+	if errorMessage == "" {
+		errorMessage = message.GetHeaderString(":error-message")
+	}
 
 	return []SSEEvent{
 		{
@@ -220,6 +407,9 @@ func (cmp *CompliantMessageProcessor) processExceptionMessage(message *EventStre
 			exceptionMessage = msg
 		}
 	}
+	if exceptionType == "" {
+		exceptionType = message.GetHeaderString(":exception-type")
+	}
 
 	return []SSEEvent{
 		{
@@ -0,0 +1,366 @@
+package parser
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"kiro2api/config"
+	"kiro2api/logger"
+	"sync"
+)
+
+const (
+	// preludeSize prelude 长度：totalLength(4) + headerLength(4) + preludeCRC(4)
+	preludeSize = 12
+
+	// decoderInitialBufferSize 解码缓冲区初始大小，足以容纳绝大多数上游帧
+	decoderInitialBufferSize = 32 * 1024
+
+	// decoderMaxPooledBufferSize 超过该大小的缓冲区不回收，避免池中滞留超大内存
+	decoderMaxPooledBufferSize = 1024 * 1024
+
+	// maxInternedStrings 每个解码器缓存的头部字符串上限
+	maxInternedStrings = 256
+)
+
+// decoderState 可复用的解码状态：读缓冲区与头部字符串缓存
+type decoderState struct {
+	buf     []byte
+	names   map[string]string // 头部名称缓存
+	values  map[string]any    // 已装箱的字符串头部值缓存
+	headers map[string]HeaderValue
+}
+
+var decoderStatePool = sync.Pool{
+	New: func() any {
+		return &decoderState{
+			buf:     make([]byte, decoderInitialBufferSize),
+			names:   make(map[string]string, 8),
+			values:  make(map[string]any, 16),
+			headers: make(map[string]HeaderValue, 4),
+		}
+	},
+}
+
+// Decoder 直接基于 io.Reader 的流式 EventStream 解码器
+// 帧在池化缓冲区内原地解析，头部名称与常见字符串值被缓存复用，稳态下每帧零分配。
+// Next 返回的消息（含 Headers 与 Payload）指向内部缓冲区，仅在下一次调用 Next 或 Release 前有效，
+// 需要保留时调用方自行拷贝。
+type Decoder struct {
+	r     io.Reader
+	state *decoderState
+	start int // 未消费数据起点
+	end   int // 已读入数据终点
+	msg   EventStreamMessage
+
+	strictMode   bool
+	err          error // 不可恢复错误，之后的调用直接返回
+	readBytes    int64
+	frames       int
+	crcErrors    int
+	skippedBytes int
+}
+
+// NewDecoder 创建流式解码器，校验模式默认取 EVENTSTREAM_CRC_MODE
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:          r,
+		state:      decoderStatePool.Get().(*decoderState),
+		strictMode: config.EventStreamCRCMode == CRCModeStrict,
+	}
+}
+
+// SetStrictMode 设置帧校验失败时是否中止流
+func (d *Decoder) SetStrictMode(strict bool) {
+	d.strictMode = strict
+}
+
+// Release 归还缓冲区，之后不得再使用解码器及其返回的消息
+func (d *Decoder) Release() {
+	if d.state == nil {
+		return
+	}
+	if cap(d.state.buf) <= decoderMaxPooledBufferSize {
+		clear(d.state.headers)
+		decoderStatePool.Put(d.state)
+	}
+	d.state = nil
+	if d.err == nil {
+		d.err = errors.New("解码器已释放")
+	}
+}
+
+// ReadBytes 返回已从上游读取的字节数
+func (d *Decoder) ReadBytes() int64 {
+	return d.readBytes
+}
+
+// GetStats 获取解码统计
+func (d *Decoder) GetStats() map[string]any {
+	return map[string]any{
+		"strict_mode":   d.strictMode,
+		"read_bytes":    d.readBytes,
+		"frames":        d.frames,
+		"crc_errors":    d.crcErrors,
+		"skipped_bytes": d.skippedBytes,
+		"aborted":       errors.Is(d.err, ErrStreamCorrupted),
+	}
+}
+
+// Next 解码下一条消息
+// 上游正常结束返回 io.EOF；在帧中间结束返回 io.ErrUnexpectedEOF；
+// 严格模式下帧校验失败返回 ErrStreamCorrupted，宽松模式下丢弃损坏帧并在下一个有效 prelude 处重新同步
+func (d *Decoder) Next() (*EventStreamMessage, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	resyncing := false
+	for {
+		if err := d.fill(preludeSize); err != nil {
+			return nil, d.fail(err)
+		}
+
+		if err := validatePrelude(d.state.buf[d.start:d.end]); err != nil {
+			// 重新同步期间逐字节滑动，只在进入同步时记录一次
+			if !resyncing {
+				if d.abort(err) {
+					return nil, d.err
+				}
+				logger.Warn("prelude 校验失败，重新同步", logger.Err(err))
+				resyncing = true
+			}
+			d.start++
+			d.skippedBytes++
+			continue
+		}
+		resyncing = false
+
+		totalLength := int(binary.BigEndian.Uint32(d.state.buf[d.start:]))
+		headerLength := int(binary.BigEndian.Uint32(d.state.buf[d.start+4:]))
+		if err := d.fill(totalLength); err != nil {
+			return nil, d.fail(err)
+		}
+
+		frame := d.state.buf[d.start : d.start+totalLength]
+		d.start += totalLength
+
+		payloadEnd := totalLength - 4
+		expectedCRC := binary.BigEndian.Uint32(frame[payloadEnd:])
+		if calculatedCRC := crc32.ChecksumIEEE(frame[:payloadEnd]); expectedCRC != calculatedCRC {
+			err := NewParseError(
+				fmt.Sprintf("消息 CRC 不匹配: 期望 %08x, 实际 %08x", expectedCRC, calculatedCRC), ErrCRCMismatch)
+			if d.abort(err) {
+				return nil, d.err
+			}
+			logger.Warn("消息 CRC 校验失败，丢弃该帧", logger.Err(err))
+			continue
+		}
+
+		if err := d.decodeHeaders(frame[preludeSize : preludeSize+headerLength]); err != nil {
+			if d.abort(err) {
+				return nil, d.err
+			}
+			logger.Warn("消息头部解析失败，丢弃该帧", logger.Err(err))
+			continue
+		}
+
+		headers := d.state.headers
+		d.msg = EventStreamMessage{
+			Headers:     headers,
+			Payload:     frame[preludeSize+headerLength : payloadEnd],
+			MessageType: GetMessageTypeFromHeaders(headers),
+			EventType:   GetEventTypeFromHeaders(headers),
+			ContentType: GetContentTypeFromHeaders(headers),
+		}
+		d.frames++
+		return &d.msg, nil
+	}
+}
+
+// fill 确保缓冲区中至少有 n 字节未消费数据
+func (d *Decoder) fill(n int) error {
+	if d.end-d.start >= n {
+		return nil
+	}
+
+	buf := d.state.buf
+	if len(buf)-d.start < n {
+		if len(buf) < n {
+			// 帧超过当前缓冲区，扩容（长度已由 prelude 校验限制在 16MB 内）
+			grown := make([]byte, max(2*len(buf), n))
+			d.end = copy(grown, buf[d.start:d.end])
+			d.state.buf = grown
+			buf = grown
+		} else {
+			// 将未消费数据移到缓冲区开头
+			d.end = copy(buf, buf[d.start:d.end])
+		}
+		d.start = 0
+	}
+
+	for emptyReads := 0; d.end-d.start < n; {
+		read, err := d.r.Read(buf[d.end:])
+		d.end += read
+		d.readBytes += int64(read)
+		if read == 0 && err == nil {
+			if emptyReads++; emptyReads >= 100 {
+				return io.ErrNoProgress
+			}
+			continue
+		}
+		if err != nil {
+			if d.end-d.start >= n {
+				return nil
+			}
+			if err == io.EOF && d.end > d.start {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// fail 记录不可恢复的读取错误
+func (d *Decoder) fail(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		logger.Warn("上游事件流在帧中间结束",
+			logger.Int("pending_bytes", d.end-d.start),
+			logger.Int("skipped_bytes", d.skippedBytes))
+	}
+	d.err = err
+	return err
+}
+
+// abort 记录帧错误，严格模式下中止解码并返回 true
+func (d *Decoder) abort(err error) bool {
+	if errors.Is(err, ErrCRCMismatch) {
+		d.crcErrors++
+	}
+	if !d.strictMode {
+		return false
+	}
+
+	d.err = fmt.Errorf("%w: %v", ErrStreamCorrupted, err)
+	logger.Error("EventStream 帧校验失败，严格模式下中止流", logger.Err(err))
+	return true
+}
+
+// decodeHeaders 按 AWS EventStream 规范解析头部到复用的 map
+func (d *Decoder) decodeHeaders(data []byte) error {
+	headers := d.state.headers
+	clear(headers)
+
+	if len(data) == 0 {
+		// 与 RobustEventStreamParser 一致：空头部视为普通文本事件
+		headers[":message-type"] = HeaderValue{Type: ValueType_STRING, Value: d.internValue([]byte(MessageTypes.EVENT))}
+		headers[":event-type"] = HeaderValue{Type: ValueType_STRING, Value: d.internValue([]byte(EventTypes.ASSISTANT_RESPONSE_EVENT))}
+		headers[":content-type"] = HeaderValue{Type: ValueType_STRING, Value: d.internValue([]byte("application/json"))}
+		return nil
+	}
+
+	for offset := 0; offset < len(data); {
+		nameLength := int(data[offset])
+		offset++
+		if nameLength == 0 || offset+nameLength+1 > len(data) {
+			return NewParseError(fmt.Sprintf("头部名称越界: offset=%d, length=%d", offset, nameLength), nil)
+		}
+		name := d.internName(data[offset : offset+nameLength])
+		offset += nameLength
+
+		valueType := ValueType(data[offset])
+		offset++
+
+		var value any
+		switch valueType {
+		case ValueType_BOOL_TRUE:
+			value = true
+		case ValueType_BOOL_FALSE:
+			value = false
+		case ValueType_BYTE, ValueType_SHORT, ValueType_INTEGER, ValueType_LONG, ValueType_TIMESTAMP, ValueType_UUID:
+			size := fixedHeaderValueSize(valueType)
+			if offset+size > len(data) {
+				return NewParseError(fmt.Sprintf("头部值越界: %s", name), nil)
+			}
+			raw := data[offset : offset+size]
+			offset += size
+			switch valueType {
+			case ValueType_BYTE:
+				value = int8(raw[0])
+			case ValueType_SHORT:
+				value = int16(binary.BigEndian.Uint16(raw))
+			case ValueType_INTEGER:
+				value = int32(binary.BigEndian.Uint32(raw))
+			case ValueType_LONG, ValueType_TIMESTAMP:
+				value = int64(binary.BigEndian.Uint64(raw))
+			case ValueType_UUID:
+				value = fmt.Sprintf("%x-%x-%x-%x-%x", raw[0:4], raw[4:6], raw[6:8], raw[8:10], raw[10:16])
+			}
+		case ValueType_BYTE_ARRAY, ValueType_STRING:
+			if offset+2 > len(data) {
+				return NewParseError(fmt.Sprintf("头部值长度越界: %s", name), nil)
+			}
+			valueLength := int(binary.BigEndian.Uint16(data[offset:]))
+			offset += 2
+			if offset+valueLength > len(data) {
+				return NewParseError(fmt.Sprintf("头部值越界: %s", name), nil)
+			}
+			raw := data[offset : offset+valueLength]
+			offset += valueLength
+			if valueType == ValueType_STRING {
+				value = d.internValue(raw)
+			} else {
+				value = append([]byte(nil), raw...)
+			}
+		default:
+			return NewParseError(fmt.Sprintf("未知的头部值类型: %d", valueType), nil)
+		}
+
+		headers[name] = HeaderValue{Type: valueType, Value: value}
+	}
+	return nil
+}
+
+// fixedHeaderValueSize 定长头部值的字节数
+func fixedHeaderValueSize(valueType ValueType) int {
+	switch valueType {
+	case ValueType_BYTE:
+		return 1
+	case ValueType_SHORT:
+		return 2
+	case ValueType_INTEGER:
+		return 4
+	case ValueType_UUID:
+		return 16
+	default:
+		return 8
+	}
+}
+
+// internName 返回缓存的头部名称，未命中时分配并缓存
+func (d *Decoder) internName(b []byte) string {
+	if s, ok := d.state.names[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	if len(d.state.names) < maxInternedStrings {
+		d.state.names[s] = s
+	}
+	return s
+}
+
+// internValue 返回已装箱的字符串值，避免每帧重复分配事件类型等常量
+func (d *Decoder) internValue(b []byte) any {
+	if v, ok := d.state.values[string(b)]; ok {
+		return v
+	}
+	s := string(b)
+	var v any = s
+	if len(d.state.values) < maxInternedStrings {
+		d.state.values[s] = v
+	}
+	return v
+}
@@ -0,0 +1,369 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestDecoder(data []byte, strict bool) *Decoder {
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetStrictMode(strict)
+	return d
+}
+
+// decodeAll 解码直到出错，返回拷贝后的 payload 与最终错误
+func decodeAll(d *Decoder) ([][]byte, error) {
+	payloads := [][]byte{}
+	for {
+		msg, err := d.Next()
+		if err != nil {
+			return payloads, err
+		}
+		payloads = append(payloads, bytes.Clone(msg.Payload))
+	}
+}
+
+func TestDecoder_ValidFramesAcrossReads(t *testing.T) {
+	frames, payloads := testFrames(3)
+	stream := bytes.Join(frames, nil)
+
+	readers := map[string]io.Reader{
+		"whole":    bytes.NewReader(stream),
+		"one_byte": iotest.OneByteReader(bytes.NewReader(stream)),
+		"half":     iotest.HalfReader(bytes.NewReader(stream)),
+		"data_err": iotest.DataErrReader(bytes.NewReader(stream)),
+	}
+	for name, r := range readers {
+		d := NewDecoder(r)
+		got, err := decodeAll(d)
+		assert.ErrorIs(t, err, io.EOF, name)
+		assert.Equal(t, payloads, got, name)
+		assert.Equal(t, int64(len(stream)), d.ReadBytes(), name)
+		d.Release()
+	}
+}
+
+func TestDecoder_HeadersMatchRobustParser(t *testing.T) {
+	frames, _ := testFrames(2)
+	stream := bytes.Join(frames, nil)
+
+	expected, err := newTestRobustParser(true).ParseStream(stream)
+	require.NoError(t, err)
+
+	d := newTestDecoder(stream, true)
+	defer d.Release()
+	for _, want := range expected {
+		msg, err := d.Next()
+		require.NoError(t, err)
+		assert.Equal(t, want.Headers, msg.Headers)
+		assert.Equal(t, want.MessageType, msg.MessageType)
+		assert.Equal(t, want.EventType, msg.EventType)
+		assert.Equal(t, want.ContentType, msg.ContentType)
+	}
+}
+
+func TestDecoder_LenientRecovers(t *testing.T) {
+	frames, payloads := testFrames(4)
+	frames[1][len(frames[1])-6] ^= 0x01 // 损坏 payload
+	frames[2][2] ^= 0x40                // 损坏长度字段
+	stream := bytes.Join([][]byte{frames[0], frames[1], frames[2], []byte("garbage"), frames[3]}, nil)
+
+	d := newTestDecoder(stream, false)
+	defer d.Release()
+	got, err := decodeAll(d)
+
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, [][]byte{payloads[0], payloads[3]}, got)
+	stats := d.GetStats()
+	assert.Equal(t, 2, stats["crc_errors"])
+	assert.Equal(t, len(frames[2])+len("garbage"), stats["skipped_bytes"])
+}
+
+func TestDecoder_StrictAborts(t *testing.T) {
+	frames, payloads := testFrames(3)
+	frames[1][len(frames[1])-6] ^= 0x01
+
+	d := newTestDecoder(bytes.Join(frames, nil), true)
+	defer d.Release()
+	got, err := decodeAll(d)
+
+	require.ErrorIs(t, err, ErrStreamCorrupted)
+	assert.ErrorContains(t, err, "消息 CRC 不匹配")
+	assert.Equal(t, [][]byte{payloads[0]}, got)
+
+	_, err = d.Next()
+	assert.ErrorIs(t, err, ErrStreamCorrupted, "中止后不再解码")
+}
+
+func TestDecoder_TruncatedStream(t *testing.T) {
+	frames, payloads := testFrames(2)
+	stream := bytes.Join(frames, nil)
+
+	d := newTestDecoder(stream[:len(stream)-3], true)
+	defer d.Release()
+	got, err := decodeAll(d)
+
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, payloads[:1], got)
+}
+
+func TestDecoder_GrowsForLargeFrames(t *testing.T) {
+	large := []byte(`{"content":"` + strings.Repeat("长", 40*1024) + `"}`)
+	frames := [][]byte{
+		buildEventStreamFrame("assistantResponseEvent", []byte(`{"content":"a"}`)),
+		buildEventStreamFrame("assistantResponseEvent", large),
+		buildEventStreamFrame("assistantResponseEvent", []byte(`{"content":"b"}`)),
+	}
+
+	d := NewDecoder(iotest.HalfReader(bytes.NewReader(bytes.Join(frames, nil))))
+	defer d.Release()
+	got, err := decodeAll(d)
+
+	assert.ErrorIs(t, err, io.EOF)
+	require.Len(t, got, 3)
+	assert.Equal(t, large, got[1])
+}
+
+func TestDecoder_NoPerFrameAllocations(t *testing.T) {
+	const frameCount = 256
+	frames, _ := testFrames(frameCount)
+
+	d := newTestDecoder(bytes.Join(frames, nil), true)
+	defer d.Release()
+	_, err := d.Next() // 预热头部缓存
+	require.NoError(t, err)
+
+	allocs := testing.AllocsPerRun(frameCount-2, func() {
+		if _, err := d.Next(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+// FuzzDecoder_Corruption 宽松模式必须恰好恢复所有未受影响的帧，严格模式不得输出损坏帧
+func FuzzDecoder_Corruption(f *testing.F) {
+	f.Add(uint16(0), uint16(0xffff), uint8(3), uint8(0))
+	f.Add(uint16(10), uint16(0xffff), uint8(0), uint8(7))
+	f.Add(uint16(120), uint16(0xffff), uint8(5), uint8(16))
+	f.Add(uint16(60), uint16(150), uint8(1), uint8(1))
+
+	frames, payloads := testFrames(3)
+	stream := bytes.Join(frames, nil)
+
+	f.Fuzz(func(t *testing.T, flipAt uint16, truncateAt uint16, bit uint8, chunk uint8) {
+		data := append([]byte(nil), stream...)
+		flipped := -1
+		if int(flipAt) < len(data) {
+			data[flipAt] ^= 1 << (bit % 8)
+			flipped = int(flipAt)
+		}
+		if int(truncateAt) < len(data) {
+			data = data[:truncateAt]
+		}
+
+		intact := [][]byte{}
+		offset := 0
+		for i, frame := range frames {
+			end := offset + len(frame)
+			if end <= len(data) && (flipped < offset || flipped >= end) {
+				intact = append(intact, payloads[i])
+			}
+			offset = end
+		}
+
+		reader := func() io.Reader {
+			return &chunkedReader{data: data, size: int(chunk)%64 + 1}
+		}
+
+		lenient := NewDecoder(reader())
+		lenient.SetStrictMode(false)
+		got, err := decodeAll(lenient)
+		lenient.Release()
+		assert.True(t, err == io.EOF || err == io.ErrUnexpectedEOF, "unexpected error: %v", err)
+		assert.Equal(t, intact, got)
+
+		strict := NewDecoder(reader())
+		strict.SetStrictMode(true)
+		got, _ = decodeAll(strict)
+		strict.Release()
+		for i, p := range got {
+			assert.Equal(t, payloads[i], p, "严格模式只能按顺序输出校验通过的帧")
+		}
+	})
+}
+
+// chunkedReader 每次最多返回 size 字节，模拟网络读取
+type chunkedReader struct {
+	data []byte
+	size int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.size)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// benchmarkCaptures 加载 K2A_BENCH_CAPTURES 指定的上游原始响应（glob），未设置时生成长响应样本
+func benchmarkCaptures(b *testing.B) map[string][]byte {
+	captures := map[string][]byte{}
+	// testdata 中为脱敏后的上游抓包，K2A_BENCH_CAPTURES 可追加本地抓包
+	patterns := []string{filepath.Join("testdata", "*.eventstream")}
+	if pattern := os.Getenv("K2A_BENCH_CAPTURES"); pattern != "" {
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		files, err := filepath.Glob(pattern)
+		require.NoError(b, err)
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			require.NoError(b, err)
+			captures[filepath.Base(file)] = data
+		}
+	}
+
+	// 模拟长回复：大量文本增量 + 分片工具调用 + 计量事件
+	var stream []byte
+	for i := 0; i < 4000; i++ {
+		payload := fmt.Sprintf(`{"content":"第 %d 段输出，包含 mixed English text and 中文内容。"}`, i)
+		stream = append(stream, buildEventStreamFrame("assistantResponseEvent", []byte(payload))...)
+	}
+	for i := 0; i < 200; i++ {
+		payload := fmt.Sprintf(`{"name":"write_file","toolUseId":"tooluse_abcdefghijklmnopqrstuv","input":"{\"line_%d\":\"content\","}`, i)
+		stream = append(stream, buildEventStreamFrame("toolUseEvent", []byte(payload))...)
+	}
+	stream = append(stream, buildEventStreamFrame("meteringEvent", []byte(`{"unit":"credit","usage":1.5}`))...)
+	captures["synthetic_long_response"] = stream
+	return captures
+}
+
+func BenchmarkEventStream_RobustParser(b *testing.B) {
+	for name, capture := range benchmarkCaptures(b) {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(capture)))
+			b.ReportAllocs()
+			frames := 0
+			for i := 0; i < b.N; i++ {
+				// 与原 ProcessEventStream 一致：按 1KB 分片喂入
+				rp := NewRobustEventStreamParser()
+				for start := 0; start < len(capture); start += 1024 {
+					messages, _ := rp.ParseStream(capture[start:min(start+1024, len(capture))])
+					frames += len(messages)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(max(frames, 1)), "ns/frame")
+		})
+	}
+}
+
+func BenchmarkEventStream_Decoder(b *testing.B) {
+	for name, capture := range benchmarkCaptures(b) {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(capture)))
+			b.ReportAllocs()
+			frames := 0
+			for i := 0; i < b.N; i++ {
+				d := NewDecoder(&chunkedReader{data: capture, size: 1024})
+				for {
+					if _, err := d.Next(); err != nil {
+						break
+					}
+					frames++
+				}
+				d.Release()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(max(frames, 1)), "ns/frame")
+		})
+	}
+}
+
+// BenchmarkEventStream_DecodeAndProcess 与 ProcessEventStream 一致：解码后仅拷贝会被保留的 payload 再交给处理器
+func BenchmarkEventStream_DecodeAndProcess(b *testing.B) {
+	for name, capture := range benchmarkCaptures(b) {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(capture)))
+			b.ReportAllocs()
+			frames := 0
+			for i := 0; i < b.N; i++ {
+				processor := NewCompliantMessageProcessor()
+				d := NewDecoder(&chunkedReader{data: capture, size: 1024})
+				for {
+					message, err := d.Next()
+					if err != nil {
+						break
+					}
+					if RetainsPayload(message) {
+						message.Payload = bytes.Clone(message.Payload)
+					}
+					_, _ = processor.ProcessMessage(message)
+					frames++
+				}
+				d.Release()
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(max(frames, 1)), "ns/frame")
+		})
+	}
+}
+
+func TestRetainsPayload(t *testing.T) {
+	capture, err := os.ReadFile(filepath.Join("testdata", "text_and_tool.eventstream"))
+	require.NoError(t, err)
+
+	processor := NewCompliantMessageProcessor()
+	d := NewDecoder(&chunkedReader{data: capture, size: 64})
+	defer d.Release()
+
+	var text strings.Builder
+	var deltas []map[string]any
+	retained := map[string]bool{}
+	for {
+		message, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		eventType := message.GetEventType()
+		retained[eventType] = RetainsPayload(message)
+		if retained[eventType] {
+			message.Payload = bytes.Clone(message.Payload)
+		}
+		events, err := processor.ProcessMessage(message)
+		require.NoError(t, err)
+		for _, event := range events {
+			data, _ := event.Data.(map[string]any)
+			if delta, ok := data["delta"].(map[string]any); ok && delta["type"] == "text_delta" {
+				text.WriteString(delta["text"].(string))
+				deltas = append(deltas, delta)
+			}
+		}
+	}
+
+	assert.Equal(t, map[string]bool{
+		"assistantResponseEvent": false,
+		"toolUseEvent":           true,
+		"meteringEvent":          false,
+		"contextUsageEvent":      false,
+	}, retained)
+
+	// 未拷贝的文本帧所在缓冲区已被后续帧覆盖，下发的正文仍须完整
+	var joined strings.Builder
+	for _, delta := range deltas {
+		joined.WriteString(delta["text"].(string))
+	}
+	assert.Equal(t, text.String(), joined.String())
+	assert.True(t, strings.HasPrefix(joined.String(), "I'll look at the failing test first."))
+	assert.Contains(t, joined.String(), "接下来我会把修改写入文件并重新运行测试。")
+}
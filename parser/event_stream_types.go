@@ -59,6 +59,16 @@ func (esm *EventStreamMessage) GetEventType() string {
 	return ""
 }
 
+// GetHeaderString 获取字符串类型的头部值，不存在时返回空串
+func (esm *EventStreamMessage) GetHeaderString(name string) string {
+	if header, exists := esm.Headers[name]; exists {
+		if value, ok := header.Value.(string); ok {
+			return value
+		}
+	}
+	return ""
+}
+
 // GetContentType 获取内容类型
 func (esm *EventStreamMessage) GetContentType() string {
 	if header, exists := esm.Headers[":content-type"]; exists {
@@ -105,8 +115,9 @@ var EventTypes = struct {
 	METERING_EVENT      string
 	CONTEXT_USAGE_EVENT string
 
-	// Claude Extended Thinking
-	THINKING_EVENT string
+	// 结构化推理事件
+	REASONING_CONTENT_EVENT string
+	THINKING_EVENT          string
 }{
 	COMPLETION:       "completion",
 	COMPLETION_CHUNK: "completion_chunk",
@@ -126,7 +137,8 @@ var EventTypes = struct {
 	METERING_EVENT:      "meteringEvent",
 	CONTEXT_USAGE_EVENT: "contextUsageEvent",
 
-	THINKING_EVENT: "thinkingEvent",
+	REASONING_CONTENT_EVENT: "reasoningContentEvent",
+	THINKING_EVENT:          "thinkingEvent",
 }
 
 // ToolExecution 工具执行状态
@@ -218,6 +230,11 @@ func (e *ParseError) Error() string {
 	return fmt.Sprintf("解析错误: %s", e.Message)
 }
 
+// Unwrap 支持 errors.Is / errors.As
+func (e *ParseError) Unwrap() error {
+	return e.Cause
+}
+
 // NewParseError 创建解析错误
 func NewParseError(message string, cause error) *ParseError {
 	return &ParseError{
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"bytes"
 	"kiro2api/logger"
 	"kiro2api/utils"
 	"strings"
@@ -31,17 +32,15 @@ func convertInputToString(input any) string {
 
 // isToolCallEvent 检查是否为工具调用事件
 func isToolCallEvent(payload []byte) bool {
-	payloadStr := string(payload)
-	return strings.Contains(payloadStr, "\"toolUseId\":") ||
-		strings.Contains(payloadStr, "\"tool_use_id\":") ||
-		strings.Contains(payloadStr, "\"name\":") && strings.Contains(payloadStr, "\"input\":")
+	return bytes.Contains(payload, []byte(`"toolUseId":`)) ||
+		bytes.Contains(payload, []byte(`"tool_use_id":`)) ||
+		bytes.Contains(payload, []byte(`"name":`)) && bytes.Contains(payload, []byte(`"input":`))
 }
 
 // isThinkingEvent 检查是否为 thinking 事件（Claude Extended Thinking）
 func isThinkingEvent(payload []byte) bool {
-	payloadStr := string(payload)
-	return strings.Contains(payloadStr, "\"type\":\"thinking\"") ||
-		strings.Contains(payloadStr, "\"type\": \"thinking\"")
+	return bytes.Contains(payload, []byte(`"type":"thinking"`)) ||
+		bytes.Contains(payload, []byte(`"type": "thinking"`))
 }
 
 // isStreamingResponse 检查是否为流式响应
@@ -323,6 +322,9 @@ func (h *StandardAssistantResponseEventHandler) Handle(message *EventStreamMessa
 
 	// 作为标准事件，优先尝试解析完整格式
 	if fullEvent, err := parseFullAssistantResponseEvent(message.Payload); err == nil {
+		// 正文会随事件下发并被缓存等环节保留，只拷贝正文而非整个 payload（见 RetainsPayload）
+		fullEvent.Content = strings.Clone(fullEvent.Content)
+
 		// 对于流式响应，放宽验证要求
 		if isStreamingResponse(fullEvent) {
 			// logger.Debug("检测到流式格式assistantResponseEvent，使用宽松验证")
@@ -335,7 +337,7 @@ func (h *StandardAssistantResponseEventHandler) Handle(message *EventStreamMessa
 
 	// 如果完整格式解析失败，回退到legacy格式处理
 	logger.Debug("完整格式解析失败，回退到legacy格式处理")
-	return h.handleLegacyFormat(message.Payload)
+	return h.handleLegacyFormat(bytes.Clone(message.Payload))
 }
 
 // handleToolCallEvent 处理工具调用事件
@@ -413,6 +415,7 @@ func (h *StandardAssistantResponseEventHandler) processContentWithThinking(conte
 
 	// 输出 thinking 内容
 	if result.ThinkingContent != "" {
+		h.processor.thinkingText.WriteString(result.ThinkingContent)
 		events = append(events, SSEEvent{
 			Event: "content_block_delta",
 			Data: map[string]any{
@@ -428,6 +431,7 @@ func (h *StandardAssistantResponseEventHandler) processContentWithThinking(conte
 
 	// 处理 thinking 块结束
 	if result.ThinkingEnded {
+		events = append(events, h.processor.thinkingSignatureEvent(ctx.GetThinkingBlockIndex()))
 		events = append(events, SSEEvent{
 			Event: "content_block_stop",
 			Data: map[string]any{
@@ -454,17 +458,11 @@ func (h *StandardAssistantResponseEventHandler) processContentWithThinking(conte
 
 	// 输出文本内容
 	if result.TextContent != "" {
-		// 如果 thinking 已提取完成，使用文本块索引
-		textIndex := 0
-		if ctx.IsThinkingExtracted() {
-			textIndex = ctx.GetTextBlockIndex()
-		}
-
 		events = append(events, SSEEvent{
 			Event: "content_block_delta",
 			Data: map[string]any{
 				"type":  "content_block_delta",
-				"index": textIndex,
+				"index": ctx.CurrentTextBlockIndex(),
 				"delta": map[string]any{
 					"type": "text_delta",
 					"text": result.TextContent,
@@ -567,50 +565,18 @@ func (h *StandardAssistantResponseEventHandler) handleLegacyFormat(payload []byt
 	return events, nil
 }
 
-// handleThinkingContent 处理 thinking 内容块
-// 将 thinking 内容以 <thinking>...</thinking> 标签包裹后输出
+// handleThinkingContent 处理旧格式中的 thinking 内容块，按结构化推理事件输出
 func (h *StandardAssistantResponseEventHandler) handleThinkingContent(data map[string]any) ([]SSEEvent, error) {
 	content, _ := data["content"].(string)
-	if content == "" {
+	signature, _ := data["signature"].(string)
+	if content == "" && signature == "" {
 		return []SSEEvent{}, nil
 	}
 
 	logger.Debug("处理 thinking 内容块",
 		logger.Int("content_length", len(content)))
 
-	// 输出为 Anthropic Extended Thinking 规范（thinking_delta），方便 Claude Code 识别“思考模式”。
-	// 注意：这里的 thinking 内容来自上游事件，本项目不生成/推断 thinking。
-	return []SSEEvent{
-		{
-			Event: "content_block_start",
-			Data: map[string]any{
-				"type":  "content_block_start",
-				"index": 0,
-				"content_block": map[string]any{
-					"type":     "thinking",
-					"thinking": "",
-				},
-			},
-		},
-		{
-			Event: "content_block_delta",
-			Data: map[string]any{
-				"type":  "content_block_delta",
-				"index": 0,
-				"delta": map[string]any{
-					"type":     "thinking_delta",
-					"thinking": content,
-				},
-			},
-		},
-		{
-			Event: "content_block_stop",
-			Data: map[string]any{
-				"type":  "content_block_stop",
-				"index": 0,
-			},
-		},
-	}, nil
+	return h.processor.handleReasoning(content, signature, ""), nil
 }
 
 // LegacyToolUseEventHandler 处理旧格式的工具使用事件
@@ -650,135 +616,102 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 	// 🔥 统一转换input，避免重复调用
 	inputStr := convertInputToString(evt.Input)
 
-	// *** 核心修复：区分一次性完整数据和流式分片数据 ***
+	// 字符串形式的input是流式分片，对象形式是一次性完整参数
+	_, isFragment := evt.Input.(string)
 
 	// 第一步：检查工具是否已经注册
 	_, toolExists := h.toolManager.GetActiveTools()[evt.ToolUseId]
 
+	var events []SSEEvent
 	if !toolExists {
 		// 首次收到工具调用，先注册工具
 		logger.Debug("首次收到工具调用片段，先注册工具",
 			logger.String("toolUseId", evt.ToolUseId),
-			logger.String("name", evt.Name))
-
-		// 创建初始工具调用请求（使用完整参数）
-		toolCall := ToolCall{
-			ID:   evt.ToolUseId,
-			Type: "function",
-			Function: ToolCallFunction{
-				Name:      evt.Name,
-				Arguments: inputStr, // 使用已转换的input参数
-			},
+			logger.String("name", evt.Name),
+			logger.Bool("is_fragment", isFragment))
+
+		// 流式分片以空参数注册，片段交给聚合器并作为增量立即转发
+		arguments := inputStr
+		if isFragment && !evt.Stop {
+			arguments = "{}"
 		}
 
 		request := ToolCallRequest{
-			ToolCalls: []ToolCall{toolCall},
+			ToolCalls: []ToolCall{{
+				ID:   evt.ToolUseId,
+				Type: "function",
+				Function: ToolCallFunction{
+					Name:      evt.Name,
+					Arguments: arguments,
+				},
+			}},
 		}
-
-		// 先注册工具到管理器
-		events := h.toolManager.HandleToolCallRequest(request)
+		events = h.toolManager.HandleToolCallRequest(request)
 
 		// 🔥 核心修复：如果是stop事件且是首次注册，说明这是一次性完整数据
 		// 已经在注册时使用了完整参数，无需再通过聚合器处理，直接返回
-		if evt.Stop {
-			logger.Debug("首次注册即收到stop信号，使用完整参数，跳过聚合器",
+		if evt.Stop || !isFragment {
+			logger.Debug("首次注册即为完整参数，跳过聚合器",
 				logger.String("toolUseId", evt.ToolUseId),
 				logger.String("arguments", inputStr))
 			return events, nil
 		}
-
-		// 🔥 关键修复：如果不是stop事件，说明后续还有数据片段
-		// 但首次注册时的数据已经是完整的JSON对象（来自evt.Input），不是片段
-		// 因此不应该通过聚合器处理，聚合器只处理后续的字符串片段
-
-		// 如果不是stop事件，说明后续还有数据片段，返回注册事件，等待后续片段
-		return events, nil
 	}
 
-	// 第二步：工具已存在，使用聚合器处理流式分片数据
-	// 🔥 关键修复：只有在工具已注册且不是首次的情况下，才使用聚合器
-	// 这避免了对已经完整的一次性数据进行二次处理
-
-	// 🔥 核心修复：区分"无参数工具"和"stop信号无新数据"
-	// 场景1：无参数工具 - 从头到尾都没有数据
-	// 场景2：stop信号无新数据 - 已有完整数据，stop事件不带新数据
-
-	if evt.Stop {
-		// 收到stop信号，需要完成聚合
-		// 🔥 关键：只传递空字符串，不传递"{}"，避免污染buffer
-		complete, fullInput := h.aggregator.ProcessToolData(evt.ToolUseId, evt.Name, "", evt.Stop, -1)
-
-		if complete {
-			// 聚合完成，更新工具参数
-			if fullInput != "" && fullInput != "{}" {
-				var testArgs map[string]any
-				if err := utils.FastUnmarshal([]byte(fullInput), &testArgs); err != nil {
-					logger.Warn("聚合后的工具调用参数JSON格式无效",
-						logger.String("toolUseId", evt.ToolUseId),
-						logger.String("fullInput", fullInput),
-						logger.Err(err))
-				} else {
-					h.toolManager.UpdateToolArguments(evt.ToolUseId, testArgs)
-				}
-			}
-
-			// 处理工具完成
-			result := ToolCallResult{
-				ToolCallID: evt.ToolUseId,
-				Result:     "Tool execution completed via toolUseEvent",
-			}
-			return h.toolManager.HandleToolCallResult(result), nil
+	// 第二步：使用聚合器处理流式分片，字符完整的部分立即作为 input_json_delta 转发
+	// 非分片的空对象（input缺失）不携带数据
+	fragment := inputStr
+	if !isFragment && fragment == "{}" {
+		fragment = ""
+	}
+	if delta := h.aggregator.ProcessToolFragment(evt.ToolUseId, evt.Name, fragment); delta != "" {
+		toolIndex := h.toolManager.GetBlockIndex(evt.ToolUseId)
+		if toolIndex >= 0 {
+			events = append(events, SSEEvent{
+				Event: "content_block_delta",
+				Data: map[string]any{
+					"type":  "content_block_delta",
+					"index": toolIndex,
+					"delta": map[string]any{
+						"type":         "input_json_delta",
+						"partial_json": delta,
+					},
+				},
+			})
+		} else {
+			logger.Warn("尝试发送增量事件但工具未注册，可能存在时序问题",
+				logger.String("toolUseId", evt.ToolUseId),
+				logger.String("name", evt.Name))
 		}
 	}
 
-	// 如果是空数据但不是stop，返回空事件
-	if inputStr == "" || inputStr == "{}" {
-		return []SSEEvent{}, nil
+	if !evt.Stop {
+		return events, nil
 	}
 
-	// 🔥 使用聚合器处理流式JSON片段
-	complete, _ := h.aggregator.ProcessToolData(evt.ToolUseId, evt.Name, inputStr, evt.Stop, -1)
-
-	// 处理未完整数据时发送增量事件
-	if !complete {
-		// 如果有新的输入片段，发送参数增量事件
-		if inputStr != "" && inputStr != "{}" {
-			// 边界情况检查：确保工具ID有效
-			if evt.ToolUseId == "" {
-				logger.Warn("工具调用片段缺少有效的toolUseId，跳过增量事件发送",
-					logger.String("inputFragment", inputStr))
-				return []SSEEvent{}, nil
-			}
-
-			// 获取工具的块索引
-			toolIndex := h.toolManager.GetBlockIndex(evt.ToolUseId)
-			if toolIndex >= 0 {
-				return []SSEEvent{{
-					Event: "content_block_delta",
-					Data: map[string]any{
-						"type":  "content_block_delta",
-						"index": toolIndex,
-						"delta": map[string]any{
-							"type":         "input_json_delta",
-							"partial_json": inputStr,
-						},
-					},
-				}}, nil
-			} else {
-				// 工具未注册的边界情况（理论上不应该发生，因为上面已经检查过）
-				logger.Warn("尝试发送增量事件但工具未注册，可能存在时序问题",
+	// 第三步：收到stop信号，校验聚合后的完整JSON并关闭工具块
+	complete, fullInput := h.aggregator.ProcessToolData(evt.ToolUseId, evt.Name, "", evt.Stop, -1)
+	if complete {
+		if fullInput != "" && fullInput != "{}" {
+			var testArgs map[string]any
+			if err := utils.FastUnmarshal([]byte(fullInput), &testArgs); err != nil {
+				logger.Warn("聚合后的工具调用参数JSON格式无效",
 					logger.String("toolUseId", evt.ToolUseId),
-					logger.String("name", evt.Name),
-					logger.String("inputFragment", inputStr))
+					logger.String("fullInput", fullInput),
+					logger.Err(err))
+			} else {
+				h.toolManager.UpdateToolArguments(evt.ToolUseId, testArgs)
 			}
 		}
 
-		// 无新数据或无法获取索引，返回空事件
-		return []SSEEvent{}, nil
+		result := ToolCallResult{
+			ToolCallID: evt.ToolUseId,
+			Result:     "Tool execution completed via toolUseEvent",
+		}
+		events = append(events, h.toolManager.HandleToolCallResult(result)...)
 	}
 
-	// 非stop事件的流式片段处理完成，返回空事件
-	return []SSEEvent{}, nil
+	return events, nil
 }
 
 // NoOpEventHandler 空操作事件处理器（用于静默忽略某些事件）
@@ -789,54 +722,36 @@ func (h *NoOpEventHandler) Handle(message *EventStreamMessage) ([]SSEEvent, erro
 	return []SSEEvent{}, nil
 }
 
-// ThinkingEventHandler 处理 Claude Extended Thinking 事件
-type ThinkingEventHandler struct{}
+// reasoningContentEvent 上游结构化推理事件
+type reasoningContentEvent struct {
+	Text            string `json:"text"`
+	Content         string `json:"content"` // thinkingEvent 使用 content 字段
+	Signature       string `json:"signature"`
+	RedactedContent string `json:"redactedContent"`
+}
+
+// ThinkingEventHandler 处理上游结构化推理事件（reasoningContentEvent / thinkingEvent）
+type ThinkingEventHandler struct {
+	processor *CompliantMessageProcessor
+}
 
 func (h *ThinkingEventHandler) Handle(message *EventStreamMessage) ([]SSEEvent, error) {
-	var data map[string]any
-	if err := utils.FastUnmarshal(message.Payload, &data); err != nil {
+	var evt reasoningContentEvent
+	if err := utils.FastUnmarshal(message.Payload, &evt); err != nil {
 		logger.Warn("解析 thinking 事件失败", logger.Err(err))
 		return []SSEEvent{}, nil
 	}
 
-	content, _ := data["content"].(string)
-	if content == "" {
-		return []SSEEvent{}, nil
+	text := evt.Text
+	if text == "" {
+		text = evt.Content
 	}
 
-	logger.Debug("处理 thinkingEvent",
-		logger.Int("content_length", len(content)))
+	logger.Debug("处理推理事件",
+		logger.String("event_type", message.GetEventType()),
+		logger.Int("content_length", len(text)),
+		logger.Bool("has_signature", evt.Signature != ""),
+		logger.Bool("redacted", evt.RedactedContent != ""))
 
-	// 输出为 Anthropic Extended Thinking 规范（thinking_delta），方便 Claude Code 识别。
-	return []SSEEvent{
-		{
-			Event: "content_block_start",
-			Data: map[string]any{
-				"type":  "content_block_start",
-				"index": 0,
-				"content_block": map[string]any{
-					"type":     "thinking",
-					"thinking": "",
-				},
-			},
-		},
-		{
-			Event: "content_block_delta",
-			Data: map[string]any{
-				"type":  "content_block_delta",
-				"index": 0,
-				"delta": map[string]any{
-					"type":     "thinking_delta",
-					"thinking": content,
-				},
-			},
-		},
-		{
-			Event: "content_block_stop",
-			Data: map[string]any{
-				"type":  "content_block_stop",
-				"index": 0,
-			},
-		},
-	}, nil
+	return h.processor.handleReasoning(text, evt.Signature, evt.RedactedContent), nil
 }
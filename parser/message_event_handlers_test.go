@@ -1,7 +1,10 @@
 package parser
 
 import (
+	"fmt"
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/assert"
 	"kiro2api/utils"
@@ -337,3 +340,150 @@ func TestLegacyToolUseEventHandler_MemoryLeakPrevention(t *testing.T) {
 
 	t.Log("✅ 内存泄漏预防测试通过")
 }
+
+// TestLegacyToolUseEventHandler_IncrementalDeltas 测试参数分片作为 input_json_delta 逐片转发
+func TestLegacyToolUseEventHandler_IncrementalDeltas(t *testing.T) {
+	toolManager := NewToolLifecycleManager()
+	handler := &LegacyToolUseEventHandler{
+		toolManager: toolManager,
+		aggregator: NewSonicStreamingJSONAggregatorWithCallback(func(toolUseId string, fullParams string) {
+			toolManager.UpdateToolArgumentsFromJSON(toolUseId, fullParams)
+		}),
+	}
+
+	// 分片在 ASCII 边界处切开（上游 JSON 字符串不会拆开多字节字符），最后一个分片随stop一起到达
+	fragments := []string{`{"path":"/tmp/test.txt","con`, `tent":"测试内容`, `"}`}
+
+	var deltas []string
+	var stops int
+	for i, fragment := range fragments {
+		payload, _ := utils.FastMarshal(toolUseEvent{
+			Name:      "write_file",
+			ToolUseId: "test-tool-005",
+			Input:     fragment,
+			Stop:      i == len(fragments)-1,
+		})
+		events, err := handler.handleToolCallEvent(&EventStreamMessage{Payload: payload})
+		assert.NoError(t, err)
+
+		for _, e := range events {
+			data := e.Data.(map[string]any)
+			switch data["type"] {
+			case "content_block_delta":
+				delta := data["delta"].(map[string]any)
+				if delta["type"] != "input_json_delta" {
+					continue
+				}
+				assert.True(t, utf8.ValidString(delta["partial_json"].(string)), "增量不得截断多字节字符")
+				deltas = append(deltas, delta["partial_json"].(string))
+			case "content_block_stop":
+				stops++
+				assert.Len(t, deltas, len(fragments), "stop必须在最后一个增量之后")
+			}
+		}
+		assert.Len(t, deltas, i+1, "每个分片都应立即产生增量")
+	}
+
+	assert.Equal(t, 1, stops)
+	assert.Equal(t, `{"path":"/tmp/test.txt","content":"测试内容"}`, strings.Join(deltas, ""))
+
+	var tool *ToolExecution
+	for _, completed := range toolManager.GetCompletedTools() {
+		if completed.ID == "test-tool-005" {
+			tool = completed
+		}
+	}
+	if assert.NotNil(t, tool) {
+		assert.Equal(t, "/tmp/test.txt", tool.Arguments["path"])
+		assert.Equal(t, "测试内容", tool.Arguments["content"])
+	}
+}
+
+// summarizeBlockEvents 将内容块事件压缩为 "类型:索引[:增量类型]" 便于断言顺序
+func summarizeBlockEvents(events []SSEEvent) []string {
+	var out []string
+	for _, e := range events {
+		data := e.Data.(map[string]any)
+		typ := data["type"].(string)
+		entry := fmt.Sprintf("%s:%d", typ, data["index"])
+		switch typ {
+		case "content_block_start":
+			entry += ":" + data["content_block"].(map[string]any)["type"].(string)
+		case "content_block_delta":
+			entry += ":" + data["delta"].(map[string]any)["type"].(string)
+		}
+		out = append(out, entry)
+	}
+	return out
+}
+
+func TestThinkingEventHandler_NativeReasoningBlocks(t *testing.T) {
+	cesp := NewCompliantEventStreamParser()
+	cesp.SetThinkingContext(NewThinkingStreamContext(true))
+
+	var stream []byte
+	for _, frame := range [][2]string{
+		{"reasoningContentEvent", `{"text":"先分析"}`},
+		{"reasoningContentEvent", `{"text":"问题","signature":"sig-abc"}`},
+		{"assistantResponseEvent", `{"content":"代码里写 <thinking> 不应被当作思考"}`},
+		{"toolUseEvent", `{"name":"read_file","toolUseId":"tooluse_1","input":"{\"path\":\"a.go\"}","stop":true}`},
+	} {
+		stream = append(stream, buildEventStreamFrame(frame[0], []byte(frame[1]))...)
+	}
+
+	events, err := cesp.ParseStream(stream)
+	assert.NoError(t, err)
+	events = append(events, cesp.FlushThinkingBuffer()...)
+
+	summary := summarizeBlockEvents(events)
+	assert.Equal(t, []string{
+		"content_block_start:0:thinking",
+		"content_block_delta:0:thinking_delta",
+		"content_block_delta:0:thinking_delta",
+		"content_block_delta:0:signature_delta",
+		"content_block_stop:0",
+		"content_block_delta:1:text_delta",
+	}, summary[:6])
+
+	// 工具块排在文本块之后
+	for _, e := range events {
+		data := e.Data.(map[string]any)
+		if data["type"] == "content_block_start" {
+			if cb := data["content_block"].(map[string]any); cb["type"] == "tool_use" {
+				assert.Equal(t, 2, data["index"])
+			}
+		}
+	}
+
+	text := events[5].Data.(map[string]any)["delta"].(map[string]any)["text"]
+	assert.Equal(t, "代码里写 <thinking> 不应被当作思考", text, "收到结构化推理后不再解析标签")
+	signature := events[3].Data.(map[string]any)["delta"].(map[string]any)["signature"].(string)
+	assert.True(t, utils.VerifyThinkingSignature("先分析问题", signature), "上游签名被替换为可校验的代理签名")
+}
+
+func TestThinkingEventHandler_RedactedAndDisabled(t *testing.T) {
+	cesp := NewCompliantEventStreamParser()
+	cesp.SetThinkingContext(NewThinkingStreamContext(true))
+
+	stream := append(buildEventStreamFrame("reasoningContentEvent", []byte(`{"text":"思考"}`)),
+		buildEventStreamFrame("reasoningContentEvent", []byte(`{"redactedContent":"ZW5jcnlwdGVk"}`))...)
+	stream = append(stream, buildEventStreamFrame("assistantResponseEvent", []byte(`{"content":"答案"}`))...)
+	events, err := cesp.ParseStream(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"content_block_start:0:thinking",
+		"content_block_delta:0:thinking_delta",
+		"content_block_delta:0:signature_delta",
+		"content_block_stop:0",
+		"content_block_start:1:redacted_thinking",
+		"content_block_stop:1",
+		"content_block_delta:2:text_delta",
+	}, summarizeBlockEvents(events))
+
+	// 请求未启用 thinking 时忽略推理内容
+	disabled := NewCompliantEventStreamParser()
+	disabled.SetThinkingContext(NewThinkingStreamContext(false))
+	events, err = disabled.ParseStream(buildEventStreamFrame("reasoningContentEvent", []byte(`{"text":"思考"}`)))
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+}
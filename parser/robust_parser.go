@@ -3,6 +3,7 @@ package parser
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"kiro2api/config"
@@ -11,6 +12,20 @@ import (
 	"sync"
 )
 
+// EventStream CRC 校验模式
+const (
+	CRCModeStrict  = "strict"  // 校验失败立即中止流
+	CRCModeLenient = "lenient" // 丢弃损坏帧，在下一个有效 prelude 处重新同步
+)
+
+var (
+	// ErrCRCMismatch prelude 或消息 CRC 不匹配
+	ErrCRCMismatch = errors.New("CRC 校验失败")
+
+	// ErrStreamCorrupted 严格模式下检测到损坏帧，流已中止
+	ErrStreamCorrupted = errors.New("上游事件流已损坏")
+)
+
 // RobustEventStreamParser 带CRC校验和错误恢复的解析器
 type RobustEventStreamParser struct {
 	headerParser *HeaderParser
@@ -18,6 +33,10 @@ type RobustEventStreamParser struct {
 	maxErrors    int
 	crcTable     *crc32.Table
 	buffer       *bytes.Buffer // 使用标准库bytes.Buffer替代RingBuffer
+	strictMode   bool          // 严格模式：任何帧校验失败都中止流
+	failed       error         // 严格模式下的中止原因，之后的调用直接返回
+	crcErrors    int           // CRC 校验失败次数
+	skippedBytes int           // 重新同步时丢弃的字节数
 	// 并发访问控制
 	mu sync.RWMutex // 保护并发访问
 }
@@ -29,6 +48,7 @@ func NewRobustEventStreamParser() *RobustEventStreamParser {
 		maxErrors:    config.ParserMaxErrors,
 		crcTable:     crc32.MakeTable(crc32.IEEE),
 		buffer:       &bytes.Buffer{},
+		strictMode:   config.EventStreamCRCMode == CRCModeStrict,
 	}
 }
 
@@ -37,9 +57,31 @@ func (rp *RobustEventStreamParser) SetMaxErrors(maxErrors int) {
 	rp.maxErrors = maxErrors
 }
 
+// SetStrictMode 设置是否为严格模式
+func (rp *RobustEventStreamParser) SetStrictMode(strict bool) {
+	rp.strictMode = strict
+}
+
+// GetStats 获取校验统计
+func (rp *RobustEventStreamParser) GetStats() map[string]any {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	return map[string]any{
+		"strict_mode":   rp.strictMode,
+		"error_count":   rp.errorCount,
+		"crc_errors":    rp.crcErrors,
+		"skipped_bytes": rp.skippedBytes,
+		"aborted":       rp.failed != nil,
+	}
+}
+
 // Reset 重置解析器状态
 func (rp *RobustEventStreamParser) Reset() {
 	rp.errorCount = 0
+	rp.failed = nil
+	rp.crcErrors = 0
+	rp.skippedBytes = 0
 	if rp.buffer != nil {
 		rp.buffer.Reset()
 	}
@@ -76,23 +118,11 @@ func (rp *RobustEventStreamParser) parseSingleMessageWithValidation(data []byte)
 		return nil, 0, NewParseError(fmt.Sprintf("数据长度不匹配: 期望 %d 字节，实际 %d 字节", totalLength, len(data)), nil)
 	}
 
-	// AWS EventStream 格式验证：检查 Prelude CRC
-	if len(data) < 12 {
-		return nil, 0, NewParseError("数据长度不足以包含 Prelude CRC", nil)
-	}
+	// AWS EventStream 格式验证：检查 Prelude CRC（前8字节：totalLength + headerLength）
 	preludeCRC := binary.BigEndian.Uint32(data[8:12])
-
-	// 验证 Prelude CRC（前8字节：totalLength + headerLength）
-	// calculatedPreludeCRC := crc32.Checksum(data[:8], rp.crcTable)
-	// if preludeCRC != calculatedPreludeCRC {
-	// 	logger.Warn("Prelude CRC 校验失败",
-	// 		logger.String("expected_crc", fmt.Sprintf("%08x", preludeCRC)),
-	// 		logger.String("calculated_crc", fmt.Sprintf("%08x", calculatedPreludeCRC)))
-	// 	// 在非严格模式下继续处理
-	// 	if rp.strictMode {
-	// 		return nil, int(totalLength), NewParseError(fmt.Sprintf("Prelude CRC 校验失败: 期望 %08x, 实际 %08x", preludeCRC, calculatedPreludeCRC), nil)
-	// 	}
-	// }
+	if err := validatePreludeCRC(data); err != nil {
+		return nil, int(totalLength), err
+	}
 
 	// 验证长度合理性（考虑 Prelude CRC）
 	if totalLength < 16 { // 最小: 4(totalLen) + 4(headerLen) + 4(preludeCRC) + 4(msgCRC) = 16
@@ -141,19 +171,13 @@ func (rp *RobustEventStreamParser) parseSingleMessageWithValidation(data []byte)
 		}()))
 
 	// CRC 校验（消息 CRC 覆盖整个消息除了最后4字节）
-	// expectedCRC := binary.BigEndian.Uint32(data[payloadEnd:totalLength])
-	// calculatedCRC := crc32.Checksum(data[:payloadEnd], rp.crcTable)
-
-	// if expectedCRC != calculatedCRC {
-	// 	err := NewParseError(fmt.Sprintf("CRC 校验失败: 期望 %08x, 实际 %08x", expectedCRC, calculatedCRC), nil)
-	// 	if rp.strictMode {
-	// 		return nil, int(totalLength), err
-	// 	} else {
-	// 		logger.Warn("CRC校验失败但继续处理",
-	// 			logger.String("expected_crc", fmt.Sprintf("%08x", expectedCRC)),
-	// 			logger.String("calculated_crc", fmt.Sprintf("%08x", calculatedCRC)))
-	// 	}
-	// }
+	// 损坏帧无论哪种模式都不解码，避免把乱码当作工具调用JSON下发
+	expectedCRC := binary.BigEndian.Uint32(data[payloadEnd:totalLength])
+	calculatedCRC := crc32.Checksum(data[:payloadEnd], rp.crcTable)
+	if expectedCRC != calculatedCRC {
+		return nil, int(totalLength), NewParseError(
+			fmt.Sprintf("消息 CRC 不匹配: 期望 %08x, 实际 %08x", expectedCRC, calculatedCRC), ErrCRCMismatch)
+	}
 
 	// 解析头部 - 支持空头部的容错处理和断点续传
 	var headers map[string]HeaderValue
@@ -345,8 +369,73 @@ func (rp *RobustEventStreamParser) isValidToolUseIdFormat(toolUseId string) bool
 	return true
 }
 
+// validatePreludeCRC 校验 prelude CRC
+func validatePreludeCRC(data []byte) error {
+	expected := binary.BigEndian.Uint32(data[8:12])
+	calculated := crc32.ChecksumIEEE(data[:8])
+	if expected != calculated {
+		return NewParseError(
+			fmt.Sprintf("prelude CRC 不匹配: 期望 %08x, 实际 %08x", expected, calculated), ErrCRCMismatch)
+	}
+	return nil
+}
+
+// validatePrelude 校验缓冲区开头的 prelude（CRC 与长度字段）
+func validatePrelude(data []byte) error {
+	if err := validatePreludeCRC(data); err != nil {
+		return err
+	}
+
+	totalLength := binary.BigEndian.Uint32(data[:4])
+	headerLength := binary.BigEndian.Uint32(data[4:8])
+	if totalLength < config.EventStreamMinMessageSize || totalLength > config.EventStreamMaxMessageSize {
+		return NewParseError(fmt.Sprintf("消息总长度异常: %d", totalLength), nil)
+	}
+	if headerLength > totalLength-config.EventStreamMinMessageSize {
+		return NewParseError(fmt.Sprintf("头部长度异常: %d", headerLength), nil)
+	}
+	return nil
+}
+
+// abort 记录帧错误，严格模式下将解析器置为中止状态并返回 true
+func (rp *RobustEventStreamParser) abort(err error) bool {
+	rp.errorCount++
+	if errors.Is(err, ErrCRCMismatch) {
+		rp.crcErrors++
+	}
+	if !rp.strictMode {
+		return false
+	}
+
+	rp.failed = fmt.Errorf("%w: %v", ErrStreamCorrupted, err)
+	logger.Error("EventStream 帧校验失败，严格模式下中止流", logger.Err(err))
+	return true
+}
+
+// resync 丢弃数据直到下一个有效 prelude
+// 找不到时保留末尾不足一个 prelude 的字节，等待更多数据后继续查找
+func (rp *RobustEventStreamParser) resync() int {
+	data := rp.buffer.Bytes()
+	const preludeSize = 12
+
+	skip := 1
+	for ; skip+preludeSize <= len(data); skip++ {
+		if validatePrelude(data[skip:]) == nil {
+			break
+		}
+	}
+
+	rp.buffer.Next(skip)
+	rp.skippedBytes += skip
+	return skip
+}
+
 // parseStreamWithBuffer 使用bytes.Buffer解析流数据
 func (rp *RobustEventStreamParser) parseStreamWithBuffer(data []byte) ([]*EventStreamMessage, error) {
+	if rp.failed != nil {
+		return nil, rp.failed
+	}
+
 	// 写入新数据到缓冲区
 	_, err := rp.buffer.Write(data)
 	if err != nil {
@@ -369,19 +458,21 @@ func (rp *RobustEventStreamParser) parseStreamWithBuffer(data []byte) ([]*EventS
 			break
 		}
 
-		// 解析消息长度
-		totalLength := binary.BigEndian.Uint32(bufferBytes[:4])
-
-		// 验证长度合理性
-		if totalLength < config.EventStreamMinMessageSize || totalLength > config.EventStreamMaxMessageSize {
-			// 跳过无效数据（丢弃1字节）
-			rp.buffer.Next(1)
-			rp.errorCount++
-			logger.Warn("跳过无效消息头",
-				logger.Int("total_length", int(totalLength)))
+		// 先校验 prelude，避免按损坏的长度字段切帧或无限等待
+		if err := validatePrelude(bufferBytes); err != nil {
+			if rp.abort(err) {
+				return messages, rp.failed
+			}
+			skipped := rp.resync()
+			logger.Warn("prelude 校验失败，重新同步",
+				logger.Err(err),
+				logger.Int("skipped_bytes", skipped))
 			continue
 		}
 
+		// 解析消息长度
+		totalLength := binary.BigEndian.Uint32(bufferBytes[:4])
+
 		// 检查是否有足够的数据
 		if available < int(totalLength) {
 			// 等待更多数据
@@ -399,11 +490,13 @@ func (rp *RobustEventStreamParser) parseStreamWithBuffer(data []byte) ([]*EventS
 			break
 		}
 
-		// 解析消息
+		// 解析消息（prelude 已通过校验，帧边界可信，失败时丢弃整帧即可）
 		message, _, err := rp.parseSingleMessageWithValidation(messageData)
 		if err != nil {
-			logger.Warn("消息解析失败", logger.Err(err))
-			rp.errorCount++
+			if rp.abort(err) {
+				return messages, rp.failed
+			}
+			logger.Warn("消息解析失败，丢弃该帧", logger.Err(err))
 			continue
 		}
 
@@ -0,0 +1,241 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildEventStreamFrame 构造带正确 prelude/消息 CRC 的 AWS EventStream 帧
+func buildEventStreamFrame(eventType string, payload []byte) []byte {
+	var headers []byte
+	headers = append(headers, buildSimpleStringHeader(":message-type", "event")...)
+	headers = append(headers, buildSimpleStringHeader(":event-type", eventType)...)
+	headers = append(headers, buildSimpleStringHeader(":content-type", "application/json")...)
+
+	total := 12 + len(headers) + len(payload) + 4
+	frame := make([]byte, 0, total)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(total))
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(headers)))
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(frame[:8]))
+	frame = append(frame, headers...)
+	frame = append(frame, payload...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(frame))
+	return frame
+}
+
+func testFrames(n int) ([][]byte, [][]byte) {
+	frames := make([][]byte, n)
+	payloads := make([][]byte, n)
+	for i := range frames {
+		payloads[i] = []byte(fmt.Sprintf(`{"content":"chunk-%d"}`, i))
+		frames[i] = buildEventStreamFrame("assistantResponseEvent", payloads[i])
+	}
+	return frames, payloads
+}
+
+func newTestRobustParser(strict bool) *RobustEventStreamParser {
+	rp := NewRobustEventStreamParser()
+	rp.SetStrictMode(strict)
+	rp.SetMaxErrors(1 << 20)
+	return rp
+}
+
+// feedInChunks 按固定大小分片喂入，模拟网络读取
+func feedInChunks(rp *RobustEventStreamParser, data []byte, chunkSize int) ([]*EventStreamMessage, error) {
+	var all []*EventStreamMessage
+	for start := 0; start < len(data); start += chunkSize {
+		end := min(start+chunkSize, len(data))
+		messages, err := rp.ParseStream(data[start:end])
+		all = append(all, messages...)
+		if err != nil {
+			return all, err
+		}
+	}
+	return all, nil
+}
+
+func payloadsOf(messages []*EventStreamMessage) [][]byte {
+	payloads := make([][]byte, 0, len(messages))
+	for _, m := range messages {
+		payloads = append(payloads, m.Payload)
+	}
+	return payloads
+}
+
+func TestRobustParser_ValidFramesAcrossChunks(t *testing.T) {
+	frames, payloads := testFrames(3)
+	stream := bytes.Join(frames, nil)
+
+	for _, chunkSize := range []int{1, 7, 16, len(stream)} {
+		messages, err := feedInChunks(newTestRobustParser(true), stream, chunkSize)
+		require.NoError(t, err, "chunk=%d", chunkSize)
+		assert.Equal(t, payloads, payloadsOf(messages), "chunk=%d", chunkSize)
+	}
+}
+
+func TestRobustParser_LenientDropsCorruptedPayload(t *testing.T) {
+	frames, payloads := testFrames(3)
+	frames[1][len(frames[1])-6] ^= 0x01 // 翻转 payload 中的一个比特
+	rp := newTestRobustParser(false)
+
+	messages, err := rp.ParseStream(bytes.Join(frames, nil))
+
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{payloads[0], payloads[2]}, payloadsOf(messages))
+	assert.Equal(t, 1, rp.GetStats()["crc_errors"])
+	assert.Equal(t, 0, rp.GetStats()["skipped_bytes"], "prelude 有效时按帧丢弃，无需逐字节同步")
+}
+
+func TestRobustParser_LenientResyncsOnCorruptedPrelude(t *testing.T) {
+	frames, payloads := testFrames(3)
+	frames[1][2] ^= 0x40 // 损坏长度字段
+	rp := newTestRobustParser(false)
+
+	messages, err := feedInChunks(rp, bytes.Join(frames, nil), 5)
+
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{payloads[0], payloads[2]}, payloadsOf(messages))
+	assert.Equal(t, len(frames[1]), rp.GetStats()["skipped_bytes"])
+}
+
+func TestRobustParser_LenientSkipsGarbageBetweenFrames(t *testing.T) {
+	frames, payloads := testFrames(2)
+	stream := append(append(append([]byte{}, frames[0]...), []byte("garbage from a flaky proxy")...), frames[1]...)
+
+	messages, err := newTestRobustParser(false).ParseStream(stream)
+
+	require.NoError(t, err)
+	assert.Equal(t, payloads, payloadsOf(messages))
+}
+
+func TestRobustParser_StrictAbortsStream(t *testing.T) {
+	frames, payloads := testFrames(3)
+	frames[1][len(frames[1])-6] ^= 0x01
+	rp := newTestRobustParser(true)
+
+	messages, err := rp.ParseStream(bytes.Join(frames, nil))
+
+	require.ErrorIs(t, err, ErrStreamCorrupted)
+	assert.ErrorContains(t, err, "消息 CRC 不匹配")
+	assert.Equal(t, [][]byte{payloads[0]}, payloadsOf(messages), "损坏帧之前的消息仍然返回")
+
+	// 中止后不再解析后续数据
+	messages, err = rp.ParseStream(frames[2])
+	assert.ErrorIs(t, err, ErrStreamCorrupted)
+	assert.Empty(t, messages)
+
+	rp.Reset()
+	messages, err = rp.ParseStream(frames[2])
+	require.NoError(t, err)
+	assert.Len(t, messages, 1)
+}
+
+func TestRobustParser_StrictRejectsCorruptedPrelude(t *testing.T) {
+	frames, _ := testFrames(1)
+	frames[0][9] ^= 0x80 // 损坏 prelude CRC 本身
+
+	_, err := newTestRobustParser(true).ParseStream(frames[0])
+
+	require.ErrorIs(t, err, ErrStreamCorrupted)
+	assert.True(t, errors.Is(err, ErrStreamCorrupted))
+	assert.ErrorContains(t, err, "prelude CRC 不匹配")
+}
+
+func TestRobustParser_TruncatedFrameWaitsForMoreData(t *testing.T) {
+	frames, payloads := testFrames(1)
+	rp := newTestRobustParser(true)
+
+	messages, err := rp.ParseStream(frames[0][:len(frames[0])-3])
+	require.NoError(t, err)
+	assert.Empty(t, messages)
+
+	messages, err = rp.ParseStream(frames[0][len(frames[0])-3:])
+	require.NoError(t, err)
+	assert.Equal(t, payloads, payloadsOf(messages))
+}
+
+func TestCompliantParser_StrictModeReturnsStreamError(t *testing.T) {
+	frames, _ := testFrames(2)
+	frames[1][len(frames[1])-6] ^= 0x01
+
+	cesp := NewCompliantEventStreamParser()
+	cesp.SetStrictMode(true)
+	_, err := cesp.ParseStream(bytes.Join(frames, nil))
+	assert.ErrorIs(t, err, ErrStreamCorrupted)
+
+	cesp = NewCompliantEventStreamParser()
+	cesp.SetStrictMode(false)
+	_, err = cesp.ParseStream(bytes.Join(frames, nil))
+	assert.NoError(t, err)
+}
+
+// FuzzRobustParser_Corruption 对三帧合法流施加比特翻转、截断与任意分片
+// 宽松模式必须恰好恢复所有未受影响的帧，严格模式不得输出损坏帧
+func FuzzRobustParser_Corruption(f *testing.F) {
+	f.Add(uint16(0), uint16(0xffff), uint8(3), uint8(0))    // 翻转第一帧长度字段
+	f.Add(uint16(10), uint16(0xffff), uint8(0), uint8(7))   // 翻转 prelude CRC
+	f.Add(uint16(120), uint16(0xffff), uint8(5), uint8(16)) // 翻转第二帧 payload
+	f.Add(uint16(60), uint16(150), uint8(1), uint8(1))      // 翻转 + 截断
+	f.Add(uint16(0xffff), uint16(200), uint8(0), uint8(63)) // 仅截断
+
+	frames, payloads := testFrames(3)
+	stream := bytes.Join(frames, nil)
+
+	f.Fuzz(func(t *testing.T, flipAt uint16, truncateAt uint16, bit uint8, chunk uint8) {
+		data := append([]byte(nil), stream...)
+		flipped := -1
+		if int(flipAt) < len(data) {
+			data[flipAt] ^= 1 << (bit % 8)
+			flipped = int(flipAt)
+		}
+		if int(truncateAt) < len(data) {
+			data = data[:truncateAt]
+		}
+		chunkSize := int(chunk)%64 + 1
+
+		// 未被翻转且完整保留的帧必须被恢复
+		intact := [][]byte{}
+		offset := 0
+		for i, frame := range frames {
+			end := offset + len(frame)
+			if end <= len(data) && (flipped < offset || flipped >= end) {
+				intact = append(intact, payloads[i])
+			}
+			offset = end
+		}
+
+		messages, err := feedInChunks(newTestRobustParser(false), data, chunkSize)
+		require.NoError(t, err)
+		assert.Equal(t, intact, payloadsOf(messages))
+
+		messages, _ = feedInChunks(newTestRobustParser(true), data, chunkSize)
+		for i, m := range messages {
+			assert.Equal(t, payloads[i], m.Payload, "严格模式只能按顺序输出校验通过的帧")
+		}
+	})
+}
+
+// FuzzRobustParser_ArbitraryInput 任意输入不得 panic，且不会输出未经校验的帧
+func FuzzRobustParser_ArbitraryInput(f *testing.F) {
+	frames, _ := testFrames(2)
+	f.Add(bytes.Join(frames, nil))
+	f.Add(frames[0][:20])
+	f.Add(append(bytes.Repeat([]byte{0xff}, 32), frames[1]...))
+	f.Add([]byte{0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, strict := range []bool{false, true} {
+			messages, _ := newTestRobustParser(strict).ParseStream(data)
+			for _, m := range messages {
+				assert.NotNil(t, m.Headers)
+			}
+		}
+	})
+}
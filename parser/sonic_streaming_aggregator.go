@@ -15,7 +15,7 @@ type ToolParamsUpdateCallback func(toolUseId string, fullParams string)
 
 // AWS EventStream流式传输配置
 // 由于EventStream按字节边界分片传输，导致UTF-8字符截断，
-// 因此只在收到停止信号时进行JSON解析，避免解析损坏的片段
+// 片段在保证字符完整后立即转发（input_json_delta），完整JSON只在收到停止信号时解析校验
 
 type SonicStreamingJSONAggregator struct {
 	activeStreamers map[string]*SonicJSONStreamer
@@ -71,12 +71,7 @@ func (ssja *SonicStreamingJSONAggregator) ProcessToolData(toolUseId, name, input
 
 	// 处理输入片段
 	if input != "" {
-		if err := streamer.appendFragment(input); err != nil {
-			logger.Warn("追加JSON片段到Sonic解析器失败",
-				logger.String("toolUseId", toolUseId),
-				logger.String("fragment", input),
-				logger.Err(err))
-		}
+		streamer.appendFragment(input)
 	}
 
 	// AWS EventStream按字节边界分片传输，导致UTF-8中文字符截断问题
@@ -85,6 +80,15 @@ func (ssja *SonicStreamingJSONAggregator) ProcessToolData(toolUseId, name, input
 		return false, ""
 	}
 
+	// 残留的不完整UTF-8字节不会再有后续片段补齐，原样写入以便解析失败时定位
+	if streamer.incompleteUTF8 != "" {
+		logger.Warn("工具参数结束时仍有不完整的UTF-8字符",
+			logger.String("toolUseId", toolUseId),
+			logger.Int("pending_bytes", len(streamer.incompleteUTF8)))
+		streamer.buffer.WriteString(streamer.incompleteUTF8)
+		streamer.incompleteUTF8 = ""
+	}
+
 	// 收到停止信号，使用Sonic尝试解析当前缓冲区
 	parseResult := streamer.tryParseWithSonic()
 
@@ -150,6 +154,25 @@ func (ssja *SonicStreamingJSONAggregator) ProcessToolData(toolUseId, name, input
 	return true, fullInput
 }
 
+// ProcessToolFragment 追加工具参数片段，返回可立即转发给客户端的部分
+// 末尾被截断的UTF-8字符会暂存到下一个片段，保证转发的每个增量都由完整字符组成
+func (ssja *SonicStreamingJSONAggregator) ProcessToolFragment(toolUseId, name, input string) string {
+	if input == "" {
+		return ""
+	}
+
+	ssja.mu.Lock()
+	defer ssja.mu.Unlock()
+
+	streamer, exists := ssja.activeStreamers[toolUseId]
+	if !exists {
+		streamer = ssja.createSonicJSONStreamer(toolUseId, name)
+		ssja.activeStreamers[toolUseId] = streamer
+	}
+
+	return streamer.appendFragment(input)
+}
+
 // createSonicJSONStreamer 创建Sonic JSON流式解析器（使用对象池优化）
 func (ssja *SonicStreamingJSONAggregator) createSonicJSONStreamer(toolUseId, toolName string) *SonicJSONStreamer {
 	// 直接分配Buffer，Go GC会自动管理
@@ -164,8 +187,8 @@ func (ssja *SonicStreamingJSONAggregator) createSonicJSONStreamer(toolUseId, too
 	}
 }
 
-// appendFragment 追加JSON片段
-func (sjs *SonicJSONStreamer) appendFragment(fragment string) error {
+// appendFragment 追加JSON片段，返回实际写入缓冲区的字符完整部分
+func (sjs *SonicJSONStreamer) appendFragment(fragment string) string {
 	// 确保UTF-8字符完整性
 	safeFragment := sjs.ensureUTF8Integrity(fragment)
 
@@ -174,7 +197,7 @@ func (sjs *SonicJSONStreamer) appendFragment(fragment string) error {
 	sjs.fragmentCount++
 	sjs.totalBytes += len(fragment) // 使用原始长度统计
 
-	return nil
+	return safeFragment
 }
 
 // ensureUTF8Integrity 确保UTF-8字符完整性
@@ -183,6 +206,15 @@ func (sjs *SonicJSONStreamer) ensureUTF8Integrity(fragment string) string {
 		return fragment
 	}
 
+	// 先拼接上一个片段遗留的不完整UTF-8字符，再检查新的结尾
+	if sjs.incompleteUTF8 != "" {
+		logger.Debug("恢复截断的UTF-8字符",
+			logger.String("toolUseId", sjs.toolUseId),
+			logger.Int("pending_bytes", len(sjs.incompleteUTF8)))
+		fragment = sjs.incompleteUTF8 + fragment
+		sjs.incompleteUTF8 = ""
+	}
+
 	// 检查片段是否以不完整的UTF-8字符结尾
 	bytes := []byte(fragment)
 	n := len(bytes)
@@ -236,18 +268,6 @@ func (sjs *SonicJSONStreamer) ensureUTF8Integrity(fragment string) string {
 		// 继续字符(10xxxxxx)，继续向前检查
 	}
 
-	// 检查是否有之前的不完整UTF-8字符需要拼接
-	if sjs.incompleteUTF8 != "" {
-		combined := sjs.incompleteUTF8 + fragment
-		logger.Debug("恢复截断的UTF-8字符",
-			logger.String("toolUseId", sjs.toolUseId),
-			logger.String("incomplete", sjs.incompleteUTF8),
-			logger.String("current_fragment", fragment[:min(10, len(fragment))]),
-			logger.String("combined_start", combined[:min(20, len(combined))]))
-		sjs.incompleteUTF8 = ""                  // 清空
-		return sjs.ensureUTF8Integrity(combined) // 递归处理合并结果
-	}
-
 	return fragment
 }
 
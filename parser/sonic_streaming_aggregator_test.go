@@ -101,3 +101,24 @@ func TestStreamingFragments(t *testing.T) {
 		t.Errorf("Expected non-empty result, got empty string")
 	}
 }
+
+// TestProcessToolFragment_HoldsBackSplitRune 测试被截断的多字节字符延迟到完整后再转发
+func TestProcessToolFragment_HoldsBackSplitRune(t *testing.T) {
+	aggregator := NewSonicStreamingJSONAggregatorWithCallback(nil)
+	raw := []byte(`{"text":"你好"}`)
+
+	// "你"被拆成两段，"好"被拆成三段
+	parts := [][]byte{raw[:10], raw[10:12], raw[12:13], raw[13:14], raw[14:]}
+	want := []string{`{"text":"`, `你`, ``, ``, `好"}`}
+	for i, part := range parts {
+		got := aggregator.ProcessToolFragment("test-005", "echo", string(part))
+		if got != want[i] {
+			t.Errorf("fragment %d: expected %q, got %q", i, want[i], got)
+		}
+	}
+
+	complete, result := aggregator.ProcessToolData("test-005", "echo", "", true, -1)
+	if !complete || result != string(raw) {
+		t.Errorf("Expected complete result %q, got %v %q", raw, complete, result)
+	}
+}
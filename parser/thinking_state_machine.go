@@ -3,6 +3,8 @@ package parser
 import (
 	"strings"
 	"sync"
+
+	"kiro2api/config"
 )
 
 // ThinkingState 状态机状态枚举（借鉴 kiro.rs）
@@ -31,11 +33,14 @@ type ThinkingStreamContext struct {
 
 	// 配置
 	ThinkingEnabled bool
+	tagFallback     bool // 是否从文本中解析 <thinking> 标签（仅用于不发送结构化推理事件的模型）
 
 	// 状态
 	state             ThinkingState
 	buffer            strings.Builder
 	ThinkingExtracted bool
+	native            bool // 已收到上游结构化推理事件，停止标签解析
+	thinkingIndexUsed bool // thinking 块索引已被结构化推理块占用
 
 	// 块索引管理（借鉴 kiro.rs）
 	ThinkingBlockIndex *int // 通常为 0
@@ -50,6 +55,7 @@ type ThinkingStreamContext struct {
 func NewThinkingStreamContext(thinkingEnabled bool) *ThinkingStreamContext {
 	ctx := &ThinkingStreamContext{
 		ThinkingEnabled: thinkingEnabled,
+		tagFallback:     true,
 		state:           StateNotInThinking,
 		nextBlockIndex:  0,
 		detector:        NewThinkingTagDetector(),
@@ -75,8 +81,11 @@ func (ctx *ThinkingStreamContext) Reset() {
 	ctx.buffer.Reset()
 	ctx.state = StateNotInThinking
 	ctx.ThinkingExtracted = false
+	ctx.native = false
+	ctx.thinkingIndexUsed = false
 	ctx.nextBlockIndex = 0
 	if ctx.ThinkingEnabled {
+		*ctx.TextBlockIndex = 1
 		ctx.nextBlockIndex = 2
 	}
 }
@@ -94,6 +103,13 @@ func (ctx *ThinkingStreamContext) ProcessChunk(chunk string) ProcessChunkResult
 		return result
 	}
 
+	if !ctx.tagFallback || ctx.native {
+		// 上游使用结构化推理事件：文本原样输出，连同此前为标签检测缓冲的内容
+		result.TextContent = ctx.buffer.String() + chunk
+		ctx.buffer.Reset()
+		return result
+	}
+
 	// 将新数据添加到缓冲区
 	ctx.buffer.WriteString(chunk)
 	bufferStr := ctx.buffer.String()
@@ -191,6 +207,70 @@ func (ctx *ThinkingStreamContext) processInThinking(buffer string) ProcessChunkR
 	return result
 }
 
+// SetTagFallback 设置是否启用 <thinking> 标签解析
+func (ctx *ThinkingStreamContext) SetTagFallback(enabled bool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	ctx.tagFallback = enabled
+}
+
+// BeginNativeThinking 收到上游结构化推理事件，返回 true 表示需要开启 thinking 块
+// 此后不再从文本中解析标签
+func (ctx *ThinkingStreamContext) BeginNativeThinking() bool {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	ctx.native = true
+	if ctx.state != StateNotInThinking {
+		return false
+	}
+	ctx.state = StateInThinking
+	return true
+}
+
+// EndNativeThinking 结束结构化推理块，返回 true 表示需要关闭 thinking 块
+func (ctx *ThinkingStreamContext) EndNativeThinking() bool {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if !ctx.native || ctx.state != StateInThinking {
+		return false
+	}
+	ctx.state = StateThinkingExtracted
+	ctx.ThinkingExtracted = true
+	return true
+}
+
+// ReserveThinkingBlockIndex 为结构化推理块分配索引
+// 第一个块使用 thinking 块索引，之后的块（如 redacted_thinking）占用文本块索引并将文本块后移
+func (ctx *ThinkingStreamContext) ReserveThinkingBlockIndex() int {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if !ctx.thinkingIndexUsed && ctx.ThinkingBlockIndex != nil {
+		ctx.thinkingIndexUsed = true
+		return *ctx.ThinkingBlockIndex
+	}
+	if ctx.TextBlockIndex == nil {
+		return 0
+	}
+	idx := *ctx.TextBlockIndex
+	*ctx.TextBlockIndex = idx + 1
+	if ctx.nextBlockIndex <= *ctx.TextBlockIndex {
+		ctx.nextBlockIndex = *ctx.TextBlockIndex + 1
+	}
+	return idx
+}
+
+// CurrentTextBlockIndex 当前文本应写入的块索引
+// thinking 块结束前文本使用 0 号块，结束后使用文本块索引
+func (ctx *ThinkingStreamContext) CurrentTextBlockIndex() int {
+	if ctx.IsThinkingExtracted() {
+		return ctx.GetTextBlockIndex()
+	}
+	return 0
+}
+
 // GetThinkingBlockIndex 获取 thinking 块索引
 func (ctx *ThinkingStreamContext) GetThinkingBlockIndex() int {
 	if ctx.ThinkingBlockIndex != nil {
@@ -250,8 +330,8 @@ func (ctx *ThinkingStreamContext) FlushBuffer() ProcessChunkResult {
 		return result
 	}
 
-	switch ctx.state {
-	case StateInThinking:
+	switch {
+	case ctx.state == StateInThinking && !ctx.native:
 		// 仍在 thinking 块内，输出剩余内容作为 thinking
 		result.ThinkingContent = bufferStr
 	default:
@@ -262,3 +342,22 @@ func (ctx *ThinkingStreamContext) FlushBuffer() ProcessChunkResult {
 	ctx.buffer.Reset()
 	return result
 }
+
+// ThinkingTagFallbackEnabled 判断模型是否使用 <thinking> 标签解析（THINKING_TAG_FALLBACK_MODELS）
+// 支持 "*" 匹配全部模型，以及 "claude-3-7*" 形式的前缀匹配
+func ThinkingTagFallbackEnabled(model string) bool {
+	for _, pattern := range strings.Split(config.ThinkingTagFallbackModels, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(model, prefix) {
+				return true
+			}
+		} else if model == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,8 @@ package parser
 
 import (
 	"testing"
+
+	"kiro2api/config"
 )
 
 func TestNewThinkingStreamContext(t *testing.T) {
@@ -317,3 +319,43 @@ func TestProcessChunkResult(t *testing.T) {
 		t.Error("ThinkingEnded should be false")
 	}
 }
+
+func TestThinkingTagFallbackEnabled(t *testing.T) {
+	old := config.ThinkingTagFallbackModels
+	defer func() { config.ThinkingTagFallbackModels = old }()
+
+	tests := []struct {
+		patterns string
+		model    string
+		want     bool
+	}{
+		{"*", "claude-sonnet-4-5", true},
+		{"claude-3-7*, claude-sonnet-4", "claude-3-7-sonnet-20250219", true},
+		{"claude-3-7*, claude-sonnet-4", "claude-sonnet-4", true},
+		{"claude-3-7*, claude-sonnet-4", "claude-sonnet-4-5", false},
+		{"", "claude-3-7-sonnet", false},
+	}
+	for _, tt := range tests {
+		config.ThinkingTagFallbackModels = tt.patterns
+		if got := ThinkingTagFallbackEnabled(tt.model); got != tt.want {
+			t.Errorf("ThinkingTagFallbackEnabled(%q) with %q = %v, want %v", tt.model, tt.patterns, got, tt.want)
+		}
+	}
+}
+
+func TestProcessChunk_TagFallbackDisabled(t *testing.T) {
+	ctx := NewThinkingStreamContext(true)
+	ctx.SetTagFallback(false)
+
+	result := ctx.ProcessChunk("<thinking>not thinking</thinking>")
+
+	if result.TextContent != "<thinking>not thinking</thinking>" {
+		t.Errorf("TextContent = %q, want literal tags", result.TextContent)
+	}
+	if result.ThinkingStarted {
+		t.Error("ThinkingStarted should be false")
+	}
+	if idx := ctx.CurrentTextBlockIndex(); idx != 0 {
+		t.Errorf("CurrentTextBlockIndex() = %d, want 0", idx)
+	}
+}
@@ -13,6 +13,12 @@ type ToolLifecycleManager struct {
 	blockIndexMap      map[string]int
 	nextBlockIndex     int
 	textIntroGenerated bool // 跟踪是否已生成文本介绍
+
+	// thinking 模式下文本块索引由 thinking 上下文决定（为空时文本块固定为0）
+	textBlockIndex func() int
+
+	// 上游工具名还原为客户端原名（为空时原样使用）
+	toolNameResolver func(string) string
 }
 
 // NewToolLifecycleManager 创建工具生命周期管理器
@@ -39,6 +45,15 @@ func (tlm *ToolLifecycleManager) Reset() {
 func (tlm *ToolLifecycleManager) HandleToolCallRequest(request ToolCallRequest) []SSEEvent {
 	events := make([]SSEEvent, 0, len(request.ToolCalls)*3) // 调整预分配容量，包含文本介绍
 
+	if tlm.toolNameResolver != nil {
+		toolCalls := make([]ToolCall, len(request.ToolCalls))
+		for i, toolCall := range request.ToolCalls {
+			toolCall.Function.Name = tlm.toolNameResolver(toolCall.Function.Name)
+			toolCalls[i] = toolCall
+		}
+		request.ToolCalls = toolCalls
+	}
+
 	// *** 关键修复：根据Claude规范，在第一个工具调用前自动生成文本介绍（index:0） ***
 	if !tlm.textIntroGenerated && len(request.ToolCalls) > 0 {
 		// 生成符合Claude规范的文本介绍事件序列
@@ -297,12 +312,25 @@ func (tlm *ToolLifecycleManager) GetCompletedTools() map[string]*ToolExecution {
 	return result
 }
 
+// SetTextBlockIndexFunc 设置文本块索引来源，工具块始终排在文本块之后，避免与 thinking/文本块索引冲突
+func (tlm *ToolLifecycleManager) SetTextBlockIndexFunc(textIndex func() int) {
+	tlm.textBlockIndex = textIndex
+}
+
+// SetToolNameResolver 设置工具名还原函数，上游返回的改写名称在下发前还原为客户端原名
+func (tlm *ToolLifecycleManager) SetToolNameResolver(resolve func(string) string) {
+	tlm.toolNameResolver = resolve
+}
+
 // getOrAssignBlockIndex 获取或分配块索引
 func (tlm *ToolLifecycleManager) getOrAssignBlockIndex(toolID string) int {
 	if index, exists := tlm.blockIndexMap[toolID]; exists {
 		return index
 	}
 
+	if tlm.textBlockIndex != nil {
+		tlm.nextBlockIndex = max(tlm.nextBlockIndex, tlm.textBlockIndex()+1)
+	}
 	index := tlm.nextBlockIndex
 	tlm.blockIndexMap[toolID] = index
 	tlm.nextBlockIndex++
@@ -337,12 +365,16 @@ func (tlm *ToolLifecycleManager) generateTextIntroduction(firstTool ToolCall) []
 	// 2. generateTextIntroduction: content_block_delta(index:0) ← 添加介绍文本
 	// 3. [工具调用处理]: content_block_start(index:1), content_block_stop(index:1), ...
 	// 4. sendFinalEvents: content_block_stop(index:0) ← 关闭文本块
+	textIndex := 0
+	if tlm.textBlockIndex != nil {
+		textIndex = tlm.textBlockIndex()
+	}
 	return []SSEEvent{
 		{
 			Event: "content_block_delta",
 			Data: map[string]any{
 				"type":  "content_block_delta",
-				"index": 0,
+				"index": textIndex,
 				"delta": map[string]any{
 					"type": "text_delta",
 					"text": introText,
@@ -0,0 +1,79 @@
+// Package respcache 缓存确定性请求的完整响应：按规范化的 AnthropicRequest 计算键，
+// 支持进程内 LRU 与磁盘两种后端，条目超过 TTL 后失效
+package respcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"kiro2api/types"
+)
+
+// keyVersion 缓存键格式版本，键的组成变化时递增，使旧条目自然失效
+const keyVersion = "v1"
+
+// Entry 缓存的响应
+type Entry struct {
+	Message  json.RawMessage `json:"message"` // 非流式格式的 Anthropic message 对象
+	StoredAt time.Time       `json:"stored_at"`
+}
+
+// Store 缓存后端
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, entry *Entry) error
+}
+
+// keyFields 参与缓存键计算的字段（不含 stream、metadata 等不影响响应内容的字段）
+type keyFields struct {
+	Version       string                          `json:"version"`
+	Namespace     string                          `json:"namespace"`
+	Model         string                          `json:"model"`
+	MaxTokens     int                             `json:"max_tokens"`
+	System        []types.AnthropicSystemMessage  `json:"system"`
+	Messages      []types.AnthropicRequestMessage `json:"messages"`
+	Tools         []types.AnthropicTool           `json:"tools"`
+	ToolChoice    any                             `json:"tool_choice"`
+	Temperature   *float64                        `json:"temperature"`
+	TopP          *float64                        `json:"top_p"`
+	TopK          *int                            `json:"top_k"`
+	StopSequences []string                        `json:"stop_sequences"`
+	Thinking      *types.Thinking                 `json:"thinking"`
+}
+
+// Key 计算请求的缓存键；namespace 隔离不同客户端的缓存，
+// 对象键按字典序序列化，字段顺序不同的等价请求得到相同的键
+func Key(namespace string, req types.AnthropicRequest) (string, error) {
+	data, err := json.Marshal(keyFields{
+		Version:       keyVersion,
+		Namespace:     namespace,
+		Model:         req.Model,
+		MaxTokens:     req.MaxTokens,
+		System:        req.System,
+		Messages:      req.Messages,
+		Tools:         req.Tools,
+		ToolChoice:    req.ToolChoice,
+		Temperature:   req.Temperature,
+		TopP:          req.TopP,
+		TopK:          req.TopK,
+		StopSequences: req.StopSequences,
+		Thinking:      req.Thinking,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Deterministic 请求是否为确定性采样（temperature 为 0）
+func Deterministic(req types.AnthropicRequest) bool {
+	return req.Temperature != nil && *req.Temperature == 0
+}
+
+// expired 条目是否已超过有效期（ttl <= 0 表示不过期）
+func expired(entry *Entry, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(entry.StoredAt) >= ttl
+}
@@ -0,0 +1,117 @@
+package respcache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRequest(t *testing.T, body string) types.AnthropicRequest {
+	t.Helper()
+	var req types.AnthropicRequest
+	require.NoError(t, json.Unmarshal([]byte(body), &req))
+	return req
+}
+
+func TestKey_Canonical(t *testing.T) {
+	base := testRequest(t, `{"model":"claude-sonnet-4-20250514","max_tokens":256,"temperature":0,
+		"messages":[{"role":"user","content":[{"type":"text","text":"lint this","cache_control":{"type":"ephemeral"}}]}]}`)
+	key, err := Key("default", base)
+	require.NoError(t, err)
+	assert.Len(t, key, 64)
+
+	// 字段顺序、stream 与 metadata 不影响缓存键
+	same := testRequest(t, `{"stream":true,"metadata":{"user_id":"session-2"},"temperature":0,"max_tokens":256,
+		"messages":[{"content":[{"cache_control":{"type":"ephemeral"},"text":"lint this","type":"text"}],"role":"user"}],
+		"model":"claude-sonnet-4-20250514"}`)
+	sameKey, err := Key("default", same)
+	require.NoError(t, err)
+	assert.Equal(t, key, sameKey)
+
+	variants := map[string]string{
+		"model":       `{"model":"claude-3-7-sonnet-20250219","max_tokens":256,"temperature":0,"messages":[{"role":"user","content":[{"type":"text","text":"lint this","cache_control":{"type":"ephemeral"}}]}]}`,
+		"temperature": `{"model":"claude-sonnet-4-20250514","max_tokens":256,"temperature":0.5,"messages":[{"role":"user","content":[{"type":"text","text":"lint this","cache_control":{"type":"ephemeral"}}]}]}`,
+		"top_p":       `{"model":"claude-sonnet-4-20250514","max_tokens":256,"temperature":0,"top_p":0.9,"messages":[{"role":"user","content":[{"type":"text","text":"lint this","cache_control":{"type":"ephemeral"}}]}]}`,
+		"system":      `{"model":"claude-sonnet-4-20250514","max_tokens":256,"temperature":0,"system":[{"type":"text","text":"be brief"}],"messages":[{"role":"user","content":[{"type":"text","text":"lint this","cache_control":{"type":"ephemeral"}}]}]}`,
+		"tools":       `{"model":"claude-sonnet-4-20250514","max_tokens":256,"temperature":0,"tools":[{"name":"Read","input_schema":{"type":"object"}}],"messages":[{"role":"user","content":[{"type":"text","text":"lint this","cache_control":{"type":"ephemeral"}}]}]}`,
+		"messages":    `{"model":"claude-sonnet-4-20250514","max_tokens":256,"temperature":0,"messages":[{"role":"user","content":"lint that"}]}`,
+	}
+	for name, body := range variants {
+		t.Run(name, func(t *testing.T) {
+			other, err := Key("default", testRequest(t, body))
+			require.NoError(t, err)
+			assert.NotEqual(t, key, other)
+		})
+	}
+
+	tenantKey, err := Key("tenant_ci", base)
+	require.NoError(t, err)
+	assert.NotEqual(t, key, tenantKey, "不同客户端的缓存相互隔离")
+}
+
+func TestDeterministic(t *testing.T) {
+	zero, half := 0.0, 0.5
+	assert.True(t, Deterministic(types.AnthropicRequest{Temperature: &zero}))
+	assert.False(t, Deterministic(types.AnthropicRequest{Temperature: &half}))
+	assert.False(t, Deterministic(types.AnthropicRequest{}), "未指定 temperature 时默认为 1")
+}
+
+func TestMemory_LRUAndTTL(t *testing.T) {
+	now := time.Now()
+	m := NewMemory(2, time.Minute)
+	m.nowFn = func() time.Time { return now }
+
+	entry := func(text string) *Entry {
+		return &Entry{Message: json.RawMessage(`{"text":"` + text + `"}`), StoredAt: now}
+	}
+	require.NoError(t, m.Set("a", entry("a")))
+	require.NoError(t, m.Set("b", entry("b")))
+	_, ok := m.Get("a") // a 成为最近使用
+	require.True(t, ok)
+	require.NoError(t, m.Set("c", entry("c")))
+
+	_, ok = m.Get("b")
+	assert.False(t, ok, "最久未使用的条目应被淘汰")
+	got, ok := m.Get("a")
+	require.True(t, ok)
+	assert.JSONEq(t, `{"text":"a"}`, string(got.Message))
+	assert.Equal(t, 2, m.Len())
+
+	now = now.Add(time.Minute)
+	_, ok = m.Get("c")
+	assert.False(t, ok, "超过 TTL 的条目失效")
+	assert.Equal(t, 1, m.Len())
+}
+
+func TestDisk_PersistAndExpire(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(dir, time.Hour)
+	require.NoError(t, err)
+
+	key := "ab" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789ab"
+	require.NoError(t, d.Set(key, &Entry{Message: json.RawMessage(`{"type":"message"}`), StoredAt: time.Now()}))
+	assert.Error(t, d.Set("../escape", &Entry{}), "非法键不能写出缓存目录")
+
+	// 重新打开后仍可读取
+	d, err = NewDisk(dir, time.Hour)
+	require.NoError(t, err)
+	got, ok := d.Get(key)
+	require.True(t, ok)
+	assert.JSONEq(t, `{"type":"message"}`, string(got.Message))
+
+	// 写入中断遗留的临时文件与过期条目在启动时清理
+	stale := filepath.Join(dir, "ab", ".tmp-123")
+	require.NoError(t, os.WriteFile(stale, []byte("{"), 0o600))
+	require.NoError(t, d.Set(key, &Entry{Message: json.RawMessage(`{}`), StoredAt: time.Now().Add(-2 * time.Hour)}))
+	_, err = NewDisk(dir, time.Hour)
+	require.NoError(t, err)
+	assert.NoFileExists(t, stale)
+	assert.NoFileExists(t, filepath.Join(dir, "ab", key+".json"))
+}
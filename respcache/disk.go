@@ -0,0 +1,110 @@
+package respcache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"kiro2api/logger"
+)
+
+// Disk 磁盘缓存，每个条目一个文件（<dir>/<键前两位>/<键>.json），进程重启后仍然有效
+type Disk struct {
+	dir   string
+	ttl   time.Duration
+	nowFn func() time.Time
+}
+
+// NewDisk 创建磁盘缓存并清理已过期的条目
+func NewDisk(dir string, ttl time.Duration) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("创建响应缓存目录失败: %w", err)
+	}
+	d := &Disk{dir: dir, ttl: ttl, nowFn: time.Now}
+	d.prune()
+	return d, nil
+}
+
+// Get 读取未过期的条目，过期或损坏的文件在此时删除
+func (d *Disk) Get(key string) (*Entry, bool) {
+	path, ok := d.path(key)
+	if !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil || expired(&entry, d.ttl, d.nowFn()) {
+		_ = os.Remove(path)
+		return nil, false
+	}
+	return &entry, true
+}
+
+// Set 写入条目，先写临时文件再重命名，避免并发读取到不完整的内容
+func (d *Disk) Set(key string, entry *Entry) error {
+	path, ok := d.path(key)
+	if !ok {
+		return fmt.Errorf("无效的缓存键: %q", key)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// path 键只允许十六进制字符，防止路径穿越
+func (d *Disk) path(key string) (string, bool) {
+	if len(key) < 3 || strings.Trim(key, "0123456789abcdef") != "" {
+		return "", false
+	}
+	return filepath.Join(d.dir, key[:2], key+".json"), true
+}
+
+// prune 删除已过期的条目与写入中断遗留的临时文件
+func (d *Disk) prune() {
+	removed := 0
+	_ = filepath.WalkDir(d.dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		name := entry.Name()
+		if strings.HasPrefix(name, ".tmp-") {
+			_ = os.Remove(path)
+			return nil
+		}
+		if key := strings.TrimSuffix(name, ".json"); key != name {
+			if _, ok := d.Get(key); !ok {
+				if _, err := os.Stat(path); os.IsNotExist(err) {
+					removed++
+				}
+			}
+		}
+		return nil
+	})
+	if removed > 0 {
+		logger.Info("已清理过期的响应缓存", logger.Int("removed", removed))
+	}
+}
@@ -0,0 +1,81 @@
+package respcache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Memory 进程内 LRU 缓存
+type Memory struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	order      *list.List // 最近使用的在前
+	items      map[string]*list.Element
+	nowFn      func() time.Time
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+// NewMemory 创建 LRU 缓存，maxEntries <= 0 时默认 1000
+func NewMemory(maxEntries int, ttl time.Duration) *Memory {
+	if maxEntries <= 0 {
+		maxEntries = 1000
+	}
+	return &Memory{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+		nowFn:      time.Now,
+	}
+}
+
+// Get 获取未过期的条目，过期条目在此时删除
+func (m *Memory) Get(key string) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elem, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*memoryItem)
+	if expired(item.entry, m.ttl, m.nowFn()) {
+		m.order.Remove(elem)
+		delete(m.items, key)
+		return nil, false
+	}
+	m.order.MoveToFront(elem)
+	return item.entry, true
+}
+
+// Set 写入条目，超出容量时淘汰最久未使用的条目
+func (m *Memory) Set(key string, entry *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if elem, ok := m.items[key]; ok {
+		elem.Value.(*memoryItem).entry = entry
+		m.order.MoveToFront(elem)
+		return nil
+	}
+	m.items[key] = m.order.PushFront(&memoryItem{key: key, entry: entry})
+	for m.order.Len() > m.maxEntries {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.items, oldest.Value.(*memoryItem).key)
+	}
+	return nil
+}
+
+// Len 当前缓存的条目数
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
@@ -0,0 +1,182 @@
+// Package rewrite 运维方定义的请求改写规则：在请求解析之后、转换为 CodeWhisperer 请求之前，
+// 按客户端、模型、路径与请求头匹配规则，执行系统提示注入、工具过滤、模型覆盖与 max_tokens 上限等动作
+package rewrite
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/types"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RuleSet 规则集，按顺序执行全部匹配的规则
+type RuleSet struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+// Rule 单条改写规则
+type Rule struct {
+	Name     string  `json:"name" yaml:"name"`
+	Disabled bool    `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	Match    Match   `json:"match" yaml:"match"`
+	Actions  Actions `json:"actions" yaml:"actions"`
+}
+
+// Match 匹配条件，各字段之间为与关系，字段内多个模式为或关系，空字段匹配任意值
+// 模式支持精确匹配、"*" 匹配全部以及 "prefix*" 前缀匹配
+type Match struct {
+	ClientKeys []string            `json:"client_keys,omitempty" yaml:"client_keys,omitempty"`
+	Models     []string            `json:"models,omitempty" yaml:"models,omitempty"`
+	Paths      []string            `json:"paths,omitempty" yaml:"paths,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+// Actions 规则动作，按字段声明顺序执行
+type Actions struct {
+	PrependSystem string   `json:"prepend_system,omitempty" yaml:"prepend_system,omitempty"`
+	AppendSystem  string   `json:"append_system,omitempty" yaml:"append_system,omitempty"`
+	RemoveTools   []string `json:"remove_tools,omitempty" yaml:"remove_tools,omitempty"`
+	Model         string   `json:"model,omitempty" yaml:"model,omitempty"`
+	MaxTokensCap  int      `json:"max_tokens_cap,omitempty" yaml:"max_tokens_cap,omitempty"`
+}
+
+// RequestInfo 规则匹配使用的请求属性
+type RequestInfo struct {
+	ClientKey string
+	Path      string
+	Header    http.Header
+}
+
+// Parse 解析 JSON 或 YAML 格式的规则集（JSON 是 YAML 的子集，统一按 YAML 解析）并校验
+func Parse(data []byte) (*RuleSet, error) {
+	rs := &RuleSet{}
+	if err := yaml.Unmarshal(data, rs); err != nil {
+		return nil, fmt.Errorf("解析改写规则失败: %w", err)
+	}
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Validate 校验规则名称唯一、模型存在且动作参数合法
+func (rs *RuleSet) Validate() error {
+	names := make(map[string]bool)
+	for i, rule := range rs.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("第 %d 条规则缺少 name", i+1)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("规则名称重复: %s", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if model := rule.Actions.Model; model != "" {
+			if _, ok := config.ModelMap[model]; !ok {
+				return fmt.Errorf("规则 %s: 不支持的模型 %s", rule.Name, model)
+			}
+		}
+		if rule.Actions.MaxTokensCap < 0 {
+			return fmt.Errorf("规则 %s: max_tokens_cap 不能为负数", rule.Name)
+		}
+	}
+	return nil
+}
+
+// Matches 判断规则是否匹配请求
+func (r *Rule) Matches(req *types.AnthropicRequest, info RequestInfo) bool {
+	if r.Disabled {
+		return false
+	}
+	if !matchAny(r.Match.ClientKeys, info.ClientKey) ||
+		!matchAny(r.Match.Models, req.Model) ||
+		!matchAny(r.Match.Paths, info.Path) {
+		return false
+	}
+	for name, patterns := range r.Match.Headers {
+		if !matchAny(patterns, info.Header.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply 按顺序执行全部匹配规则的动作，返回生效的规则名称
+func (rs *RuleSet) Apply(req *types.AnthropicRequest, info RequestInfo) []string {
+	if rs == nil {
+		return nil
+	}
+	var applied []string
+	for i := range rs.Rules {
+		rule := &rs.Rules[i]
+		if !rule.Matches(req, info) {
+			continue
+		}
+		rule.Actions.apply(req)
+		applied = append(applied, rule.Name)
+	}
+	return applied
+}
+
+func (a *Actions) apply(req *types.AnthropicRequest) {
+	if a.PrependSystem != "" {
+		req.System = append([]types.AnthropicSystemMessage{{Type: "text", Text: a.PrependSystem}}, req.System...)
+	}
+	if a.AppendSystem != "" {
+		req.System = append(req.System, types.AnthropicSystemMessage{Type: "text", Text: a.AppendSystem})
+	}
+	if len(a.RemoveTools) > 0 {
+		removeTools(req, a.RemoveTools)
+	}
+	if a.Model != "" {
+		req.Model = a.Model
+	}
+	if a.MaxTokensCap > 0 && (req.MaxTokens <= 0 || req.MaxTokens > a.MaxTokensCap) {
+		req.MaxTokens = a.MaxTokensCap
+	}
+}
+
+// removeTools 移除名称匹配的工具；tool_choice 指向被移除的工具或已无工具可调用时回退为 auto
+func removeTools(req *types.AnthropicRequest, patterns []string) {
+	kept := make([]types.AnthropicTool, 0, len(req.Tools))
+	for _, tool := range req.Tools {
+		if !matchAny(patterns, tool.Name) {
+			kept = append(kept, tool)
+		}
+	}
+	req.Tools = kept
+
+	tc := converter.ResolveToolChoice(req.ToolChoice)
+	if tc == nil {
+		return
+	}
+	if (tc.Name != "" && matchAny(patterns, tc.Name)) || (len(req.Tools) == 0 && tc.RequiresTool()) {
+		req.ToolChoice = nil
+	}
+}
+
+// matchAny 空模式列表匹配任意值
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matchPattern(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPattern 支持精确匹配与 "prefix*" 前缀匹配（"*" 匹配全部）
+func matchPattern(pattern, value string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(value, prefix)
+	}
+	return pattern == value
+}
@@ -0,0 +1,167 @@
+package rewrite
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const yamlRules = `
+rules:
+  - name: org-preamble
+    actions:
+      prepend_system: "Follow the ACME engineering handbook."
+  - name: no-bash-for-ci
+    match:
+      client_keys: ["tenant_ci*"]
+      paths: ["/v1/messages"]
+      headers:
+        X-Team: ["infra", "ops*"]
+    actions:
+      remove_tools: ["Bash", "mcp__*"]
+      model: claude-sonnet-4-20250514
+      max_tokens_cap: 4096
+  - name: disabled
+    disabled: true
+    actions:
+      append_system: "never"
+`
+
+func testRequest() *types.AnthropicRequest {
+	return &types.AnthropicRequest{
+		Model:     "claude-3-7-sonnet-20250219",
+		MaxTokens: 32000,
+		System:    []types.AnthropicSystemMessage{{Type: "text", Text: "You are Claude Code."}},
+		Tools: []types.AnthropicTool{
+			{Name: "Bash"},
+			{Name: "Read"},
+			{Name: "mcp__github__create_issue"},
+		},
+		ToolChoice: map[string]any{"type": "tool", "name": "Bash"},
+		Messages:   []types.AnthropicRequestMessage{{Role: "user", Content: "hi"}},
+	}
+}
+
+func toolNames(req *types.AnthropicRequest) []string {
+	var names []string
+	for _, tool := range req.Tools {
+		names = append(names, tool.Name)
+	}
+	return names
+}
+
+func TestParse_YAMLAndJSON(t *testing.T) {
+	rs, err := Parse([]byte(yamlRules))
+	require.NoError(t, err)
+	require.Len(t, rs.Rules, 3)
+	assert.Equal(t, []string{"infra", "ops*"}, rs.Rules[1].Match.Headers["X-Team"])
+	assert.Equal(t, 4096, rs.Rules[1].Actions.MaxTokensCap)
+
+	rs, err = Parse([]byte(`{"rules":[{"name":"cap","actions":{"max_tokens_cap":1024}}]}`))
+	require.NoError(t, err)
+	assert.Equal(t, 1024, rs.Rules[0].Actions.MaxTokensCap)
+}
+
+func TestParse_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"missing_name":   `{"rules":[{"actions":{"max_tokens_cap":1}}]}`,
+		"duplicate_name": `{"rules":[{"name":"a"},{"name":"a"}]}`,
+		"unknown_model":  `{"rules":[{"name":"a","actions":{"model":"gpt-4"}}]}`,
+		"negative_cap":   `{"rules":[{"name":"a","actions":{"max_tokens_cap":-1}}]}`,
+		"malformed":      `rules: [`,
+	}
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(data))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestApply_MatchingRules(t *testing.T) {
+	rs, err := Parse([]byte(yamlRules))
+	require.NoError(t, err)
+
+	header := http.Header{}
+	header.Set("X-Team", "ops-east")
+	req := testRequest()
+	applied := rs.Apply(req, RequestInfo{ClientKey: "tenant_ci01", Path: "/v1/messages", Header: header})
+
+	assert.Equal(t, []string{"org-preamble", "no-bash-for-ci"}, applied)
+	require.Len(t, req.System, 2)
+	assert.Equal(t, "Follow the ACME engineering handbook.", req.System[0].Text)
+	assert.Equal(t, []string{"Read"}, toolNames(req))
+	assert.Nil(t, req.ToolChoice, "指向被移除工具的 tool_choice 应回退为 auto")
+	assert.Equal(t, "claude-sonnet-4-20250514", req.Model)
+	assert.Equal(t, 4096, req.MaxTokens)
+}
+
+func TestApply_NonMatching(t *testing.T) {
+	rs, err := Parse([]byte(yamlRules))
+	require.NoError(t, err)
+
+	cases := map[string]RequestInfo{
+		"client_key": {ClientKey: "default", Path: "/v1/messages", Header: http.Header{"X-Team": {"infra"}}},
+		"path":       {ClientKey: "tenant_ci01", Path: "/v1/chat/completions", Header: http.Header{"X-Team": {"infra"}}},
+		"header":     {ClientKey: "tenant_ci01", Path: "/v1/messages", Header: http.Header{"X-Team": {"web"}}},
+		"no_header":  {ClientKey: "tenant_ci01", Path: "/v1/messages"},
+	}
+	for name, info := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := testRequest()
+			applied := rs.Apply(req, info)
+			assert.Equal(t, []string{"org-preamble"}, applied)
+			assert.Len(t, req.Tools, 3)
+			assert.Equal(t, 32000, req.MaxTokens)
+		})
+	}
+}
+
+func TestApply_KeepsToolChoiceForRemainingTools(t *testing.T) {
+	req := testRequest()
+	req.ToolChoice = map[string]any{"type": "any"}
+	rs := &RuleSet{Rules: []Rule{{Name: "drop", Actions: Actions{RemoveTools: []string{"Bash"}}}}}
+	rs.Apply(req, RequestInfo{})
+	assert.Equal(t, map[string]any{"type": "any"}, req.ToolChoice)
+
+	rs.Rules[0].Actions.RemoveTools = []string{"*"}
+	rs.Apply(req, RequestInfo{})
+	assert.Empty(t, req.Tools)
+	assert.Nil(t, req.ToolChoice, "没有可调用的工具时 any 应回退为 auto")
+}
+
+func TestLoadFileAndSave(t *testing.T) {
+	defer Set(nil)
+	dir := t.TempDir()
+
+	rs, err := LoadFile("")
+	require.NoError(t, err)
+	assert.Nil(t, rs)
+
+	path := filepath.Join(dir, "rules.yaml")
+	rs, err = LoadFile(path)
+	require.NoError(t, err, "文件不存在时以空规则集启动")
+	assert.Empty(t, rs.Rules)
+	assert.Equal(t, path, File())
+
+	persisted, err := Save(&RuleSet{Rules: []Rule{{Name: "cap", Actions: Actions{MaxTokensCap: 2048}}}})
+	require.NoError(t, err)
+	assert.True(t, persisted)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	reloaded, err := Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, 2048, reloaded.Rules[0].Actions.MaxTokensCap)
+	assert.Equal(t, 2048, Current().Rules[0].Actions.MaxTokensCap)
+
+	_, err = Save(&RuleSet{Rules: []Rule{{Name: ""}}})
+	assert.Error(t, err)
+	assert.Len(t, Current().Rules, 1, "校验失败时保留原规则")
+}
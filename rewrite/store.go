@@ -0,0 +1,105 @@
+package rewrite
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	current   *RuleSet
+	rulesFile string
+	currentMu sync.RWMutex
+)
+
+// Current 返回当前生效的规则集，未配置时返回 nil
+func Current() *RuleSet {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	return current
+}
+
+// Set 替换当前规则集（管理 API 或测试使用），传入 nil 关闭改写
+func Set(rs *RuleSet) {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = rs
+}
+
+// File 返回规则文件路径，未配置时为空
+func File() string {
+	currentMu.RLock()
+	defer currentMu.RUnlock()
+	return rulesFile
+}
+
+// LoadFile 从 JSON/YAML 文件加载规则集并设为当前规则，path 为空时不启用；文件不存在时以空规则集启动
+func LoadFile(path string) (*RuleSet, error) {
+	if path == "" {
+		return nil, nil
+	}
+	rs := &RuleSet{}
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, fmt.Errorf("读取改写规则文件失败: %w", err)
+	default:
+		if rs, err = Parse(data); err != nil {
+			return nil, err
+		}
+	}
+
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = rs
+	rulesFile = path
+	return rs, nil
+}
+
+// Save 校验并替换当前规则集，配置了规则文件时按扩展名写回（.yaml/.yml 为 YAML，其余为 JSON）
+func Save(rs *RuleSet) (persisted bool, err error) {
+	if err := rs.Validate(); err != nil {
+		return false, err
+	}
+
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if rulesFile != "" {
+		if err := writeFile(rulesFile, rs); err != nil {
+			return false, err
+		}
+		persisted = true
+	}
+	current = rs
+	return persisted, nil
+}
+
+// writeFile 先写临时文件再重命名，避免写入中断导致规则文件损坏
+func writeFile(path string, rs *RuleSet) error {
+	var data []byte
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(rs)
+	default:
+		data, err = json.MarshalIndent(rs, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("序列化改写规则失败: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("写入改写规则文件失败: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("写入改写规则文件失败: %w", err)
+	}
+	return nil
+}
@@ -545,6 +545,17 @@ func RegisterAdminRoutes(r *gin.Engine) {
 		admin.POST("/tokens/batch", handleBatchAddTokens)
 		admin.POST("/tokens/upload", handleUploadTokenFile)
 
+		// 租户管理（多租户模式）
+		admin.GET("/tenants", handleListTenants)
+		admin.POST("/tenants", handleAddTenant)
+		admin.PUT("/tenants/:id", handleUpdateTenant)
+		admin.DELETE("/tenants/:id", handleDeleteTenant)
+
+		// 请求改写规则
+		admin.GET("/rules", handleGetRewriteRules)
+		admin.PUT("/rules", handleUpdateRewriteRules)
+		admin.POST("/rules/dry-run", handleRewriteDryRun)
+
 		// 导出/导入
 		admin.GET("/export", handleExportConfig)
 		admin.POST("/import", handleImportConfig)
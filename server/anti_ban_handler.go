@@ -6,6 +6,7 @@ import (
 
 	"kiro2api/auth"
 	"kiro2api/config"
+	"kiro2api/notify"
 
 	"github.com/gin-gonic/gin"
 )
@@ -37,19 +38,39 @@ func handleAntiBanStatus(c *gin.Context) {
 		"token_cache_ttl_sec": config.TokenCacheTTL.Seconds(),
 	}
 
+	// 获取后台调度器和健康探测统计（未启用时为nil）
+	var schedulerStats, healthStats map[string]any
+	if v, exists := c.Get("auth_service"); exists {
+		if as, ok := v.(*auth.AuthService); ok && as.GetTokenManager() != nil {
+			if scheduler := as.GetTokenManager().GetScheduler(); scheduler != nil {
+				schedulerStats = scheduler.GetStats()
+			}
+			if health := as.GetTokenManager().GetHealthMonitor(); health != nil {
+				healthStats = health.GetStats()
+			}
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"timestamp":    time.Now().Format(time.RFC3339),
-		"status":       "active",
-		"rate_limiter": rateLimiterStats,
-		"fingerprints": fingerprintStats,
-		"proxy_pool":   proxyPoolStats,
-		"config":       configInfo,
+		"timestamp":       time.Now().Format(time.RFC3339),
+		"status":          "active",
+		"rate_limiter":    rateLimiterStats,
+		"fingerprints":    fingerprintStats,
+		"proxy_pool":      proxyPoolStats,
+		"token_scheduler": schedulerStats,
+		"token_health":    healthStats,
+		"notifier":        notify.GetNotifier().GetStats(),
+		"upstream_errors": notify.GetErrorRateTracker().GetStats(),
+		"config":          configInfo,
 		"features": map[string]bool{
 			"fingerprint_randomization": true,
 			"rate_limiting":             true,
 			"smart_token_rotation":      true,
 			"cooldown_on_error":         true,
 			"proxy_pool":                proxyPool.IsEnabled(),
+			"background_token_refresh":  schedulerStats != nil,
+			"health_probe":              healthStats != nil,
+			"webhook_notifications":     notify.GetNotifier().IsEnabled(),
 		},
 	})
 }
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+
+	"kiro2api/auth"
+	"kiro2api/batch"
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchManager 消息批次管理器，由 InitBatches 设置，为空表示批次功能不可用
+var batchManager *batch.Manager
+
+// batchExcludedHeaders 不随批次持久化的请求头（认证信息单独保存）
+var batchExcludedHeaders = map[string]bool{
+	"Authorization":  true,
+	"X-Api-Key":      true,
+	"Cookie":         true,
+	"Content-Length": true,
+	"Content-Type":   true,
+}
+
+// InitBatches 初始化消息批次（数据写入 dataDir/batches），继续处理重启前未完成的批次
+func InitBatches(dataDir string, authService *auth.AuthService) error {
+	m, err := batch.NewManager(filepath.Join(dataDir, "batches"), batch.Options{
+		Concurrency: config.BatchConcurrency,
+		MaxRequests: config.BatchMaxRequests,
+		Expiry:      config.BatchExpiry,
+	}, batchExecutor(authService))
+	if err != nil {
+		return err
+	}
+	batchManager = m
+	return nil
+}
+
+// batchExecutor 以批次创建者的身份将单条请求交给 /v1/messages 的非流式处理流程，
+// Token 获取与频率限制与普通请求一致
+func batchExecutor(authService tokenProvider) batch.Executor {
+	return func(ctx context.Context, meta batch.Meta, req batch.Request) (int, []byte) {
+		var params map[string]any
+		if err := utils.SafeUnmarshal(req.Params, &params); err != nil {
+			return http.StatusBadRequest, nil
+		}
+		params["stream"] = false
+		body, err := utils.SafeMarshal(params)
+		if err != nil {
+			return http.StatusBadRequest, nil
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "/v1/messages", bytes.NewReader(body))
+		if err != nil {
+			return http.StatusInternalServerError, nil
+		}
+		for name, value := range meta.Headers {
+			httpReq.Header.Set(name, value)
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httpReq
+		c.Set("request_id", meta.ID+"_"+req.CustomID)
+		c.Set("auth_service", authService)
+		c.Set("isMultiTenant", meta.Credential != "")
+		if meta.Credential != "" {
+			cred, err := auth.ParseTenantCredential(meta.Credential)
+			if err != nil {
+				return http.StatusUnauthorized, nil
+			}
+			c.Set("tenantCredential", cred)
+		}
+
+		handleMessages(c, authService)
+		return w.Code, w.Body.Bytes()
+	}
+}
+
+// getOwnedBatch 获取当前客户端创建的批次，其他客户端的批次按不存在处理
+func getOwnedBatch(c *gin.Context) (*batch.Batch, bool) {
+	if batchManager == nil {
+		respondError(c, http.StatusServiceUnavailable, "%s", "消息批次功能不可用")
+		return nil, false
+	}
+	b, ok := batchManager.Get(c.Param("id"))
+	if !ok || b.Owner() != rewriteClientKey(c) {
+		respondError(c, http.StatusNotFound, "批次不存在: %s", c.Param("id"))
+		return nil, false
+	}
+	return b, true
+}
+
+// batchResultsURL 批次结果地址（按当前请求的协议与主机生成绝对地址）
+func batchResultsURL(c *gin.Context, id string) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host + "/v1/messages/batches/" + id + "/results"
+}
+
+// handleCreateBatch POST /v1/messages/batches
+func handleCreateBatch(c *gin.Context) {
+	if batchManager == nil {
+		respondError(c, http.StatusServiceUnavailable, "%s", "消息批次功能不可用")
+		return
+	}
+
+	var req struct {
+		Requests []batch.Request `json:"requests"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+		return
+	}
+
+	headers := make(map[string]string)
+	for name, values := range c.Request.Header {
+		if !batchExcludedHeaders[name] && len(values) > 0 {
+			headers[name] = values[0]
+		}
+	}
+	_, credential := parseAPIKey(extractAPIKey(c))
+
+	view, err := batchManager.Create(rewriteClientKey(c), credential, headers, req.Requests)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// handleListBatches GET /v1/messages/batches，按创建时间倒序分页
+func handleListBatches(c *gin.Context) {
+	if batchManager == nil {
+		respondError(c, http.StatusServiceUnavailable, "%s", "消息批次功能不可用")
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 1000 {
+		respondError(c, http.StatusBadRequest, "%s", "limit 必须为 1-1000")
+		return
+	}
+
+	views := batchManager.List(rewriteClientKey(c))
+	start, end := 0, len(views)
+	for i, view := range views {
+		if afterID := c.Query("after_id"); afterID != "" && view.ID == afterID {
+			start = i + 1
+		}
+		if beforeID := c.Query("before_id"); beforeID != "" && view.ID == beforeID {
+			end = i
+		}
+	}
+	if start > end {
+		start = end
+	}
+	page := views[start:end]
+	hasMore := false
+	if len(page) > limit {
+		hasMore = true
+		if c.Query("before_id") != "" && c.Query("after_id") == "" {
+			page = page[len(page)-limit:]
+		} else {
+			page = page[:limit]
+		}
+	}
+
+	for i := range page {
+		if page[i].ProcessingStatus == batch.StatusEnded {
+			url := batchResultsURL(c, page[i].ID)
+			page[i].ResultsURL = &url
+		}
+	}
+	if page == nil {
+		page = []batch.MessageBatch{}
+	}
+	resp := gin.H{"data": page, "has_more": hasMore, "first_id": nil, "last_id": nil}
+	if len(page) > 0 {
+		resp["first_id"] = page[0].ID
+		resp["last_id"] = page[len(page)-1].ID
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleGetBatch GET /v1/messages/batches/:id
+func handleGetBatch(c *gin.Context) {
+	b, ok := getOwnedBatch(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, b.View(batchResultsURL(c, c.Param("id"))))
+}
+
+// handleCancelBatch POST /v1/messages/batches/:id/cancel
+func handleCancelBatch(c *gin.Context) {
+	b, ok := getOwnedBatch(c)
+	if !ok {
+		return
+	}
+	if _, err := batchManager.Cancel(c.Param("id")); err != nil {
+		respondError(c, http.StatusNotFound, "%v", err)
+		return
+	}
+	c.JSON(http.StatusOK, b.View(batchResultsURL(c, c.Param("id"))))
+}
+
+// handleBatchResults GET /v1/messages/batches/:id/results，以 JSONL 返回全部结果
+func handleBatchResults(c *gin.Context) {
+	b, ok := getOwnedBatch(c)
+	if !ok {
+		return
+	}
+	if b.View("").ProcessingStatus != batch.StatusEnded {
+		respondError(c, http.StatusBadRequest, "批次尚未结束: %s", c.Param("id"))
+		return
+	}
+	c.Header("Content-Type", "application/x-jsonl")
+	c.File(b.ResultsPath())
+}
+
+// handleDeleteBatch DELETE /v1/messages/batches/:id，仅可删除已结束的批次
+func handleDeleteBatch(c *gin.Context) {
+	if _, ok := getOwnedBatch(c); !ok {
+		return
+	}
+	id := c.Param("id")
+	if err := batchManager.Delete(id); err != nil {
+		if errors.Is(err, batch.ErrNotEnded) {
+			respondError(c, http.StatusBadRequest, "批次尚未结束，请先取消: %s", id)
+			return
+		}
+		logger.Error("删除消息批次失败", addReqFields(c, logger.String("batch_id", id), logger.Err(err))...)
+		respondError(c, http.StatusInternalServerError, "删除批次失败: %v", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "type": "message_batch_deleted"})
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/batch"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBatchBody = `{"requests": [
+	{"custom_id": "first", "params": {"model": "claude-sonnet-4-20250514", "max_tokens": 64, "stream": true, "messages": [{"role": "user", "content": "hi"}]}},
+	{"custom_id": "second", "params": {"model": "claude-sonnet-4-20250514", "max_tokens": 64, "messages": [{"role": "user", "content": "hello"}]}}
+]}`
+
+// useBatchManager 以指定执行函数替换批次管理器
+func useBatchManager(t *testing.T, exec batch.Executor) {
+	t.Helper()
+	m, err := batch.NewManager(t.TempDir(), batch.Options{Concurrency: 1, Expiry: time.Hour}, exec)
+	require.NoError(t, err)
+	old := batchManager
+	batchManager = m
+	t.Cleanup(func() {
+		m.Close()
+		batchManager = old
+	})
+}
+
+func batchRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if tenant := c.GetHeader("X-Test-Tenant"); tenant != "" {
+			c.Set("tenantCredential", auth.TenantCredential{TenantID: tenant})
+		}
+	})
+	r.POST("/v1/messages/batches", handleCreateBatch)
+	r.GET("/v1/messages/batches", handleListBatches)
+	r.GET("/v1/messages/batches/:id", handleGetBatch)
+	r.POST("/v1/messages/batches/:id/cancel", handleCancelBatch)
+	r.GET("/v1/messages/batches/:id/results", handleBatchResults)
+	r.DELETE("/v1/messages/batches/:id", handleDeleteBatch)
+	return r
+}
+
+func serveBatch(r *gin.Engine, method, path, body, tenant string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if tenant != "" {
+		req.Header.Set("X-Test-Tenant", tenant)
+	}
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func waitBatchEnded(t *testing.T, r *gin.Engine, id string) batch.MessageBatch {
+	t.Helper()
+	var view batch.MessageBatch
+	require.Eventually(t, func() bool {
+		w := serveBatch(r, http.MethodGet, "/v1/messages/batches/"+id, "", "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &view))
+		return view.ProcessingStatus == batch.StatusEnded
+	}, 5*time.Second, 10*time.Millisecond)
+	return view
+}
+
+func TestBatches_ExecuteThroughMessagesHandler(t *testing.T) {
+	requests := mockUpstreamTurns(t, textTurn("first answer"), textTurn("second answer"))
+	useBatchManager(t, batchExecutor(&MockAuthService{token: types.TokenInfo{AccessToken: "test"}}))
+	r := batchRouter()
+
+	w := serveBatch(r, http.MethodPost, "/v1/messages/batches", testBatchBody, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created batch.MessageBatch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, batch.StatusInProgress, created.ProcessingStatus)
+	assert.Nil(t, created.ResultsURL)
+
+	view := waitBatchEnded(t, r, created.ID)
+	assert.Equal(t, batch.RequestCounts{Succeeded: 2}, view.RequestCounts)
+	require.NotNil(t, view.ResultsURL)
+	assert.Equal(t, "http://example.com/v1/messages/batches/"+created.ID+"/results", *view.ResultsURL)
+	require.Len(t, *requests, 2)
+	assert.False(t, (*requests)[0].Stream, "批次请求一律按非流式执行")
+
+	w = serveBatch(r, http.MethodGet, "/v1/messages/batches/"+created.ID+"/results", "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-jsonl", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 2)
+	var result struct {
+		CustomID string `json:"custom_id"`
+		Result   struct {
+			Type    string         `json:"type"`
+			Message map[string]any `json:"message"`
+		} `json:"result"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &result))
+	assert.Equal(t, "first", result.CustomID)
+	assert.Equal(t, batch.ResultSucceeded, result.Result.Type)
+	assert.Equal(t, "message", result.Result.Message["type"])
+	assert.Contains(t, lines[0], "first answer")
+}
+
+func TestBatches_OwnershipAndLifecycle(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	useBatchManager(t, func(ctx context.Context, _ batch.Meta, _ batch.Request) (int, []byte) {
+		started <- struct{}{}
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		return http.StatusOK, []byte(`{"type":"message"}`)
+	})
+	defer close(release)
+	r := batchRouter()
+
+	w := serveBatch(r, http.MethodPost, "/v1/messages/batches", testBatchBody, "alice")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var created batch.MessageBatch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	path := "/v1/messages/batches/" + created.ID
+	<-started
+
+	// 其他客户端看不到该批次
+	assert.Equal(t, http.StatusNotFound, serveBatch(r, http.MethodGet, path, "", "bob").Code)
+	assert.Equal(t, http.StatusNotFound, serveBatch(r, http.MethodPost, path+"/cancel", "", "").Code)
+	w = serveBatch(r, http.MethodGet, "/v1/messages/batches", "", "bob")
+	assert.JSONEq(t, `{"data":[],"has_more":false,"first_id":null,"last_id":null}`, w.Body.String())
+
+	// 未结束的批次不能获取结果或删除
+	assert.Equal(t, http.StatusBadRequest, serveBatch(r, http.MethodGet, path+"/results", "", "alice").Code)
+	assert.Equal(t, http.StatusBadRequest, serveBatch(r, http.MethodDelete, path, "", "alice").Code)
+
+	w = serveBatch(r, http.MethodPost, path+"/cancel", "", "alice")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"cancel_initiated_at":"`)
+	release <- struct{}{}
+
+	require.Eventually(t, func() bool {
+		b, _ := batchManager.Get(created.ID)
+		return b.View("").ProcessingStatus == batch.StatusEnded
+	}, 5*time.Second, 10*time.Millisecond)
+
+	w = serveBatch(r, http.MethodGet, "/v1/messages/batches?limit=1", "", "alice")
+	var list struct {
+		Data    []batch.MessageBatch `json:"data"`
+		HasMore bool                 `json:"has_more"`
+		FirstID string               `json:"first_id"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Data, 1)
+	assert.Equal(t, created.ID, list.FirstID)
+	assert.Equal(t, batch.RequestCounts{Succeeded: 1, Canceled: 1}, list.Data[0].RequestCounts)
+	assert.NotNil(t, list.Data[0].ResultsURL)
+
+	w = serveBatch(r, http.MethodDelete, path, "", "alice")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"`+created.ID+`","type":"message_batch_deleted"}`, w.Body.String())
+	assert.Equal(t, http.StatusNotFound, serveBatch(r, http.MethodGet, path, "", "alice").Code)
+}
+
+func TestBatches_CreateValidation(t *testing.T) {
+	useBatchManager(t, nil)
+	r := batchRouter()
+
+	w := serveBatch(r, http.MethodPost, "/v1/messages/batches", `{"requests": [{"custom_id": "bad id", "params": {}}]}`, "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "custom_id")
+
+	w = serveBatch(r, http.MethodGet, "/v1/messages/batches?limit=0", "", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,482 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 捕获目录中的文件，每次上游调用各保存一对请求与响应（序号从 1 开始）
+const (
+	captureMetaFile             = "meta.json"
+	captureAnthropicRequestFile = "anthropic_request.json"
+	captureCWRequestFile        = "cw_request_%d.json"
+	captureResponseFile         = "upstream_%d.eventstream"
+	captureEventsFile           = "events.sse"
+
+	captureContextKey = "stream_capture"
+	redactedValue     = "[REDACTED]"
+)
+
+var (
+	// captureDir 捕获根目录，由 InitCapture 设置，为空表示未启用
+	captureDir string
+	// captureRequestIDs 指定捕获的请求ID集合
+	captureRequestIDs map[string]bool
+)
+
+// InitCapture 初始化上游流捕获（写入 dataDir/captures）
+func InitCapture(dataDir string) {
+	captureDir = filepath.Join(dataDir, "captures")
+	captureRequestIDs = make(map[string]bool)
+	for _, id := range strings.Split(config.CaptureRequestIDs, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			captureRequestIDs[id] = true
+		}
+	}
+
+	if len(captureRequestIDs) > 0 || config.CaptureSampleRate > 0 {
+		logger.Info("上游流捕获已启用",
+			logger.String("dir", captureDir),
+			logger.Int("request_ids", len(captureRequestIDs)),
+			logger.Float64("sample_rate", config.CaptureSampleRate))
+	}
+}
+
+// shouldCapture 判断请求是否需要捕获
+func shouldCapture(c *gin.Context) bool {
+	if captureDir == "" || c.Request.Method != http.MethodPost {
+		return false
+	}
+	if path := c.Request.URL.Path; path != "/v1/messages" && path != "/v1/chat/completions" {
+		return false
+	}
+	if captureRequestIDs[GetRequestID(c)] {
+		return true
+	}
+	return config.CaptureSampleRate > 0 && rand.Float64() < config.CaptureSampleRate
+}
+
+// CaptureMeta 捕获元数据
+type CaptureMeta struct {
+	RequestID     string    `json:"request_id"`
+	Path          string    `json:"path"`
+	Stream        bool      `json:"stream"`
+	Model         string    `json:"model"`
+	MessageID     string    `json:"message_id,omitempty"`
+	InputTokens   int       `json:"input_tokens"`
+	StatusCode    int       `json:"status_code"`
+	StartedAt     time.Time `json:"started_at"`
+	DurationMs    int64     `json:"duration_ms"`
+	UpstreamCalls int       `json:"upstream_calls"`
+	ResponseBytes int       `json:"response_bytes"`
+	Truncated     bool      `json:"truncated"`
+}
+
+// limitedBuffer 超出上限后丢弃数据并标记截断
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) {
+	if room := config.CaptureMaxBytes - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		p = p[:max(room, 0)]
+	}
+	b.buf.Write(p)
+}
+
+// upstreamCall 单次上游调用（首次请求、web_search 续写、tool_choice 重试等）的请求与响应
+type upstreamCall struct {
+	cwRequest []byte
+	response  limitedBuffer
+}
+
+// streamCapture 单个请求的捕获内容
+// 上游响应体可能在 keepalive 读取协程中读取，所有字段由 mu 保护
+type streamCapture struct {
+	mu               sync.Mutex
+	meta             CaptureMeta
+	anthropicRequest []byte
+	calls            []*upstreamCall
+	events           limitedBuffer
+}
+
+// captureWriter 记录下发给客户端的全部数据
+type captureWriter struct {
+	gin.ResponseWriter
+	capture *streamCapture
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	w.capture.mu.Lock()
+	w.capture.events.Write(data)
+	w.capture.mu.Unlock()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.capture.mu.Lock()
+	w.capture.events.Write([]byte(s))
+	w.capture.mu.Unlock()
+	return w.ResponseWriter.WriteString(s)
+}
+
+// captureBody 旁路记录单次上游调用的响应字节
+type captureBody struct {
+	io.ReadCloser
+	capture *streamCapture
+	call    *upstreamCall
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.capture.mu.Lock()
+		b.call.response.Write(p[:n])
+		b.capture.meta.ResponseBytes += n
+		b.capture.mu.Unlock()
+	}
+	return n, err
+}
+
+// CaptureMiddleware 对命中请求ID或抽样的请求记录上游原始响应与下发事件
+func CaptureMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !shouldCapture(c) {
+			c.Next()
+			return
+		}
+
+		capture := &streamCapture{meta: CaptureMeta{
+			RequestID: GetRequestID(c),
+			Path:      c.Request.URL.Path,
+			StartedAt: time.Now(),
+		}}
+		c.Set(captureContextKey, capture)
+		c.Writer = &captureWriter{ResponseWriter: c.Writer, capture: capture}
+
+		c.Next()
+
+		capture.mu.Lock()
+		capture.meta.StatusCode = c.Writer.Status()
+		capture.meta.DurationMs = time.Since(capture.meta.StartedAt).Milliseconds()
+		capture.meta.Truncated = capture.events.truncated
+		for _, call := range capture.calls {
+			capture.meta.Truncated = capture.meta.Truncated || call.response.truncated
+		}
+		meta := capture.meta
+		dir, err := capture.save(captureDir)
+		capture.mu.Unlock()
+
+		if err != nil {
+			logger.Warn("保存上游流捕获失败", addReqFields(c, logger.Err(err))...)
+			return
+		}
+		logger.Info("已保存上游流捕获",
+			addReqFields(c,
+				logger.String("dir", dir),
+				logger.Int("upstream_calls", meta.UpstreamCalls),
+				logger.Int("response_bytes", meta.ResponseBytes),
+				logger.Bool("truncated", meta.Truncated),
+			)...)
+	}
+}
+
+// getCapture 获取当前请求的捕获，未启用时返回 nil
+func getCapture(c *gin.Context) *streamCapture {
+	if v, ok := c.Get(captureContextKey); ok {
+		if capture, ok := v.(*streamCapture); ok {
+			return capture
+		}
+	}
+	return nil
+}
+
+// captureRequest 开始记录一次上游调用：首次调用同时记录客户端的原始请求
+func captureRequest(c *gin.Context, anthropicReq types.AnthropicRequest, cwReqBody []byte) {
+	capture := getCapture(c)
+	if capture == nil {
+		return
+	}
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+
+	if len(capture.calls) == 0 {
+		capture.meta.Model = anthropicReq.Model
+		capture.meta.Stream = anthropicReq.Stream
+		if data, err := utils.SafeMarshal(anthropicReq); err == nil {
+			capture.anthropicRequest = data
+		}
+	}
+	capture.calls = append(capture.calls, &upstreamCall{cwRequest: cwReqBody})
+	capture.meta.UpstreamCalls = len(capture.calls)
+}
+
+// captureResponse 旁路记录最近一次上游调用的响应体
+func captureResponse(c *gin.Context, resp *http.Response) {
+	capture := getCapture(c)
+	if capture == nil || resp == nil || resp.Body == nil {
+		return
+	}
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+
+	if len(capture.calls) == 0 {
+		capture.calls = append(capture.calls, &upstreamCall{})
+		capture.meta.UpstreamCalls = 1
+	}
+	call := capture.calls[len(capture.calls)-1]
+	resp.Body = &captureBody{ReadCloser: resp.Body, capture: capture, call: call}
+}
+
+// captureStreamInfo 记录回放所需的流式上下文
+func captureStreamInfo(c *gin.Context, messageID string, inputTokens int) {
+	if capture := getCapture(c); capture != nil {
+		capture.mu.Lock()
+		capture.meta.MessageID = messageID
+		capture.meta.InputTokens = inputTokens
+		capture.mu.Unlock()
+	}
+}
+
+// save 写入捕获目录，返回目录路径（调用方需持有 sc.mu）
+func (sc *streamCapture) save(root string) (string, error) {
+	name := sc.meta.StartedAt.Format("20060102-150405") + "_" + sanitizeFileName(sc.meta.RequestID)
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	meta, err := utils.MarshalIndent(sc.meta, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	files := map[string][]byte{
+		captureMetaFile:             meta,
+		captureAnthropicRequestFile: redactJSON(sc.anthropicRequest),
+		captureEventsFile:           []byte(redactText(sc.events.buf.String())),
+	}
+	for i, call := range sc.calls {
+		files[fmt.Sprintf(captureCWRequestFile, i+1)] = redactJSON(call.cwRequest)
+		files[fmt.Sprintf(captureResponseFile, i+1)] = call.response.buf.Bytes()
+	}
+	for file, data := range files {
+		if data == nil {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, file), data, 0o600); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// sanitizeFileName 请求ID来自客户端，需过滤后才能作为目录名
+func sanitizeFileName(s string) string {
+	s = unsafeFileNameChars.ReplaceAllString(s, "_")
+	if len(s) > 64 {
+		s = s[:64]
+	}
+	if s == "" {
+		s = "unknown"
+	}
+	return s
+}
+
+// ========== 脱敏 ==========
+
+// sensitiveKeys 需要整体脱敏的字段（小写并去除 - 和 _ 后比较）
+var sensitiveKeys = map[string]bool{
+	"authorization": true,
+	"accesstoken":   true,
+	"refreshtoken":  true,
+	"idtoken":       true,
+	"sessiontoken":  true,
+	"apikey":        true,
+	"xapikey":       true,
+	"clientsecret":  true,
+	"secret":        true,
+	"password":      true,
+	"cookie":        true,
+	"profilearn":    true,
+}
+
+// sensitivePatterns 文本中出现的凭据
+var sensitivePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9._~+/=-]+`),
+	regexp.MustCompile(`sk-ant-[A-Za-z0-9_-]+`),
+	regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`arn:aws:codewhisperer:[^"\s]+`),
+}
+
+// redactText 替换文本中的凭据
+func redactText(s string) string {
+	for _, pattern := range sensitivePatterns {
+		s = pattern.ReplaceAllString(s, redactedValue)
+	}
+	return s
+}
+
+// redactJSON 脱敏 JSON 文档，无法解析时按文本处理
+func redactJSON(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	var doc any
+	if err := utils.SafeUnmarshal(data, &doc); err != nil {
+		return []byte(redactText(string(data)))
+	}
+	out, err := utils.MarshalIndent(redactValue(doc), "", "  ")
+	if err != nil {
+		return []byte(redactText(string(data)))
+	}
+	return out
+}
+
+func redactValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, child := range val {
+			key := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(k))
+			if s, ok := child.(string); ok && sensitiveKeys[key] && s != "" {
+				val[k] = redactedValue
+				continue
+			}
+			val[k] = redactValue(child)
+		}
+		return val
+	case []any:
+		for i, child := range val {
+			val[i] = redactValue(child)
+		}
+		return val
+	case string:
+		return redactText(val)
+	default:
+		return v
+	}
+}
+
+// ========== 回放 ==========
+
+// ReplayResult 捕获回放结果
+type ReplayResult struct {
+	Meta     CaptureMeta
+	Recorded []string // 捕获时下发的 SSE 事件
+	Replayed []string // 回放生成的 SSE 事件
+	Diff     []string
+}
+
+// Match 回放输出是否与捕获一致
+func (r *ReplayResult) Match() bool {
+	return len(r.Diff) == 0
+}
+
+// ReplayCapture 将捕获的上游原始响应重新送入 EventStreamProcessor，并与捕获时的输出对比
+// 目前仅支持单次上游调用的 Anthropic 流式请求（/v1/messages, stream=true）
+func ReplayCapture(dir string) (*ReplayResult, error) {
+	var meta CaptureMeta
+	if err := readCaptureJSON(dir, captureMetaFile, &meta); err != nil {
+		return nil, err
+	}
+	if meta.Path != "/v1/messages" || !meta.Stream {
+		return nil, fmt.Errorf("仅支持回放 Anthropic 流式请求: path=%s stream=%v", meta.Path, meta.Stream)
+	}
+	// web_search 续写、tool_choice 重试等多次上游调用的输出依赖中间改写，无法单独回放
+	if meta.UpstreamCalls != 1 {
+		return nil, fmt.Errorf("仅支持回放单次上游调用的捕获: upstream_calls=%d", meta.UpstreamCalls)
+	}
+
+	var anthropicReq types.AnthropicRequest
+	if err := readCaptureJSON(dir, captureAnthropicRequestFile, &anthropicReq); err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf(captureResponseFile, 1)))
+	if err != nil {
+		return nil, fmt.Errorf("读取上游响应失败: %w", err)
+	}
+	recorded, err := os.ReadFile(filepath.Join(dir, captureEventsFile))
+	if err != nil {
+		return nil, fmt.Errorf("读取下发事件失败: %w", err)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, meta.Path, nil)
+	c.Set("request_id", meta.RequestID)
+	c.Set("message_id", meta.MessageID)
+
+	token := &types.TokenWithUsage{}
+	streamUpstreamResponse(c, anthropicReq, token, &AnthropicStreamSender{}, createAnthropicStreamEvents,
+		meta.MessageID, meta.InputTokens, bytes.NewReader(raw))
+
+	result := &ReplayResult{
+		Meta:     meta,
+		Recorded: splitSSEEvents(string(recorded)),
+		Replayed: splitSSEEvents(redactText(w.Body.String())),
+	}
+	result.Diff = diffSSEEvents(result.Recorded, result.Replayed)
+	return result, nil
+}
+
+func readCaptureJSON(dir, file string, v any) error {
+	data, err := os.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		return fmt.Errorf("读取 %s 失败: %w", file, err)
+	}
+	if err := utils.SafeUnmarshal(data, v); err != nil {
+		return fmt.Errorf("解析 %s 失败: %w", file, err)
+	}
+	return nil
+}
+
+// splitSSEEvents 按空行切分 SSE 事件
+func splitSSEEvents(s string) []string {
+	var events []string
+	for _, event := range strings.Split(s, "\n\n") {
+		if event = strings.TrimSpace(event); event != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// diffSSEEvents 逐个事件对比，输出不一致的位置
+func diffSSEEvents(recorded, replayed []string) []string {
+	var diff []string
+	for i := 0; i < max(len(recorded), len(replayed)); i++ {
+		want, got := "(无)", "(无)"
+		if i < len(recorded) {
+			want = recorded[i]
+		}
+		if i < len(replayed) {
+			got = replayed[i]
+		}
+		if want == got {
+			continue
+		}
+		diff = append(diff, fmt.Sprintf("@@ 事件 #%d", i), "- "+want, "+ "+got)
+	}
+	return diff
+}
@@ -2,15 +2,19 @@ package server
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"kiro2api/auth"
 	"kiro2api/config"
 	"kiro2api/converter"
 	"kiro2api/logger"
+	"kiro2api/notify"
 	"kiro2api/types"
 	"kiro2api/utils"
 
@@ -87,17 +91,34 @@ func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReq
 		return nil, err
 	}
 
-	resp, err := utils.DoRequest(req)
+	resp, err := doUpstreamRequest(c, req)
 	if err != nil {
+		// 客户端已断开：上游请求随之取消，不计入上游错误率
+		if c.Request.Context().Err() != nil {
+			GetStreamMetrics().RecordClientCancel(0, 0)
+			logger.Info("客户端断开连接，已取消上游请求",
+				addReqFields(c,
+					logger.String("stage", "upstream_request"),
+					logger.Err(err),
+				)...)
+			return nil, err
+		}
+		notify.GetErrorRateTracker().Record(false)
 		handleRequestSendError(c, err)
 		return nil, err
 	}
 
+	// 记录上游结果用于错误率突增告警
+	notify.GetErrorRateTracker().Record(resp.StatusCode == http.StatusOK)
+
 	if handleCodeWhispererError(c, resp) {
 		resp.Body.Close()
 		return nil, fmt.Errorf("CodeWhisperer API error")
 	}
 
+	markRequestTokenSucceeded(c)
+	captureResponse(c, resp)
+
 	// 上游响应成功，记录方向与会话
 	logger.Debug("上游响应成功",
 		addReqFields(c,
@@ -108,9 +129,48 @@ func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReq
 	return resp, nil
 }
 
+// proxyClient 代理池请求客户端（按代理复用连接）
+var proxyClient = utils.NewProxyAwareClient()
+
+// doUpstreamRequest 发送上游请求
+// 启用代理池时按本次请求所用token（租户或共享池）选择绑定的代理，并记录代理健康统计
+func doUpstreamRequest(c *gin.Context, req *http.Request) (*http.Response, error) {
+	pool := auth.GetProxyPool()
+	if !pool.IsEnabled() {
+		return utils.DoRequest(c.Request.Context(), req)
+	}
+
+	tokenKey := c.GetString("tenant_key")
+	if tokenKey == "" {
+		tokenKey = c.GetString("token_key")
+	}
+	proxy := pool.GetProxyForToken(tokenKey)
+	if proxy == nil {
+		return utils.DoRequest(c.Request.Context(), req)
+	}
+
+	pool.RecordUse(proxy)
+	start := time.Now()
+	resp, err := proxyClient.DoWithProxy(req, proxy.URL)
+	if err != nil {
+		// 客户端主动取消不计入代理失败
+		if req.Context().Err() == nil {
+			pool.RecordFailure(proxy, err)
+		}
+		return nil, err
+	}
+	pool.RecordSuccess(proxy, time.Since(start).Milliseconds())
+	return resp, nil
+}
+
 // execCWRequest 供测试覆盖的请求执行入口（可在测试中替换）
 var execCWRequest = executeCodeWhispererRequest
 
+// acquireTenantToken 获取租户 Token（可在测试中替换）
+var acquireTenantToken = func(cred auth.TenantCredential) (*auth.TenantToken, error) {
+	return auth.GetUserTokenCache().Acquire(cred)
+}
+
 // buildCodeWhispererRequest 构建通用的CodeWhisperer请求
 func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Request, error) {
 	cwReq, err := converter.BuildCodeWhispererRequest(anthropicReq, c)
@@ -128,6 +188,7 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	if err != nil {
 		return nil, fmt.Errorf("序列化请求失败: %v", err)
 	}
+	captureRequest(c, anthropicReq, cwReqBody)
 
 	// 临时调试：记录发送给CodeWhisperer的请求内容
 	// 补充：当工具直传启用时输出工具名称预览
@@ -149,7 +210,8 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 		logger.Int("tools_count", len(cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools)),
 		logger.String("tools_names", toolNamesPreview))
 
-	req, err := http.NewRequest("POST", config.CodeWhispererURL, bytes.NewReader(cwReqBody))
+	// 绑定客户端请求的 context：客户端断开时中止上游生成，避免继续消耗额度
+	req, err := http.NewRequestWithContext(c.Request.Context(), "POST", config.CodeWhispererURL, bytes.NewReader(cwReqBody))
 	if err != nil {
 		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
@@ -218,12 +280,9 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
 	// 特殊处理：403错误表示token失效 (保持向后兼容)
 	if resp.StatusCode == http.StatusForbidden {
 		logger.Warn("收到403错误，token可能已失效，触发冷却")
-		// 标记token失败，触发冷却和轮换
-		if authService, exists := c.Get("auth_service"); exists {
-			if as, ok := authService.(AuthServiceWithFingerprint); ok {
-				as.MarkTokenFailed()
-			}
-		}
+		// 上报错误（暂停检测和健康状态），再标记token失败，触发冷却和轮换
+		reportRequestTokenError(c, string(body))
+		markRequestTokenFailed(c)
 		respondErrorWithCode(c, http.StatusUnauthorized, "unauthorized", "%s", "Token已失效，请重试")
 		return true
 	}
@@ -231,11 +290,7 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
 	// 429 Too Many Requests 也触发冷却
 	if resp.StatusCode == http.StatusTooManyRequests {
 		logger.Warn("收到429错误，请求过于频繁，触发冷却")
-		if authService, exists := c.Get("auth_service"); exists {
-			if as, ok := authService.(AuthServiceWithFingerprint); ok {
-				as.MarkTokenFailed()
-			}
-		}
+		markRequestTokenFailed(c)
 		respondErrorWithCode(c, http.StatusTooManyRequests, "rate_limited", "%s", "请求过于频繁，请稍后重试")
 		return true
 	}
@@ -261,6 +316,55 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
 	return true
 }
 
+// getTenantCredential 从上下文获取多租户凭据
+func getTenantCredential(c *gin.Context) (auth.TenantCredential, bool) {
+	if v, exists := c.Get("tenantCredential"); exists {
+		if cred, ok := v.(auth.TenantCredential); ok {
+			return cred, true
+		}
+	}
+	return auth.TenantCredential{}, false
+}
+
+// markRequestTokenFailed 标记本次请求所用token失败
+// 多租户请求只冷却该租户自身，不影响服务端共享池
+func markRequestTokenFailed(c *gin.Context) {
+	if tenantKey := c.GetString("tenant_key"); tenantKey != "" {
+		auth.GetUserTokenCache().MarkFailed(tenantKey)
+		return
+	}
+	if authService, exists := c.Get("auth_service"); exists {
+		if as, ok := authService.(AuthServiceWithFingerprint); ok {
+			as.MarkTokenFailed()
+		}
+	}
+}
+
+// markRequestTokenSucceeded 上游响应成功，重置本次请求所用token的失败计数（租户或共享池）
+func markRequestTokenSucceeded(c *gin.Context) {
+	if tenantKey := c.GetString("tenant_key"); tenantKey != "" {
+		auth.GetUserTokenCache().MarkSuccess(tenantKey)
+		return
+	}
+	if v, exists := c.Get("auth_service"); exists {
+		if as, ok := v.(*auth.AuthService); ok {
+			as.MarkTokenSuccess(c.GetString("token_key"))
+		}
+	}
+}
+
+// reportRequestTokenError 将上游错误上报给共享池的健康探测（多租户请求不参与）
+func reportRequestTokenError(c *gin.Context, errorMsg string) {
+	if c.GetString("tenant_key") != "" {
+		return
+	}
+	if v, exists := c.Get("auth_service"); exists {
+		if as, ok := v.(*auth.AuthService); ok {
+			as.ReportTokenError(c.GetString("token_key"), errorMsg)
+		}
+	}
+}
+
 // StreamEventSender 统一的流事件发送接口
 type StreamEventSender interface {
 	SendEvent(c *gin.Context, data any) error
@@ -334,11 +438,16 @@ func (s *OpenAIStreamSender) SendEvent(c *gin.Context, data any) error {
 }
 
 func (s *OpenAIStreamSender) SendError(c *gin.Context, message string, _ error) error {
+	return s.sendTypedError(c, message, "server_error", "internal_error")
+}
+
+// sendTypedError 发送指定 type/code 的 OpenAI 流式错误
+func (s *OpenAIStreamSender) sendTypedError(c *gin.Context, message, errType, code string) error {
 	errorResp := map[string]any{
 		"error": map[string]any{
 			"message": message,
-			"type":    "server_error",
-			"code":    "internal_error",
+			"type":    errType,
+			"code":    code,
 		},
 	}
 
@@ -359,6 +468,11 @@ type AuthServiceWithFingerprint interface {
 	MarkTokenFailed()
 }
 
+// AuthServiceWithTokenKey 可返回所选token key的认证服务接口
+type AuthServiceWithTokenKey interface {
+	GetTokenWithKey() (types.TokenInfo, *auth.Fingerprint, string, error)
+}
+
 // RequestContext 请求处理上下文，封装通用的请求处理逻辑
 type RequestContext struct {
 	GinContext  *gin.Context
@@ -369,31 +483,70 @@ type RequestContext struct {
 }
 
 // GetTokenAndBody 通用的token获取和请求体读取
-// 支持多租户模式：如果上下文中有 userRefreshToken，则使用用户的 Token
 // 返回: tokenInfo, requestBody, error
 func (rc *RequestContext) GetTokenAndBody() (types.TokenInfo, []byte, error) {
+	tokenInfo, err := rc.AcquireToken()
+	if err != nil {
+		return types.TokenInfo{}, nil, err
+	}
+	body, err := rc.ReadBody()
+	if err != nil {
+		return types.TokenInfo{}, nil, err
+	}
+	return tokenInfo, body, nil
+}
+
+// AcquireToken 获取本次请求使用的token，失败时已写入错误响应
+// 支持多租户模式：如果上下文中有 tenantCredential，则使用租户的 Token
+func (rc *RequestContext) AcquireToken() (types.TokenInfo, error) {
 	var tokenInfo types.TokenInfo
 	var err error
 
 	// 检查是否为多租户模式
-	if userToken, exists := rc.GinContext.Get("userRefreshToken"); exists {
-		if refreshToken, ok := userToken.(string); ok && refreshToken != "" {
-			// 多租户模式：使用用户提供的 RefreshToken
-			logger.Debug("多租户模式：使用用户 RefreshToken")
-			tokenInfo, err = auth.GetUserTokenCache().GetOrRefresh(refreshToken)
-			if err != nil {
-				logger.Error("刷新用户 Token 失败", logger.Err(err))
-				respondError(rc.GinContext, http.StatusUnauthorized, "用户 Token 无效: %v", err)
-				return types.TokenInfo{}, nil, err
-			}
-			// 多租户模式不使用指纹
-			goto readBody
+	if cred, ok := getTenantCredential(rc.GinContext); ok {
+		// 多租户模式：使用租户自己的凭据、指纹和频率限制，绝不回退到共享池
+		tenant, tenantErr := acquireTenantToken(cred)
+		var limitErr *auth.TenantRateLimitError
+		if errors.As(tenantErr, &limitErr) {
+			// 凭据有效，仅是租户自身受限：返回 429，避免客户端误判为凭据失效
+			logger.Warn("租户请求受限",
+				addReqFields(rc.GinContext,
+					logger.String("tenant_key", cred.Key()),
+					logger.Duration("retry_after", limitErr.RetryAfter),
+					logger.Err(tenantErr),
+				)...)
+			retryAfter := int((limitErr.RetryAfter + time.Second - 1) / time.Second)
+			rc.GinContext.Header("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+			respondErrorWithCode(rc.GinContext, http.StatusTooManyRequests, "rate_limit_error", "%v", tenantErr)
+			return types.TokenInfo{}, tenantErr
+		}
+		if tenantErr != nil {
+			logger.Error("获取租户 Token 失败",
+				logger.String("tenant_key", cred.Key()),
+				logger.Err(tenantErr))
+			respondError(rc.GinContext, http.StatusUnauthorized, "用户 Token 无效: %v", tenantErr)
+			return types.TokenInfo{}, tenantErr
+		}
+		rc.GinContext.Set("tenant_key", tenant.Key)
+		if tenant.Fingerprint != nil {
+			rc.GinContext.Set("request_fingerprint", tenant.Fingerprint)
 		}
+		return tenant.Token, nil
 	}
 
 	// 标准模式：使用服务端配置的 Token
-	// 尝试使用带指纹的方法获取token
-	if authWithFp, ok := rc.AuthService.(AuthServiceWithFingerprint); ok {
+	// 优先获取token key，用于按token绑定代理；其次尝试使用带指纹的方法获取token
+	if authWithKey, ok := rc.AuthService.(AuthServiceWithTokenKey); ok {
+		var fingerprint *auth.Fingerprint
+		var tokenKey string
+		tokenInfo, fingerprint, tokenKey, err = authWithKey.GetTokenWithKey()
+		if err == nil {
+			rc.GinContext.Set("token_key", tokenKey)
+			if fingerprint != nil {
+				rc.GinContext.Set("request_fingerprint", fingerprint)
+			}
+		}
+	} else if authWithFp, ok := rc.AuthService.(AuthServiceWithFingerprint); ok {
 		var fingerprint *auth.Fingerprint
 		tokenInfo, fingerprint, err = authWithFp.GetTokenWithFingerprint()
 		if err == nil && fingerprint != nil {
@@ -411,16 +564,18 @@ func (rc *RequestContext) GetTokenAndBody() (types.TokenInfo, []byte, error) {
 	if err != nil {
 		logger.Error("获取token失败", logger.Err(err))
 		respondError(rc.GinContext, http.StatusInternalServerError, "获取token失败: %v", err)
-		return types.TokenInfo{}, nil, err
+		return types.TokenInfo{}, err
 	}
+	return tokenInfo, nil
+}
 
-readBody:
-	// 读取请求体
+// ReadBody 读取请求体，失败时已写入错误响应
+func (rc *RequestContext) ReadBody() ([]byte, error) {
 	body, err := rc.GinContext.GetRawData()
 	if err != nil {
 		logger.Error("读取请求体失败", logger.Err(err))
 		respondError(rc.GinContext, http.StatusBadRequest, "读取请求体失败: %v", err)
-		return types.TokenInfo{}, nil, err
+		return nil, err
 	}
 
 	// 记录请求日志
@@ -433,5 +588,5 @@ readBody:
 			logger.String("user_agent", rc.GinContext.GetHeader("User-Agent")),
 		)...)
 
-	return tokenInfo, body, nil
+	return body, nil
 }
@@ -6,8 +6,11 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"kiro2api/auth"
 	"kiro2api/types"
 
 	"github.com/gin-gonic/gin"
@@ -144,6 +147,57 @@ func TestRequestContext_GetTokenAndBody(t *testing.T) {
 	}
 }
 
+func TestHandleMessages_TenantErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{
+			name:       "冷却期返回429",
+			err:        &auth.TenantRateLimitError{Reason: "租户 Token 处于冷却期，请稍后重试", RetryAfter: 1500 * time.Millisecond},
+			status:     http.StatusTooManyRequests,
+			code:       "rate_limit_error",
+			retryAfter: "2",
+		},
+		{
+			name:   "刷新失败返回401",
+			err:    errors.New("refresh failed"),
+			status: http.StatusUnauthorized,
+			code:   "unauthorized",
+		},
+	}
+
+	old := acquireTenantToken
+	t.Cleanup(func() { acquireTenantToken = old })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acquireTenantToken = func(auth.TenantCredential) (*auth.TenantToken, error) {
+				return nil, tt.err
+			}
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(cachedRequestBody))
+			c.Set("tenantCredential", auth.TenantCredential{AuthType: auth.AuthMethodSocial, RefreshToken: "rt"})
+			handleMessages(c, &MockAuthService{token: types.TokenInfo{AccessToken: "shared"}})
+
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, tt.retryAfter, w.Header().Get("Retry-After"))
+			var resp struct {
+				Error struct {
+					Code string `json:"code"`
+				} `json:"error"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.code, resp.Error.Code)
+		})
+	}
+}
+
 func TestHandleRequestBuildError(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
 	"kiro2api/auth"
 	"kiro2api/config"
+	"kiro2api/converter"
 	"kiro2api/logger"
 	"kiro2api/parser"
 	"kiro2api/types"
@@ -57,7 +59,7 @@ func handleStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, to
 		AvailableCount: 100, // 默认可用次数
 		LastUsageCheck: time.Now(),
 	}
-	sender := &AnthropicStreamSender{}
+	sender := newCachingStreamSender(c, &AnthropicStreamSender{})
 	handleGenericStreamRequest(c, anthropicReq, tokenWithUsage, sender, createAnthropicStreamEvents)
 }
 
@@ -91,6 +93,14 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 	messageID := fmt.Sprintf(config.MessageIDFormat, time.Now().Format(config.MessageIDTimeFormat))
 	c.Set("message_id", messageID)
 
+	// 请求声明了 web_search 服务端工具时由代理模拟执行
+	if ws := newWebSearchSession(anthropicReq, token.TokenInfo); ws != nil {
+		c.Set(webSearchSessionKey, ws)
+	}
+	if guard := newToolChoiceGuard(anthropicReq, token.TokenInfo); guard != nil {
+		c.Set(toolChoiceGuardKey, guard)
+	}
+
 	// 执行CodeWhisperer请求
 	resp, err := execCWRequest(c, anthropicReq, token.TokenInfo, true)
 	if err != nil {
@@ -103,6 +113,14 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 	}
 	defer resp.Body.Close()
 
+	captureStreamInfo(c, messageID, inputTokens)
+	streamUpstreamResponse(c, anthropicReq, token, sender, eventCreator, messageID, inputTokens, resp.Body)
+}
+
+// streamUpstreamResponse 将上游事件流转换为SSE事件下发（捕获回放复用此路径）
+func streamUpstreamResponse(c *gin.Context, anthropicReq types.AnthropicRequest, token *types.TokenWithUsage, sender StreamEventSender, eventCreator func(string, int, string) []map[string]any, messageID string, inputTokens int, body io.Reader) {
+	GetStreamMetrics().RecordStart()
+
 	// 创建流处理上下文
 	ctx := NewStreamProcessorContext(c, anthropicReq, token, sender, messageID, inputTokens)
 	defer ctx.Cleanup()
@@ -114,8 +132,25 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 
 	// 处理事件流
 	processor := NewEventStreamProcessor(ctx)
-	if err := processor.ProcessEventStream(resp.Body); err != nil {
-		logger.Error("事件流处理失败", logger.Err(err))
+	err := processor.ProcessEventStream(body)
+	for err == nil && ctx.forcedStopReason == "" {
+		if ctx.webSearch.needsContinuation() {
+			err = processor.continueWebSearch()
+		} else if ctx.toolChoice.needsRetry() {
+			err = processor.retryToolChoice()
+		} else {
+			break
+		}
+	}
+	if err == nil {
+		err = processor.releaseToolChoice()
+	}
+	if err != nil {
+		// 客户端断开、上游流中异常、strict 模式协议违规已在处理器中记录
+		var streamErr *errUpstreamStreamException
+		if c.Request.Context().Err() == nil && !errors.As(err, &streamErr) && !errors.Is(err, errSSEProtocolViolation) {
+			logger.Error("事件流处理失败", logger.Err(err))
+		}
 		return
 	}
 
@@ -124,6 +159,7 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 		logger.Error("发送结束事件失败", logger.Err(err))
 		return
 	}
+	GetStreamMetrics().RecordCompleted()
 }
 
 // createAnthropicStreamEvents 创建Anthropic流式初始事件
@@ -206,9 +242,160 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	}
 	inputTokens := estimator.EstimateTokens(countReq)
 
-	resp, err := executeCodeWhispererRequest(c, anthropicReq, token, false)
+	// 转换为Anthropic格式
+	var contexts []map[string]any
+	var allText strings.Builder
+	sawToolUse := false
+	forcedStopReason := ""
+
+	// 请求声明了 web_search 服务端工具时由代理模拟执行，仅搜索的轮次以结果续写
+	ws := newWebSearchSession(anthropicReq, token)
+	guard := newToolChoiceGuard(anthropicReq, token)
+	req := anthropicReq
+	for {
+		turn, ok := fetchNonStreamTurn(c, req, token)
+		if !ok {
+			return
+		}
+		textAgg, allTools := turn.text, turn.tools
+
+		// tool_choice 要求调用工具但未调用：丢弃本次响应并重试
+		if len(allTools) == 0 && len(contexts) == 0 && guard.needsRetry() {
+			logger.Info("tool_choice要求调用工具但响应未调用，重试",
+				addReqFields(c,
+					logger.String("tool_choice", guard.choice.Type),
+					logger.Int("attempt", guard.attempts+1),
+				)...)
+			req = guard.retryRequest(req, textAgg)
+			if ws != nil {
+				ws.req = req
+			}
+			continue
+		}
+		allTools = guard.limitTools(allTools)
+		allText.WriteString(textAgg)
+
+		// 推理块位于本轮文本之前
+		contexts = append(contexts, turn.thinking...)
+
+		// 添加文本内容
+		if textAgg != "" {
+			contexts = append(contexts, map[string]any{
+				"type": "text",
+				"text": textAgg,
+			})
+		}
+		if ws != nil {
+			ws.text.WriteString(textAgg)
+		}
+
+		for _, tool := range allTools {
+			if ws != nil && ws.isWebSearchTool(tool.Name) {
+				call := &webSearchCall{ID: tool.ID}
+				call.Query, _ = tool.Arguments["query"].(string)
+				ws.run(c.Request.Context(), call)
+				useBlock, resultBlock := ws.blocks(call)
+				contexts = append(contexts, useBlock, resultBlock)
+				continue
+			}
+
+			// 创建标准的tool_use块，确保包含完整的状态信息
+			toolUseBlock := map[string]any{
+				"type":  "tool_use",
+				"id":    tool.ID,
+				"name":  tool.Name,
+				"input": tool.Arguments,
+			}
+
+			// 如果工具参数为空或nil，确保为空对象而不是nil
+			if tool.Arguments == nil {
+				toolUseBlock["input"] = map[string]any{}
+			}
+
+			contexts = append(contexts, toolUseBlock)
+			sawToolUse = true
+			if ws != nil {
+				ws.clientTools = true
+			}
+		}
+
+		if !ws.needsContinuation() {
+			break
+		}
+		if ws.rounds >= config.WebSearchMaxRounds {
+			forcedStopReason = "pause_turn"
+			break
+		}
+		req = ws.nextRequest()
+	}
+
+	// 使用新的stop_reason管理器，确保符合Claude官方规范
+	stopReasonManager := NewStopReasonManager(anthropicReq)
+
+	// 计算输出tokens（使用TokenEstimator统一算法）
+	textAgg := allText.String()
+	baseTokens := estimator.EstimateTextTokens(textAgg)
+	outputTokens := baseTokens
+	if sawToolUse {
+		outputTokens = int(float64(baseTokens) * 1.2) // 增加20%结构化开销
+	}
+	if outputTokens < 1 && len(textAgg) > 0 {
+		outputTokens = 1
+	}
+
+	stopReasonManager.UpdateToolCallStatus(sawToolUse, sawToolUse)
+	stopReason := stopReasonManager.DetermineStopReason()
+	if forcedStopReason != "" {
+		stopReason = forcedStopReason
+	}
+
+	// logger.Debug("非流式响应stop_reason决策",
+	// 	logger.String("stop_reason", stopReason),
+	// 	logger.String("description", GetStopReasonDescription(stopReason)),
+	// 	logger.Bool("saw_tool_use", sawToolUse),
+	// 	logger.Int("output_tokens", outputTokens))
+
+	anthropicResp := map[string]any{
+		"content":       contexts,
+		"model":         anthropicReq.Model,
+		"role":          "assistant",
+		"stop_reason":   stopReason,
+		"stop_sequence": nil,
+		"type":          "message",
+		"usage": map[string]any{
+			"input_tokens":  inputTokens,
+			"output_tokens": outputTokens,
+		},
+	}
+
+	// logger.Debug("非流式响应最终数据",
+	// 	logger.String("stop_reason", stopReason),
+	// 	logger.Int("content_blocks", len(contexts)))
+
+	logger.Debug("下发非流式响应",
+		addReqFields(c,
+			logger.String("direction", "downstream_send"),
+			logger.Any("contexts", contexts),
+			logger.Bool("saw_tool_use", sawToolUse),
+			logger.Int("content_count", len(contexts)),
+		)...)
+	c.JSON(http.StatusOK, anthropicResp)
+	storeCachedResponse(c, anthropicResp)
+}
+
+// nonStreamTurn 单次上游请求的解析结果
+type nonStreamTurn struct {
+	thinking []map[string]any // thinking 与 redacted_thinking 块
+	text     string
+	tools    []*parser.ToolExecution
+}
+
+// fetchNonStreamTurn 执行一次上游请求并解析完整响应，返回推理块、文本与工具调用
+// 失败时已写入错误响应，返回 ok=false
+func fetchNonStreamTurn(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) (*nonStreamTurn, bool) {
+	resp, err := execCWRequest(c, anthropicReq, token, false)
 	if err != nil {
-		return
+		return nil, false
 	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
@@ -218,11 +405,12 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	body, err := utils.ReadHTTPResponse(resp.Body)
 	if err != nil {
 		handleResponseReadError(c, err)
-		return
+		return nil, false
 	}
-
 	// 使用新的符合AWS规范的解析器，但在非流式模式下增加超时保护
-	compliantParser := parser.NewCompliantEventStreamParser()
+	// 与流式一致设置 thinking 上下文，推理内容汇总为 thinking 块
+	compliantParser := newRequestParser(anthropicReq)
+	compliantParser.SetThinkingContext(newThinkingContext(anthropicReq))
 	compliantParser.SetMaxErrors(5) // 限制最大错误次数以防死循环
 
 	// 为非流式解析添加超时保护
@@ -239,6 +427,9 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 				close(done)
 			}()
 			result, err = compliantParser.ParseResponse(body)
+			if err == nil {
+				result.Events = append(result.Events, compliantParser.FlushThinkingBuffer()...)
+			}
 		}()
 
 		select {
@@ -274,13 +465,9 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		}
 
 		c.JSON(statusCode, errorResp)
-		return
+		return nil, false
 	}
 
-	// 转换为Anthropic格式
-	var contexts []map[string]any
-	textAgg := result.GetCompletionText()
-
 	// 先获取工具管理器的所有工具，确保sawToolUse的判断基于实际工具
 	toolManager := compliantParser.GetToolManager()
 	allTools := make([]*parser.ToolExecution, 0)
@@ -295,115 +482,34 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		allTools = append(allTools, tool)
 	}
 
-	// 基于实际工具数量判断是否包含工具调用
-	sawToolUse := len(allTools) > 0
-
-	// logger.Debug("非流式响应处理完成",
-	// 	addReqFields(c,
-	// 		logger.String("text_content", textAgg[:utils.IntMin(config.LogPreviewMaxLength, len(textAgg))]),
-	// 		logger.Int("tool_calls_count", len(allTools)),
-	// 		logger.Bool("saw_tool_use", sawToolUse),
-	// 	)...)
-
-	// 添加文本内容
-	if textAgg != "" {
-		contexts = append(contexts, map[string]any{
-			"type": "text",
-			"text": textAgg,
-		})
-	}
-
-	// 添加工具调用
-	// 工具已经在前面从toolManager获取到allTools中
-	// logger.Debug("从工具生命周期管理器获取工具调用",
-	// 	logger.Int("total_tools", len(allTools)),
-	// 	logger.Int("parse_result_tools", len(result.GetToolCalls())))
-
-	for _, tool := range allTools {
-		// logger.Debug("添加工具调用到响应",
-		// 	logger.String("tool_id", tool.ID),
-		// 	logger.String("tool_name", tool.Name),
-		// 	logger.String("tool_status", tool.Status.String()),
-		// 	logger.Any("tool_arguments", tool.Arguments))
-
-		// 创建标准的tool_use块，确保包含完整的状态信息
-		toolUseBlock := map[string]any{
-			"type":  "tool_use",
-			"id":    tool.ID,
-			"name":  tool.Name,
-			"input": tool.Arguments,
-		}
-
-		// 如果工具参数为空或nil，确保为空对象而不是nil
-		if tool.Arguments == nil {
-			toolUseBlock["input"] = map[string]any{}
-		}
-
-		// 添加详细的调试日志，验证tool_use块格式
-		// if toolUseBlockJSON, err := utils.SafeMarshal(toolUseBlock); err == nil {
-		// 	logger.Debug("发送给Claude CLI的tool_use块详细结构",
-		// 		logger.String("tool_id", tool.ID),
-		// 		logger.String("tool_name", tool.Name),
-		// 		logger.String("tool_use_json", string(toolUseBlockJSON)),
-		// 		logger.String("input_type", fmt.Sprintf("%T", tool.Arguments)),
-		// 		logger.Any("arguments_value", tool.Arguments))
-		// }
-
-		contexts = append(contexts, toolUseBlock)
-
-		// 记录工具调用完成状态，帮助客户端识别工具调用已完成
-		// logger.Debug("工具调用已添加到响应",
-		// 	logger.String("tool_id", tool.ID),
-		// 	logger.String("tool_name", tool.Name))
-	}
-
-	// 使用新的stop_reason管理器，确保符合Claude官方规范
-	stopReasonManager := NewStopReasonManager(anthropicReq)
-
-	// 计算输出tokens（使用TokenEstimator统一算法）
-	baseTokens := estimator.EstimateTextTokens(textAgg)
-	outputTokens := baseTokens
-	if sawToolUse {
-		outputTokens = int(float64(baseTokens) * 1.2) // 增加20%结构化开销
-	}
-	if outputTokens < 1 && len(textAgg) > 0 {
-		outputTokens = 1
-	}
+	// 按块索引排序，保持上游调用顺序
+	sort.SliceStable(allTools, func(i, j int) bool {
+		return allTools[i].BlockIndex < allTools[j].BlockIndex
+	})
 
-	stopReasonManager.UpdateToolCallStatus(sawToolUse, sawToolUse)
-	stopReason := stopReasonManager.DetermineStopReason()
+	return &nonStreamTurn{
+		thinking: result.GetThinkingBlocks(),
+		text:     result.GetCompletionText(),
+		tools:    allTools,
+	}, true
+}
 
-	// logger.Debug("非流式响应stop_reason决策",
-	// 	logger.String("stop_reason", stopReason),
-	// 	logger.String("description", GetStopReasonDescription(stopReason)),
-	// 	logger.Bool("saw_tool_use", sawToolUse),
-	// 	logger.Int("output_tokens", outputTokens))
+// newThinkingContext 按请求创建 thinking 上下文（借鉴 kiro.rs）
+// 不发送结构化推理事件的模型才从文本中解析 <thinking> 标签
+func newThinkingContext(req types.AnthropicRequest) *parser.ThinkingStreamContext {
+	thinkingEnabled := req.Thinking != nil && req.Thinking.Type == "enabled"
+	ctx := parser.NewThinkingStreamContext(thinkingEnabled)
+	ctx.SetTagFallback(parser.ThinkingTagFallbackEnabled(req.Model))
+	return ctx
+}
 
-	anthropicResp := map[string]any{
-		"content":       contexts,
-		"model":         anthropicReq.Model,
-		"role":          "assistant",
-		"stop_reason":   stopReason,
-		"stop_sequence": nil,
-		"type":          "message",
-		"usage": map[string]any{
-			"input_tokens":  inputTokens,
-			"output_tokens": outputTokens,
-		},
+// newRequestParser 创建事件流解析器，上游返回的改写工具名按请求还原为原名
+func newRequestParser(req types.AnthropicRequest) *parser.CompliantEventStreamParser {
+	compliantParser := parser.NewCompliantEventStreamParser()
+	if mapper := converter.NewToolNameMapper(req); mapper != nil {
+		compliantParser.SetToolNameResolver(mapper.ClientName)
 	}
-
-	// logger.Debug("非流式响应最终数据",
-	// 	logger.String("stop_reason", stopReason),
-	// 	logger.Int("content_blocks", len(contexts)))
-
-	logger.Debug("下发非流式响应",
-		addReqFields(c,
-			logger.String("direction", "downstream_send"),
-			logger.Any("contexts", contexts),
-			logger.Bool("saw_tool_use", sawToolUse),
-			logger.Int("content_count", len(contexts)),
-		)...)
-	c.JSON(http.StatusOK, anthropicResp)
+	return compliantParser
 }
 
 // createTokenPreview 创建token预览显示格式 (***+后10位)
@@ -465,8 +571,9 @@ func handleTokenPoolAPI(c *gin.Context) {
 			continue
 		}
 
-		// 尝试获取token信息
-		tokenInfo, err := refreshSingleTokenByConfig(authConfig)
+		// 尝试获取token信息（经该token绑定的代理）
+		tokenKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		tokenInfo, err := refreshSingleTokenByConfig(tokenKey, authConfig)
 		if err != nil {
 			tokenData := map[string]any{
 				"index":           i,
@@ -488,7 +595,7 @@ func handleTokenPoolAPI(c *gin.Context) {
 		var available float64 // 默认值 (浮点数)
 		var userEmail = "未知用户"
 
-		checker := auth.NewUsageLimitsChecker()
+		checker := auth.NewUsageLimitsCheckerForToken(tokenKey)
 		if usage, checkErr := checker.CheckUsageLimits(tokenInfo); checkErr == nil {
 			usageInfo = usage
 			available = auth.CalculateAvailableCount(usage)
@@ -572,12 +679,12 @@ func handleTokenPoolAPI(c *gin.Context) {
 }
 
 // refreshSingleTokenByConfig 根据配置刷新单个token
-func refreshSingleTokenByConfig(config auth.AuthConfig) (types.TokenInfo, error) {
+func refreshSingleTokenByConfig(tokenKey string, config auth.AuthConfig) (types.TokenInfo, error) {
 	switch config.AuthType {
 	case auth.AuthMethodSocial:
-		return auth.RefreshSocialToken(config.RefreshToken)
+		return auth.RefreshSocialToken(tokenKey, config.RefreshToken)
 	case auth.AuthMethodIdC:
-		return auth.RefreshIdCToken(config)
+		return auth.RefreshIdCToken(tokenKey, config)
 	default:
 		return types.TokenInfo{}, fmt.Errorf("不支持的认证类型: %s", config.AuthType)
 	}
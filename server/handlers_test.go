@@ -1,11 +1,14 @@
 package server
 
 import (
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -206,3 +209,46 @@ func TestCreateTokenPreview_EdgeCases(t *testing.T) {
 		})
 	}
 }
+
+func TestNonStream_ThinkingBlocks(t *testing.T) {
+	mockUpstreamTurns(t, buildTestEventStream(
+		[2]string{"reasoningContentEvent", `{"text":"先分析"}`},
+		[2]string{"reasoningContentEvent", `{"text":"问题","signature":"sig-upstream"}`},
+		[2]string{"reasoningContentEvent", `{"redactedContent":"ZW5jcnlwdGVk"}`},
+		[2]string{"assistantResponseEvent", `{"content":"答案是42"}`},
+	))
+
+	w := postMessages(`{"model":"claude-sonnet-4-20250514","max_tokens":2048,
+		"thinking":{"type":"enabled","budget_tokens":1024},
+		"messages":[{"role":"user","content":"计算"}]}`, false, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var message struct {
+		Content []map[string]any `json:"content"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &message))
+	require.Len(t, message.Content, 3, w.Body.String())
+
+	assert.Equal(t, "thinking", message.Content[0]["type"])
+	assert.Equal(t, "先分析问题", message.Content[0]["thinking"])
+	assert.NotEmpty(t, message.Content[0]["signature"])
+	assert.Equal(t, map[string]any{"type": "redacted_thinking", "data": "ZW5jcnlwdGVk"}, message.Content[1])
+	assert.Equal(t, map[string]any{"type": "text", "text": "答案是42"}, message.Content[2])
+}
+
+func TestNonStream_ThinkingDisabledDropsReasoning(t *testing.T) {
+	mockUpstreamTurns(t, buildTestEventStream(
+		[2]string{"reasoningContentEvent", `{"text":"先分析"}`},
+		[2]string{"assistantResponseEvent", `{"content":"答案是42"}`},
+	))
+
+	w := postMessages(`{"model":"claude-sonnet-4-20250514","max_tokens":256,
+		"messages":[{"role":"user","content":"计算"}]}`, false, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var message struct {
+		Content []map[string]any `json:"content"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &message))
+	assert.Equal(t, []map[string]any{{"type": "text", "text": "答案是42"}}, message.Content)
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrUpstreamIdleTimeout 上游在空闲超时时间内没有返回任何数据
+var ErrUpstreamIdleTimeout = errors.New("上游响应空闲超时")
+
+const keepAliveBufferSize = 8 * 1024
+
+// readResult 后台读取结果
+type readResult struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// keepAliveReader 在等待上游数据期间发送心跳，并在上游长时间无数据时返回 ErrUpstreamIdleTimeout
+// 上游读取在后台goroutine中进行，心跳回调始终在调用 Read 的goroutine中执行，
+// 因此可以直接写入响应而无需额外加锁
+type keepAliveReader struct {
+	ctx     context.Context
+	results chan readResult
+	free    chan []byte
+	done    chan struct{}
+
+	current []byte // 当前读取块（消费完后归还）
+	pending []byte // 当前读取块中尚未返回的数据
+	err     error
+
+	ping         func() error
+	pingInterval time.Duration
+	idleTimeout  time.Duration
+	pingTimer    *time.Timer
+	idleTimer    *time.Timer
+}
+
+// newKeepAliveReader 包装上游响应体，pingInterval 或 idleTimeout 为0时关闭对应功能
+// ctx 取消（客户端断开）时 Read 立即返回 ctx.Err()
+func newKeepAliveReader(ctx context.Context, upstream io.Reader, ping func() error, pingInterval, idleTimeout time.Duration) *keepAliveReader {
+	r := &keepAliveReader{
+		ctx:          ctx,
+		results:      make(chan readResult),
+		free:         make(chan []byte, 2),
+		done:         make(chan struct{}),
+		ping:         ping,
+		pingInterval: pingInterval,
+		idleTimeout:  idleTimeout,
+	}
+	// 双缓冲：消费一块的同时后台读取下一块
+	r.free <- make([]byte, keepAliveBufferSize)
+	r.free <- make([]byte, keepAliveBufferSize)
+
+	if ping != nil && pingInterval > 0 {
+		r.pingTimer = time.NewTimer(pingInterval)
+	}
+	if idleTimeout > 0 {
+		r.idleTimer = time.NewTimer(idleTimeout)
+	}
+
+	go r.readLoop(upstream)
+	return r
+}
+
+// readLoop 后台读取上游数据
+func (r *keepAliveReader) readLoop(upstream io.Reader) {
+	for {
+		var buf []byte
+		select {
+		case buf = <-r.free:
+		case <-r.done:
+			return
+		}
+
+		n, err := upstream.Read(buf)
+		select {
+		case r.results <- readResult{buf: buf, n: n, err: err}:
+		case <-r.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read 实现 io.Reader
+func (r *keepAliveReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if err := r.wait(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	if len(r.pending) == 0 {
+		r.free <- r.current
+		r.current = nil
+	}
+	return n, nil
+}
+
+// wait 等待下一块上游数据，期间按间隔发送心跳
+func (r *keepAliveReader) wait() error {
+	resetTimer(r.pingTimer, r.pingInterval)
+	resetTimer(r.idleTimer, r.idleTimeout)
+
+	for {
+		select {
+		case res := <-r.results:
+			if res.err != nil {
+				r.err = res.err
+			}
+			if res.n > 0 {
+				r.current = res.buf
+				r.pending = res.buf[:res.n]
+				return nil
+			}
+			r.free <- res.buf
+			if r.err != nil {
+				return r.err
+			}
+		case <-timerC(r.pingTimer):
+			if err := r.ping(); err != nil {
+				r.err = err
+				return err
+			}
+			r.pingTimer.Reset(r.pingInterval)
+		case <-timerC(r.idleTimer):
+			r.err = ErrUpstreamIdleTimeout
+			return r.err
+		case <-r.ctx.Done():
+			r.err = r.ctx.Err()
+			return r.err
+		}
+	}
+}
+
+// Close 停止后台读取（阻塞中的读取由调用方关闭上游响应体来解除）
+func (r *keepAliveReader) Close() {
+	select {
+	case <-r.done:
+	default:
+		close(r.done)
+		if r.pingTimer != nil {
+			r.pingTimer.Stop()
+		}
+		if r.idleTimer != nil {
+			r.idleTimer.Stop()
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if t != nil {
+		t.Reset(d)
+	}
+}
+
+// timerC 未启用的计时器返回 nil 通道，select 中永不就绪
+func timerC(t *time.Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
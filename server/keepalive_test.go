@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepAliveReader_PingsWhileWaiting(t *testing.T) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("abc"))
+		time.Sleep(150 * time.Millisecond)
+		pw.Write([]byte("def"))
+		pw.Close()
+	}()
+
+	pings := 0
+	r := newKeepAliveReader(context.Background(), pr, func() error { pings++; return nil }, 30*time.Millisecond, time.Second)
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", string(data))
+	assert.GreaterOrEqual(t, pings, 2)
+}
+
+func TestKeepAliveReader_IdleTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	pings := 0
+	r := newKeepAliveReader(context.Background(), pr, func() error { pings++; return nil }, 20*time.Millisecond, 100*time.Millisecond)
+	defer r.Close()
+
+	start := time.Now()
+	_, err := r.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, ErrUpstreamIdleTimeout)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Greater(t, pings, 0, "超时前应持续发送心跳")
+
+	_, err = r.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, ErrUpstreamIdleTimeout, "超时后保持错误状态")
+}
+
+func TestKeepAliveReader_Disabled(t *testing.T) {
+	r := newKeepAliveReader(context.Background(), strings.NewReader(strings.Repeat("x", 3*keepAliveBufferSize)), nil, 0, 0)
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Len(t, data, 3*keepAliveBufferSize)
+}
+
+func TestStreamUpstreamResponse_PingAndIdleTimeout(t *testing.T) {
+	oldPing, oldIdle := config.SSEPingInterval, config.UpstreamIdleTimeout
+	config.SSEPingInterval, config.UpstreamIdleTimeout = 20*time.Millisecond, 150*time.Millisecond
+	defer func() { config.SSEPingInterval, config.UpstreamIdleTimeout = oldPing, oldIdle }()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(buildTestEventStream([2]string{"assistantResponseEvent", `{"content":"思考中"}`}))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req := types.AnthropicRequest{Model: "claude-sonnet-4-20250514", MaxTokens: 100, Stream: true}
+
+	streamUpstreamResponse(c, req, &types.TokenWithUsage{}, &AnthropicStreamSender{}, createAnthropicStreamEvents, "msg_test", 10, pr)
+
+	events := splitSSEEvents(w.Body.String())
+	require.NotEmpty(t, events)
+	assert.Contains(t, w.Body.String(), "思考中")
+	assert.Greater(t, strings.Count(w.Body.String(), "event: ping"), 1, "等待上游时应发送 ping")
+	assert.Contains(t, events[len(events)-1], "event: error")
+	assert.Contains(t, events[len(events)-1], "上游响应超时")
+}
+
+func TestKeepAliveReader_ContextCancel(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := newKeepAliveReader(ctx, pr, nil, 0, time.Minute)
+	defer r.Close()
+
+	time.AfterFunc(30*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := r.Read(make([]byte, 16))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestStreamUpstreamResponse_ClientDisconnect(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(buildTestEventStream([2]string{"assistantResponseEvent", `{"content":"部分输出"}`}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil).WithContext(ctx)
+	req := types.AnthropicRequest{Model: "claude-sonnet-4-20250514", MaxTokens: 100, Stream: true}
+
+	before := GetStreamMetrics().GetStats()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	streamUpstreamResponse(c, req, &types.TokenWithUsage{}, &AnthropicStreamSender{}, createAnthropicStreamEvents, "msg_test", 10, pr)
+	after := GetStreamMetrics().GetStats()
+
+	assert.Contains(t, w.Body.String(), "部分输出")
+	assert.NotContains(t, w.Body.String(), "message_stop", "断开后不应继续下发结束事件")
+	assert.Equal(t, before["client_cancelled"].(int64)+1, after["client_cancelled"])
+	assert.Equal(t, before["completed"], after["completed"])
+	assert.Greater(t, after["cancelled_bytes"].(int64), before["cancelled_bytes"].(int64))
+}
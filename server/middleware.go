@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"strings"
 
+	"kiro2api/auth"
 	"kiro2api/logger"
 	"kiro2api/utils"
 
@@ -106,7 +107,7 @@ func extractAPIKey(c *gin.Context) string {
 // validateAPIKey 验证API密钥 - 支持多租户模式
 // 支持两种格式：
 // 1. 简单格式: PROXY_API_KEY
-// 2. 组合格式: PROXY_API_KEY:USER_REFRESH_TOKEN（多租户模式）
+// 2. 组合格式: PROXY_API_KEY:TENANT_CREDENTIAL（多租户模式，见 auth.ParseTenantCredential）
 func validateAPIKey(c *gin.Context, authToken string) bool {
 	providedApiKey := extractAPIKey(c)
 
@@ -127,11 +128,19 @@ func validateAPIKey(c *gin.Context, authToken string) bool {
 		return false
 	}
 
-	// 如果有用户 Token，设置到上下文
+	// 如果有用户凭据，解析后设置到上下文
 	if userToken != "" {
-		c.Set("userRefreshToken", userToken)
+		cred, err := auth.ParseTenantCredential(userToken)
+		if err != nil {
+			logger.Warn("多租户凭据无效", logger.Err(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "401"})
+			return false
+		}
+		c.Set("tenantCredential", cred)
 		c.Set("isMultiTenant", true)
-		logger.Debug("多租户模式：使用用户提供的 RefreshToken")
+		logger.Debug("多租户模式：使用用户提供的凭据",
+			logger.String("tenant_key", cred.Key()),
+			logger.String("auth_type", cred.AuthType))
 	} else {
 		c.Set("isMultiTenant", false)
 	}
@@ -140,7 +149,7 @@ func validateAPIKey(c *gin.Context, authToken string) bool {
 }
 
 // parseAPIKey 解析 API Key，支持组合格式
-// 返回 (proxyKey, userRefreshToken)
+// 返回 (proxyKey, tenantCredential)
 func parseAPIKey(apiKey string) (string, string) {
 	// 查找第一个冒号
 	idx := strings.Index(apiKey, ":")
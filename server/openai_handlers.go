@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -32,15 +33,15 @@ func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRe
 	}
 
 	// 使用新的符合AWS规范的解析器
-	compliantParser := parser.NewCompliantEventStreamParser()
+	compliantParser := newRequestParser(anthropicReq)
 	result, err := compliantParser.ParseResponse(body)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "响应解析失败"})
 		return
 	}
 
-	// 转换为Anthropic格式
-	contexts := []map[string]any{}
+	// 转换为Anthropic格式，推理块与流式一致在转换时以 <thinking> 标签透出
+	contexts := result.GetThinkingBlocks()
 	allContent := result.GetCompletionText()
 	sawToolUse := len(result.GetToolCalls()) > 0
 
@@ -136,6 +137,12 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 
 	// 立即刷新响应头
 	c.Writer.Flush()
+	streamOpenAIResponse(c, anthropicReq, messageId, resp.Body)
+}
+
+// streamOpenAIResponse 将上游事件流转换为OpenAI流式chunk下发
+func streamOpenAIResponse(c *gin.Context, anthropicReq types.AnthropicRequest, messageId string, body io.Reader) {
+	GetStreamMetrics().RecordStart()
 
 	sender := &OpenAIStreamSender{}
 
@@ -158,7 +165,7 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	sender.SendEvent(c, initialEvent)
 
 	// 创建符合AWS规范的流式解析器
-	compliantParser := parser.NewCompliantEventStreamParser()
+	compliantParser := newRequestParser(anthropicReq)
 
 	// OpenAI 工具调用增量状态
 	toolIndexByToolUseId := make(map[string]int)  // tool_use_id -> tool_calls 数组索引
@@ -167,6 +174,7 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	sawToolUse := false
 	sentFinal := false
 	inThinking := false
+	lengthStop := false // 上游内容长度超限，以 finish_reason=length 结束
 
 	// 添加完整性跟踪
 	totalBytesRead := 0
@@ -175,19 +183,23 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	consecutiveErrors := 0
 	const maxConsecutiveErrors = 3
 
+	// 等待上游数据时发送SSE注释保活，上游长时间无数据时结束流
+	upstream := newKeepAliveReader(c.Request.Context(), body, func() error {
+		_, err := fmt.Fprint(c.Writer, ": ping\n\n")
+		c.Writer.Flush()
+		return err
+	}, config.SSEPingInterval, config.UpstreamIdleTimeout)
+	defer upstream.Close()
+
 	// 使用更大的缓冲区避免数据丢失
 	buf := make([]byte, 8192) // 增加到8KB
 	for hasMoreData {
-		n, err := resp.Body.Read(buf)
+		n, err := upstream.Read(buf)
 		if n > 0 {
 			totalBytesRead += n
 			consecutiveErrors = 0 // 重置错误计数
 
 			events, parseErr := compliantParser.ParseStream(buf[:n])
-			if parseErr != nil {
-				// 在宽松模式下继续处理
-				continue
-			}
 			messageCount += len(events)
 			for _, event := range events {
 				if event.Data != nil {
@@ -431,20 +443,71 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 							}
 						case "content_block_stop":
 							// 忽略，最终结束由message_delta驱动
+						case "exception", "error":
+							// 上游流中异常：内容长度超限按 length 结束，其余下发带类型的错误并中止流
+							outcome := mapStreamException(dataMap)
+							if !outcome.MaxTokens {
+								GetStreamMetrics().RecordUpstreamError()
+								logger.Warn("上游流中返回异常，下发错误",
+									addReqFields(c,
+										logger.String("exception_type", outcome.UpstreamType),
+										logger.String("error_type", outcome.ErrorType),
+										logger.String("exception_message", outcome.Message),
+									)...)
+								errType, code := outcome.openAIError()
+								_ = sender.sendTypedError(c, outcome.Message, errType, code)
+								return
+							}
+							lengthStop = true
 						}
 					}
 				}
 				c.Writer.Flush()
+				if lengthStop {
+					break
+				}
+			}
+			if lengthStop {
+				break
+			}
+
+			// 严格模式下上游帧校验失败：下发错误并中止流
+			if errors.Is(parseErr, parser.ErrStreamCorrupted) {
+				GetStreamMetrics().RecordCorrupted()
+				logger.Error("上游事件流校验失败，中止流", logger.Err(parseErr))
+				_ = sender.SendError(c, "上游事件流校验失败", parseErr)
+				return
 			}
 		}
 
 		// 错误处理
 		if err != nil {
+			if c.Request.Context().Err() != nil {
+				// 客户端已断开：上游请求随 context 取消，不再向客户端写入
+				GetStreamMetrics().RecordClientCancel(max(c.Writer.Size(), 0), messageCount)
+				logger.Info("客户端断开连接，已取消上游请求",
+					addReqFields(c,
+						logger.String("stage", "streaming"),
+						logger.Int("total_read_bytes", totalBytesRead),
+						logger.Int("downstream_bytes", max(c.Writer.Size(), 0)),
+						logger.Int("processed_events", messageCount),
+					)...)
+				return
+			}
+			if errors.Is(err, ErrUpstreamIdleTimeout) {
+				GetStreamMetrics().RecordIdleTimeout()
+				logger.Warn("上游响应空闲超时，结束流",
+					logger.Duration("idle_timeout", config.UpstreamIdleTimeout),
+					logger.Int("total_read_bytes", totalBytesRead))
+				_ = sender.SendError(c, "上游响应超时", err)
+				return
+			}
 			if err == io.EOF {
 				// 正常结束
 				hasMoreData = false
 			} else if err == io.ErrUnexpectedEOF {
 				// 意外结束，尝试恢复
+				GetStreamMetrics().RecordUpstreamError()
 				consecutiveErrors++
 				if consecutiveErrors >= maxConsecutiveErrors {
 					// 连续错误过多，停止
@@ -460,6 +523,7 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 				}
 			} else {
 				// 其他错误
+				GetStreamMetrics().RecordUpstreamError()
 				consecutiveErrors++
 				if consecutiveErrors >= maxConsecutiveErrors {
 					hasMoreData = false
@@ -494,7 +558,9 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 		}
 
 		finishReason := "stop"
-		if sawToolUse {
+		if lengthStop {
+			finishReason = "length"
+		} else if sawToolUse {
 			finishReason = "tool_calls"
 		}
 
@@ -518,4 +584,5 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	// 发送结束标记
 	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
 	c.Writer.Flush()
+	GetStreamMetrics().RecordCompleted()
 }
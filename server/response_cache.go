@@ -0,0 +1,309 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/respcache"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// responseCache 响应缓存，由 InitResponseCache 设置，为空表示未启用
+var responseCache respcache.Store
+
+const (
+	// responseCacheKeyCtx 上下文中保存缓存键，响应成功后据此写入缓存
+	responseCacheKeyCtx = "response_cache_key"
+	// responseCacheHeader 缓存状态响应头：HIT、MISS 或 BYPASS
+	responseCacheHeader = "X-Response-Cache"
+)
+
+// InitResponseCache 按 RESPONSE_CACHE 初始化响应缓存，disk 后端写入 dataDir/response_cache
+func InitResponseCache(dataDir string) error {
+	switch config.ResponseCache {
+	case "":
+		return nil
+	case "memory":
+		responseCache = respcache.NewMemory(config.ResponseCacheMaxEntries, config.ResponseCacheTTL)
+	case "disk":
+		store, err := respcache.NewDisk(filepath.Join(dataDir, "response_cache"), config.ResponseCacheTTL)
+		if err != nil {
+			return err
+		}
+		responseCache = store
+	default:
+		return fmt.Errorf("未知的响应缓存后端: %s（可选 memory、disk）", config.ResponseCache)
+	}
+	logger.Info("响应缓存已启用",
+		logger.String("backend", config.ResponseCache),
+		logger.Duration("ttl", config.ResponseCacheTTL),
+		logger.Bool("deterministic_only", config.ResponseCacheDeterministicOnly))
+	return nil
+}
+
+// serveCachedResponse 查找响应缓存，命中时直接下发缓存的响应并返回 true；
+// 未命中时在上下文中记录缓存键，响应成功后写入。
+// 请求头 Cache-Control: no-cache 跳过查找但刷新缓存，no-store 完全绕过缓存
+func serveCachedResponse(c *gin.Context, req types.AnthropicRequest) bool {
+	if responseCache == nil {
+		return false
+	}
+	if config.ResponseCacheDeterministicOnly && !respcache.Deterministic(req) {
+		return false
+	}
+
+	directives := strings.ToLower(c.GetHeader("Cache-Control"))
+	if strings.Contains(directives, "no-store") {
+		c.Header(responseCacheHeader, "BYPASS")
+		return false
+	}
+	key, err := respcache.Key(rewriteClientKey(c), req)
+	if err != nil {
+		logger.Warn("计算响应缓存键失败", addReqFields(c, logger.Err(err))...)
+		return false
+	}
+	c.Set(responseCacheKeyCtx, key)
+	if strings.Contains(directives, "no-cache") {
+		c.Header(responseCacheHeader, "BYPASS")
+		return false
+	}
+
+	entry, ok := responseCache.Get(key)
+	if !ok {
+		c.Header(responseCacheHeader, "MISS")
+		return false
+	}
+	var message map[string]any
+	if err := utils.SafeUnmarshal(entry.Message, &message); err != nil {
+		logger.Warn("解析缓存响应失败，按未命中处理", addReqFields(c, logger.Err(err))...)
+		c.Header(responseCacheHeader, "MISS")
+		return false
+	}
+
+	c.Header(responseCacheHeader, "HIT")
+	c.Header("Age", strconv.Itoa(int(time.Since(entry.StoredAt).Seconds())))
+	logger.Info("响应缓存命中",
+		addReqFields(c,
+			logger.String("cache_key", key[:16]),
+			logger.Bool("stream", req.Stream),
+		)...)
+	if req.Stream {
+		replayCachedStream(c, message)
+	} else {
+		c.JSON(http.StatusOK, message)
+	}
+	return true
+}
+
+// storeCachedResponse 写入成功的响应（非流式格式，不含消息 ID），未记录缓存键时忽略
+func storeCachedResponse(c *gin.Context, message map[string]any) {
+	key := c.GetString(responseCacheKeyCtx)
+	if key == "" || responseCache == nil {
+		return
+	}
+
+	stored := make(map[string]any, len(message))
+	for k, v := range message {
+		if k != "id" {
+			stored[k] = v
+		}
+	}
+	data, err := utils.SafeMarshal(stored)
+	if err == nil {
+		err = responseCache.Set(key, &respcache.Entry{Message: data, StoredAt: time.Now()})
+	}
+	if err != nil {
+		logger.Warn("写入响应缓存失败", addReqFields(c, logger.Err(err))...)
+	}
+}
+
+// cachingStreamSender 将下发的流式事件还原为完整的 message，流正常结束后写入响应缓存
+type cachingStreamSender struct {
+	inner     StreamEventSender
+	message   map[string]any
+	blocks    map[int]map[string]any
+	toolInput map[int]*strings.Builder
+	failed    bool
+}
+
+// newCachingStreamSender 请求记录了缓存键时包装发送器，否则原样返回
+func newCachingStreamSender(c *gin.Context, sender StreamEventSender) StreamEventSender {
+	if c.GetString(responseCacheKeyCtx) == "" {
+		return sender
+	}
+	return &cachingStreamSender{
+		inner:     sender,
+		blocks:    make(map[int]map[string]any),
+		toolInput: make(map[int]*strings.Builder),
+	}
+}
+
+func (s *cachingStreamSender) SendEvent(c *gin.Context, data any) error {
+	if err := s.inner.SendEvent(c, data); err != nil {
+		s.failed = true
+		return err
+	}
+	if event, ok := data.(map[string]any); ok {
+		s.record(c, event)
+	}
+	return nil
+}
+
+func (s *cachingStreamSender) SendError(c *gin.Context, message string, err error) error {
+	s.failed = true
+	return s.inner.SendError(c, message, err)
+}
+
+func (s *cachingStreamSender) record(c *gin.Context, event map[string]any) {
+	eventType, _ := event["type"].(string)
+	index := extractIndex(event)
+	switch eventType {
+	case "message_start":
+		if msg, ok := event["message"].(map[string]any); ok {
+			s.message = copyMap(msg)
+		}
+	case "content_block_start":
+		if block, ok := event["content_block"].(map[string]any); ok && index >= 0 {
+			s.blocks[index] = copyMap(block)
+		}
+	case "content_block_delta":
+		block := s.blocks[index]
+		delta, _ := event["delta"].(map[string]any)
+		if block == nil || delta == nil {
+			return
+		}
+		switch delta["type"] {
+		case "text_delta":
+			block["text"] = getStringField(block, "text") + getStringField(delta, "text")
+		case "thinking_delta":
+			block["thinking"] = getStringField(block, "thinking") + getStringField(delta, "thinking")
+		case "signature_delta":
+			block["signature"] = getStringField(delta, "signature")
+		case "input_json_delta":
+			if s.toolInput[index] == nil {
+				s.toolInput[index] = &strings.Builder{}
+			}
+			s.toolInput[index].WriteString(getStringField(delta, "partial_json"))
+		}
+	case "content_block_stop":
+		if buf := s.toolInput[index]; buf != nil && s.blocks[index] != nil {
+			input := map[string]any{}
+			if buf.Len() > 0 && utils.SafeUnmarshal([]byte(buf.String()), &input) != nil {
+				s.failed = true
+			}
+			s.blocks[index]["input"] = input
+		}
+	case "message_delta":
+		if s.message == nil {
+			return
+		}
+		if delta, ok := event["delta"].(map[string]any); ok {
+			s.message["stop_reason"] = delta["stop_reason"]
+			s.message["stop_sequence"] = delta["stop_sequence"]
+		}
+		if usage, ok := event["usage"].(map[string]any); ok {
+			s.message["usage"] = copyMap(usage)
+		}
+	case "message_stop":
+		if s.failed || s.message == nil || c.Request.Context().Err() != nil {
+			return
+		}
+		indexes := make([]int, 0, len(s.blocks))
+		for i := range s.blocks {
+			indexes = append(indexes, i)
+		}
+		sort.Ints(indexes)
+		// 与非流式响应一致，不保存空文本块
+		content := make([]any, 0, len(indexes))
+		for _, i := range indexes {
+			if block := s.blocks[i]; block["type"] != "text" || getStringField(block, "text") != "" {
+				content = append(content, block)
+			}
+		}
+		s.message["content"] = content
+		storeCachedResponse(c, s.message)
+	case "error":
+		s.failed = true
+	}
+}
+
+// replayCachedStream 将缓存的 message 经 SSEStateManager 还原为流式事件序列
+func replayCachedStream(c *gin.Context, message map[string]any) {
+	sender := wrapValidatingSender(&AnthropicStreamSender{})
+	if vs, ok := sender.(*validatingSender); ok {
+		defer vs.finish(c)
+	}
+	if err := initializeSSEResponse(c); err != nil {
+		_ = sender.SendError(c, "连接不支持SSE刷新", err)
+		return
+	}
+
+	usage, _ := message["usage"].(map[string]any)
+	inputTokens, _ := extractIntAny(usage["input_tokens"])
+	outputTokens, _ := extractIntAny(usage["output_tokens"])
+	stopReason, _ := message["stop_reason"].(string)
+	messageID := fmt.Sprintf(config.MessageIDFormat, time.Now().Format(config.MessageIDTimeFormat))
+
+	events := createAnthropicStreamEvents(messageID, inputTokens, getStringField(message, "model"))
+	content, _ := message["content"].([]any)
+	for i, raw := range content {
+		if block, ok := raw.(map[string]any); ok {
+			events = append(events, cachedBlockEvents(i, block)...)
+		}
+	}
+	events = append(events, createAnthropicFinalEvents(outputTokens, inputTokens, stopReason)...)
+
+	ssm := NewSSEStateManager(false)
+	for _, event := range events {
+		if err := ssm.SendEvent(c, sender, event); err != nil {
+			logger.Error("回放缓存响应失败", addReqFields(c, logger.Err(err))...)
+			return
+		}
+	}
+}
+
+// cachedBlockEvents 将单个内容块还原为 start、delta、stop 事件
+func cachedBlockEvents(index int, block map[string]any) []map[string]any {
+	start := copyMap(block)
+	var deltas []map[string]any
+	switch block["type"] {
+	case "text":
+		start["text"] = ""
+		deltas = append(deltas, map[string]any{"type": "text_delta", "text": getStringField(block, "text")})
+	case "thinking":
+		start["thinking"] = ""
+		delete(start, "signature")
+		deltas = append(deltas, map[string]any{"type": "thinking_delta", "thinking": getStringField(block, "thinking")})
+		if signature := getStringField(block, "signature"); signature != "" {
+			deltas = append(deltas, map[string]any{"type": "signature_delta", "signature": signature})
+		}
+	case "tool_use", "server_tool_use":
+		start["input"] = map[string]any{}
+		input, _ := utils.SafeMarshal(block["input"])
+		deltas = append(deltas, map[string]any{"type": "input_json_delta", "partial_json": string(input)})
+	}
+
+	events := []map[string]any{{"type": "content_block_start", "index": index, "content_block": start}}
+	for _, delta := range deltas {
+		events = append(events, map[string]any{"type": "content_block_delta", "index": index, "delta": delta})
+	}
+	return append(events, map[string]any{"type": "content_block_stop", "index": index})
+}
+
+func copyMap(m map[string]any) map[string]any {
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
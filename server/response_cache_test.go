@@ -0,0 +1,142 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/respcache"
+	"kiro2api/ssevalidator"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const cachedRequestBody = `{"model":"claude-sonnet-4-20250514","max_tokens":256,"temperature":0,
+	"messages":[{"role":"user","content":"explain the lint error"}]}`
+
+// useResponseCache 为测试启用内存响应缓存
+func useResponseCache(t *testing.T) {
+	t.Helper()
+	old := responseCache
+	responseCache = respcache.NewMemory(10, time.Hour)
+	t.Cleanup(func() { responseCache = old })
+}
+
+// postMessages 经 /v1/messages 处理流程发送请求
+func postMessages(body string, stream bool, header http.Header) *httptest.ResponseRecorder {
+	if stream {
+		body = strings.Replace(body, `"temperature":0`, `"temperature":0,"stream":true`, 1)
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		c.Request.Header[name] = values
+	}
+	handleMessages(c, &MockAuthService{token: types.TokenInfo{AccessToken: "test"}})
+	return w
+}
+
+func parseReplayedStream(t *testing.T, w *httptest.ResponseRecorder) []map[string]any {
+	t.Helper()
+	events, err := ssevalidator.ParseSSE(w.Body.String())
+	require.NoError(t, err)
+	assert.Empty(t, ssevalidator.ValidateEvents(events))
+	return events
+}
+
+func TestResponseCache_NonStreamHit(t *testing.T) {
+	useResponseCache(t)
+	requests := mockUpstreamTurns(t, textTurn("unused variable x"))
+
+	w := postMessages(cachedRequestBody, false, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "MISS", w.Header().Get(responseCacheHeader))
+	first := w.Body.String()
+
+	// 第二次请求不访问上游（mock 只准备了一轮响应）
+	w = postMessages(cachedRequestBody, false, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "HIT", w.Header().Get(responseCacheHeader))
+	assert.NotEmpty(t, w.Header().Get("Age"))
+	assert.JSONEq(t, first, w.Body.String())
+	assert.Len(t, *requests, 1)
+
+	// 缓存的非流式响应可回放为流式事件
+	w = postMessages(cachedRequestBody, true, nil)
+	assert.Equal(t, "HIT", w.Header().Get(responseCacheHeader))
+	events := parseReplayedStream(t, w)
+	assert.Equal(t, "unused variable x", streamText(events))
+	assert.Equal(t, "end_turn", finalStopReason(events))
+	assert.Len(t, *requests, 1)
+}
+
+func TestResponseCache_StreamToolUseReplay(t *testing.T) {
+	useResponseCache(t)
+	requests := mockUpstreamTurns(t, toolTurn("toolu_1"))
+	body := `{"model":"claude-sonnet-4-20250514","max_tokens":256,"temperature":0,
+		"tools":[{"name":"extract","description":"extract","input_schema":{"type":"object"}}],
+		"messages":[{"role":"user","content":"提取语言名称"}]}`
+
+	w := postMessages(body, true, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "MISS", w.Header().Get(responseCacheHeader))
+	parseReplayedStream(t, w)
+
+	w = postMessages(body, true, nil)
+	assert.Equal(t, "HIT", w.Header().Get(responseCacheHeader))
+	replayed := parseReplayedStream(t, w)
+	assert.Equal(t, []string{"tool_use"}, blockStarts(replayed))
+	assert.Equal(t, "tool_use", finalStopReason(replayed))
+	assert.Len(t, *requests, 1)
+
+	// 流式响应还原的 message 与非流式格式一致
+	w = postMessages(body, false, nil)
+	assert.Equal(t, "HIT", w.Header().Get(responseCacheHeader))
+	var message struct {
+		Content []struct {
+			Type  string         `json:"type"`
+			ID    string         `json:"id"`
+			Input map[string]any `json:"input"`
+		} `json:"content"`
+		StopReason string `json:"stop_reason"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &message))
+	require.Len(t, message.Content, 1)
+	assert.Equal(t, "tool_use", message.Content[0].Type)
+	assert.Equal(t, "toolu_1", message.Content[0].ID)
+	assert.Equal(t, map[string]any{"name": "Go"}, message.Content[0].Input)
+	assert.Equal(t, "tool_use", message.StopReason)
+}
+
+func TestResponseCache_Bypass(t *testing.T) {
+	useResponseCache(t)
+	requests := mockUpstreamTurns(t, textTurn("first"), textTurn("second"), textTurn("third"))
+
+	// 非确定性请求不缓存
+	w := postMessages(strings.Replace(cachedRequestBody, `"temperature":0`, `"temperature":1`, 1), false, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, w.Header().Get(responseCacheHeader))
+
+	// no-store 既不读取也不写入
+	w = postMessages(cachedRequestBody, false, http.Header{"Cache-Control": {"no-store"}})
+	assert.Equal(t, "BYPASS", w.Header().Get(responseCacheHeader))
+	assert.Contains(t, w.Body.String(), "second")
+
+	// no-cache 跳过读取但刷新缓存
+	w = postMessages(cachedRequestBody, false, http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, "BYPASS", w.Header().Get(responseCacheHeader))
+	assert.Contains(t, w.Body.String(), "third")
+
+	w = postMessages(cachedRequestBody, false, nil)
+	assert.Equal(t, "HIT", w.Header().Get(responseCacheHeader))
+	assert.Contains(t, w.Body.String(), "third")
+	assert.Len(t, *requests, 3)
+}
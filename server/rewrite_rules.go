@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/rewrite"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultClientKey 使用服务端 Token 池的请求在规则匹配中的客户端标识
+const defaultClientKey = "default"
+
+// InitRewriteRules 加载请求改写规则（REWRITE_RULES_FILE）
+func InitRewriteRules() error {
+	rs, err := rewrite.LoadFile(config.RewriteRulesFile)
+	if err != nil {
+		return err
+	}
+	if rs != nil {
+		logger.Info("请求改写规则已启用",
+			logger.String("file", config.RewriteRulesFile),
+			logger.Int("rules", len(rs.Rules)))
+	}
+	return nil
+}
+
+// rewriteClientKey 规则匹配使用的客户端标识：多租户请求为租户 Key（tenant_<ID> 或凭据哈希），否则为 default
+func rewriteClientKey(c *gin.Context) string {
+	if v, ok := c.Get("tenantCredential"); ok {
+		if cred, ok := v.(auth.TenantCredential); ok {
+			return cred.Key()
+		}
+	}
+	return defaultClientKey
+}
+
+// applyRewriteRules 在转换为 CodeWhisperer 请求前执行改写规则，生效的规则名通过 X-Rewrite-Rules 响应头返回
+func applyRewriteRules(c *gin.Context, req *types.AnthropicRequest) {
+	rs := rewrite.Current()
+	if rs == nil || len(rs.Rules) == 0 {
+		return
+	}
+	model := req.Model
+	applied := rs.Apply(req, rewrite.RequestInfo{
+		ClientKey: rewriteClientKey(c),
+		Path:      c.Request.URL.Path,
+		Header:    c.Request.Header,
+	})
+	if len(applied) == 0 {
+		return
+	}
+	c.Header("X-Rewrite-Rules", strings.Join(applied, ","))
+	logger.Debug("已应用请求改写规则", addReqFields(c,
+		logger.String("rules", strings.Join(applied, ",")),
+		logger.String("original_model", model),
+		logger.String("model", req.Model),
+		logger.Int("tools", len(req.Tools)),
+		logger.Int("max_tokens", req.MaxTokens))...)
+}
+
+// === 改写规则管理 API ===
+
+// handleGetRewriteRules 获取当前改写规则
+func handleGetRewriteRules(c *gin.Context) {
+	rs := rewrite.Current()
+	if rs == nil {
+		rs = &rewrite.RuleSet{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"rules": rs.Rules,
+		"file":  rewrite.File(),
+	})
+}
+
+// handleUpdateRewriteRules 替换全部改写规则，配置了规则文件时写回文件
+func handleUpdateRewriteRules(c *gin.Context) {
+	var rs rewrite.RuleSet
+	if err := c.ShouldBindJSON(&rs); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求格式错误"})
+		return
+	}
+
+	persisted, err := rewrite.Save(&rs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.Info("更新请求改写规则", logger.Int("rules", len(rs.Rules)), logger.Bool("persisted", persisted), logger.String("ip", c.ClientIP()))
+	c.JSON(http.StatusOK, gin.H{
+		"rules":     rs.Rules,
+		"persisted": persisted,
+	})
+}
+
+// rewriteDryRunRequest 改写规则试运行请求
+type rewriteDryRunRequest struct {
+	Path      string            `json:"path"`       // 默认 /v1/messages，/v1/chat/completions 时 request 为 OpenAI 格式
+	ClientKey string            `json:"client_key"` // 默认 default
+	Headers   map[string]string `json:"headers"`
+	Request   json.RawMessage   `json:"request"`
+	Rules     *rewrite.RuleSet  `json:"rules"` // 为空时使用当前规则
+}
+
+// handleRewriteDryRun 展示请求经改写规则处理后的结果，不发送上游请求
+func handleRewriteDryRun(c *gin.Context) {
+	var req rewriteDryRunRequest
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.Request) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求格式错误"})
+		return
+	}
+	if req.Path == "" {
+		req.Path = "/v1/messages"
+	}
+	if req.ClientKey == "" {
+		req.ClientKey = defaultClientKey
+	}
+
+	rs := req.Rules
+	if rs == nil {
+		rs = rewrite.Current()
+	} else if err := rs.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var anthropicReq types.AnthropicRequest
+	if req.Path == "/v1/chat/completions" {
+		var openaiReq types.OpenAIRequest
+		if err := utils.SafeUnmarshal(req.Request, &openaiReq); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "解析 request 失败: " + err.Error()})
+			return
+		}
+		anthropicReq = converter.ConvertOpenAIToAnthropic(openaiReq)
+	} else if err := utils.SafeUnmarshal(req.Request, &anthropicReq); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "解析 request 失败: " + err.Error()})
+		return
+	}
+
+	header := http.Header{}
+	for name, value := range req.Headers {
+		header.Set(name, value)
+	}
+	applied := rs.Apply(&anthropicReq, rewrite.RequestInfo{
+		ClientKey: req.ClientKey,
+		Path:      req.Path,
+		Header:    header,
+	})
+	if applied == nil {
+		applied = []string{}
+	}
+
+	resp := gin.H{
+		"applied": applied,
+		"request": anthropicReq,
+	}
+	if len(anthropicReq.Messages) > 0 {
+		if cwReq, err := converter.BuildCodeWhispererRequest(anthropicReq, c); err != nil {
+			resp["codewhisperer_error"] = err.Error()
+		} else {
+			resp["codewhisperer"] = cwReq
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
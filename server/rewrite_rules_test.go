@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/auth"
+	"kiro2api/rewrite"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRewriteRules() *rewrite.RuleSet {
+	return &rewrite.RuleSet{Rules: []rewrite.Rule{
+		{
+			Name:    "org-preamble",
+			Actions: rewrite.Actions{PrependSystem: "Org policy."},
+		},
+		{
+			Name:    "no-bash",
+			Match:   rewrite.Match{ClientKeys: []string{"tenant_ci"}, Headers: map[string][]string{"X-Team": {"infra"}}},
+			Actions: rewrite.Actions{RemoveTools: []string{"Bash"}, MaxTokensCap: 1024},
+		},
+	}}
+}
+
+func TestApplyRewriteRules_ClientKeyAndHeader(t *testing.T) {
+	rewrite.Set(testRewriteRules())
+	defer rewrite.Set(nil)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	c.Request.Header.Set("X-Team", "infra")
+	c.Set("tenantCredential", auth.TenantCredential{TenantID: "ci"})
+
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 8192,
+		Tools:     []types.AnthropicTool{{Name: "Bash"}, {Name: "Read"}},
+		Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "hi"}},
+	}
+	applyRewriteRules(c, &req)
+
+	assert.Equal(t, "org-preamble,no-bash", w.Header().Get("X-Rewrite-Rules"))
+	require.Len(t, req.Tools, 1)
+	assert.Equal(t, "Read", req.Tools[0].Name)
+	assert.Equal(t, 1024, req.MaxTokens)
+	assert.Equal(t, "Org policy.", req.System[0].Text)
+
+	// 服务端 Token 池请求的客户端标识为 default
+	c.Set("tenantCredential", nil)
+	assert.Equal(t, defaultClientKey, rewriteClientKey(c))
+}
+
+func TestHandleRewriteDryRun(t *testing.T) {
+	rewrite.Set(testRewriteRules())
+	defer rewrite.Set(nil)
+
+	body := `{
+		"client_key": "tenant_ci",
+		"headers": {"x-team": "infra"},
+		"request": {
+			"model": "claude-sonnet-4-20250514",
+			"max_tokens": 8192,
+			"tools": [{"name": "Bash", "input_schema": {"type": "object"}}],
+			"messages": [{"role": "user", "content": "hi"}]
+		}
+	}`
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/admin/rules/dry-run", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handleRewriteDryRun(c)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Applied       []string                   `json:"applied"`
+		Request       types.AnthropicRequest     `json:"request"`
+		CodeWhisperer types.CodeWhispererRequest `json:"codewhisperer"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"org-preamble", "no-bash"}, resp.Applied)
+	assert.Empty(t, resp.Request.Tools)
+	assert.Equal(t, 1024, resp.Request.MaxTokens)
+	assert.Empty(t, resp.CodeWhisperer.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools)
+	assert.Equal(t, "hi", resp.CodeWhisperer.ConversationState.CurrentMessage.UserInputMessage.Content)
+}
+
+func TestHandleRewriteDryRun_InlineRulesAndOpenAI(t *testing.T) {
+	body := `{
+		"path": "/v1/chat/completions",
+		"rules": {"rules": [{"name": "force-model", "match": {"paths": ["/v1/chat/*"]}, "actions": {"model": "claude-sonnet-4-20250514"}}]},
+		"request": {"model": "claude-3-7-sonnet-20250219", "messages": [{"role": "user", "content": "hi"}]}
+	}`
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/admin/rules/dry-run", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handleRewriteDryRun(c)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var resp struct {
+		Applied []string               `json:"applied"`
+		Request types.AnthropicRequest `json:"request"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, []string{"force-model"}, resp.Applied)
+	assert.Equal(t, "claude-sonnet-4-20250514", resp.Request.Model)
+
+	// 无效的内联规则返回 400
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/admin/rules/dry-run",
+		strings.NewReader(`{"rules": {"rules": [{"name": ""}]}, "request": {"messages": []}}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	handleRewriteDryRun(c)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -42,6 +42,8 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 	})
 	// 只对 /v1 开头的端点进行认证
 	r.Use(PathBasedAuthMiddleware(authToken, []string{"/v1"}))
+	// 按请求ID或抽样捕获上游原始响应，用于问题复现
+	r.Use(CaptureMiddleware())
 
 	// 静态资源服务 - 前后端完全分离
 	r.Static("/static", "./static")
@@ -58,6 +60,7 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 	// API端点 - 纯数据服务
 	r.GET("/api/tokens", handleTokenPoolAPI)
 	r.GET("/api/anti-ban/status", handleAntiBanStatus)
+	r.GET("/api/stream/stats", handleStreamStats)
 
 	// GET /v1/models 端点
 	r.GET("/v1/models", func(c *gin.Context) {
@@ -85,108 +88,20 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 	})
 
 	r.POST("/v1/messages", func(c *gin.Context) {
-		// 使用RequestContext统一处理token获取和请求体读取
-		reqCtx := &RequestContext{
-			GinContext:  c,
-			AuthService: authService,
-			RequestType: "Anthropic",
-		}
-
-		tokenInfo, body, err := reqCtx.GetTokenAndBody()
-		if err != nil {
-			return // 错误已在GetTokenAndBody中处理
-		}
-
-		// 先解析为通用map以便处理工具格式
-		var rawReq map[string]any
-		if err := utils.SafeUnmarshal(body, &rawReq); err != nil {
-			logger.Error("解析请求体失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
-			return
-		}
-
-		// 标准化工具格式处理
-		if tools, exists := rawReq["tools"]; exists && tools != nil {
-			if toolsArray, ok := tools.([]any); ok {
-				normalizedTools := make([]map[string]any, 0, len(toolsArray))
-				for _, tool := range toolsArray {
-					if toolMap, ok := tool.(map[string]any); ok {
-						// 检查是否是简化的工具格式（直接包含name, description, input_schema）
-						if name, hasName := toolMap["name"]; hasName {
-							if description, hasDesc := toolMap["description"]; hasDesc {
-								if inputSchema, hasSchema := toolMap["input_schema"]; hasSchema {
-									// 转换为标准Anthropic工具格式
-									normalizedTool := map[string]any{
-										"name":         name,
-										"description":  description,
-										"input_schema": inputSchema,
-									}
-									normalizedTools = append(normalizedTools, normalizedTool)
-									continue
-								}
-							}
-						}
-						// 如果不是简化格式，保持原样
-						normalizedTools = append(normalizedTools, toolMap)
-					}
-				}
-				rawReq["tools"] = normalizedTools
-			}
-		}
-
-		// 重新序列化并解析为AnthropicRequest
-		normalizedBody, err := utils.SafeMarshal(rawReq)
-		if err != nil {
-			logger.Error("重新序列化请求失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "处理请求格式失败: %v", err)
-			return
-		}
-
-		var anthropicReq types.AnthropicRequest
-		if err := utils.SafeUnmarshal(normalizedBody, &anthropicReq); err != nil {
-			logger.Error("解析标准化请求体失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
-			return
-		}
-
-		// 验证请求的有效性
-		if len(anthropicReq.Messages) == 0 {
-			logger.Error("请求中没有消息")
-			respondError(c, http.StatusBadRequest, "%s", "messages 数组不能为空")
-			return
-		}
-
-		// 验证最后一条消息有有效内容
-		lastMsg := anthropicReq.Messages[len(anthropicReq.Messages)-1]
-		content, err := utils.GetMessageContent(lastMsg.Content)
-		if err != nil {
-			logger.Error("获取消息内容失败",
-				logger.Err(err),
-				logger.String("raw_content", fmt.Sprintf("%v", lastMsg.Content)))
-			respondError(c, http.StatusBadRequest, "获取消息内容失败: %v", err)
-			return
-		}
-
-		trimmedContent := strings.TrimSpace(content)
-		if trimmedContent == "" || trimmedContent == "answer for user question" {
-			logger.Error("消息内容为空或无效",
-				logger.String("content", content),
-				logger.String("trimmed_content", trimmedContent))
-			respondError(c, http.StatusBadRequest, "%s", "消息内容不能为空")
-			return
-		}
-
-		if anthropicReq.Stream {
-			handleStreamRequest(c, anthropicReq, tokenInfo)
-			return
-		}
-
-		handleNonStreamRequest(c, anthropicReq, tokenInfo)
+		handleMessages(c, authService)
 	})
 
 	// Token计数端点
 	r.POST("/v1/messages/count_tokens", handleCountTokens)
 
+	// 消息批次（本地模拟 Message Batches API）
+	r.POST("/v1/messages/batches", handleCreateBatch)
+	r.GET("/v1/messages/batches", handleListBatches)
+	r.GET("/v1/messages/batches/:id", handleGetBatch)
+	r.POST("/v1/messages/batches/:id/cancel", handleCancelBatch)
+	r.GET("/v1/messages/batches/:id/results", handleBatchResults)
+	r.DELETE("/v1/messages/batches/:id", handleDeleteBatch)
+
 	// 新增：OpenAI兼容的 /v1/chat/completions 端点
 	r.POST("/v1/chat/completions", func(c *gin.Context) {
 		// 使用RequestContext统一处理token获取和请求体读取
@@ -220,6 +135,13 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 
 		// 转换为Anthropic格式
 		anthropicReq := converter.ConvertOpenAIToAnthropic(openaiReq)
+		applyRewriteRules(c, &anthropicReq)
+
+		// response_format=json_schema：取出工具入参校验后作为文本返回
+		if so := converter.ResolveStructuredOutput(openaiReq.ResponseFormat); so != nil {
+			handleStructuredOutputRequest(c, so, anthropicReq, tokenInfo)
+			return
+		}
 
 		if anthropicReq.Stream {
 			handleOpenAIStreamRequest(c, anthropicReq, tokenInfo)
@@ -246,6 +168,7 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 	logger.Info("  GET  /v1/models                 - 模型列表")
 	logger.Info("  POST /v1/messages               - Anthropic API代理")
 	logger.Info("  POST /v1/messages/count_tokens  - Token计数接口")
+	logger.Info("  POST /v1/messages/batches       - 消息批次（本地模拟）")
 	logger.Info("  POST /v1/chat/completions       - OpenAI API代理")
 	logger.Info("按Ctrl+C停止服务器")
 
@@ -263,11 +186,131 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 	}
 }
 
+// tokenProvider 请求处理所需的 Token 来源（与 RequestContext.AuthService 一致）
+type tokenProvider interface {
+	GetToken() (types.TokenInfo, error)
+}
+
+// handleMessages 处理 /v1/messages 请求（消息批次的单条请求复用该处理流程）
+func handleMessages(c *gin.Context, authService tokenProvider) {
+	// 使用RequestContext统一处理token获取和请求体读取
+	reqCtx := &RequestContext{
+		GinContext:  c,
+		AuthService: authService,
+		RequestType: "Anthropic",
+	}
+
+	// 先读取请求体，响应缓存命中时无需获取 Token
+	body, err := reqCtx.ReadBody()
+	if err != nil {
+		return // 错误已在ReadBody中处理
+	}
+
+	// 先解析为通用map以便处理工具格式
+	var rawReq map[string]any
+	if err := utils.SafeUnmarshal(body, &rawReq); err != nil {
+		logger.Error("解析请求体失败", logger.Err(err))
+		respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+		return
+	}
+
+	// 标准化工具格式处理
+	if tools, exists := rawReq["tools"]; exists && tools != nil {
+		if toolsArray, ok := tools.([]any); ok {
+			normalizedTools := make([]map[string]any, 0, len(toolsArray))
+			for _, tool := range toolsArray {
+				if toolMap, ok := tool.(map[string]any); ok {
+					// 检查是否是简化的工具格式（直接包含name, description, input_schema）
+					if name, hasName := toolMap["name"]; hasName {
+						if description, hasDesc := toolMap["description"]; hasDesc {
+							if inputSchema, hasSchema := toolMap["input_schema"]; hasSchema {
+								// 转换为标准Anthropic工具格式
+								normalizedTool := map[string]any{
+									"name":         name,
+									"description":  description,
+									"input_schema": inputSchema,
+								}
+								normalizedTools = append(normalizedTools, normalizedTool)
+								continue
+							}
+						}
+					}
+					// 如果不是简化格式，保持原样
+					normalizedTools = append(normalizedTools, toolMap)
+				}
+			}
+			rawReq["tools"] = normalizedTools
+		}
+	}
+
+	// 重新序列化并解析为AnthropicRequest
+	normalizedBody, err := utils.SafeMarshal(rawReq)
+	if err != nil {
+		logger.Error("重新序列化请求失败", logger.Err(err))
+		respondError(c, http.StatusBadRequest, "处理请求格式失败: %v", err)
+		return
+	}
+
+	var anthropicReq types.AnthropicRequest
+	if err := utils.SafeUnmarshal(normalizedBody, &anthropicReq); err != nil {
+		logger.Error("解析标准化请求体失败", logger.Err(err))
+		respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+		return
+	}
+
+	// 验证请求的有效性
+	if len(anthropicReq.Messages) == 0 {
+		logger.Error("请求中没有消息")
+		respondError(c, http.StatusBadRequest, "%s", "messages 数组不能为空")
+		return
+	}
+
+	// 验证最后一条消息有有效内容
+	lastMsg := anthropicReq.Messages[len(anthropicReq.Messages)-1]
+	content, err := utils.GetMessageContent(lastMsg.Content)
+	if err != nil {
+		logger.Error("获取消息内容失败",
+			logger.Err(err),
+			logger.String("raw_content", fmt.Sprintf("%v", lastMsg.Content)))
+		respondError(c, http.StatusBadRequest, "获取消息内容失败: %v", err)
+		return
+	}
+
+	trimmedContent := strings.TrimSpace(content)
+	if trimmedContent == "" || trimmedContent == "answer for user question" {
+		logger.Error("消息内容为空或无效",
+			logger.String("content", content),
+			logger.String("trimmed_content", trimmedContent))
+		respondError(c, http.StatusBadRequest, "%s", "消息内容不能为空")
+		return
+	}
+
+	// 运维方定义的改写规则（系统提示注入、工具过滤、模型覆盖等）
+	applyRewriteRules(c, &anthropicReq)
+
+	// 命中响应缓存时直接返回，不消耗账号额度
+	if serveCachedResponse(c, anthropicReq) {
+		return
+	}
+
+	tokenInfo, err := reqCtx.AcquireToken()
+	if err != nil {
+		return // 错误已在AcquireToken中处理
+	}
+
+	if anthropicReq.Stream {
+		handleStreamRequest(c, anthropicReq, tokenInfo)
+		return
+	}
+
+	handleNonStreamRequest(c, anthropicReq, tokenInfo)
+}
+
 // corsMiddleware CORS中间件
 func corsMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
 		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key")
 
 		if c.Request.Method == "OPTIONS" {
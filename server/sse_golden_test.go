@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/ssevalidator"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "重新生成 testdata/sse 下的 golden 文件")
+
+// sseFixture 上游事件流样本（testdata/sse/<name>.json）
+type sseFixture struct {
+	Thinking         bool   `json:"thinking"`
+	CRCMode          string `json:"crc_mode"`
+	CorruptLastFrame bool   `json:"corrupt_last_frame"`
+	Frames           []struct {
+		Event   string          `json:"event"`
+		Payload json.RawMessage `json:"payload"`
+	} `json:"frames"`
+}
+
+// 代理签名含随机密钥派生的 HMAC，比较前归一化
+var proxySignaturePattern = regexp.MustCompile(`k2a1\.[A-Za-z0-9_-]+`)
+
+func TestSSEGoldenCorpus(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "sse", "*.json"))
+	require.NoError(t, err)
+	require.NotEmpty(t, fixtures)
+
+	for _, path := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		t.Run(name, func(t *testing.T) {
+			raw, err := os.ReadFile(path)
+			require.NoError(t, err)
+			var fixture sseFixture
+			require.NoError(t, json.Unmarshal(raw, &fixture))
+
+			body := proxySignaturePattern.ReplaceAllString(renderFixture(t, fixture), "k2a1.SIGNATURE")
+
+			events, err := ssevalidator.ParseSSE(body)
+			require.NoError(t, err)
+			for _, v := range ssevalidator.ValidateEvents(events) {
+				t.Errorf("协议违规: %v", v)
+			}
+
+			goldenPath := filepath.Join("testdata", "sse", name+".golden.sse")
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(goldenPath, []byte(body), 0o644))
+			}
+			golden, err := os.ReadFile(goldenPath)
+			require.NoError(t, err, "缺少 golden 文件，使用 -update 生成")
+			assert.Equal(t, string(golden), body)
+		})
+	}
+}
+
+// renderFixture 将样本送入流式转换路径，返回下发的 SSE 文本
+func renderFixture(t *testing.T, fixture sseFixture) string {
+	t.Helper()
+
+	oldCRC, oldValidation := config.EventStreamCRCMode, config.SSEValidation
+	config.SSEValidation = "strict"
+	if fixture.CRCMode != "" {
+		config.EventStreamCRCMode = fixture.CRCMode
+	}
+	defer func() { config.EventStreamCRCMode, config.SSEValidation = oldCRC, oldValidation }()
+
+	var stream []byte
+	for i, frame := range fixture.Frames {
+		data := buildTestEventStream([2]string{frame.Event, string(frame.Payload)})
+		if fixture.CorruptLastFrame && i == len(fixture.Frames)-1 {
+			data[len(data)-5] ^= 0xff // 破坏负载，使消息 CRC 校验失败
+		}
+		stream = append(stream, data...)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req := types.AnthropicRequest{Model: "claude-sonnet-4-20250514", MaxTokens: 1024, Stream: true}
+	if fixture.Thinking {
+		req.Thinking = &types.Thinking{Type: "enabled", BudgetTokens: 1024}
+	}
+
+	streamUpstreamResponse(c, req, &types.TokenWithUsage{}, &AnthropicStreamSender{}, createAnthropicStreamEvents, "msg_test", 10, strings.NewReader(string(stream)))
+	return w.Body.String()
+}
+
+func TestValidatingSender_StrictTerminatesOnViolation(t *testing.T) {
+	old := config.SSEValidation
+	config.SSEValidation = "strict"
+	defer func() { config.SSEValidation = old }()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	sender := wrapValidatingSender(&AnthropicStreamSender{})
+	require.IsType(t, &validatingSender{}, sender)
+
+	for _, event := range createAnthropicStreamEvents("msg_test", 10, "claude-sonnet-4-20250514") {
+		require.NoError(t, sender.SendEvent(c, event))
+	}
+	// 索引跳跃的块不下发，改为发送一个 api_error 事件并结束流
+	err := sender.SendEvent(c, map[string]any{"type": "content_block_start", "index": 3, "content_block": map[string]any{"type": "text", "text": ""}})
+	require.ErrorIs(t, err, errSSEProtocolViolation)
+	// 之后的事件与错误不再转发
+	err = sender.SendEvent(c, map[string]any{"type": "content_block_delta", "index": 3, "delta": map[string]any{"type": "text_delta", "text": "x"}})
+	require.ErrorIs(t, err, errSSEProtocolViolation)
+	require.NoError(t, sender.SendError(c, "boom", nil))
+
+	assert.NotContains(t, w.Body.String(), "event: content_block_start")
+	assert.NotContains(t, w.Body.String(), "event: content_block_delta")
+	events, err := ssevalidator.ParseSSE(w.Body.String())
+	require.NoError(t, err)
+	assert.Empty(t, ssevalidator.ValidateEvents(events))
+	last := events[len(events)-1]
+	assert.Equal(t, "error", last["type"])
+	assert.Equal(t, "api_error", last["error"].(map[string]any)["type"])
+	assert.Equal(t, 1, strings.Count(w.Body.String(), "event: error"))
+
+	config.SSEValidation = "off"
+	assert.IsType(t, &AnthropicStreamSender{}, wrapValidatingSender(&AnthropicStreamSender{}))
+	assert.IsType(t, &OpenAIStreamSender{}, wrapValidatingSender(&OpenAIStreamSender{}))
+}
@@ -225,8 +225,11 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 		blockType := "text" // 默认为文本块
 		if delta, ok := eventData["delta"].(map[string]any); ok {
 			if deltaType, ok := delta["type"].(string); ok {
-				if deltaType == "input_json_delta" {
+				switch deltaType {
+				case "input_json_delta":
 					blockType = "tool_use"
+				case "thinking_delta", "signature_delta":
+					blockType = "thinking"
 				}
 			}
 		}
@@ -243,6 +246,8 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 		switch blockType {
 		case "text":
 			startEvent["content_block"].(map[string]any)["text"] = ""
+		case "thinking":
+			startEvent["content_block"].(map[string]any)["thinking"] = ""
 		case "tool_use":
 			// 为工具使用块添加必要字段
 			startEvent["content_block"].(map[string]any)["id"] = fmt.Sprintf("tooluse_auto_%d", index)
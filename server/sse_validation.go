@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/ssevalidator"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errSSEProtocolViolation strict 模式下事件违反流式协议，流已以 error 事件终止
+var errSSEProtocolViolation = errors.New("SSE事件违反流式协议")
+
+// validatingSender 在发送前按 Anthropic 流式协议校验事件（SSE_VALIDATION）
+type validatingSender struct {
+	inner     StreamEventSender
+	validator *ssevalidator.Validator
+	strict    bool
+	aborted   bool // strict 模式已发送 error 事件，之后的事件不再转发
+}
+
+// wrapValidatingSender 按配置为 Anthropic 发送器包装协议校验
+func wrapValidatingSender(sender StreamEventSender) StreamEventSender {
+	switch sender.(type) {
+	case *AnthropicStreamSender, *cachingStreamSender:
+	default:
+		return sender
+	}
+	switch config.SSEValidation {
+	case "log":
+		return &validatingSender{inner: sender, validator: ssevalidator.New()}
+	case "strict":
+		return &validatingSender{inner: sender, validator: ssevalidator.New(), strict: true}
+	default:
+		return sender
+	}
+}
+
+func (s *validatingSender) SendEvent(c *gin.Context, data any) error {
+	if s.aborted {
+		return errSSEProtocolViolation
+	}
+	if err := s.validator.Check(toEventMap(data)); err != nil {
+		if s.strict {
+			// 丢弃单个事件会让后续事件继续出错，直接以 error 事件结束流
+			logger.Error("SSE事件违反流式协议，终止流", addReqFields(c, logger.Err(err))...)
+			s.aborted = true
+			errorEvent := map[string]any{
+				"type": "error",
+				"error": map[string]any{
+					"type":    "api_error",
+					"message": "响应事件违反流式协议: " + err.Error(),
+				},
+			}
+			_ = s.validator.Check(errorEvent)
+			if sendErr := s.inner.SendEvent(c, errorEvent); sendErr != nil {
+				return sendErr
+			}
+			return errSSEProtocolViolation
+		}
+		logger.Warn("SSE事件违反流式协议", addReqFields(c, logger.Err(err))...)
+	}
+	return s.inner.SendEvent(c, data)
+}
+
+func (s *validatingSender) SendError(c *gin.Context, message string, err error) error {
+	if s.aborted {
+		return nil // 已发送过 error 事件
+	}
+	// error 事件终止流，记录到校验器以便 finish 判断完整性
+	_ = s.validator.Check(map[string]any{"type": "error", "error": map[string]any{"type": "overloaded_error"}})
+	return s.inner.SendError(c, message, err)
+}
+
+// finish 流结束时检查事件序列是否完整
+func (s *validatingSender) finish(c *gin.Context) {
+	if c.Request != nil && c.Request.Context().Err() != nil {
+		return // 客户端断开，流必然不完整
+	}
+	if err := s.validator.Finish(); err != nil {
+		logger.Warn("SSE事件流未完整结束", addReqFields(c, logger.Err(err))...)
+	}
+}
+
+// toEventMap 将事件统一为 map 形式供校验
+func toEventMap(data any) map[string]any {
+	if m, ok := data.(map[string]any); ok {
+		return m
+	}
+	var m map[string]any
+	if raw, err := json.Marshal(data); err == nil {
+		_ = json.Unmarshal(raw, &m)
+	}
+	return m
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// streamErrorOutcome 响应头发出后上游异常的处理结果
+type streamErrorOutcome struct {
+	MaxTokens    bool   // 按 max_tokens 正常结束流
+	ErrorType    string // Anthropic error.type
+	Message      string
+	UpstreamType string // 归一化后的上游异常类型
+}
+
+// errUpstreamStreamException 流中上游异常已按映射结果下发，流已结束
+type errUpstreamStreamException struct {
+	outcome streamErrorOutcome
+}
+
+func (e *errUpstreamStreamException) Error() string {
+	return fmt.Sprintf("上游流中异常: %s (%s)", e.outcome.UpstreamType, e.outcome.Message)
+}
+
+// streamExceptionMappings 上游异常类型到 Anthropic 错误类型的映射（按子串匹配，先匹配先生效）
+var streamExceptionMappings = []struct {
+	patterns  []string
+	errorType string
+}{
+	{[]string{"Throttling", "TooManyRequests", "ServiceQuotaExceeded", "ServiceUnavailable", "ModelStreamErrorException"}, "overloaded_error"},
+	{[]string{"Validation", "BadRequest", "InvalidRequest", "SerializationException"}, "invalid_request_error"},
+	{[]string{"AccessDenied", "Unauthorized", "ExpiredToken"}, "permission_error"},
+}
+
+// 各错误类型的默认提示（上游未给出 message 时使用）
+var streamErrorDefaultMessages = map[string]string{
+	"overloaded_error":      "上游服务繁忙，请稍后重试",
+	"invalid_request_error": "上游拒绝了请求参数",
+	"permission_error":      "上游拒绝访问",
+	"api_error":             "上游服务内部错误",
+}
+
+// mapStreamException 将上游 exception/error 消息映射为处理结果
+// 内容长度超限映射为 max_tokens 结束，其余映射为带类型的 error 事件
+func mapStreamException(dataMap map[string]any) streamErrorOutcome {
+	var outcome streamErrorOutcome
+	var rawType, reason string
+	if dataMap["type"] == "error" {
+		rawType, _ = dataMap["error_code"].(string)
+		outcome.Message, _ = dataMap["error_message"].(string)
+	} else {
+		rawType, _ = dataMap["exception_type"].(string)
+		outcome.Message, _ = dataMap["exception_message"].(string)
+	}
+	if raw, ok := dataMap["raw_data"].(map[string]any); ok {
+		reason, _ = raw["reason"].(string)
+	}
+
+	// AWS __type 形如 "com.amazon.aws.codewhisperer#ThrottlingException"
+	outcome.UpstreamType = rawType
+	if i := strings.LastIndexAny(rawType, "#:"); i >= 0 {
+		outcome.UpstreamType = rawType[i+1:]
+	}
+
+	if outcome.UpstreamType == "ContentLengthExceededException" ||
+		strings.Contains(rawType, "CONTENT_LENGTH_EXCEEDS") ||
+		strings.Contains(reason, "CONTENT_LENGTH_EXCEEDS") {
+		outcome.MaxTokens = true
+		return outcome
+	}
+
+	outcome.ErrorType = matchStreamErrorType(outcome.UpstreamType)
+	if outcome.Message == "" {
+		outcome.Message = streamErrorDefaultMessages[outcome.ErrorType]
+	}
+	return outcome
+}
+
+// matchStreamErrorType 按映射表匹配错误类型，未知异常视为上游内部错误
+func matchStreamErrorType(upstreamType string) string {
+	for _, m := range streamExceptionMappings {
+		for _, p := range m.patterns {
+			if strings.Contains(upstreamType, p) {
+				return m.errorType
+			}
+		}
+	}
+	return "api_error"
+}
+
+// anthropicEvent Anthropic SSE error 事件
+func (o streamErrorOutcome) anthropicEvent() map[string]any {
+	return map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    o.ErrorType,
+			"message": o.Message,
+		},
+	}
+}
+
+// openAIError OpenAI 流式错误的 type 与 code
+func (o streamErrorOutcome) openAIError() (string, string) {
+	switch o.ErrorType {
+	case "overloaded_error":
+		return "server_error", "overloaded"
+	case "invalid_request_error":
+		return "invalid_request_error", "invalid_request"
+	case "permission_error":
+		return "invalid_request_error", "permission_denied"
+	default:
+		return "server_error", "internal_error"
+	}
+}
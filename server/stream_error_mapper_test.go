@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/ssevalidator"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildTestExceptionFrame 构造上游 exception 帧
+func buildTestExceptionFrame(exceptionType, payload string) []byte {
+	return buildTestFrame([][2]string{{":message-type", "exception"}, {":exception-type", exceptionType}, {":content-type", "application/json"}}, payload)
+}
+
+// midStreamExceptionCases 每种上游异常及其期望映射
+var midStreamExceptionCases = []struct {
+	name          string
+	frame         []byte
+	wantMaxTokens bool
+	wantErrorType string
+	wantOpenAI    [2]string // type, code
+	wantMessage   string
+}{
+	{
+		name:          "限流",
+		frame:         buildTestExceptionFrame("ThrottlingException", `{"message":"Rate exceeded"}`),
+		wantErrorType: "overloaded_error",
+		wantOpenAI:    [2]string{"server_error", "overloaded"},
+		wantMessage:   "Rate exceeded",
+	},
+	{
+		name:          "参数校验",
+		frame:         buildTestExceptionFrame("ValidationException", `{"__type":"com.amazon.aws.codewhisperer#ValidationException","message":"Improperly formed request"}`),
+		wantErrorType: "invalid_request_error",
+		wantOpenAI:    [2]string{"invalid_request_error", "invalid_request"},
+		wantMessage:   "Improperly formed request",
+	},
+	{
+		name:          "内容长度超限",
+		frame:         buildTestExceptionFrame("ContentLengthExceededException", `{"message":"Response too long"}`),
+		wantMaxTokens: true,
+	},
+	{
+		name:          "内容长度超限（reason）",
+		frame:         buildTestExceptionFrame("ValidationException", `{"message":"Input is too long","reason":"CONTENT_LENGTH_EXCEEDS_THRESHOLD"}`),
+		wantMaxTokens: true,
+	},
+	{
+		name:          "内部错误",
+		frame:         buildTestExceptionFrame("InternalServerException", `{}`),
+		wantErrorType: "api_error",
+		wantOpenAI:    [2]string{"server_error", "internal_error"},
+		wantMessage:   "上游服务内部错误",
+	},
+	{
+		name:          "error 消息",
+		frame:         buildTestFrame([][2]string{{":message-type", "error"}, {":error-code", "ServiceUnavailableException"}, {":error-message", "try again"}}, ""),
+		wantErrorType: "overloaded_error",
+		wantOpenAI:    [2]string{"server_error", "overloaded"},
+		wantMessage:   "try again",
+	},
+}
+
+func midStreamUpstream(exceptionFrame []byte) []byte {
+	var stream []byte
+	stream = append(stream, buildTestEventStream([2]string{"assistantResponseEvent", `{"content":"前半段"}`})...)
+	stream = append(stream, exceptionFrame...)
+	// 异常之后的数据不应再下发
+	stream = append(stream, buildTestEventStream([2]string{"assistantResponseEvent", `{"content":"异常后的内容"}`})...)
+	return stream
+}
+
+func TestStreamUpstreamResponse_MidStreamException(t *testing.T) {
+	for _, tt := range midStreamExceptionCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			req := types.AnthropicRequest{Model: "claude-sonnet-4-20250514", MaxTokens: 100, Stream: true}
+
+			streamUpstreamResponse(c, req, &types.TokenWithUsage{}, &AnthropicStreamSender{}, createAnthropicStreamEvents, "msg_test", 10, bytes.NewReader(midStreamUpstream(tt.frame)))
+
+			events, err := ssevalidator.ParseSSE(w.Body.String())
+			require.NoError(t, err)
+			assert.Empty(t, ssevalidator.ValidateEvents(events))
+			assert.Contains(t, w.Body.String(), "前半段")
+			assert.NotContains(t, w.Body.String(), "异常后的内容")
+			assert.NotContains(t, w.Body.String(), "exception")
+
+			last := events[len(events)-1]
+			if tt.wantMaxTokens {
+				assert.Equal(t, "message_stop", last["type"])
+				delta := events[len(events)-2]["delta"].(map[string]any)
+				assert.Equal(t, "max_tokens", delta["stop_reason"])
+				return
+			}
+			require.Equal(t, "error", last["type"])
+			errObj := last["error"].(map[string]any)
+			assert.Equal(t, tt.wantErrorType, errObj["type"])
+			assert.Equal(t, tt.wantMessage, errObj["message"])
+		})
+	}
+}
+
+func TestStreamOpenAIResponse_MidStreamException(t *testing.T) {
+	for _, tt := range midStreamExceptionCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			req := types.AnthropicRequest{Model: "claude-sonnet-4-20250514", MaxTokens: 100, Stream: true}
+
+			streamOpenAIResponse(c, req, "chatcmpl-test", bytes.NewReader(midStreamUpstream(tt.frame)))
+
+			body := w.Body.String()
+			assert.Contains(t, body, "前半段")
+			assert.NotContains(t, body, "异常后的内容")
+
+			chunks := strings.Split(strings.TrimSpace(body), "\n\n")
+			if tt.wantMaxTokens {
+				assert.Equal(t, "data: [DONE]", chunks[len(chunks)-1])
+				var final map[string]any
+				require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(chunks[len(chunks)-2], "data: ")), &final))
+				choice := final["choices"].([]any)[0].(map[string]any)
+				assert.Equal(t, "length", choice["finish_reason"])
+				return
+			}
+			assert.NotContains(t, body, "[DONE]")
+			var errChunk map[string]any
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(chunks[len(chunks)-1], "data: ")), &errChunk))
+			errObj := errChunk["error"].(map[string]any)
+			assert.Equal(t, tt.wantOpenAI[0], errObj["type"])
+			assert.Equal(t, tt.wantOpenAI[1], errObj["code"])
+			assert.Equal(t, tt.wantMessage, errObj["message"])
+		})
+	}
+}
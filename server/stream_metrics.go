@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamMetrics 流式响应结果统计
+type StreamMetrics struct {
+	started         atomic.Int64
+	completed       atomic.Int64
+	clientCancelled atomic.Int64
+	idleTimeouts    atomic.Int64
+	corrupted       atomic.Int64
+	upstreamErrors  atomic.Int64
+
+	// 客户端断开前已下发的数据量
+	cancelledBytes  atomic.Int64
+	cancelledEvents atomic.Int64
+}
+
+var (
+	streamMetrics     *StreamMetrics
+	streamMetricsOnce sync.Once
+)
+
+// GetStreamMetrics 获取全局流式统计
+func GetStreamMetrics() *StreamMetrics {
+	streamMetricsOnce.Do(func() {
+		streamMetrics = &StreamMetrics{}
+	})
+	return streamMetrics
+}
+
+// RecordStart 记录流开始
+func (m *StreamMetrics) RecordStart() {
+	m.started.Add(1)
+}
+
+// RecordCompleted 记录流正常结束
+func (m *StreamMetrics) RecordCompleted() {
+	m.completed.Add(1)
+}
+
+// RecordClientCancel 记录客户端断开，bytes/events 为断开前已下发的数据量
+func (m *StreamMetrics) RecordClientCancel(bytes, events int) {
+	m.clientCancelled.Add(1)
+	m.cancelledBytes.Add(int64(bytes))
+	m.cancelledEvents.Add(int64(events))
+}
+
+// RecordIdleTimeout 记录上游空闲超时
+func (m *StreamMetrics) RecordIdleTimeout() {
+	m.idleTimeouts.Add(1)
+}
+
+// RecordCorrupted 记录上游事件流校验失败
+func (m *StreamMetrics) RecordCorrupted() {
+	m.corrupted.Add(1)
+}
+
+// RecordUpstreamError 记录读取上游时的其他错误
+func (m *StreamMetrics) RecordUpstreamError() {
+	m.upstreamErrors.Add(1)
+}
+
+// GetStats 获取统计信息
+func (m *StreamMetrics) GetStats() map[string]any {
+	return map[string]any{
+		"started":          m.started.Load(),
+		"completed":        m.completed.Load(),
+		"client_cancelled": m.clientCancelled.Load(),
+		"idle_timeouts":    m.idleTimeouts.Load(),
+		"corrupted":        m.corrupted.Load(),
+		"upstream_errors":  m.upstreamErrors.Load(),
+		"cancelled_bytes":  m.cancelledBytes.Load(),
+		"cancelled_events": m.cancelledEvents.Load(),
+	}
+}
+
+// handleStreamStats 流式响应统计接口
+func handleStreamStats(c *gin.Context) {
+	c.JSON(http.StatusOK, GetStreamMetrics().GetStats())
+}
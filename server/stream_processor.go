@@ -1,10 +1,11 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"strings"
 
 	"kiro2api/config"
 	"kiro2api/logger"
@@ -47,6 +48,15 @@ type StreamProcessorContext struct {
 
 	// Thinking 状态机（借鉴 kiro.rs）
 	thinkingContext *parser.ThinkingStreamContext
+
+	// 上游异常映射出的 stop_reason（如内容长度超限时为 max_tokens）
+	forcedStopReason string
+
+	// web_search 服务端工具模拟（未启用时为 nil）
+	webSearch *webSearchSession
+
+	// tool_choice 执行（无需执行时为 nil）
+	toolChoice *toolChoiceGuard
 }
 
 // NewStreamProcessorContext 创建流处理上下文
@@ -58,21 +68,22 @@ func NewStreamProcessorContext(
 	messageID string,
 	inputTokens int,
 ) *StreamProcessorContext {
-	// 判断是否启用 thinking（借鉴 kiro.rs）
-	thinkingEnabled := req.Thinking != nil && req.Thinking.Type == "enabled"
-
-	// 创建 thinking 上下文
-	thinkingContext := parser.NewThinkingStreamContext(thinkingEnabled)
+	thinkingContext := newThinkingContext(req)
 
 	// 创建 parser 并设置 thinking 上下文
-	compliantParser := parser.NewCompliantEventStreamParser()
+	compliantParser := newRequestParser(req)
 	compliantParser.SetThinkingContext(thinkingContext)
 
+	webSearch, _ := c.Get(webSearchSessionKey)
+	ws, _ := webSearch.(*webSearchSession)
+	toolChoice, _ := c.Get(toolChoiceGuardKey)
+	guard, _ := toolChoice.(*toolChoiceGuard)
+
 	return &StreamProcessorContext{
 		c:                     c,
 		req:                   req,
 		token:                 token,
-		sender:                sender,
+		sender:                wrapValidatingSender(sender),
 		messageID:             messageID,
 		inputTokens:           inputTokens,
 		sseStateManager:       NewSSEStateManager(false),
@@ -82,12 +93,18 @@ func NewStreamProcessorContext(
 		toolUseIdByBlockIndex: make(map[int]string),
 		completedToolUseIds:   make(map[string]bool),
 		thinkingContext:       thinkingContext,
+		webSearch:             ws,
+		toolChoice:            guard,
 	}
 }
 
 // Cleanup 清理资源
 // 完整清理所有状态，防止内存泄漏
 func (ctx *StreamProcessorContext) Cleanup() {
+	if vs, ok := ctx.sender.(*validatingSender); ok {
+		vs.finish(ctx.c)
+	}
+
 	// 重置解析器状态
 	if ctx.compliantParser != nil {
 		ctx.compliantParser.Reset()
@@ -122,6 +139,11 @@ func (ctx *StreamProcessorContext) Cleanup() {
 	}
 }
 
+// sendPing 等待上游数据期间发送心跳
+func (ctx *StreamProcessorContext) sendPing() error {
+	return ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, map[string]any{"type": "ping"})
+}
+
 // initializeSSEResponse 初始化SSE响应头
 func initializeSSEResponse(c *gin.Context) error {
 	// 设置SSE响应头，禁用反向代理缓冲
@@ -220,8 +242,10 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 	if flushEvents := ctx.compliantParser.FlushThinkingBuffer(); len(flushEvents) > 0 {
 		for _, event := range flushEvents {
 			if dataMap, ok := event.Data.(map[string]any); ok {
-				if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, dataMap); err != nil {
-					logger.Error("刷新 thinking 缓冲区事件发送失败", logger.Err(err))
+				for _, ev := range ctx.outgoingEvents(dataMap) {
+					if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, ev); err != nil {
+						logger.Error("刷新 thinking 缓冲区事件发送失败", logger.Err(err))
+					}
 				}
 			}
 		}
@@ -274,6 +298,9 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 
 	// 确定stop_reason
 	stopReason := ctx.stopReasonManager.DetermineStopReason()
+	if ctx.forcedStopReason != "" {
+		stopReason = ctx.forcedStopReason
+	}
 
 	logger.Debug("创建结束事件",
 		logger.String("stop_reason", stopReason),
@@ -291,6 +318,18 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 	return nil
 }
 
+// outgoingEvents 依次经 web_search 模拟与 tool_choice 执行改写上游事件
+func (ctx *StreamProcessorContext) outgoingEvents(dataMap map[string]any) []map[string]any {
+	if ctx.webSearch == nil && ctx.toolChoice == nil {
+		return []map[string]any{dataMap}
+	}
+	var events []map[string]any
+	for _, ev := range ctx.rewriteEvent(dataMap) {
+		events = append(events, ctx.filterEvent(ev)...)
+	}
+	return events
+}
+
 // 辅助函数
 
 // extractIndex 从数据映射中提取索引
@@ -342,43 +381,60 @@ func NewEventStreamProcessor(ctx *StreamProcessorContext) *EventStreamProcessor
 
 // ProcessEventStream 处理事件流的主循环
 func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
-	buf := make([]byte, 1024)
+	upstream := newKeepAliveReader(esp.ctx.c.Request.Context(), reader, esp.ctx.sendPing, config.SSEPingInterval, config.UpstreamIdleTimeout)
+	defer upstream.Close()
 
-	for {
-		n, err := reader.Read(buf)
-		esp.ctx.totalReadBytes += n
-
-		if n > 0 {
-			// 解析事件流
-			events, parseErr := esp.ctx.compliantParser.ParseStream(buf[:n])
-			esp.ctx.lastParseErr = parseErr
+	decoder := parser.NewDecoder(upstream)
+	defer decoder.Release()
 
-			if parseErr != nil {
-				logger.Warn("符合规范的解析器处理失败",
-					addReqFields(esp.ctx.c,
-						logger.Err(parseErr),
-						logger.Int("read_bytes", n),
-						logger.String("direction", "upstream_response"),
-					)...)
-			}
-
-			esp.ctx.totalProcessedEvents += len(events)
+	for {
+		message, err := decoder.Next()
+		esp.ctx.totalReadBytes = int(decoder.ReadBytes())
 
-			// 处理每个事件
-			for _, event := range events {
-				if err := esp.processEvent(event); err != nil {
-					return err
-				}
+		if err != nil {
+			if err != io.EOF {
+				esp.ctx.lastParseErr = err
 			}
-		}
 
-		if err != nil {
-			if err == io.EOF {
+			switch {
+			case err == io.EOF:
 				logger.Debug("响应流结束",
 					addReqFields(esp.ctx.c,
 						logger.Int("total_read_bytes", esp.ctx.totalReadBytes),
 					)...)
-			} else {
+			case esp.ctx.c.Request.Context().Err() != nil:
+				// 客户端已断开：上游请求随 context 取消，不再向客户端写入
+				GetStreamMetrics().RecordClientCancel(max(esp.ctx.c.Writer.Size(), 0), esp.ctx.totalProcessedEvents)
+				logger.Info("客户端断开连接，已取消上游请求",
+					addReqFields(esp.ctx.c,
+						logger.String("stage", "streaming"),
+						logger.Int("total_read_bytes", esp.ctx.totalReadBytes),
+						logger.Int("downstream_bytes", max(esp.ctx.c.Writer.Size(), 0)),
+						logger.Int("processed_events", esp.ctx.totalProcessedEvents),
+					)...)
+				return esp.ctx.c.Request.Context().Err()
+			case errors.Is(err, parser.ErrStreamCorrupted):
+				// 严格模式下上游帧校验失败：下发 SSE error 事件并中止流
+				GetStreamMetrics().RecordCorrupted()
+				_ = esp.ctx.sender.SendError(esp.ctx.c, "上游事件流校验失败", err)
+				return err
+			case errors.Is(err, ErrUpstreamIdleTimeout):
+				GetStreamMetrics().RecordIdleTimeout()
+				logger.Warn("上游响应空闲超时，结束流",
+					addReqFields(esp.ctx.c,
+						logger.Duration("idle_timeout", config.UpstreamIdleTimeout),
+						logger.Int("total_read_bytes", esp.ctx.totalReadBytes),
+					)...)
+				_ = esp.ctx.sender.SendError(esp.ctx.c, "上游响应超时", err)
+				return err
+			case errors.Is(err, io.ErrUnexpectedEOF):
+				GetStreamMetrics().RecordUpstreamError()
+				logger.Warn("上游事件流截断，丢弃未完成的帧",
+					addReqFields(esp.ctx.c,
+						logger.Int("total_read_bytes", esp.ctx.totalReadBytes),
+					)...)
+			default:
+				GetStreamMetrics().RecordUpstreamError()
 				logger.Error("读取响应流时发生错误",
 					addReqFields(esp.ctx.c,
 						logger.Err(err),
@@ -386,12 +442,39 @@ func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 						logger.String("direction", "upstream_response"),
 					)...)
 			}
-			break
+			// 直传模式：无需冲刷剩余文本
+			return nil
 		}
-	}
 
-	// 直传模式：无需冲刷剩余文本
-	return nil
+		// 解码器复用缓冲区，处理器会保留其中字符串的消息需先拷贝
+		if parser.RetainsPayload(message) {
+			message.Payload = bytes.Clone(message.Payload)
+		}
+
+		events, processErr := esp.ctx.compliantParser.ProcessMessage(message)
+		if processErr != nil {
+			logger.Warn("流式处理消息失败",
+				addReqFields(esp.ctx.c,
+					logger.Err(processErr),
+					logger.String("event_type", message.EventType),
+					logger.String("direction", "upstream_response"),
+				)...)
+			continue
+		}
+
+		esp.ctx.totalProcessedEvents += len(events)
+
+		// 处理每个事件
+		for _, event := range events {
+			if err := esp.processEvent(event); err != nil {
+				var streamErr *errUpstreamStreamException
+				if errors.As(err, &streamErr) && streamErr.outcome.MaxTokens {
+					return nil // 以 max_tokens 正常结束
+				}
+				return err
+			}
+		}
+	}
 }
 
 // processEvent 处理单个事件
@@ -402,6 +485,16 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 		return nil
 	}
 
+	for _, ev := range esp.ctx.outgoingEvents(dataMap) {
+		if err := esp.processEventData(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processEventData 处理并下发单个事件数据
+func (esp *EventStreamProcessor) processEventData(dataMap map[string]any) error {
 	eventType, _ := dataMap["type"].(string)
 
 	// 处理不同类型的事件
@@ -426,15 +519,17 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 			}
 		}
 
-	case "exception":
-		// 处理上游异常事件，检查是否需要映射为max_tokens
-		if esp.handleExceptionEvent(dataMap) {
-			return nil // 已转换并发送，不转发原始exception事件
-		}
+	case "exception", "error":
+		// 上游异常不直接转发，按映射结果结束流
+		return esp.handleUpstreamException(dataMap)
 	}
 
 	// 使用状态管理器发送事件（直传）
 	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, dataMap); err != nil {
+		if errors.Is(err, errSSEProtocolViolation) {
+			// strict 模式已下发 error 事件，终止后续上游数据的处理
+			return err
+		}
 		logger.Error("SSE事件发送违规", logger.Err(err))
 		// 非严格模式下，违规事件被跳过但不中断流
 	}
@@ -478,74 +573,34 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 // 返回true表示已处理（聚合），不需要转发原始事件
 // processContentBlockDelta 已废弃（直传模式不再需要）
 
-// handleExceptionEvent 处理上游异常事件，检查是否需要映射为max_tokens
-// 返回true表示已处理并转换，不需要转发原始exception事件
-func (esp *EventStreamProcessor) handleExceptionEvent(dataMap map[string]any) bool {
-	// 提取异常类型
-	exceptionType, _ := dataMap["exception_type"].(string)
-
-	// 检查是否为内容长度超限异常
-	if exceptionType == "ContentLengthExceededException" ||
-		strings.Contains(exceptionType, "CONTENT_LENGTH_EXCEEDS") {
+// handleUpstreamException 处理响应头发出后的上游 exception/error 消息
+// 内容长度超限以 max_tokens 结束（结束事件由 sendFinalEvents 下发），其余下发带类型的 error 事件
+// 始终返回 *errUpstreamStreamException，终止后续上游数据的处理
+func (esp *EventStreamProcessor) handleUpstreamException(dataMap map[string]any) error {
+	outcome := mapStreamException(dataMap)
 
+	if outcome.MaxTokens {
 		logger.Info("检测到内容长度超限异常，映射为max_tokens stop_reason",
 			addReqFields(esp.ctx.c,
-				logger.String("exception_type", exceptionType),
+				logger.String("exception_type", outcome.UpstreamType),
 				logger.String("claude_stop_reason", "max_tokens"))...)
-
-		// 关闭所有活跃的content_block
-		activeBlocks := esp.ctx.sseStateManager.GetActiveBlocks()
-		for index, block := range activeBlocks {
-			if block.Started && !block.Stopped {
-				stopEvent := map[string]any{
-					"type":  "content_block_stop",
-					"index": index,
-				}
-				_ = esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent)
-			}
-		}
-
-		// 构造符合Claude规范的max_tokens响应
-		maxTokensEvent := map[string]any{
-			"type": "message_delta",
-			"delta": map[string]any{
-				"stop_reason":   "max_tokens",
-				"stop_sequence": nil,
-			},
-			"usage": map[string]any{
-				"input_tokens": esp.ctx.inputTokens,
-				"output_tokens": func() int {
-					if esp.ctx.totalOutputTokens > 0 {
-						return esp.ctx.totalOutputTokens
-					}
-					// 回退路径
-					return esp.ctx.totalOutputChars / config.TokenEstimationRatio
-				}(),
-			},
-		}
-
-		// 发送max_tokens事件
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, maxTokensEvent); err != nil {
-			logger.Error("发送max_tokens响应失败", logger.Err(err))
-			return false
-		}
-
-		// 发送message_stop事件
-		stopEvent := map[string]any{
-			"type": "message_stop",
-		}
-		if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, stopEvent); err != nil {
-			logger.Error("发送message_stop失败", logger.Err(err))
-			return false
-		}
-
-		esp.ctx.c.Writer.Flush()
-
-		return true // 已转换并发送，不转发原始exception
+		esp.ctx.forcedStopReason = "max_tokens"
+		return &errUpstreamStreamException{outcome: outcome}
 	}
 
-	// 其他类型的异常，正常转发
-	return false
+	GetStreamMetrics().RecordUpstreamError()
+	logger.Warn("上游流中返回异常，下发error事件",
+		addReqFields(esp.ctx.c,
+			logger.String("exception_type", outcome.UpstreamType),
+			logger.String("error_type", outcome.ErrorType),
+			logger.String("exception_message", outcome.Message),
+			logger.Int("total_read_bytes", esp.ctx.totalReadBytes),
+		)...)
+	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, outcome.anthropicEvent()); err != nil {
+		logger.Error("发送error事件失败", logger.Err(err))
+	}
+	esp.ctx.c.Writer.Flush()
+	return &errUpstreamStreamException{outcome: outcome}
 }
 
 // 直传模式：无flush逻辑
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/parser"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 结构化输出（OpenAI response_format=json_schema）：
+// 请求中的 schema 已转为强制调用的 structured_output 工具，这里取出工具入参并按 schema 校验，
+// 校验失败时附带错误信息重试（最多 STRUCTURED_OUTPUT_MAX_RETRIES 次），
+// 通过后以 JSON 文本作为 message.content 返回；流式请求在校验通过后按内容增量下发
+
+// structuredOutputChunkRunes 流式下发时每个内容增量的字符数
+const structuredOutputChunkRunes = 64
+
+// structuredOutputResult 单次尝试的结果
+type structuredOutputResult struct {
+	text  string
+	tool  *parser.ToolExecution
+	value any
+	err   error
+}
+
+// extractStructuredOutput 从一次响应中取出结构化输出并校验；
+// 未调用工具时，文本本身是合法 JSON 也可接受
+func extractStructuredOutput(so *converter.StructuredOutput, text string, tools []*parser.ToolExecution) structuredOutputResult {
+	result := structuredOutputResult{text: text}
+	for _, tool := range tools {
+		if tool.Name == converter.StructuredOutputToolName {
+			result.tool = tool
+			break
+		}
+	}
+
+	if result.tool != nil {
+		result.value = result.tool.Arguments
+		if result.tool.Arguments == nil {
+			result.value = map[string]any{}
+		}
+	} else {
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || utils.SafeUnmarshal([]byte(trimmed), &result.value) != nil {
+			result.err = fmt.Errorf("响应未调用 %s 工具", converter.StructuredOutputToolName)
+			return result
+		}
+	}
+
+	if err := utils.ValidateJSONSchema(so.Schema, result.value); err != nil {
+		result.err = fmt.Errorf("输出不符合 schema: %w", err)
+	}
+	return result
+}
+
+// structuredOutputRetryRequest 追加上次输出与校验错误生成重试请求
+func structuredOutputRetryRequest(base types.AnthropicRequest, result structuredOutputResult) types.AnthropicRequest {
+	next := base
+	next.Messages = make([]types.AnthropicRequestMessage, 0, len(base.Messages)+2)
+	next.Messages = append(next.Messages, base.Messages...)
+
+	if result.tool != nil {
+		assistant := make([]any, 0, 2)
+		if strings.TrimSpace(result.text) != "" {
+			assistant = append(assistant, map[string]any{"type": "text", "text": result.text})
+		}
+		assistant = append(assistant, map[string]any{
+			"type":  "tool_use",
+			"id":    result.tool.ID,
+			"name":  result.tool.Name,
+			"input": result.value,
+		})
+		next.Messages = append(next.Messages,
+			types.AnthropicRequestMessage{Role: "assistant", Content: assistant},
+			types.AnthropicRequestMessage{Role: "user", Content: []any{map[string]any{
+				"type":        "tool_result",
+				"tool_use_id": result.tool.ID,
+				"content":     fmt.Sprintf("Invalid input: %v. Call %s again with input that matches the schema exactly.", result.err, converter.StructuredOutputToolName),
+				"is_error":    true,
+			}}},
+		)
+		return next
+	}
+
+	if strings.TrimSpace(result.text) != "" {
+		next.Messages = append(next.Messages, types.AnthropicRequestMessage{Role: "assistant", Content: result.text})
+	}
+	next.Messages = append(next.Messages, types.AnthropicRequestMessage{
+		Role:    "user",
+		Content: converter.ToolChoiceReminder(converter.ResolveToolChoice(base.ToolChoice)),
+	})
+	return next
+}
+
+// fetchStructuredOutput 请求上游直到得到通过 schema 校验的输出，失败时已写入错误响应
+func fetchStructuredOutput(c *gin.Context, so *converter.StructuredOutput, anthropicReq types.AnthropicRequest, token types.TokenInfo) (string, bool) {
+	req := anthropicReq
+	for attempt := 0; ; attempt++ {
+		turn, ok := fetchNonStreamTurn(c, req, token)
+		if !ok {
+			return "", false
+		}
+
+		result := extractStructuredOutput(so, turn.text, turn.tools)
+		if result.err == nil {
+			b, err := utils.SafeMarshal(result.value)
+			if err != nil {
+				respondError(c, http.StatusInternalServerError, "序列化结构化输出失败: %v", err)
+				return "", false
+			}
+			return string(b), true
+		}
+
+		if attempt >= config.StructuredOutputMaxRetries {
+			logger.Warn("结构化输出校验失败，重试耗尽",
+				addReqFields(c,
+					logger.String("schema_name", so.Name),
+					logger.Int("attempts", attempt+1),
+					logger.Err(result.err),
+				)...)
+			respondErrorWithCode(c, http.StatusBadGateway, "structured_output_invalid",
+				"模型输出未通过 response_format schema 校验: %v", result.err)
+			return "", false
+		}
+
+		logger.Info("结构化输出校验失败，重试",
+			addReqFields(c,
+				logger.String("schema_name", so.Name),
+				logger.Int("attempt", attempt+1),
+				logger.Err(result.err),
+			)...)
+		req = structuredOutputRetryRequest(req, result)
+	}
+}
+
+// handleStructuredOutputRequest 处理带 response_format=json_schema 的 OpenAI 请求
+func handleStructuredOutputRequest(c *gin.Context, so *converter.StructuredOutput, anthropicReq types.AnthropicRequest, token types.TokenInfo) {
+	output, ok := fetchStructuredOutput(c, so, anthropicReq, token)
+	if !ok {
+		return
+	}
+
+	messageId := fmt.Sprintf("chatcmpl-%s", time.Now().Format(config.MessageIDTimeFormat))
+	if anthropicReq.Stream {
+		c.Set("message_id", messageId)
+		streamStructuredOutput(c, anthropicReq.Model, messageId, output)
+		return
+	}
+
+	estimator := utils.NewTokenEstimator()
+	inputTokens := estimator.EstimateTokens(&types.CountTokensRequest{
+		Model:    anthropicReq.Model,
+		System:   anthropicReq.System,
+		Messages: anthropicReq.Messages,
+		Tools:    anthropicReq.Tools,
+	})
+	anthropicResp := map[string]any{
+		"content":       []map[string]any{{"type": "text", "text": output}},
+		"model":         anthropicReq.Model,
+		"role":          "assistant",
+		"stop_reason":   "end_turn",
+		"stop_sequence": nil,
+		"type":          "message",
+		"usage": map[string]any{
+			"input_tokens":  inputTokens,
+			"output_tokens": utils.CountTokensWithTiktoken(output, "cl100k_base"),
+		},
+	}
+	c.JSON(http.StatusOK, converter.ConvertAnthropicToOpenAI(anthropicResp, anthropicReq.Model, messageId))
+}
+
+// streamStructuredOutput 以 OpenAI 流式 chunk 下发校验通过的 JSON
+func streamStructuredOutput(c *gin.Context, model, messageId, output string) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+
+	sender := &OpenAIStreamSender{}
+	chunk := func(delta map[string]any, finishReason any) map[string]any {
+		return map[string]any{
+			"id":      messageId,
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []map[string]any{
+				{
+					"index":         0,
+					"delta":         delta,
+					"finish_reason": finishReason,
+				},
+			},
+		}
+	}
+
+	sender.SendEvent(c, chunk(map[string]any{"role": "assistant"}, nil))
+	for rest := output; rest != ""; {
+		n := 0
+		for i := 0; i < structuredOutputChunkRunes && n < len(rest); i++ {
+			_, size := utf8.DecodeRuneInString(rest[n:])
+			n += size
+		}
+		sender.SendEvent(c, chunk(map[string]any{"content": rest[:n]}, nil))
+		rest = rest[n:]
+	}
+	sender.SendEvent(c, chunk(map[string]any{}, "stop"))
+
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	c.Writer.Flush()
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func structuredOutputTurn(input string) []byte {
+	args, _ := json.Marshal(input)
+	return buildTestEventStream(
+		[2]string{"toolUseEvent", `{"name":"structured_output","toolUseId":"tooluse_1","input":` + string(args) + `,"stop":true}`},
+	)
+}
+
+func runStructuredOutputRequest(t *testing.T, stream bool) *httptest.ResponseRecorder {
+	t.Helper()
+	openaiReq := types.OpenAIRequest{
+		Model:    "claude-sonnet-4-20250514",
+		Messages: []types.OpenAIMessage{{Role: "user", Content: "介绍 Go 语言"}},
+		Stream:   &stream,
+		ResponseFormat: &types.OpenAIResponseFormat{
+			Type: "json_schema",
+			JSONSchema: &types.OpenAIJSONSchema{
+				Name: "language",
+				Schema: map[string]any{
+					"type":                 "object",
+					"properties":           map[string]any{"name": map[string]any{"type": "string"}, "year": map[string]any{"type": "integer"}},
+					"required":             []any{"name", "year"},
+					"additionalProperties": false,
+				},
+			},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	so := converter.ResolveStructuredOutput(openaiReq.ResponseFormat)
+	handleStructuredOutputRequest(c, so, converter.ConvertOpenAIToAnthropic(openaiReq), types.TokenInfo{AccessToken: "test"})
+	return w
+}
+
+func TestStructuredOutputNonStream(t *testing.T) {
+	requests := mockUpstreamTurns(t, structuredOutputTurn(`{"name":"Go","year":2009}`))
+
+	w := runStructuredOutputRequest(t, false)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp types.OpenAIResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Choices, 1)
+	assert.JSONEq(t, `{"name":"Go","year":2009}`, resp.Choices[0].Message.Content.(string))
+	assert.Empty(t, resp.Choices[0].Message.ToolCalls)
+	assert.Equal(t, "stop", resp.Choices[0].FinishReason)
+	assert.Len(t, *requests, 1)
+}
+
+func TestStructuredOutputStream(t *testing.T) {
+	mockUpstreamTurns(t, structuredOutputTurn(`{"name":"Go","year":2009}`))
+
+	w := runStructuredOutputRequest(t, true)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	var content, finish string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta        map[string]any `json:"delta"`
+				FinishReason *string        `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		if s, ok := chunk.Choices[0].Delta["content"].(string); ok {
+			content += s
+		}
+		if chunk.Choices[0].FinishReason != nil {
+			finish = *chunk.Choices[0].FinishReason
+		}
+	}
+	assert.JSONEq(t, `{"name":"Go","year":2009}`, content)
+	assert.Equal(t, "stop", finish)
+	assert.True(t, strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n"))
+}
+
+func TestStructuredOutput_RetriesInvalidOutput(t *testing.T) {
+	requests := mockUpstreamTurns(t,
+		structuredOutputTurn(`{"name":"Go"}`),
+		structuredOutputTurn(`{"name":"Go","year":2009}`),
+	)
+
+	w := runStructuredOutputRequest(t, false)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, *requests, 2)
+	msgs := (*requests)[1].Messages
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "assistant", msgs[1].Role)
+	result := msgs[2].Content.([]any)[0].(map[string]any)
+	assert.Equal(t, "tool_result", result["type"])
+	assert.Equal(t, true, result["is_error"])
+	assert.Contains(t, result["content"], `缺少必填字段 "year"`)
+}
+
+func TestStructuredOutput_RetriesExhausted(t *testing.T) {
+	old := config.StructuredOutputMaxRetries
+	config.StructuredOutputMaxRetries = 1
+	t.Cleanup(func() { config.StructuredOutputMaxRetries = old })
+
+	requests := mockUpstreamTurns(t, textTurn("Go 是一门编程语言"), structuredOutputTurn(`{"name":1,"year":2009}`))
+
+	w := runStructuredOutputRequest(t, false)
+
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), "structured_output_invalid")
+	assert.Contains(t, w.Body.String(), "$.name")
+	require.Len(t, *requests, 2)
+	assert.Contains(t, (*requests)[1].Messages[2].Content, `"structured_output"`)
+}
+
+func TestStructuredOutput_AcceptsJSONText(t *testing.T) {
+	requests := mockUpstreamTurns(t, textTurn(`{\"name\":\"Go\",\"year\":2009}`))
+
+	w := runStructuredOutputRequest(t, false)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `\"year\":2009`)
+	assert.Len(t, *requests, 1)
+}
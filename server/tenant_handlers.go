@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+
+	"kiro2api/auth"
+	"kiro2api/logger"
+	"kiro2api/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// === 租户管理 API（多租户模式） ===
+
+// handleListTenants 获取已注册租户列表及缓存统计
+func handleListTenants(c *gin.Context) {
+	s := store.GetStore()
+	if s == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储未初始化"})
+		return
+	}
+
+	tenants := s.GetAllTenants()
+
+	// 隐藏敏感信息
+	for i := range tenants {
+		tenants[i].RefreshToken = maskToken(tenants[i].RefreshToken)
+		tenants[i].ClientSecret = maskToken(tenants[i].ClientSecret)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tenants": tenants,
+		"cache":   auth.GetUserTokenCache().GetStats(),
+	})
+}
+
+// handleAddTenant 注册租户
+func handleAddTenant(c *gin.Context) {
+	var req store.TenantConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求格式错误"})
+		return
+	}
+
+	if req.AuthType == "" {
+		req.AuthType = auth.AuthMethodSocial
+	}
+	cred := auth.TenantCredential{
+		AuthType:     req.AuthType,
+		RefreshToken: req.RefreshToken,
+		ClientID:     req.ClientID,
+		ClientSecret: req.ClientSecret,
+	}
+	if err := cred.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	s := store.GetStore()
+	if s == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储未初始化"})
+		return
+	}
+
+	tenant, err := s.AddTenant(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.Info("注册租户", logger.String("id", tenant.ID), logger.String("auth_type", tenant.AuthType), logger.String("ip", c.ClientIP()))
+	c.JSON(http.StatusCreated, gin.H{
+		"id":      tenant.ID,
+		"name":    tenant.Name,
+		"auth":    tenant.AuthType,
+		"api_key": "<PROXY_API_KEY>:" + auth.TenantCredentialIDPrefix + tenant.ID,
+	})
+}
+
+// handleUpdateTenant 更新租户
+func handleUpdateTenant(c *gin.Context) {
+	id := c.Param("id")
+
+	var req store.TenantConfig
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "请求格式错误"})
+		return
+	}
+
+	s := store.GetStore()
+	if s == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储未初始化"})
+		return
+	}
+
+	tenant, err := s.UpdateTenant(id, req)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenant.RefreshToken = maskToken(tenant.RefreshToken)
+	tenant.ClientSecret = maskToken(tenant.ClientSecret)
+
+	logger.Info("更新租户", logger.String("id", id), logger.String("ip", c.ClientIP()))
+	c.JSON(http.StatusOK, tenant)
+}
+
+// handleDeleteTenant 删除租户
+func handleDeleteTenant(c *gin.Context) {
+	id := c.Param("id")
+
+	s := store.GetStore()
+	if s == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "存储未初始化"})
+		return
+	}
+
+	if err := s.DeleteTenant(id); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	logger.Info("删除租户", logger.String("id", id), logger.String("ip", c.ClientIP()))
+	c.JSON(http.StatusOK, gin.H{"message": "删除成功"})
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/parser"
+	"kiro2api/types"
+)
+
+// tool_choice 执行：
+// 要求调用工具（any / 指定工具）时，在出现工具调用前缓冲下发事件，
+// 响应未调用工具则丢弃缓冲并追加提醒重试（最多 TOOL_CHOICE_MAX_RETRIES 次）；
+// disable_parallel_tool_use 时只保留第一个工具调用
+
+const toolChoiceGuardKey = "tool_choice_guard"
+
+// toolChoiceGuard 单个请求内的 tool_choice 执行状态
+type toolChoiceGuard struct {
+	choice   *types.ToolChoice
+	req      types.AnthropicRequest
+	token    types.TokenInfo
+	attempts int // 已重试次数
+
+	released  bool             // 已出现工具调用（或无需强制调用），事件直接下发
+	buffered  []map[string]any // 出现工具调用前缓冲的事件
+	text      strings.Builder  // 本次尝试的文本，用于重试历史
+	toolCalls int              // 已下发的 tool_use 块数
+	dropped   map[int]bool     // 被丢弃的并行 tool_use 块
+	indexMap  map[int]int      // 输入块索引 -> 下发块索引（丢弃块后保持索引连续）
+	nextIndex int
+}
+
+// newToolChoiceGuard 请求声明了工具且 tool_choice 需要执行时创建，否则返回 nil
+func newToolChoiceGuard(req types.AnthropicRequest, token types.TokenInfo) *toolChoiceGuard {
+	if len(req.Tools) == 0 {
+		return nil
+	}
+	tc := converter.ResolveToolChoice(req.ToolChoice)
+	if !tc.RequiresTool() && (tc == nil || !tc.DisableParallelToolUse) {
+		return nil
+	}
+	return &toolChoiceGuard{
+		choice:   tc,
+		req:      req,
+		token:    token,
+		released: !tc.RequiresTool(),
+		dropped:  make(map[int]bool),
+		indexMap: make(map[int]int),
+	}
+}
+
+// filter 过滤一个待下发事件，返回实际需要下发的事件（可能为空）
+func (g *toolChoiceGuard) filter(dataMap map[string]any) []map[string]any {
+	eventType, _ := dataMap["type"].(string)
+	switch eventType {
+	case "content_block_start", "content_block_delta", "content_block_stop":
+	default:
+		return []map[string]any{dataMap}
+	}
+
+	idx := extractIndex(dataMap)
+	if idx < 0 {
+		return []map[string]any{dataMap}
+	}
+	if g.dropped[idx] {
+		if eventType == "content_block_stop" {
+			delete(g.dropped, idx)
+		}
+		return nil
+	}
+
+	switch eventType {
+	case "content_block_start":
+		if cb, ok := dataMap["content_block"].(map[string]any); ok {
+			switch getStringField(cb, "type") {
+			case "tool_use":
+				if g.choice.DisableParallelToolUse && g.toolCalls > 0 {
+					logger.Debug("disable_parallel_tool_use：丢弃额外的工具调用",
+						logger.String("tool_name", getStringField(cb, "name")))
+					g.dropped[idx] = true
+					return nil
+				}
+				g.toolCalls++
+				g.released = true
+			case "server_tool_use":
+				g.released = true
+			}
+		}
+	case "content_block_delta":
+		if delta, ok := dataMap["delta"].(map[string]any); ok && getStringField(delta, "type") == "text_delta" {
+			text, _ := delta["text"].(string)
+			g.text.WriteString(text)
+		}
+	}
+
+	if !g.released {
+		g.buffered = append(g.buffered, dataMap)
+		return nil
+	}
+	return g.remap(append(g.flush(), dataMap))
+}
+
+// flush 取出缓冲的事件
+func (g *toolChoiceGuard) flush() []map[string]any {
+	events := g.buffered
+	g.buffered = nil
+	return events
+}
+
+// release 重试耗尽或无需重试时，下发缓冲的事件
+func (g *toolChoiceGuard) release() []map[string]any {
+	g.released = true
+	return g.remap(g.flush())
+}
+
+// remap 为下发事件分配连续的块索引，丢弃未启动块的 stop
+func (g *toolChoiceGuard) remap(events []map[string]any) []map[string]any {
+	out := events[:0]
+	for _, ev := range events {
+		idx := extractIndex(ev)
+		if idx < 0 {
+			out = append(out, ev)
+			continue
+		}
+		mapped, ok := g.indexMap[idx]
+		if !ok {
+			if ev["type"] == "content_block_stop" {
+				continue
+			}
+			mapped = g.nextIndex
+			g.nextIndex++
+			g.indexMap[idx] = mapped
+		}
+		ev["index"] = mapped
+		out = append(out, ev)
+	}
+	return out
+}
+
+// needsRetry 要求调用工具但本次响应未调用且仍有重试次数
+func (g *toolChoiceGuard) needsRetry() bool {
+	return g != nil && !g.released && g.attempts < config.ToolChoiceMaxRetries
+}
+
+// retryRequest 丢弃本次响应，追加助手文本与提醒生成重试请求
+func (g *toolChoiceGuard) retryRequest(base types.AnthropicRequest, text string) types.AnthropicRequest {
+	next := base
+	next.Messages = make([]types.AnthropicRequestMessage, 0, len(base.Messages)+2)
+	next.Messages = append(next.Messages, base.Messages...)
+	if strings.TrimSpace(text) != "" {
+		next.Messages = append(next.Messages, types.AnthropicRequestMessage{Role: "assistant", Content: text})
+	}
+	next.Messages = append(next.Messages, types.AnthropicRequestMessage{
+		Role:    "user",
+		Content: converter.ToolChoiceReminder(g.choice),
+	})
+
+	g.attempts++
+	g.req = next
+	g.buffered = nil
+	g.text.Reset()
+	g.dropped = make(map[int]bool)
+	return next
+}
+
+// limitTools 非流式响应：disable_parallel_tool_use 时只保留第一个工具调用
+func (g *toolChoiceGuard) limitTools(tools []*parser.ToolExecution) []*parser.ToolExecution {
+	if g == nil || !g.choice.DisableParallelToolUse || len(tools) <= 1 {
+		return tools
+	}
+	return tools[:1]
+}
+
+// filterEvent 启用 tool_choice 执行时过滤待下发事件，否则原样返回
+func (ctx *StreamProcessorContext) filterEvent(dataMap map[string]any) []map[string]any {
+	if ctx.toolChoice == nil {
+		return []map[string]any{dataMap}
+	}
+	return ctx.toolChoice.filter(dataMap)
+}
+
+// retryToolChoice 响应未调用工具时丢弃已缓冲内容并重新请求上游
+func (esp *EventStreamProcessor) retryToolChoice() error {
+	ctx := esp.ctx
+	g := ctx.toolChoice
+
+	// 剩余的 thinking 内容一并进入缓冲后丢弃
+	for _, event := range ctx.compliantParser.FlushThinkingBuffer() {
+		if err := esp.processEvent(event); err != nil {
+			return err
+		}
+	}
+	ctx.compliantParser.Reset()
+
+	base := g.req
+	if ctx.webSearch != nil {
+		base = ctx.webSearch.req
+	}
+	saved := g.buffered
+	req := g.retryRequest(base, g.text.String())
+	if ctx.webSearch != nil {
+		ctx.webSearch.req = req
+	}
+
+	logger.Info("tool_choice要求调用工具但响应未调用，重试",
+		addReqFields(ctx.c,
+			logger.String("tool_choice", g.choice.Type),
+			logger.Int("attempt", g.attempts),
+		)...)
+
+	body, err := continueCWRequest(ctx.c, req, g.token)
+	if err != nil {
+		if ctx.c.Request.Context().Err() != nil {
+			return ctx.c.Request.Context().Err()
+		}
+		// 重试失败时按原响应结束
+		logger.Warn("tool_choice重试请求失败", addReqFields(ctx.c, logger.Err(err))...)
+		g.buffered = saved
+		return nil
+	}
+	defer body.Close()
+
+	return esp.ProcessEventStream(body)
+}
+
+// releaseToolChoice 结束前下发仍在缓冲中的事件
+func (esp *EventStreamProcessor) releaseToolChoice() error {
+	ctx := esp.ctx
+	if ctx.toolChoice == nil || ctx.toolChoice.released {
+		return nil
+	}
+	for _, event := range ctx.compliantParser.FlushThinkingBuffer() {
+		if err := esp.processEvent(event); err != nil {
+			return err
+		}
+	}
+	for _, ev := range ctx.toolChoice.release() {
+		if err := esp.processEventData(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
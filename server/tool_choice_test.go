@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func textTurn(text string) []byte {
+	return buildTestEventStream([2]string{"assistantResponseEvent", `{"content":"` + text + `"}`})
+}
+
+func toolTurn(ids ...string) []byte {
+	var stream []byte
+	for _, id := range ids {
+		stream = append(stream, buildTestEventStream(
+			[2]string{"toolUseEvent", `{"name":"extract","toolUseId":"` + id + `","input":"{\"name\":\"Go\"}","stop":true}`},
+		)...)
+	}
+	return stream
+}
+
+func toolChoiceRequest(stream bool, toolChoice any) types.AnthropicRequest {
+	return types.AnthropicRequest{
+		Model:      "claude-sonnet-4-20250514",
+		MaxTokens:  100,
+		Stream:     stream,
+		Messages:   []types.AnthropicRequestMessage{{Role: "user", Content: "提取语言名称"}},
+		Tools:      []types.AnthropicTool{{Name: "extract", InputSchema: map[string]any{"type": "object"}}},
+		ToolChoice: toolChoice,
+	}
+}
+
+func streamText(events []map[string]any) string {
+	var text string
+	for _, e := range events {
+		if delta, ok := e["delta"].(map[string]any); ok && delta["type"] == "text_delta" {
+			text += delta["text"].(string)
+		}
+	}
+	return text
+}
+
+func TestToolChoiceStream_RetriesWhenNoToolCalled(t *testing.T) {
+	requests := mockUpstreamTurns(t, textTurn("这是 Go 语言。"), toolTurn("tooluse_1"))
+
+	events := runStreamRequest(t, toolChoiceRequest(true, map[string]any{"type": "tool", "name": "extract"}))
+
+	assert.NotContains(t, streamText(events), "这是 Go 语言。", "被重试的响应不应下发")
+	assert.Contains(t, blockStarts(events), "tool_use")
+	assert.Equal(t, "tool_use", finalStopReason(events))
+
+	require.Len(t, *requests, 2)
+	msgs := (*requests)[1].Messages
+	require.Len(t, msgs, 3)
+	assert.Equal(t, "assistant", msgs[1].Role)
+	assert.Equal(t, "这是 Go 语言。", msgs[1].Content)
+	assert.Contains(t, msgs[2].Content, `"extract"`)
+}
+
+func TestToolChoiceStream_RetriesExhausted(t *testing.T) {
+	old := config.ToolChoiceMaxRetries
+	config.ToolChoiceMaxRetries = 1
+	t.Cleanup(func() { config.ToolChoiceMaxRetries = old })
+
+	requests := mockUpstreamTurns(t, textTurn("第一次"), textTurn("第二次"))
+
+	events := runStreamRequest(t, toolChoiceRequest(true, &types.ToolChoice{Type: "any"}))
+
+	assert.Equal(t, "第二次", streamText(events))
+	assert.Equal(t, "end_turn", finalStopReason(events))
+	assert.Len(t, *requests, 2)
+}
+
+func TestToolChoiceStream_DisableParallelToolUse(t *testing.T) {
+	requests := mockUpstreamTurns(t, append(textTurn("调用工具"), toolTurn("tooluse_1", "tooluse_2")...))
+
+	events := runStreamRequest(t, toolChoiceRequest(true, map[string]any{"type": "auto", "disable_parallel_tool_use": true}))
+
+	var ids []string
+	for _, e := range events {
+		if cb, ok := e["content_block"].(map[string]any); ok && cb["type"] == "tool_use" {
+			ids = append(ids, cb["id"].(string))
+		}
+	}
+	assert.Equal(t, []string{"tooluse_1"}, ids)
+	assert.Equal(t, "调用工具", streamText(events))
+	assert.Len(t, *requests, 1)
+}
+
+func TestToolChoiceNonStream_Retry(t *testing.T) {
+	requests := mockUpstreamTurns(t, textTurn("这是 Go 语言。"), toolTurn("tooluse_1", "tooluse_2"))
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	handleNonStreamRequest(c, toolChoiceRequest(false, map[string]any{"type": "any", "disable_parallel_tool_use": true}), types.TokenInfo{AccessToken: "test"})
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Content    []map[string]any `json:"content"`
+		StopReason string           `json:"stop_reason"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Content, 1)
+	assert.Equal(t, "tool_use", resp.Content[0]["type"])
+	assert.Equal(t, "tooluse_1", resp.Content[0]["id"])
+	assert.Equal(t, "tool_use", resp.StopReason)
+	assert.Len(t, *requests, 2)
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/converter"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mangledTestToolName = "github.create_issue"
+
+func mangledToolTurn() []byte {
+	return buildTestEventStream(
+		[2]string{"toolUseEvent", `{"name":"` + converter.UpstreamToolName(mangledTestToolName) + `","toolUseId":"tooluse_1","input":"{\"title\":\"bug\"}","stop":true}`},
+	)
+}
+
+func mangledToolRequest(stream bool) types.AnthropicRequest {
+	return types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 100,
+		Stream:    stream,
+		Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "创建 issue"}},
+		Tools:     []types.AnthropicTool{{Name: mangledTestToolName, InputSchema: map[string]any{"type": "object"}}},
+	}
+}
+
+func TestToolNames_StreamRestoresClientName(t *testing.T) {
+	mockUpstreamTurns(t, mangledToolTurn())
+
+	events := runStreamRequest(t, mangledToolRequest(true))
+
+	var names []string
+	for _, e := range events {
+		if cb, ok := e["content_block"].(map[string]any); ok && cb["type"] == "tool_use" {
+			names = append(names, cb["name"].(string))
+		}
+	}
+	assert.Equal(t, []string{mangledTestToolName}, names)
+}
+
+func TestToolNames_NonStreamRestoresClientName(t *testing.T) {
+	mockUpstreamTurns(t, mangledToolTurn())
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	handleNonStreamRequest(c, mangledToolRequest(false), types.TokenInfo{AccessToken: "test"})
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Content []map[string]any `json:"content"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.NotEmpty(t, resp.Content)
+	last := resp.Content[len(resp.Content)-1]
+	assert.Equal(t, "tool_use", last["type"])
+	assert.Equal(t, mangledTestToolName, last["name"])
+}
+
+func TestToolNames_OpenAIStreamRestoresClientName(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	streamOpenAIResponse(c, mangledToolRequest(true), "chatcmpl-test", bytes.NewReader(mangledToolTurn()))
+
+	assert.Contains(t, w.Body.String(), `"name":"`+mangledTestToolName+`"`)
+	assert.NotContains(t, w.Body.String(), converter.UpstreamToolName(mangledTestToolName))
+}
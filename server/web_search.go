@@ -0,0 +1,417 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/websearch"
+
+	"github.com/gin-gonic/gin"
+)
+
+// web_search 服务端工具模拟：
+// 上游把 web_search 当作普通工具调用，代理拦截该调用、执行搜索，
+// 向客户端下发 server_tool_use + web_search_tool_result 块，
+// 再把搜索结果作为 tool_result 续写请求，直到模型不再搜索
+
+const webSearchSessionKey = "web_search_session"
+
+// webSearchCall 一次被拦截的 web_search 调用
+type webSearchCall struct {
+	ID      string // 上游 tool_use id
+	Query   string
+	Results []websearch.Result
+	ErrCode string // 非空时下发 web_search_tool_result_error
+}
+
+// webSearchSession 单个请求内的 web_search 模拟状态
+type webSearchSession struct {
+	backend  websearch.Backend
+	opts     websearch.Options
+	maxUses  int
+	toolName string // 客户端声明的工具名
+	req      types.AnthropicRequest
+	token    types.TokenInfo
+
+	uses   int // 已执行的搜索次数（跨轮次）
+	rounds int // 已续写的轮次
+
+	// 当前上游轮次的状态
+	indexMap    map[int]int              // 上游块索引 -> 下发块索引
+	nextIndex   int                      // 下一个下发块索引（跨轮次递增）
+	open        map[int]bool             // 已下发 start 但未 stop 的上游块
+	closed      map[int]bool             // 在 server_tool_use 前被提前关闭的上游块
+	pending     map[int]*webSearchCall   // 被拦截的 web_search 块
+	pendingArgs map[int]*strings.Builder // 被拦截块的 partial_json
+	calls       []*webSearchCall         // 本轮已执行的调用
+	text        strings.Builder          // 本轮文本，用于续写历史
+	clientTools bool                     // 本轮包含需客户端执行的工具调用
+}
+
+// newWebSearchSession 请求声明了 web_search 服务端工具且已启用模拟时创建会话，否则返回 nil
+func newWebSearchSession(req types.AnthropicRequest, token types.TokenInfo) *webSearchSession {
+	backend := websearch.GetBackend()
+	if backend == nil {
+		return nil
+	}
+	for _, tool := range req.Tools {
+		if !tool.IsServerWebSearch() {
+			continue
+		}
+		s := &webSearchSession{
+			backend:  backend,
+			maxUses:  tool.MaxUses,
+			toolName: tool.Name,
+			req:      req,
+			token:    token,
+			opts: websearch.Options{
+				AllowedDomains: tool.AllowedDomains,
+				BlockedDomains: tool.BlockedDomains,
+			},
+		}
+		s.resetTurn()
+		return s
+	}
+	return nil
+}
+
+// resetTurn 清空当前轮次的状态（下发索引保持递增）
+func (s *webSearchSession) resetTurn() {
+	s.indexMap = make(map[int]int)
+	s.open = make(map[int]bool)
+	s.closed = make(map[int]bool)
+	s.pending = make(map[int]*webSearchCall)
+	s.pendingArgs = make(map[int]*strings.Builder)
+	s.calls = nil
+	s.text.Reset()
+	s.clientTools = false
+}
+
+// isWebSearchTool 上游工具调用是否为被模拟的 web_search
+func (s *webSearchSession) isWebSearchTool(name string) bool {
+	return name == s.toolName || name == "web_search"
+}
+
+// needsContinuation 本轮仅执行了搜索、没有客户端工具调用时需要续写
+func (s *webSearchSession) needsContinuation() bool {
+	return s != nil && len(s.calls) > 0 && !s.clientTools
+}
+
+// rewrite 改写一个上游事件：拦截 web_search 工具块、重排块索引
+// 返回需要下发的事件（可能为空）
+func (s *webSearchSession) rewrite(ctx context.Context, dataMap map[string]any) []map[string]any {
+	eventType, _ := dataMap["type"].(string)
+	switch eventType {
+	case "content_block_start", "content_block_delta", "content_block_stop":
+	default:
+		return []map[string]any{dataMap}
+	}
+
+	idx := extractIndex(dataMap)
+	if idx < 0 {
+		return []map[string]any{dataMap}
+	}
+
+	if call, ok := s.pending[idx]; ok {
+		switch eventType {
+		case "content_block_delta":
+			if delta, ok := dataMap["delta"].(map[string]any); ok {
+				if pj, ok := delta["partial_json"].(string); ok {
+					s.pendingArgs[idx].WriteString(pj)
+				}
+			}
+		case "content_block_stop":
+			call.Query = parseWebSearchQuery(s.pendingArgs[idx].String(), call.Query)
+			delete(s.pending, idx)
+			delete(s.pendingArgs, idx)
+			return s.execute(ctx, call)
+		}
+		return nil
+	}
+
+	switch eventType {
+	case "content_block_start":
+		if cb, ok := dataMap["content_block"].(map[string]any); ok && getStringField(cb, "type") == "tool_use" {
+			if s.isWebSearchTool(getStringField(cb, "name")) {
+				call := &webSearchCall{ID: getStringField(cb, "id")}
+				if input, ok := cb["input"].(map[string]any); ok {
+					call.Query, _ = input["query"].(string)
+				}
+				s.pending[idx] = call
+				s.pendingArgs[idx] = &strings.Builder{}
+				return nil
+			}
+			s.clientTools = true
+		}
+	case "content_block_delta":
+		if s.closed[idx] {
+			// 提前关闭的块又收到增量：作为新块下发
+			delete(s.closed, idx)
+			delete(s.indexMap, idx)
+		}
+		if delta, ok := dataMap["delta"].(map[string]any); ok && getStringField(delta, "type") == "text_delta" {
+			text, _ := delta["text"].(string)
+			s.text.WriteString(text)
+		}
+	case "content_block_stop":
+		if _, mapped := s.indexMap[idx]; !mapped || s.closed[idx] {
+			delete(s.closed, idx)
+			return nil
+		}
+	}
+
+	out, ok := s.indexMap[idx]
+	if !ok {
+		out = s.nextIndex
+		s.nextIndex++
+		s.indexMap[idx] = out
+	}
+	if eventType == "content_block_stop" {
+		delete(s.open, idx)
+	} else {
+		s.open[idx] = true
+	}
+	dataMap["index"] = out
+	return []map[string]any{dataMap}
+}
+
+// execute 执行搜索并返回需要下发的 server_tool_use / web_search_tool_result 事件
+func (s *webSearchSession) execute(ctx context.Context, call *webSearchCall) []map[string]any {
+	s.run(ctx, call)
+
+	// 先关闭本轮仍打开的块，保证服务端工具块不与文本块交错
+	var events []map[string]any
+	openIdx := make([]int, 0, len(s.open))
+	for idx := range s.open {
+		openIdx = append(openIdx, idx)
+	}
+	sort.Ints(openIdx)
+	for _, idx := range openIdx {
+		events = append(events, map[string]any{"type": "content_block_stop", "index": s.indexMap[idx]})
+		s.closed[idx] = true
+		delete(s.open, idx)
+	}
+
+	useBlock, resultBlock := s.blocks(call)
+	useIdx := s.nextIndex
+	s.nextIndex += 2
+
+	input, _ := json.Marshal(useBlock["input"])
+	useStart := map[string]any{}
+	for k, v := range useBlock {
+		useStart[k] = v
+	}
+	useStart["input"] = map[string]any{}
+
+	return append(events,
+		map[string]any{"type": "content_block_start", "index": useIdx, "content_block": useStart},
+		map[string]any{"type": "content_block_delta", "index": useIdx, "delta": map[string]any{"type": "input_json_delta", "partial_json": string(input)}},
+		map[string]any{"type": "content_block_stop", "index": useIdx},
+		map[string]any{"type": "content_block_start", "index": useIdx + 1, "content_block": resultBlock},
+		map[string]any{"type": "content_block_stop", "index": useIdx + 1},
+	)
+}
+
+// run 执行一次搜索并记录到本轮调用
+func (s *webSearchSession) run(ctx context.Context, call *webSearchCall) {
+	s.uses++
+	switch {
+	case s.maxUses > 0 && s.uses > s.maxUses:
+		call.ErrCode = "max_uses_exceeded"
+	case strings.TrimSpace(call.Query) == "":
+		call.ErrCode = "invalid_tool_input"
+	default:
+		results, err := websearch.Search(ctx, s.backend, call.Query, s.opts)
+		if err != nil {
+			logger.Warn("web_search搜索失败",
+				logger.String("backend", s.backend.Name()),
+				logger.String("query", call.Query),
+				logger.Err(err))
+			call.ErrCode = "unavailable"
+		} else {
+			call.Results = results
+		}
+	}
+	s.calls = append(s.calls, call)
+}
+
+// blocks 构造下发给客户端的 server_tool_use 与 web_search_tool_result 块
+func (s *webSearchSession) blocks(call *webSearchCall) (useBlock, resultBlock map[string]any) {
+	id := serverToolUseID(call.ID)
+	useBlock = map[string]any{
+		"type":  "server_tool_use",
+		"id":    id,
+		"name":  "web_search",
+		"input": map[string]any{"query": call.Query},
+	}
+
+	var content any
+	if call.ErrCode != "" {
+		content = map[string]any{
+			"type":       "web_search_tool_result_error",
+			"error_code": call.ErrCode,
+		}
+	} else {
+		items := make([]any, 0, len(call.Results))
+		for _, r := range call.Results {
+			item := map[string]any{
+				"type":              "web_search_result",
+				"title":             r.Title,
+				"url":               r.URL,
+				"encrypted_content": websearch.EncodeContent(r.Snippet),
+			}
+			if r.PageAge != "" {
+				item["page_age"] = r.PageAge
+			}
+			items = append(items, item)
+		}
+		content = items
+	}
+
+	resultBlock = map[string]any{
+		"type":        "web_search_tool_result",
+		"tool_use_id": id,
+		"content":     content,
+	}
+	return useBlock, resultBlock
+}
+
+// nextRequest 将本轮搜索作为 tool_use/tool_result 追加到历史，生成续写请求并开始新一轮
+func (s *webSearchSession) nextRequest() types.AnthropicRequest {
+	assistant := make([]any, 0, len(s.calls)+1)
+	if text := s.text.String(); text != "" {
+		assistant = append(assistant, map[string]any{"type": "text", "text": text})
+	}
+	results := make([]any, 0, len(s.calls))
+	for _, call := range s.calls {
+		assistant = append(assistant, map[string]any{
+			"type":  "tool_use",
+			"id":    call.ID,
+			"name":  s.toolName,
+			"input": map[string]any{"query": call.Query},
+		})
+		content := websearch.FormatResults(call.Query, call.Results)
+		if call.ErrCode != "" {
+			content = fmt.Sprintf("Web search for query %q failed: %s", call.Query, call.ErrCode)
+		}
+		results = append(results, map[string]any{
+			"type":        "tool_result",
+			"tool_use_id": call.ID,
+			"content":     content,
+			"is_error":    call.ErrCode != "",
+		})
+	}
+
+	next := s.req
+	next.Messages = make([]types.AnthropicRequestMessage, 0, len(s.req.Messages)+2)
+	next.Messages = append(next.Messages, s.req.Messages...)
+	next.Messages = append(next.Messages,
+		types.AnthropicRequestMessage{Role: "assistant", Content: assistant},
+		types.AnthropicRequestMessage{Role: "user", Content: results},
+	)
+	s.req = next
+	s.rounds++
+	s.resetTurn()
+	return next
+}
+
+// serverToolUseID 由上游 tool_use id 派生 server_tool_use id
+func serverToolUseID(id string) string {
+	return "srvtoolu_" + strings.TrimPrefix(id, "tooluse_")
+}
+
+// parseWebSearchQuery 从工具参数 JSON 中提取查询词，解析失败时使用 fallback
+func parseWebSearchQuery(args, fallback string) string {
+	if strings.TrimSpace(args) == "" {
+		return fallback
+	}
+	var input map[string]any
+	if err := json.Unmarshal([]byte(args), &input); err != nil {
+		return fallback
+	}
+	if q, ok := input["query"].(string); ok {
+		return q
+	}
+	return fallback
+}
+
+// continueCWRequest 发送续写请求，失败时不写 HTTP 响应（响应头已作为 SSE 发出）
+var continueCWRequest = func(c *gin.Context, req types.AnthropicRequest, tokenInfo types.TokenInfo) (io.ReadCloser, error) {
+	httpReq, err := buildCodeWhispererRequest(c, req, tokenInfo, true)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doUpstreamRequest(c, httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("上游返回状态码 %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp.Body, nil
+}
+
+// rewriteEvent 启用 web_search 模拟时改写上游事件，否则原样返回
+func (ctx *StreamProcessorContext) rewriteEvent(dataMap map[string]any) []map[string]any {
+	if ctx.webSearch == nil {
+		return []map[string]any{dataMap}
+	}
+	return ctx.webSearch.rewrite(ctx.c.Request.Context(), dataMap)
+}
+
+// continueWebSearch 以搜索结果续写上游请求，并在同一 SSE 流中继续处理
+func (esp *EventStreamProcessor) continueWebSearch() error {
+	ctx := esp.ctx
+	ws := ctx.webSearch
+
+	if ws.rounds >= config.WebSearchMaxRounds {
+		logger.Info("web_search续写轮次达到上限，以pause_turn结束",
+			addReqFields(ctx.c, logger.Int("rounds", ws.rounds))...)
+		ctx.forcedStopReason = "pause_turn"
+		ws.resetTurn()
+		return nil
+	}
+
+	// 刷新本轮剩余的 thinking 内容
+	for _, event := range ctx.compliantParser.FlushThinkingBuffer() {
+		if err := esp.processEvent(event); err != nil {
+			return err
+		}
+	}
+	ctx.compliantParser.Reset()
+
+	req := ws.nextRequest()
+	logger.Debug("web_search续写上游请求",
+		addReqFields(ctx.c,
+			logger.Int("round", ws.rounds),
+			logger.Int("messages", len(req.Messages)),
+		)...)
+
+	body, err := continueCWRequest(ctx.c, req, ws.token)
+	if err != nil {
+		if ctx.c.Request.Context().Err() != nil {
+			return ctx.c.Request.Context().Err()
+		}
+		GetStreamMetrics().RecordUpstreamError()
+		logger.Warn("web_search续写请求失败", addReqFields(ctx.c, logger.Err(err))...)
+		outcome := streamErrorOutcome{ErrorType: "api_error", Message: "web_search续写请求失败"}
+		if sendErr := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, outcome.anthropicEvent()); sendErr != nil {
+			logger.Error("发送error事件失败", logger.Err(sendErr))
+		}
+		ctx.c.Writer.Flush()
+		return &errUpstreamStreamException{outcome: outcome}
+	}
+	defer body.Close()
+
+	return esp.ProcessEventStream(body)
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/ssevalidator"
+	"kiro2api/types"
+	"kiro2api/websearch"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webSearchUpstreamTurn 上游先输出文本再调用 web_search
+func webSearchUpstreamTurn(text, toolUseID, query string) []byte {
+	var stream []byte
+	if text != "" {
+		stream = buildTestEventStream([2]string{"assistantResponseEvent", `{"content":"` + text + `"}`})
+	}
+	return append(stream, buildTestEventStream(
+		[2]string{"toolUseEvent", `{"name":"web_search","toolUseId":"` + toolUseID + `","input":"{\"query\":\"` + query + `\"}"}`},
+		[2]string{"toolUseEvent", `{"name":"web_search","toolUseId":"` + toolUseID + `","stop":true}`},
+	)...)
+}
+
+// setupWebSearch 启用 stub 搜索后端并替换上游请求入口
+func setupWebSearch(t *testing.T, stub *websearch.StubBackend, first []byte, continuations ...[]byte) *[]types.AnthropicRequest {
+	websearch.SetBackend(stub)
+	t.Cleanup(func() { websearch.SetBackend(nil) })
+	return mockUpstreamTurns(t, first, continuations...)
+}
+
+// mockUpstreamTurns 替换上游请求入口：首轮响应为 first，之后的请求（续写或重试）依次返回 continuations
+// 所有请求记录到返回的切片
+func mockUpstreamTurns(t *testing.T, first []byte, continuations ...[]byte) *[]types.AnthropicRequest {
+	var requests []types.AnthropicRequest
+	next := func(req types.AnthropicRequest) ([]byte, error) {
+		requests = append(requests, req)
+		if len(requests) == 1 {
+			return first, nil
+		}
+		if len(requests)-2 >= len(continuations) {
+			return nil, errors.New("unexpected upstream request")
+		}
+		return continuations[len(requests)-2], nil
+	}
+
+	oldExec, oldContinue := execCWRequest, continueCWRequest
+	execCWRequest = func(c *gin.Context, req types.AnthropicRequest, token types.TokenInfo, isStream bool) (*http.Response, error) {
+		body, err := next(req)
+		if err != nil {
+			return nil, err
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))}, nil
+	}
+	continueCWRequest = func(c *gin.Context, req types.AnthropicRequest, token types.TokenInfo) (io.ReadCloser, error) {
+		body, err := next(req)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	t.Cleanup(func() {
+		execCWRequest, continueCWRequest = oldExec, oldContinue
+	})
+	return &requests
+}
+
+func webSearchRequest(stream bool) types.AnthropicRequest {
+	return types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 100,
+		Stream:    stream,
+		Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "Go 最新版本是什么？"}},
+		Tools:     []types.AnthropicTool{{Type: "web_search_20250305", Name: "web_search", MaxUses: 2}},
+	}
+}
+
+func runStreamRequest(t *testing.T, req types.AnthropicRequest) []map[string]any {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	handleStreamRequest(c, req, types.TokenInfo{AccessToken: "test"})
+
+	events, err := ssevalidator.ParseSSE(w.Body.String())
+	require.NoError(t, err)
+	assert.Empty(t, ssevalidator.ValidateEvents(events))
+	return events
+}
+
+func blockStarts(events []map[string]any) []string {
+	var types []string
+	for _, e := range events {
+		if e["type"] == "content_block_start" {
+			types = append(types, e["content_block"].(map[string]any)["type"].(string))
+		}
+	}
+	return types
+}
+
+func finalStopReason(events []map[string]any) string {
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i]["type"] == "message_delta" {
+			return events[i]["delta"].(map[string]any)["stop_reason"].(string)
+		}
+	}
+	return ""
+}
+
+func TestWebSearchStream_ExecutesAndContinues(t *testing.T) {
+	stub := &websearch.StubBackend{}
+	requests := setupWebSearch(t, stub,
+		webSearchUpstreamTurn("我先搜索一下。", "tooluse_abc", "golang latest"),
+		buildTestEventStream([2]string{"assistantResponseEvent", `{"content":"最新版本是 Go 1.25。"}`}),
+	)
+
+	events := runStreamRequest(t, webSearchRequest(true))
+
+	assert.Equal(t, []string{"text", "server_tool_use", "web_search_tool_result", "text"}, blockStarts(events))
+	assert.Equal(t, "end_turn", finalStopReason(events))
+	assert.Equal(t, []string{"golang latest"}, stub.Queries())
+
+	var result map[string]any
+	for _, e := range events {
+		if cb, ok := e["content_block"].(map[string]any); ok && cb["type"] == "server_tool_use" {
+			assert.Equal(t, "srvtoolu_abc", cb["id"])
+		}
+		if cb, ok := e["content_block"].(map[string]any); ok && cb["type"] == "web_search_tool_result" {
+			result = cb
+		}
+	}
+	require.NotNil(t, result)
+	assert.Equal(t, "srvtoolu_abc", result["tool_use_id"])
+	item := result["content"].([]any)[0].(map[string]any)
+	assert.Equal(t, "Stub result for golang latest", item["title"])
+	assert.Contains(t, websearch.DecodeContent(item["encrypted_content"].(string)), "golang latest")
+
+	// 续写请求携带 tool_use / tool_result 历史
+	require.Len(t, *requests, 2)
+	msgs := (*requests)[1].Messages
+	require.Len(t, msgs, 3)
+	assistant, _ := json.Marshal(msgs[1].Content)
+	assert.Contains(t, string(assistant), `"id":"tooluse_abc"`)
+	assert.Contains(t, string(assistant), "我先搜索一下。")
+	user, _ := json.Marshal(msgs[2].Content)
+	assert.Contains(t, string(user), "Stub result for golang latest")
+}
+
+func TestWebSearchStream_MaxUsesAndBackendError(t *testing.T) {
+	stub := &websearch.StubBackend{Err: errors.New("down")}
+	setupWebSearch(t, stub,
+		webSearchUpstreamTurn("", "tooluse_1", "q1"),
+		webSearchUpstreamTurn("", "tooluse_2", "q2"),
+		webSearchUpstreamTurn("", "tooluse_3", "q3"),
+		buildTestEventStream([2]string{"assistantResponseEvent", `{"content":"无法搜索。"}`}),
+	)
+
+	events := runStreamRequest(t, webSearchRequest(true))
+
+	var codes []string
+	for _, e := range events {
+		if cb, ok := e["content_block"].(map[string]any); ok && cb["type"] == "web_search_tool_result" {
+			codes = append(codes, cb["content"].(map[string]any)["error_code"].(string))
+		}
+	}
+	assert.Equal(t, []string{"unavailable", "unavailable", "max_uses_exceeded"}, codes)
+	assert.Equal(t, []string{"q1", "q2"}, stub.Queries())
+	assert.Equal(t, "end_turn", finalStopReason(events))
+}
+
+func TestWebSearchStream_RoundLimitPausesTurn(t *testing.T) {
+	old := config.WebSearchMaxRounds
+	config.WebSearchMaxRounds = 1
+	t.Cleanup(func() { config.WebSearchMaxRounds = old })
+
+	setupWebSearch(t, &websearch.StubBackend{},
+		webSearchUpstreamTurn("", "tooluse_1", "q1"),
+		webSearchUpstreamTurn("", "tooluse_2", "q2"),
+	)
+
+	events := runStreamRequest(t, webSearchRequest(true))
+	assert.Equal(t, "pause_turn", finalStopReason(events))
+}
+
+func TestWebSearchStream_ClientToolStopsContinuation(t *testing.T) {
+	upstream := append(webSearchUpstreamTurn("", "tooluse_1", "q1"), buildTestEventStream(
+		[2]string{"toolUseEvent", `{"name":"get_weather","toolUseId":"tooluse_w","input":"{\"city\":\"北京\"}","stop":true}`},
+	)...)
+	requests := setupWebSearch(t, &websearch.StubBackend{}, upstream)
+
+	req := webSearchRequest(true)
+	req.Tools = append(req.Tools, types.AnthropicTool{Name: "get_weather", InputSchema: map[string]any{"type": "object"}})
+	events := runStreamRequest(t, req)
+
+	assert.Equal(t, []string{"text", "server_tool_use", "web_search_tool_result", "tool_use"}, blockStarts(events))
+	assert.Equal(t, "tool_use", finalStopReason(events))
+	assert.Len(t, *requests, 1)
+}
+
+func TestWebSearchNonStream(t *testing.T) {
+	requests := setupWebSearch(t, &websearch.StubBackend{},
+		webSearchUpstreamTurn("我先搜索一下。", "tooluse_abc", "golang latest"),
+		buildTestEventStream([2]string{"assistantResponseEvent", `{"content":"最新版本是 Go 1.25。"}`}),
+	)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	handleNonStreamRequest(c, webSearchRequest(false), types.TokenInfo{AccessToken: "test"})
+
+	require.Equal(t, http.StatusOK, w.Code)
+	var resp struct {
+		Content    []map[string]any `json:"content"`
+		StopReason string           `json:"stop_reason"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+	var blockTypes []string
+	for _, b := range resp.Content {
+		blockTypes = append(blockTypes, b["type"].(string))
+	}
+	assert.Equal(t, []string{"text", "server_tool_use", "web_search_tool_result", "text"}, blockTypes)
+	assert.Equal(t, "end_turn", resp.StopReason)
+	assert.Len(t, *requests, 2)
+}
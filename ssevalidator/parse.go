@@ -0,0 +1,48 @@
+package ssevalidator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ParseSSE 将 SSE 文本解析为事件数据列表
+// 每个事件的 data 必须是 JSON 对象，且 event 字段（如有）与 data.type 一致
+func ParseSSE(body string) ([]map[string]any, error) {
+	var events []map[string]any
+
+	for n, raw := range strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n\n") {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+
+		var name string
+		var data []string
+		for _, line := range strings.Split(raw, "\n") {
+			switch {
+			case line == "" || strings.HasPrefix(line, ":"):
+				// 空行或注释
+			case strings.HasPrefix(line, "event:"):
+				name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			default:
+				return nil, fmt.Errorf("第 %d 个事件包含无法识别的行: %q", n, line)
+			}
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		var event map[string]any
+		if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event); err != nil {
+			return nil, fmt.Errorf("第 %d 个事件 data 不是 JSON 对象: %w", n, err)
+		}
+		if t, _ := event["type"].(string); name != "" && t != name {
+			return nil, fmt.Errorf("第 %d 个事件名 %q 与 data.type %q 不一致", n, name, t)
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,253 @@
+// Package ssevalidator 按 Anthropic Messages 流式协议校验 SSE 事件序列
+//
+// 语法：
+//
+//	message_start → (content_block_start → content_block_delta* → content_block_stop)* → message_delta → message_stop
+//
+// ping 可出现在任意位置；error 事件可在任意位置出现并终止流。
+package ssevalidator
+
+import (
+	"fmt"
+)
+
+// Violation 一次协议违规
+type Violation struct {
+	Index     int    // 违规事件在序列中的位置（Finish 检查为事件总数）
+	EventType string // 违规事件类型
+	Message   string
+}
+
+func (v Violation) Error() string {
+	return fmt.Sprintf("事件 #%d (%s): %s", v.Index, v.EventType, v.Message)
+}
+
+// 各类内容块允许的 delta 类型
+var allowedDeltas = map[string]map[string]bool{
+	"text":                   {"text_delta": true, "citations_delta": true},
+	"thinking":               {"thinking_delta": true, "signature_delta": true},
+	"redacted_thinking":      {},
+	"tool_use":               {"input_json_delta": true},
+	"server_tool_use":        {"input_json_delta": true},
+	"web_search_tool_result": {},
+}
+
+// 合法的 stop_reason
+var validStopReasons = map[string]bool{
+	"end_turn":      true,
+	"max_tokens":    true,
+	"stop_sequence": true,
+	"tool_use":      true,
+	"pause_turn":    true,
+	"refusal":       true,
+}
+
+// Validator 增量校验 SSE 事件序列（非并发安全）
+type Validator struct {
+	count      int
+	violations []Violation
+
+	messageStarted bool
+	messageDelta   bool
+	terminated     string // 终止流的事件类型（message_stop / error）
+
+	nextIndex int    // 下一个内容块应使用的索引
+	openIndex int    // 当前打开的内容块索引，-1 表示没有
+	openType  string // 当前打开的内容块类型
+}
+
+// New 创建校验器
+func New() *Validator {
+	return &Validator{openIndex: -1}
+}
+
+// Check 校验下一个事件，违规时返回 Violation 且不推进状态
+func (v *Validator) Check(event map[string]any) error {
+	index := v.count
+	v.count++
+
+	eventType, _ := event["type"].(string)
+	if msg := v.check(eventType, event); msg != "" {
+		violation := Violation{Index: index, EventType: eventType, Message: msg}
+		v.violations = append(v.violations, violation)
+		return violation
+	}
+	return nil
+}
+
+// Finish 校验流是否完整结束
+func (v *Validator) Finish() error {
+	if v.terminated != "" {
+		return nil
+	}
+
+	msg := "流未以 message_stop 或 error 结束"
+	if v.openIndex >= 0 {
+		msg = fmt.Sprintf("流结束时索引 %d 的 %s 块未关闭", v.openIndex, v.openType)
+	}
+	violation := Violation{Index: v.count, EventType: "<eof>", Message: msg}
+	v.violations = append(v.violations, violation)
+	return violation
+}
+
+// Violations 返回已发现的全部违规
+func (v *Validator) Violations() []Violation {
+	return v.violations
+}
+
+// ValidateEvents 校验完整事件序列，返回全部违规
+func ValidateEvents(events []map[string]any) []Violation {
+	v := New()
+	for _, event := range events {
+		_ = v.Check(event)
+	}
+	_ = v.Finish()
+	return v.Violations()
+}
+
+func (v *Validator) check(eventType string, event map[string]any) string {
+	if v.terminated != "" {
+		return fmt.Sprintf("流已由 %s 终止", v.terminated)
+	}
+
+	switch eventType {
+	case "ping":
+		return ""
+
+	case "error":
+		errObj, ok := event["error"].(map[string]any)
+		if !ok {
+			return "error 事件缺少 error 对象"
+		}
+		if t, _ := errObj["type"].(string); t == "" {
+			return "error.type 为空"
+		}
+		v.terminated = eventType
+		return ""
+
+	case "message_start":
+		if v.messageStarted {
+			return "重复的 message_start"
+		}
+		msg, ok := event["message"].(map[string]any)
+		if !ok {
+			return "message_start 缺少 message 对象"
+		}
+		if id, _ := msg["id"].(string); id == "" {
+			return "message.id 为空"
+		}
+		if role, _ := msg["role"].(string); role != "assistant" {
+			return fmt.Sprintf("message.role 应为 assistant，实际为 %q", role)
+		}
+		v.messageStarted = true
+		return ""
+	}
+
+	if !v.messageStarted {
+		return "message_start 之前出现事件"
+	}
+
+	switch eventType {
+	case "content_block_start":
+		if v.messageDelta {
+			return "message_delta 之后出现内容块"
+		}
+		if v.openIndex >= 0 {
+			return fmt.Sprintf("索引 %d 的 %s 块尚未关闭", v.openIndex, v.openType)
+		}
+		idx, ok := intField(event, "index")
+		if !ok {
+			return "缺少 index"
+		}
+		if idx != v.nextIndex {
+			return fmt.Sprintf("索引不连续：期望 %d，实际 %d", v.nextIndex, idx)
+		}
+		block, ok := event["content_block"].(map[string]any)
+		if !ok {
+			return "缺少 content_block"
+		}
+		blockType, _ := block["type"].(string)
+		if _, known := allowedDeltas[blockType]; !known {
+			return fmt.Sprintf("未知的内容块类型 %q", blockType)
+		}
+		if (blockType == "tool_use" || blockType == "server_tool_use") && (block["id"] == "" || block["id"] == nil || block["name"] == "" || block["name"] == nil) {
+			return "tool_use 块缺少 id 或 name"
+		}
+		v.openIndex = idx
+		v.openType = blockType
+		v.nextIndex++
+		return ""
+
+	case "content_block_delta":
+		idx, ok := intField(event, "index")
+		if !ok {
+			return "缺少 index"
+		}
+		if v.openIndex < 0 || idx != v.openIndex {
+			return fmt.Sprintf("索引 %d 没有打开的内容块", idx)
+		}
+		delta, ok := event["delta"].(map[string]any)
+		if !ok {
+			return "缺少 delta"
+		}
+		deltaType, _ := delta["type"].(string)
+		if !allowedDeltas[v.openType][deltaType] {
+			return fmt.Sprintf("%s 块不允许 %s", v.openType, deltaType)
+		}
+		return ""
+
+	case "content_block_stop":
+		idx, ok := intField(event, "index")
+		if !ok {
+			return "缺少 index"
+		}
+		if v.openIndex < 0 || idx != v.openIndex {
+			return fmt.Sprintf("索引 %d 没有打开的内容块", idx)
+		}
+		v.openIndex = -1
+		v.openType = ""
+		return ""
+
+	case "message_delta":
+		if v.messageDelta {
+			return "重复的 message_delta"
+		}
+		if v.openIndex >= 0 {
+			return fmt.Sprintf("索引 %d 的 %s 块尚未关闭", v.openIndex, v.openType)
+		}
+		delta, ok := event["delta"].(map[string]any)
+		if !ok {
+			return "缺少 delta"
+		}
+		if reason, _ := delta["stop_reason"].(string); !validStopReasons[reason] {
+			return fmt.Sprintf("未知的 stop_reason %q", reason)
+		}
+		if _, ok := event["usage"].(map[string]any); !ok {
+			return "缺少 usage"
+		}
+		v.messageDelta = true
+		return ""
+
+	case "message_stop":
+		if !v.messageDelta {
+			return "message_stop 之前缺少 message_delta"
+		}
+		v.terminated = eventType
+		return ""
+	}
+
+	return fmt.Sprintf("未知事件类型 %q", eventType)
+}
+
+// intField 读取整数字段，兼容 JSON 解码后的 float64
+func intField(event map[string]any, key string) (int, bool) {
+	switch n := event[key].(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), n == float64(int(n))
+	}
+	return 0, false
+}
@@ -0,0 +1,132 @@
+package ssevalidator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func messageStart() map[string]any {
+	return map[string]any{"type": "message_start", "message": map[string]any{"id": "msg_1", "role": "assistant"}}
+}
+
+func blockStart(index int, blockType string) map[string]any {
+	block := map[string]any{"type": blockType}
+	if blockType == "tool_use" {
+		block["id"], block["name"] = "toolu_1", "get_weather"
+	}
+	return map[string]any{"type": "content_block_start", "index": index, "content_block": block}
+}
+
+func blockDelta(index int, deltaType string) map[string]any {
+	return map[string]any{"type": "content_block_delta", "index": index, "delta": map[string]any{"type": deltaType}}
+}
+
+func blockStop(index int) map[string]any {
+	return map[string]any{"type": "content_block_stop", "index": index}
+}
+
+func messageDelta(stopReason string) map[string]any {
+	return map[string]any{"type": "message_delta", "delta": map[string]any{"stop_reason": stopReason}, "usage": map[string]any{"output_tokens": 1}}
+}
+
+var messageStop = map[string]any{"type": "message_stop"}
+
+func TestValidateEvents_Valid(t *testing.T) {
+	events := []map[string]any{
+		messageStart(),
+		{"type": "ping"},
+		blockStart(0, "thinking"), blockDelta(0, "thinking_delta"), blockDelta(0, "signature_delta"), blockStop(0),
+		blockStart(1, "text"), blockDelta(1, "text_delta"), blockStop(1),
+		{"type": "ping"},
+		blockStart(2, "tool_use"), blockDelta(2, "input_json_delta"), blockStop(2),
+		messageDelta("tool_use"),
+		messageStop,
+	}
+	assert.Empty(t, ValidateEvents(events))
+}
+
+func TestValidateEvents_ErrorTerminates(t *testing.T) {
+	events := []map[string]any{
+		messageStart(),
+		blockStart(0, "text"), blockDelta(0, "text_delta"),
+		{"type": "error", "error": map[string]any{"type": "api_error", "message": "boom"}},
+	}
+	assert.Empty(t, ValidateEvents(events), "error 事件可在块未关闭时终止流")
+
+	events = append(events, blockStop(0))
+	violations := ValidateEvents(events)
+	require.Len(t, violations, 1)
+	assert.Equal(t, 4, violations[0].Index)
+}
+
+func TestValidateEvents_Violations(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []map[string]any
+		index  int
+	}{
+		{"缺少 message_start", []map[string]any{blockStart(0, "text")}, 0},
+		{"重复 message_start", []map[string]any{messageStart(), messageStart()}, 1},
+		{"索引跳跃", []map[string]any{messageStart(), blockStart(1, "text")}, 1},
+		{"索引重复", []map[string]any{messageStart(), blockStart(0, "text"), blockStop(0), blockStart(0, "text")}, 3},
+		{"块重叠", []map[string]any{messageStart(), blockStart(0, "text"), blockStart(1, "tool_use")}, 2},
+		{"未知块类型", []map[string]any{messageStart(), blockStart(0, "image")}, 1},
+		{"文本块收到 input_json_delta", []map[string]any{messageStart(), blockStart(0, "text"), blockDelta(0, "input_json_delta")}, 2},
+		{"工具块收到 text_delta", []map[string]any{messageStart(), blockStart(0, "tool_use"), blockDelta(0, "text_delta")}, 2},
+		{"redacted_thinking 收到 delta", []map[string]any{messageStart(), blockStart(0, "redacted_thinking"), blockDelta(0, "thinking_delta")}, 2},
+		{"delta 指向未打开的块", []map[string]any{messageStart(), blockDelta(0, "text_delta")}, 1},
+		{"stop 索引不匹配", []map[string]any{messageStart(), blockStart(0, "text"), blockStop(1)}, 2},
+		{"块未关闭即 message_delta", []map[string]any{messageStart(), blockStart(0, "text"), messageDelta("end_turn")}, 2},
+		{"未知 stop_reason", []map[string]any{messageStart(), messageDelta("done")}, 1},
+		{"message_stop 缺少 message_delta", []map[string]any{messageStart(), messageStop}, 1},
+		{"message_delta 之后开始新块", []map[string]any{messageStart(), messageDelta("end_turn"), blockStart(0, "text")}, 2},
+		{"message_stop 之后仍有事件", []map[string]any{messageStart(), messageDelta("end_turn"), messageStop, {"type": "ping"}}, 3},
+		{"未知事件", []map[string]any{messageStart(), {"type": "exception"}}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := ValidateEvents(tt.events)
+			require.NotEmpty(t, violations)
+			assert.Equal(t, tt.index, violations[0].Index, violations[0].Error())
+		})
+	}
+}
+
+func TestValidator_Finish(t *testing.T) {
+	v := New()
+	require.NoError(t, v.Check(messageStart()))
+	require.NoError(t, v.Check(blockStart(0, "text")))
+
+	err := v.Finish()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "未关闭")
+}
+
+func TestValidator_ViolationDoesNotAdvance(t *testing.T) {
+	v := New()
+	require.NoError(t, v.Check(messageStart()))
+	assert.Error(t, v.Check(blockStart(1, "text")))
+	assert.NoError(t, v.Check(blockStart(0, "text")), "违规事件不应推进状态")
+}
+
+func TestParseSSE(t *testing.T) {
+	body := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"id\":\"msg_1\",\"role\":\"assistant\"}}\n\n" +
+		": keep-alive\n\n" +
+		"event: content_block_start\ndata: {\"type\":\"content_block_start\",\"index\":0,\"content_block\":{\"type\":\"text\"}}\n\n"
+
+	events, err := ParseSSE(body)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	assert.Equal(t, "content_block_start", events[1]["type"])
+
+	v := New()
+	for _, e := range events {
+		assert.NoError(t, v.Check(e), "JSON 解码后的 float64 索引应被接受")
+	}
+
+	_, err = ParseSSE("event: ping\ndata: {\"type\":\"message_stop\"}\n\n")
+	assert.Error(t, err)
+}
@@ -174,7 +174,7 @@ class AdminPanel {
         const tbody = document.getElementById('tokenTableBody');
 
         if (tokens.length === 0) {
-            tbody.innerHTML = '<tr><td colspan="8" class="loading">暂无 Token</td></tr>';
+            tbody.innerHTML = '<tr><td colspan="9" class="loading">暂无 Token</td></tr>';
             return;
         }
 
@@ -191,6 +191,7 @@ class AdminPanel {
                         ${token.disabled ? '禁用' : '启用'}
                     </span>
                 </td>
+                <td>${this.renderHealth(token)}</td>
                 <td>
                     <div class="action-btns">
                         <button class="btn btn-sm btn-secondary" onclick="adminPanel.editToken('${token.id}')">编辑</button>
@@ -205,12 +206,28 @@ class AdminPanel {
         `).join('');
     }
 
+    renderHealth(token) {
+        const labels = {
+            healthy: '健康',
+            degraded: '降级',
+            quarantined: '隔离',
+            retired: '退役'
+        };
+        const state = labels[token.healthState] ? token.healthState : 'healthy';
+        const title = token.healthReason
+            ? `${this.formatDate(token.healthChangedAt)} ${token.healthReason}`
+            : '';
+        return `<span class="status-badge health-${state}" title="${this.escapeAttr(title)}">${labels[state]}</span>`;
+    }
+
     updateStats(stats) {
         document.getElementById('statTotal').textContent = stats.total || 0;
         document.getElementById('statEnabled').textContent = stats.enabled || 0;
         document.getElementById('statDisabled').textContent = stats.disabled || 0;
         document.getElementById('statSocial').textContent = stats.social || 0;
         document.getElementById('statIdc').textContent = stats.idc || 0;
+        document.getElementById('statQuarantined').textContent = stats.quarantined || 0;
+        document.getElementById('statRetired').textContent = stats.retired || 0;
     }
 
     async addToken() {
@@ -609,6 +626,14 @@ class AdminPanel {
         }
     }
 
+    escapeAttr(str) {
+        return String(str)
+            .replace(/&/g, '&amp;')
+            .replace(/"/g, '&quot;')
+            .replace(/</g, '&lt;')
+            .replace(/>/g, '&gt;');
+    }
+
     showToast(message, type = 'info') {
         const toast = document.createElement('div');
         toast.className = `toast toast-${type}`;
@@ -16,9 +16,10 @@ import (
 
 // StoreData JSON 存储的数据结构
 type StoreData struct {
-	Admin    AdminConfig   `json:"admin"`
-	Tokens   []TokenConfig `json:"tokens"`
-	Sessions []Session     `json:"sessions,omitempty"`
+	Admin    AdminConfig    `json:"admin"`
+	Tokens   []TokenConfig  `json:"tokens"`
+	Tenants  []TenantConfig `json:"tenants,omitempty"`
+	Sessions []Session      `json:"sessions,omitempty"`
 }
 
 // AdminConfig 管理员配置
@@ -41,8 +42,26 @@ type TokenConfig struct {
 	RemainingUsage int    `json:"remainingUsage,omitempty"`
 	LastUsed       string `json:"lastUsed,omitempty"`
 	LastError      string `json:"lastError,omitempty"`
-	CreatedAt      string `json:"createdAt,omitempty"`
-	UpdatedAt      string `json:"updatedAt,omitempty"`
+	// 健康状态: healthy / degraded / quarantined / retired
+	HealthState     string `json:"healthState,omitempty"`
+	HealthReason    string `json:"healthReason,omitempty"`
+	HealthChangedAt string `json:"healthChangedAt,omitempty"`
+	CreatedAt       string `json:"createdAt,omitempty"`
+	UpdatedAt       string `json:"updatedAt,omitempty"`
+}
+
+// TenantConfig 已注册租户的凭据（多租户模式）
+// 客户端使用 PROXY_API_KEY:tenant:<ID> 引用，凭据不随请求传输
+type TenantConfig struct {
+	ID           string `json:"id"`
+	Name         string `json:"name,omitempty"`
+	AuthType     string `json:"auth"`
+	RefreshToken string `json:"refreshToken"`
+	ClientID     string `json:"clientId,omitempty"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	Disabled     bool   `json:"disabled,omitempty"`
+	CreatedAt    string `json:"createdAt,omitempty"`
+	UpdatedAt    string `json:"updatedAt,omitempty"`
 }
 
 // Session 会话
@@ -398,6 +417,12 @@ func (s *Store) ToggleToken(id string) (*TokenConfig, error) {
 		if token.ID == id {
 			s.data.Tokens[i].Disabled = !s.data.Tokens[i].Disabled
 			s.data.Tokens[i].UpdatedAt = time.Now().Format(time.RFC3339)
+			// 重新启用已退役的 Token 时清除健康状态，重启后重新参与轮询
+			if !s.data.Tokens[i].Disabled && s.data.Tokens[i].HealthState == "retired" {
+				s.data.Tokens[i].HealthState = ""
+				s.data.Tokens[i].HealthReason = ""
+				s.data.Tokens[i].HealthChangedAt = ""
+			}
 
 			if err := s.saveUnsafe(); err != nil {
 				return nil, err
@@ -467,6 +492,22 @@ func (s *Store) UpdateTokenStatus(id string, userEmail string, remainingUsage in
 	}
 }
 
+// UpdateTokenHealth 更新 Token 健康状态
+func (s *Store) UpdateTokenHealth(id string, state string, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, token := range s.data.Tokens {
+		if token.ID == id {
+			s.data.Tokens[i].HealthState = state
+			s.data.Tokens[i].HealthReason = reason
+			s.data.Tokens[i].HealthChangedAt = time.Now().Format(time.RFC3339)
+			s.saveUnsafe()
+			return
+		}
+	}
+}
+
 // GetEnabledTokens 获取所有启用的 Token
 func (s *Store) GetEnabledTokens() []TokenConfig {
 	s.mu.RLock()
@@ -487,11 +528,14 @@ func (s *Store) GetTokenStats() map[string]int {
 	defer s.mu.RUnlock()
 
 	stats := map[string]int{
-		"total":    len(s.data.Tokens),
-		"enabled":  0,
-		"disabled": 0,
-		"social":   0,
-		"idc":      0,
+		"total":       len(s.data.Tokens),
+		"enabled":     0,
+		"disabled":    0,
+		"social":      0,
+		"idc":         0,
+		"degraded":    0,
+		"quarantined": 0,
+		"retired":     0,
 	}
 
 	for _, token := range s.data.Tokens {
@@ -505,6 +549,10 @@ func (s *Store) GetTokenStats() map[string]int {
 		} else if token.AuthType == "IdC" {
 			stats["idc"]++
 		}
+		switch token.HealthState {
+		case "degraded", "quarantined", "retired":
+			stats[token.HealthState]++
+		}
 	}
 
 	return stats
@@ -677,3 +725,112 @@ func (s *Store) ClearAllTokens() int {
 	s.saveUnsafe()
 	return count
 }
+
+// === 租户管理 ===
+
+// GetAllTenants 获取所有已注册租户
+func (s *Store) GetAllTenants() []TenantConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenants := make([]TenantConfig, len(s.data.Tenants))
+	copy(tenants, s.data.Tenants)
+	return tenants
+}
+
+// GetTenant 根据 ID 获取租户
+func (s *Store) GetTenant(id string) (*TenantConfig, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, tenant := range s.data.Tenants {
+		if tenant.ID == id {
+			t := tenant // 复制
+			return &t, true
+		}
+	}
+	return nil, false
+}
+
+// AddTenant 注册租户
+func (s *Store) AddTenant(tenant TenantConfig) (*TenantConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if tenant.ID == "" {
+		tenant.ID = generateTokenID()
+	}
+	for _, t := range s.data.Tenants {
+		if t.ID == tenant.ID {
+			return nil, fmt.Errorf("租户已存在: %s", tenant.ID)
+		}
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	tenant.CreatedAt = now
+	tenant.UpdatedAt = now
+
+	if tenant.AuthType == "" {
+		tenant.AuthType = "Social"
+	}
+
+	s.data.Tenants = append(s.data.Tenants, tenant)
+
+	if err := s.saveUnsafe(); err != nil {
+		return nil, err
+	}
+
+	return &tenant, nil
+}
+
+// UpdateTenant 更新租户
+func (s *Store) UpdateTenant(id string, updates TenantConfig) (*TenantConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, tenant := range s.data.Tenants {
+		if tenant.ID == id {
+			if updates.Name != "" {
+				s.data.Tenants[i].Name = updates.Name
+			}
+			if updates.AuthType != "" {
+				s.data.Tenants[i].AuthType = updates.AuthType
+			}
+			if updates.RefreshToken != "" {
+				s.data.Tenants[i].RefreshToken = updates.RefreshToken
+			}
+			if updates.ClientID != "" {
+				s.data.Tenants[i].ClientID = updates.ClientID
+			}
+			if updates.ClientSecret != "" {
+				s.data.Tenants[i].ClientSecret = updates.ClientSecret
+			}
+			s.data.Tenants[i].Disabled = updates.Disabled
+			s.data.Tenants[i].UpdatedAt = time.Now().Format(time.RFC3339)
+
+			if err := s.saveUnsafe(); err != nil {
+				return nil, err
+			}
+
+			t := s.data.Tenants[i]
+			return &t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("租户不存在: %s", id)
+}
+
+// DeleteTenant 删除租户
+func (s *Store) DeleteTenant(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, tenant := range s.data.Tenants {
+		if tenant.ID == id {
+			s.data.Tenants = append(s.data.Tenants[:i], s.data.Tenants[i+1:]...)
+			return s.saveUnsafe()
+		}
+	}
+
+	return fmt.Errorf("租户不存在: %s", id)
+}
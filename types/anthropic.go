@@ -3,21 +3,42 @@ package types
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"kiro2api/config"
 )
 
 // AnthropicTool 表示 Anthropic API 的工具结构
 type AnthropicTool struct {
+	Type        string         `json:"type,omitempty"` // 服务端工具类型，如 "web_search_20250305"
 	Name        string         `json:"name"`
 	Description string         `json:"description"`
 	InputSchema map[string]any `json:"input_schema"`
+
+	// web_search 服务端工具参数
+	MaxUses        int      `json:"max_uses,omitempty"`
+	AllowedDomains []string `json:"allowed_domains,omitempty"`
+	BlockedDomains []string `json:"blocked_domains,omitempty"`
+}
+
+// IsServerWebSearch 是否为 web_search 服务端工具（而非客户端自定义的同名工具）
+func (t AnthropicTool) IsServerWebSearch() bool {
+	if strings.HasPrefix(t.Type, "web_search") {
+		return true
+	}
+	return t.InputSchema == nil && (t.Name == "web_search" || t.Name == "websearch")
 }
 
 // ToolChoice 表示工具选择策略
 type ToolChoice struct {
-	Type string `json:"type"`           // "auto", "any", "tool"
-	Name string `json:"name,omitempty"` // 当type为"tool"时指定的工具名称
+	Type                   string `json:"type"`                                // "auto", "any", "tool", "none"
+	Name                   string `json:"name,omitempty"`                      // 当type为"tool"时指定的工具名称
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"` // 一次响应最多调用一个工具
+}
+
+// RequiresTool 是否要求响应必须调用工具（any 或指定工具）
+func (tc *ToolChoice) RequiresTool() bool {
+	return tc != nil && (tc.Type == "any" || tc.Type == "tool")
 }
 
 // Thinking 表示 Claude 深度思考配置
@@ -91,6 +112,11 @@ type AnthropicRequest struct {
 	Temperature *float64                  `json:"temperature,omitempty"`
 	Metadata    map[string]any            `json:"metadata,omitempty"`
 	Thinking    *Thinking                 `json:"thinking,omitempty"` // Claude 深度思考配置
+
+	// 以下采样参数上游不支持，仅参与响应缓存键的计算
+	TopP          *float64 `json:"top_p,omitempty"`
+	TopK          *int     `json:"top_k,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
 }
 
 // AnthropicStreamResponse 表示 Anthropic 流式响应的结构
@@ -126,12 +152,15 @@ type ContentBlock struct {
 	Type      string       `json:"type"`
 	Text      *string      `json:"text,omitempty"`
 	ToolUseId *string      `json:"tool_use_id,omitempty"`
-	Content   any          `json:"content,omitempty"`  // tool_result的内容，可以是string、[]any或map[string]any
-	Name      *string      `json:"name,omitempty"`     // tool_use的名称
-	Input     *any         `json:"input,omitempty"`    // tool_use的输入参数
-	ID        *string      `json:"id,omitempty"`       // tool_use的唯一标识符
-	IsError   *bool        `json:"is_error,omitempty"` // tool_result是否表示错误
-	Source    *ImageSource `json:"source,omitempty"`   // 图片数据源
+	Content   any          `json:"content,omitempty"`   // tool_result的内容，可以是string、[]any或map[string]any
+	Name      *string      `json:"name,omitempty"`      // tool_use的名称
+	Input     *any         `json:"input,omitempty"`     // tool_use的输入参数
+	ID        *string      `json:"id,omitempty"`        // tool_use的唯一标识符
+	IsError   *bool        `json:"is_error,omitempty"`  // tool_result是否表示错误
+	Source    *ImageSource `json:"source,omitempty"`    // 图片数据源
+	Thinking  *string      `json:"thinking,omitempty"`  // thinking块的推理内容
+	Signature *string      `json:"signature,omitempty"` // thinking块的签名
+	Data      *string      `json:"data,omitempty"`      // redacted_thinking块的加密内容
 }
 
 // ImageSource 表示图片数据源的结构
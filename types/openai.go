@@ -48,6 +48,23 @@ type OpenAIRequest struct {
 	Stream      *bool           `json:"stream,omitempty"`
 	Tools       []OpenAITool    `json:"tools,omitempty"`
 	ToolChoice  any             `json:"tool_choice,omitempty"` // 可以是 "auto", "none", "required" 或 OpenAIToolChoice
+
+	ParallelToolCalls *bool                 `json:"parallel_tool_calls,omitempty"` // false 时一次响应最多调用一个工具
+	ResponseFormat    *OpenAIResponseFormat `json:"response_format,omitempty"`
+}
+
+// OpenAIResponseFormat 表示OpenAI的response_format（text / json_object / json_schema）
+type OpenAIResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *OpenAIJSONSchema `json:"json_schema,omitempty"`
+}
+
+// OpenAIJSONSchema 表示response_format中的json_schema定义
+type OpenAIJSONSchema struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Schema      map[string]any `json:"schema,omitempty"`
+	Strict      *bool          `json:"strict,omitempty"`
 }
 
 type OpenAIChoice struct {
@@ -9,6 +9,7 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"kiro2api/config"
@@ -19,6 +20,9 @@ import (
 var (
 	// SharedHTTPClient 共享的HTTP客户端实例，优化了连接池和性能配置
 	SharedHTTPClient *http.Client
+
+	// sharedDialer 共享的基础 dialer，代理池的 SOCKS5 连接也基于它建立
+	sharedDialer *net.Dialer
 )
 
 func init() {
@@ -29,7 +33,7 @@ func init() {
 	}
 
 	// 创建基础 dialer
-	baseDialer := &net.Dialer{
+	sharedDialer = &net.Dialer{
 		Timeout:   15 * time.Second,
 		KeepAlive: config.HTTPClientKeepAlive,
 		DualStack: true,
@@ -44,7 +48,7 @@ func init() {
 		IdleConnTimeout:     120 * time.Second,
 
 		// 连接建立配置
-		DialContext: baseDialer.DialContext,
+		DialContext: sharedDialer.DialContext,
 
 		// TLS配置
 		TLSHandshakeTimeout: config.HTTPClientTLSHandshakeTimeout,
@@ -68,7 +72,7 @@ func init() {
 	}
 
 	// 配置代理（支持 HTTP/HTTPS/SOCKS5）
-	if err := configureProxy(transport, baseDialer); err != nil {
+	if err := configureProxy(transport, sharedDialer); err != nil {
 		os.Stderr.WriteString(fmt.Sprintf("[WARNING] 代理配置失败: %v，使用直连\n", err))
 	}
 
@@ -93,20 +97,27 @@ func configureProxy(transport *http.Transport, baseDialer *net.Dialer) error {
 		return nil
 	}
 
-	parsed, err := url.Parse(proxyURL)
+	parsed, err := ParseProxyURL(proxyURL)
 	if err != nil {
-		return fmt.Errorf("解析代理 URL 失败: %w", err)
+		return err
 	}
 
-	scheme := strings.ToLower(parsed.Scheme)
-	switch scheme {
+	if err := applyProxy(transport, parsed, baseDialer); err != nil {
+		return err
+	}
+	os.Stderr.WriteString(fmt.Sprintf("[INFO] 已配置 %s 代理: %s\n", strings.ToUpper(parsed.Scheme), parsed.Host))
+	return nil
+}
+
+// applyProxy 将代理应用到 transport
+// HTTP/HTTPS 代理走 transport.Proxy（HTTPS 代理与代理之间也是 TLS），
+// SOCKS5 代理替换 DialContext，认证信息取自 URL 中的 user:pass
+func applyProxy(transport *http.Transport, parsed *url.URL, baseDialer *net.Dialer) error {
+	switch strings.ToLower(parsed.Scheme) {
 	case "http", "https":
-		// HTTP/HTTPS 代理
 		transport.Proxy = http.ProxyURL(parsed)
-		os.Stderr.WriteString(fmt.Sprintf("[INFO] 已配置 HTTP 代理: %s\n", parsed.Host))
 
 	case "socks5", "socks5h":
-		// SOCKS5 代理
 		var auth *proxy.Auth
 		if parsed.User != nil {
 			password, _ := parsed.User.Password()
@@ -121,7 +132,8 @@ func configureProxy(transport *http.Transport, baseDialer *net.Dialer) error {
 			return fmt.Errorf("创建 SOCKS5 dialer 失败: %w", err)
 		}
 
-		// 转换为 ContextDialer
+		// SOCKS5 在连接层代理，不能再叠加 HTTP 代理
+		transport.Proxy = nil
 		if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
 			transport.DialContext = contextDialer.DialContext
 		} else {
@@ -130,57 +142,100 @@ func configureProxy(transport *http.Transport, baseDialer *net.Dialer) error {
 				return dialer.Dial(network, addr)
 			}
 		}
-		os.Stderr.WriteString(fmt.Sprintf("[INFO] 已配置 SOCKS5 代理: %s\n", parsed.Host))
 
 	default:
-		return fmt.Errorf("不支持的代理协议: %s", scheme)
+		return fmt.Errorf("不支持的代理协议: %s", parsed.Scheme)
 	}
 
 	return nil
 }
 
+// ParseProxyURL 解析并校验代理URL（支持 http/https/socks5/socks5h）
+func ParseProxyURL(proxyURL string) (*url.URL, error) {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("解析代理 URL 失败: %w", err)
+	}
+
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("不支持的代理协议: %s", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return nil, fmt.Errorf("代理 URL 缺少主机地址: %s", parsed.Redacted())
+	}
+	return parsed, nil
+}
+
+// NewProxyTransport 基于共享 transport 创建使用指定代理的 transport
+func NewProxyTransport(proxyURL string) (*http.Transport, error) {
+	parsed, err := ParseProxyURL(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// 清除全局 PROXY_URL 的设置，避免代理叠加
+	transport := SharedHTTPClient.Transport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = sharedDialer.DialContext
+	if err := applyProxy(transport, parsed, sharedDialer); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
 // DoRequest 执行HTTP请求
-func DoRequest(req *http.Request) (*http.Response, error) {
+// ctx 取消（如客户端断开连接）时中止请求，包括已开始的响应体读取
+func DoRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if ctx != nil && ctx != req.Context() {
+		req = req.WithContext(ctx)
+	}
 	return SharedHTTPClient.Do(req)
 }
 
 // ProxyAwareClient 支持代理池的HTTP客户端
+// 每个代理URL复用一个 transport，保持连接池
 type ProxyAwareClient struct {
-	baseTransport *http.Transport
+	mutex   sync.Mutex
+	clients map[string]*http.Client
 }
 
 // NewProxyAwareClient 创建支持代理池的客户端
 func NewProxyAwareClient() *ProxyAwareClient {
 	return &ProxyAwareClient{
-		baseTransport: SharedHTTPClient.Transport.(*http.Transport).Clone(),
+		clients: make(map[string]*http.Client),
 	}
 }
 
-// DoWithProxy 使用指定代理执行请求
+// DoWithProxy 使用指定代理执行请求（支持 http/https/socks5，代理认证取自URL）
+// 不设置整体超时，流式响应由调用方的 context 控制
 func (c *ProxyAwareClient) DoWithProxy(req *http.Request, proxyURL string) (*http.Response, error) {
-	if proxyURL == "" {
-		return SharedHTTPClient.Do(req)
-	}
-
-	// 解析代理URL
-	proxy, err := parseProxyURL(proxyURL)
+	client, err := c.ClientFor(proxyURL)
 	if err != nil {
 		return nil, err
 	}
+	return client.Do(req)
+}
 
-	// 克隆transport并设置代理
-	transport := c.baseTransport.Clone()
-	transport.Proxy = http.ProxyURL(proxy)
-
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   60 * time.Second,
+// ClientFor 获取或创建指定代理的客户端，proxyURL 为空时返回共享客户端
+func (c *ProxyAwareClient) ClientFor(proxyURL string) (*http.Client, error) {
+	if proxyURL == "" {
+		return SharedHTTPClient, nil
 	}
 
-	return client.Do(req)
-}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-// parseProxyURL 解析代理URL
-func parseProxyURL(proxyURL string) (*url.URL, error) {
-	return url.Parse(proxyURL)
+	if client, exists := c.clients[proxyURL]; exists {
+		return client, nil
+	}
+
+	transport, err := NewProxyTransport(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: transport}
+	c.clients[proxyURL] = client
+	return client, nil
 }
@@ -0,0 +1,336 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidateJSONSchema 按 JSON Schema 校验解码后的 JSON 值（map[string]any / []any / 基本类型）
+// 支持结构化输出常用的子集：type、properties、required、additionalProperties、items、
+// enum、const、anyOf/oneOf/allOf、长度/数量/数值范围、pattern 与本地 $ref（#/$defs、#/definitions）
+// 返回第一个不匹配项，错误信息包含 JSON 路径
+func ValidateJSONSchema(schema map[string]any, value any) error {
+	v := &schemaValidator{root: schema}
+	return v.validate(schema, value, "$")
+}
+
+type schemaValidator struct {
+	root map[string]any
+}
+
+func (v *schemaValidator) validate(schema map[string]any, value any, path string) error {
+	if schema == nil {
+		return nil
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		resolved, err := v.resolveRef(ref)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		return v.validate(resolved, value, path)
+	}
+
+	if err := v.validateType(schema, value, path); err != nil {
+		return err
+	}
+
+	if enum, ok := schema["enum"].([]any); ok && !containsJSONValue(enum, value) {
+		return fmt.Errorf("%s: 值 %s 不在 enum 中", path, compactJSON(value))
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		return fmt.Errorf("%s: 值应为 %s", path, compactJSON(c))
+	}
+
+	if err := v.validateCombinators(schema, value, path); err != nil {
+		return err
+	}
+
+	switch val := value.(type) {
+	case map[string]any:
+		return v.validateObject(schema, val, path)
+	case []any:
+		return v.validateArray(schema, val, path)
+	case string:
+		return validateString(schema, val, path)
+	case float64:
+		return validateNumber(schema, val, path)
+	case int:
+		return validateNumber(schema, float64(val), path)
+	case int64:
+		return validateNumber(schema, float64(val), path)
+	}
+	return nil
+}
+
+// validateType 校验 type（支持字符串或数组形式）
+func (v *schemaValidator) validateType(schema map[string]any, value any, path string) error {
+	var types []string
+	switch t := schema["type"].(type) {
+	case string:
+		types = []string{t}
+	case []any:
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+	default:
+		return nil
+	}
+	if nullable, _ := schema["nullable"].(bool); nullable {
+		types = append(types, "null")
+	}
+
+	actual := jsonTypeOf(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: 类型应为 %s，实际为 %s", path, strings.Join(types, "|"), actual)
+}
+
+func (v *schemaValidator) validateCombinators(schema map[string]any, value any, path string) error {
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, item := range all {
+			if sub, ok := item.(map[string]any); ok {
+				if err := v.validate(sub, value, path); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		if v.countMatches(anyOf, value, path) == 0 {
+			return fmt.Errorf("%s: 不满足 anyOf 中的任何一个模式", path)
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		if n := v.countMatches(oneOf, value, path); n != 1 {
+			return fmt.Errorf("%s: 应恰好满足 oneOf 中的一个模式，实际满足 %d 个", path, n)
+		}
+	}
+	return nil
+}
+
+func (v *schemaValidator) countMatches(schemas []any, value any, path string) int {
+	n := 0
+	for _, item := range schemas {
+		if sub, ok := item.(map[string]any); ok && v.validate(sub, value, path) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (v *schemaValidator) validateObject(schema map[string]any, obj map[string]any, path string) error {
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, exists := obj[name]; name != "" && !exists {
+				return fmt.Errorf("%s: 缺少必填字段 %q", path, name)
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		childPath := path + "." + k
+		if propSchema, ok := properties[k].(map[string]any); ok {
+			if err := v.validate(propSchema, obj[k], childPath); err != nil {
+				return err
+			}
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				return fmt.Errorf("%s: 不允许的字段 %q", path, k)
+			}
+		case map[string]any:
+			if err := v.validate(additional, obj[k], childPath); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n, ok := schemaInt(schema, "minProperties"); ok && len(obj) < n {
+		return fmt.Errorf("%s: 字段数不能少于 %d", path, n)
+	}
+	if n, ok := schemaInt(schema, "maxProperties"); ok && len(obj) > n {
+		return fmt.Errorf("%s: 字段数不能多于 %d", path, n)
+	}
+	return nil
+}
+
+func (v *schemaValidator) validateArray(schema map[string]any, arr []any, path string) error {
+	if n, ok := schemaInt(schema, "minItems"); ok && len(arr) < n {
+		return fmt.Errorf("%s: 元素数不能少于 %d", path, n)
+	}
+	if n, ok := schemaInt(schema, "maxItems"); ok && len(arr) > n {
+		return fmt.Errorf("%s: 元素数不能多于 %d", path, n)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range arr {
+			for j := i + 1; j < len(arr); j++ {
+				if jsonEqual(arr[i], arr[j]) {
+					return fmt.Errorf("%s: 元素 %d 与 %d 重复", path, i, j)
+				}
+			}
+		}
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range arr {
+			if err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(schema map[string]any, s, path string) error {
+	length := utf8.RuneCountInString(s)
+	if n, ok := schemaInt(schema, "minLength"); ok && length < n {
+		return fmt.Errorf("%s: 长度不能少于 %d", path, n)
+	}
+	if n, ok := schemaInt(schema, "maxLength"); ok && length > n {
+		return fmt.Errorf("%s: 长度不能超过 %d", path, n)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err == nil && !re.MatchString(s) {
+			return fmt.Errorf("%s: 不匹配 pattern %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(schema map[string]any, n float64, path string) error {
+	if t, _ := schema["type"].(string); t == "integer" && n != math.Trunc(n) {
+		return fmt.Errorf("%s: 类型应为 integer", path)
+	}
+	if min, ok := schemaFloat(schema, "minimum"); ok && n < min {
+		return fmt.Errorf("%s: 不能小于 %v", path, min)
+	}
+	if max, ok := schemaFloat(schema, "maximum"); ok && n > max {
+		return fmt.Errorf("%s: 不能大于 %v", path, max)
+	}
+	if min, ok := schemaFloat(schema, "exclusiveMinimum"); ok && n <= min {
+		return fmt.Errorf("%s: 必须大于 %v", path, min)
+	}
+	if max, ok := schemaFloat(schema, "exclusiveMaximum"); ok && n >= max {
+		return fmt.Errorf("%s: 必须小于 %v", path, max)
+	}
+	return nil
+}
+
+// resolveRef 解析本地引用 #/$defs/X 或 #/definitions/X
+func (v *schemaValidator) resolveRef(ref string) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("不支持的 $ref: %s", ref)
+	}
+	var node any = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("无法解析 $ref: %s", ref)
+		}
+		node = m[strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")]
+	}
+	resolved, ok := node.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("无法解析 $ref: %s", ref)
+	}
+	return resolved, nil
+}
+
+// jsonTypeOf 返回值的 JSON Schema 类型名
+func jsonTypeOf(value any) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "integer"
+		}
+		return "number"
+	case int, int64:
+		return "integer"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func schemaInt(schema map[string]any, key string) (int, bool) {
+	f, ok := schemaFloat(schema, key)
+	return int(f), ok
+}
+
+func schemaFloat(schema map[string]any, key string) (float64, bool) {
+	switch n := schema[key].(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func containsJSONValue(values []any, value any) bool {
+	for _, candidate := range values {
+		if jsonEqual(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonEqual 比较两个 JSON 值（数字统一按 float64 比较）
+func jsonEqual(a, b any) bool {
+	if fa, ok := schemaNumber(a); ok {
+		fb, ok := schemaNumber(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func schemaNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func compactJSON(v any) string {
+	b, err := SafeMarshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(b)
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func decodeJSON(t *testing.T, s string) any {
+	t.Helper()
+	var v any
+	require.NoError(t, json.Unmarshal([]byte(s), &v))
+	return v
+}
+
+func personSchema(t *testing.T) map[string]any {
+	return decodeJSON(t, `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"role": {"enum": ["admin", "user"]},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"address": {"$ref": "#/$defs/address"}
+		},
+		"required": ["name", "age"],
+		"additionalProperties": false,
+		"$defs": {
+			"address": {"type": ["object", "null"], "properties": {"city": {"type": "string"}}, "required": ["city"]}
+		}
+	}`).(map[string]any)
+}
+
+func TestValidateJSONSchema_Valid(t *testing.T) {
+	schema := personSchema(t)
+	assert.NoError(t, ValidateJSONSchema(schema, decodeJSON(t, `{"name":"Ada","age":36,"role":"admin","tags":["a"],"address":{"city":"London"}}`)))
+	assert.NoError(t, ValidateJSONSchema(schema, decodeJSON(t, `{"name":"Ada","age":36,"address":null}`)))
+}
+
+func TestValidateJSONSchema_Invalid(t *testing.T) {
+	schema := personSchema(t)
+	cases := map[string]struct {
+		value string
+		want  string
+	}{
+		"缺少必填字段":    {`{"name":"Ada"}`, `缺少必填字段 "age"`},
+		"类型错误":      {`{"name":"Ada","age":"36"}`, "$.age: 类型应为 integer"},
+		"非整数":       {`{"name":"Ada","age":1.5}`, "$.age: 类型应为 integer"},
+		"不允许的字段":    {`{"name":"Ada","age":1,"extra":true}`, `不允许的字段 "extra"`},
+		"enum":      {`{"name":"Ada","age":1,"role":"root"}`, "$.role: 值 \"root\" 不在 enum 中"},
+		"数组元素":      {`{"name":"Ada","age":1,"tags":[1]}`, "$.tags[0]: 类型应为 string"},
+		"数组长度":      {`{"name":"Ada","age":1,"tags":["a","b","c"]}`, "$.tags: 元素数不能多于 2"},
+		"$ref":      {`{"name":"Ada","age":1,"address":{}}`, `$.address: 缺少必填字段 "city"`},
+		"minLength": {`{"name":"","age":1}`, "$.name: 长度不能少于 1"},
+		"minimum":   {`{"name":"Ada","age":-1}`, "$.age: 不能小于 0"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateJSONSchema(schema, decodeJSON(t, tc.value))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.want)
+		})
+	}
+}
+
+func TestValidateJSONSchema_Combinators(t *testing.T) {
+	schema := decodeJSON(t, `{"oneOf":[{"type":"string"},{"type":"number"}]}`).(map[string]any)
+	assert.NoError(t, ValidateJSONSchema(schema, "x"))
+	assert.Error(t, ValidateJSONSchema(schema, true))
+
+	anyOf := decodeJSON(t, `{"anyOf":[{"type":"integer"},{"type":"number"}]}`).(map[string]any)
+	assert.NoError(t, ValidateJSONSchema(anyOf, float64(3)))
+
+	oneOf := decodeJSON(t, `{"oneOf":[{"type":"integer"},{"type":"number"}]}`).(map[string]any)
+	assert.Error(t, ValidateJSONSchema(oneOf, float64(3)), "整数同时满足两个模式")
+}
+
+func TestValidateJSONSchema_EmptySchemaAcceptsAnything(t *testing.T) {
+	assert.NoError(t, ValidateJSONSchema(map[string]any{}, decodeJSON(t, `{"a":[1,"b",null]}`)))
+	assert.NoError(t, ValidateJSONSchema(nil, "x"))
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"sync"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// thinking 块签名
+// 上游的推理签名无法随历史回传，代理为下发的每个 thinking 块重新生成 HMAC 签名，
+// 客户端在后续轮次回传 thinking 块时据此校验内容未被改动
+
+const thinkingSignaturePrefix = "k2a1."
+
+var (
+	thinkingKey     []byte
+	thinkingKeyOnce sync.Once
+)
+
+// thinkingSignatureKey 签名密钥：THINKING_SIGNATURE_KEY，未配置时由 KIRO_CLIENT_TOKEN 派生
+func thinkingSignatureKey() []byte {
+	thinkingKeyOnce.Do(func() {
+		secret := config.ThinkingSignatureKey
+		if secret == "" {
+			secret = os.Getenv("KIRO_CLIENT_TOKEN")
+		}
+		if secret == "" {
+			thinkingKey = make([]byte, 32)
+			_, _ = rand.Read(thinkingKey)
+			logger.Warn("未配置 THINKING_SIGNATURE_KEY，重启后历史 thinking 块签名将失效")
+			return
+		}
+		sum := sha256.Sum256([]byte("kiro2api-thinking-signature:" + secret))
+		thinkingKey = sum[:]
+	})
+	return thinkingKey
+}
+
+// SignThinking 生成 thinking 内容的签名
+func SignThinking(thinking string) string {
+	mac := hmac.New(sha256.New, thinkingSignatureKey())
+	mac.Write([]byte(thinking))
+	return thinkingSignaturePrefix + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyThinkingSignature 校验 thinking 内容与签名是否匹配
+func VerifyThinkingSignature(thinking, signature string) bool {
+	return hmac.Equal([]byte(SignThinking(thinking)), []byte(signature))
+}
@@ -116,7 +116,7 @@ func (tc *TokenCounter) countViaAnthropicAPI(ctx context.Context, req *types.Cou
 	httpReq.Header.Set("x-api-key", tc.claudeAPIKey)
 	httpReq.Header.Set("anthropic-version", tc.anthropicVersion)
 
-	resp, err := DoRequest(httpReq)
+	resp, err := DoRequest(ctx, httpReq)
 	if err != nil {
 		return 0, err
 	}
@@ -0,0 +1,183 @@
+// Package websearch 为 web_search 服务端工具提供可插拔的搜索后端
+package websearch
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// Result 单条搜索结果
+type Result struct {
+	Title   string
+	URL     string
+	Snippet string
+	PageAge string // 页面时间（如 "2025-01-02"），未知时为空
+}
+
+// Options 搜索参数（来自客户端 web_search 工具定义）
+type Options struct {
+	MaxResults     int
+	AllowedDomains []string
+	BlockedDomains []string
+}
+
+// Backend 搜索后端
+type Backend interface {
+	Name() string
+	Search(ctx context.Context, query string, opts Options) ([]Result, error)
+}
+
+var (
+	backend     Backend
+	backendOnce sync.Once
+	backendMu   sync.RWMutex
+)
+
+// GetBackend 获取配置的搜索后端（WEB_SEARCH_BACKEND），未配置时返回 nil
+func GetBackend() Backend {
+	backendOnce.Do(func() {
+		b, err := NewBackend(config.WebSearchBackend)
+		if err != nil {
+			logger.Error("初始化web_search后端失败，web_search工具将被过滤", logger.Err(err))
+			return
+		}
+		backendMu.Lock()
+		backend = b
+		backendMu.Unlock()
+		if b != nil {
+			logger.Info("web_search模拟已启用", logger.String("backend", b.Name()))
+		}
+	})
+	backendMu.RLock()
+	defer backendMu.RUnlock()
+	return backend
+}
+
+// SetBackend 替换搜索后端（测试或嵌入方使用），传入 nil 关闭模拟
+func SetBackend(b Backend) {
+	backendOnce.Do(func() {})
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	backend = b
+}
+
+// Enabled 是否启用 web_search 模拟
+func Enabled() bool {
+	return GetBackend() != nil
+}
+
+// NewBackend 按名称创建搜索后端，名称为空时返回 nil
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "stub":
+		return &StubBackend{}, nil
+	case "searxng":
+		if config.WebSearchSearXNGURL == "" {
+			return nil, fmt.Errorf("searxng 后端需要设置 WEB_SEARCH_SEARXNG_URL")
+		}
+		return NewSearXNGBackend(config.WebSearchSearXNGURL), nil
+	default:
+		return nil, fmt.Errorf("未知的web_search后端: %s", name)
+	}
+}
+
+// Search 执行搜索并按域名限制与结果数过滤
+func Search(ctx context.Context, b Backend, query string, opts Options) ([]Result, error) {
+	if opts.MaxResults <= 0 {
+		opts.MaxResults = config.WebSearchMaxResults
+	}
+	ctx, cancel := context.WithTimeout(ctx, config.WebSearchTimeout)
+	defer cancel()
+
+	results, err := b.Search(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]Result, 0, min(len(results), opts.MaxResults))
+	for _, r := range results {
+		if !domainAllowed(r.URL, opts) {
+			continue
+		}
+		filtered = append(filtered, r)
+		if len(filtered) == opts.MaxResults {
+			break
+		}
+	}
+	return filtered, nil
+}
+
+// domainAllowed 检查结果域名是否满足 allowed_domains / blocked_domains
+func domainAllowed(rawURL string, opts Options) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, d := range opts.BlockedDomains {
+		if matchDomain(host, d) {
+			return false
+		}
+	}
+	if len(opts.AllowedDomains) == 0 {
+		return true
+	}
+	for _, d := range opts.AllowedDomains {
+		if matchDomain(host, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain 域名及其子域名匹配
+func matchDomain(host, domain string) bool {
+	domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "www.")
+	host = strings.TrimPrefix(host, "www.")
+	return domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// FormatResults 将搜索结果格式化为提供给模型的文本
+func FormatResults(query string, results []Result) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Web search results for query: %q\n", query)
+	if len(results) == 0 {
+		sb.WriteString("\nNo results found.")
+		return sb.String()
+	}
+	for i, r := range results {
+		fmt.Fprintf(&sb, "\n[%d] %s\nURL: %s\n", i+1, r.Title, r.URL)
+		if r.PageAge != "" {
+			fmt.Fprintf(&sb, "Date: %s\n", r.PageAge)
+		}
+		if r.Snippet != "" {
+			sb.WriteString(r.Snippet)
+			sb.WriteString("\n")
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// EncodeContent 编码结果摘要，作为 web_search_result.encrypted_content 下发
+// 客户端在后续请求中原样回传，由 DecodeContent 还原为历史文本
+func EncodeContent(snippet string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(snippet))
+}
+
+// DecodeContent 还原 EncodeContent 编码的摘要，无法解码时返回空串
+func DecodeContent(encoded string) string {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
@@ -0,0 +1,73 @@
+package websearch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSearch_DomainFilterAndLimit(t *testing.T) {
+	stub := &StubBackend{Results: []Result{
+		{Title: "a", URL: "https://docs.example.com/a"},
+		{Title: "b", URL: "https://www.blocked.org/b"},
+		{Title: "c", URL: "https://example.com/c"},
+		{Title: "d", URL: "https://other.net/d"},
+		{Title: "bad", URL: "not a url"},
+	}}
+
+	results, err := Search(context.Background(), stub, "go", Options{BlockedDomains: []string{"blocked.org"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c", "d"}, titles(results))
+
+	results, err = Search(context.Background(), stub, "go", Options{AllowedDomains: []string{"example.com"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, titles(results))
+
+	results, err = Search(context.Background(), stub, "go", Options{MaxResults: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, titles(results))
+
+	assert.Equal(t, []string{"go", "go", "go"}, stub.Queries())
+}
+
+func TestSearch_BackendError(t *testing.T) {
+	_, err := Search(context.Background(), &StubBackend{Err: errors.New("down")}, "go", Options{})
+	assert.EqualError(t, err, "down")
+}
+
+func TestSearXNGBackend(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/search", r.URL.Path)
+		assert.Equal(t, "golang 1.25", r.URL.Query().Get("q"))
+		assert.Equal(t, "json", r.URL.Query().Get("format"))
+		w.Write([]byte(`{"results":[{"title":"Go 1.25","url":"https://go.dev/doc/go1.25","content":"Release notes","publishedDate":"2025-08-12T00:00:00"}]}`))
+	}))
+	defer srv.Close()
+
+	results, err := NewSearXNGBackend(srv.URL+"/").Search(context.Background(), "golang 1.25", Options{})
+	require.NoError(t, err)
+	assert.Equal(t, []Result{{Title: "Go 1.25", URL: "https://go.dev/doc/go1.25", Snippet: "Release notes", PageAge: "2025-08-12"}}, results)
+}
+
+func TestFormatResultsAndContentEncoding(t *testing.T) {
+	text := FormatResults("go", []Result{{Title: "Go", URL: "https://go.dev", Snippet: "The Go language", PageAge: "2025-01-01"}})
+	assert.Contains(t, text, `query: "go"`)
+	assert.Contains(t, text, "[1] Go\nURL: https://go.dev\nDate: 2025-01-01\nThe Go language")
+	assert.Contains(t, FormatResults("go", nil), "No results found.")
+
+	assert.Equal(t, "摘要 snippet", DecodeContent(EncodeContent("摘要 snippet")))
+	assert.Empty(t, DecodeContent("%%%"))
+}
+
+func titles(results []Result) []string {
+	out := make([]string, 0, len(results))
+	for _, r := range results {
+		out = append(out, r.Title)
+	}
+	return out
+}
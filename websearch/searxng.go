@@ -0,0 +1,78 @@
+package websearch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"kiro2api/utils"
+)
+
+// SearXNGBackend 通过 SearXNG JSON API 搜索
+type SearXNGBackend struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewSearXNGBackend 创建 SearXNG 后端，baseURL 形如 http://localhost:8888
+func NewSearXNGBackend(baseURL string) *SearXNGBackend {
+	return &SearXNGBackend{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  utils.SharedHTTPClient,
+	}
+}
+
+func (s *SearXNGBackend) Name() string { return "searxng" }
+
+type searxngResponse struct {
+	Results []struct {
+		Title         string `json:"title"`
+		URL           string `json:"url"`
+		Content       string `json:"content"`
+		PublishedDate string `json:"publishedDate"`
+	} `json:"results"`
+}
+
+func (s *SearXNGBackend) Search(ctx context.Context, query string, _ Options) ([]Result, error) {
+	endpoint := s.baseURL + "/search?" + url.Values{"q": {query}, "format": {"json"}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("searxng 请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("searxng 返回状态码 %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var parsed searxngResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("解析 searxng 响应失败: %w", err)
+	}
+
+	results := make([]Result, 0, len(parsed.Results))
+	for _, r := range parsed.Results {
+		pageAge := r.PublishedDate
+		if len(pageAge) > len("2006-01-02") {
+			pageAge = pageAge[:len("2006-01-02")]
+		}
+		results = append(results, Result{
+			Title:   r.Title,
+			URL:     r.URL,
+			Snippet: r.Content,
+			PageAge: pageAge,
+		})
+	}
+	return results, nil
+}
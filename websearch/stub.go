@@ -0,0 +1,47 @@
+package websearch
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// StubBackend 本地搜索后端，返回固定或按查询生成的结果，不访问网络
+type StubBackend struct {
+	Results []Result // 为空时按查询生成结果
+	Err     error    // 非空时每次搜索返回该错误
+
+	mu      sync.Mutex
+	queries []string
+}
+
+func (s *StubBackend) Name() string { return "stub" }
+
+func (s *StubBackend) Search(_ context.Context, query string, _ Options) ([]Result, error) {
+	s.mu.Lock()
+	s.queries = append(s.queries, query)
+	s.mu.Unlock()
+
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	if s.Results != nil {
+		return s.Results, nil
+	}
+
+	return []Result{
+		{
+			Title:   fmt.Sprintf("Stub result for %s", query),
+			URL:     "https://example.com/search?q=" + url.QueryEscape(query),
+			Snippet: fmt.Sprintf("This is a stub search result for %q.", query),
+		},
+	}, nil
+}
+
+// Queries 返回已执行的查询
+func (s *StubBackend) Queries() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}